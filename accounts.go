@@ -0,0 +1,540 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User accounts gate signaling by person as well as by device. Users sign
+// in with a password from the local store or through an OpenID Connect
+// provider (oidc.go); either way they get a signed token, kept in a cookie
+// by browsers and sent in X-User-Token by other clients. The token names
+// the user; permissions and quotas are looked up on every request, so
+// changing or deleting an account applies at once.
+
+const (
+	userTokenHeader = "X-User-Token"
+	userCookie      = "chimera_session"
+	userTokenTTL    = 12 * time.Hour
+
+	permAdmin  = "admin"  // Everything, and every session (roles.go)
+	permStream = "stream" // Start sessions and rooms
+	permWatch  = "watch"  // Watch or join sessions others started
+
+	providerLocal = "local"
+	providerOIDC  = "oidc"
+)
+
+var (
+	usersFile   = "users.json"
+	userKeyFile = "user-token-key"
+
+	// When set, signaling needs a signed-in user with the permission the
+	// route asks for. Requests from the host itself are always allowed.
+	requireLogin = false
+)
+
+// userAccount is a user of the local store. Provider users are matched to
+// one by subject or verified email; those matching none get the provider's
+// default permissions.
+type userAccount struct {
+	Name string `json:"name"`
+	// PasswordHash is bcrypt; empty for users who only sign in through
+	// the provider
+	PasswordHash string   `json:"password_hash,omitempty"`
+	OIDCSubject  string   `json:"oidc_subject,omitempty"`
+	Email        string   `json:"email,omitempty"`
+	Permissions  []string `json:"permissions"`
+	// Limits lower the host's offer limits for the user's sessions
+	Limits *offerLimits `json:"limits,omitempty"`
+	// MaxSessions caps how many sessions the user runs at once, 0 for no
+	// cap
+	MaxSessions int `json:"max_sessions,omitempty"`
+}
+
+func (u *userAccount) can(perm string) bool {
+	for _, p := range u.Permissions {
+		// Starting sessions includes joining them
+		if p == perm || p == permAdmin || (p == permStream && perm == permWatch) {
+			return true
+		}
+	}
+	return false
+}
+
+func validPermission(perm string) bool {
+	return perm == permAdmin || perm == permStream || perm == permWatch
+}
+
+var (
+	users     []*userAccount
+	usersLock sync.Mutex
+	userKey   []byte
+)
+
+func loadUsers() {
+	loadUserKey()
+	loadUserAccounts()
+}
+
+func loadUserAccounts() {
+	data, err := os.ReadFile(usersFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading users: %v", err)
+		}
+		return
+	}
+
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	if err := json.Unmarshal(data, &users); err != nil {
+		log.Printf("Error parsing %s: %v", usersFile, err)
+		return
+	}
+	log.Printf("Loaded %d users", len(users))
+}
+
+// saveUsers must be called with usersLock held
+func saveUsers() error {
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(usersFile, data, 0600)
+}
+
+// loadUserKey reads the key user tokens are signed with, creating it on
+// first start. Unlike share links, sign-ins survive restarts and updates.
+func loadUserKey() {
+	key, err := os.ReadFile(userKeyFile)
+	if err == nil && len(key) >= 32 {
+		userKey = key
+		return
+	}
+	userKey = make([]byte, 32)
+	rand.Read(userKey)
+	if err := os.WriteFile(userKeyFile, userKey, 0600); err != nil {
+		log.Printf("Error saving %s, sign-ins end on restart: %v", userKeyFile, err)
+	}
+}
+
+// getUserLocked must be called with usersLock held
+func getUserLocked(name string) *userAccount {
+	for _, u := range users {
+		if strings.EqualFold(u.Name, name) {
+			return u
+		}
+	}
+	return nil
+}
+
+// userClaims are the payload of a user token, a JWT signed with HS256
+type userClaims struct {
+	Subject  string `json:"sub"` // Account name, or the provider user's
+	Provider string `json:"idp"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+}
+
+var errInvalidUserToken = errors.New("invalid user token")
+
+// Header of every user token; verification accepts nothing else, so the
+// algorithm cannot be switched
+var userTokenHeaderJSON = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func signUserToken(claims userClaims) string {
+	payload, _ := json.Marshal(claims)
+	signed := userTokenHeaderJSON + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, userKey)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifyUserToken(token string) (*userClaims, error) {
+	header, rest, ok := strings.Cut(token, ".")
+	if !ok || header != userTokenHeaderJSON {
+		return nil, errInvalidUserToken
+	}
+	encPayload, encSig, ok := strings.Cut(rest, ".")
+	if !ok {
+		return nil, errInvalidUserToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encSig)
+	if err != nil {
+		return nil, errInvalidUserToken
+	}
+	mac := hmac.New(sha256.New, userKey)
+	mac.Write([]byte(header + "." + encPayload))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errInvalidUserToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return nil, errInvalidUserToken
+	}
+	var claims userClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidUserToken
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return nil, errInvalidUserToken
+	}
+	return &claims, nil
+}
+
+// currentUser returns the signed-in user making r, or nil. The account is
+// a copy.
+func currentUser(r *http.Request) *userAccount {
+	token := r.Header.Get(userTokenHeader)
+	if token == "" {
+		if cookie, err := r.Cookie(userCookie); err == nil {
+			token = cookie.Value
+		}
+	}
+	if token == "" {
+		return nil
+	}
+	claims, err := verifyUserToken(token)
+	if err != nil {
+		return nil
+	}
+
+	usersLock.Lock()
+	u := getUserLocked(claims.Subject)
+	usersLock.Unlock()
+	if u != nil {
+		account := *u
+		return &account
+	}
+	if claims.Provider == providerOIDC {
+		if perms := oidcDefaultPermissions(); len(perms) > 0 {
+			return &userAccount{Name: claims.Subject, Permissions: perms}
+		}
+	}
+	return nil
+}
+
+// requirePermission wraps signaling handlers that need a signed-in user
+// with perm while requireLogin is set
+func requirePermission(perm string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requireLogin && !isHostRequest(r) {
+			u := currentUser(r)
+			if u == nil {
+				writeError(w, http.StatusUnauthorized, "login_required", "Sign in first")
+				return
+			}
+			if !u.can(perm) {
+				writeErrorDetails(w, http.StatusForbidden, "permission_denied", "Not allowed", map[string]string{"permission": perm})
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// userSessionCount counts the running sessions the user started
+func userSessionCount(name string) int {
+	sessionsLock.RLock()
+	defer sessionsLock.RUnlock()
+	count := 0
+	for _, session := range sessions {
+		if session.parent == nil && session.user != "" && strings.EqualFold(session.user, name) {
+			count++
+		}
+	}
+	return count
+}
+
+var errSessionQuota = errors.New("Session quota reached")
+
+// checkSessionQuota refuses a new session to a user running their
+// MaxSessions already
+func checkSessionQuota(u *userAccount) error {
+	if u != nil && u.MaxSessions > 0 && userSessionCount(u.Name) >= u.MaxSessions {
+		return errSessionQuota
+	}
+	return nil
+}
+
+func writeQuotaError(w http.ResponseWriter, u *userAccount) {
+	writeErrorDetails(w, http.StatusForbidden, "quota_exceeded", errSessionQuota.Error(), map[string]int{"max_sessions": u.MaxSessions})
+}
+
+// issueUserToken signs the user in: the token goes in a cookie for the
+// web client and in the response for other clients
+func issueUserToken(w http.ResponseWriter, r *http.Request, name, provider string) (string, time.Time) {
+	now := time.Now()
+	expires := now.Add(userTokenTTL)
+	token := signUserToken(userClaims{
+		Subject:  name,
+		Provider: provider,
+		IssuedAt: now.Unix(),
+		Expires:  expires.Unix(),
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     userCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Printf("User %s signed in (%s)", name, provider)
+	auditRequest(r, "login", name, map[string]interface{}{"provider": provider})
+	return token, expires
+}
+
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// handleLogin signs in a user of the local store
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+
+	usersLock.Lock()
+	var name, hash string
+	if u := getUserLocked(req.Username); u != nil {
+		name, hash = u.Name, u.PasswordHash
+	}
+	usersLock.Unlock()
+	if hash == "" || bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+		log.Printf("Failed sign-in as %q from %s", req.Username, r.RemoteAddr)
+		auditRequest(r, "login_failed", req.Username, map[string]interface{}{"provider": providerLocal})
+		writeError(w, http.StatusUnauthorized, "invalid_credentials", "Wrong username or password")
+		return
+	}
+
+	token, expires := issueUserToken(w, r, name, providerLocal)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      token,
+		"user":       name,
+		"expires_at": expires.Format(time.RFC3339),
+	})
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if u := currentUser(r); u != nil {
+		auditRequest(r, "logout", u.Name, nil)
+	}
+	http.SetCookie(w, &http.Cookie{Name: userCookie, Path: "/", MaxAge: -1, HttpOnly: true})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCurrentUser returns the signed-in user
+func handleCurrentUser(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	if u == nil {
+		writeError(w, http.StatusUnauthorized, "login_required", "Sign in first")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userInfo(u))
+}
+
+// handleAuthProviders tells clients how they can sign in
+func handleAuthProviders(w http.ResponseWriter, r *http.Request) {
+	usersLock.Lock()
+	password := false
+	for _, u := range users {
+		password = password || u.PasswordHash != ""
+	}
+	usersLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"login_required": requireLogin,
+		"password":       password,
+		"oidc":           oidcEnabled(),
+	})
+}
+
+func userInfo(u *userAccount) map[string]interface{} {
+	info := map[string]interface{}{
+		"name":        u.Name,
+		"permissions": u.Permissions,
+		"password":    u.PasswordHash != "",
+		"sessions":    userSessionCount(u.Name),
+	}
+	if u.OIDCSubject != "" {
+		info["oidc_subject"] = u.OIDCSubject
+	}
+	if u.Email != "" {
+		info["email"] = u.Email
+	}
+	if u.Limits != nil {
+		info["limits"] = u.Limits
+	}
+	if u.MaxSessions > 0 {
+		info["max_sessions"] = u.MaxSessions
+	}
+	return info
+}
+
+// UserRequest creates or updates an account. An empty Password keeps the
+// current one.
+type UserRequest struct {
+	Password    string       `json:"password"`
+	OIDCSubject string       `json:"oidc_subject"`
+	Email       string       `json:"email"`
+	Permissions []string     `json:"permissions"`
+	Limits      *offerLimits `json:"limits,omitempty"`
+	MaxSessions int          `json:"max_sessions"`
+}
+
+// HTTP handlers, host only: GET /users lists the accounts, PUT and DELETE
+// /users/{name} manage one
+func handleListUsers(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Users can only be managed from the host")
+		return
+	}
+
+	usersLock.Lock()
+	list := make([]*userAccount, len(users))
+	copy(list, users)
+	usersLock.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	infos := make([]map[string]interface{}, 0, len(list))
+	for _, u := range list {
+		infos = append(infos, userInfo(u))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"users": infos})
+}
+
+func handlePutUser(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Users can only be managed from the host")
+		return
+	}
+
+	name := r.PathValue("name")
+	var req UserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+	if name == "" || len(name) > 64 || strings.ContainsAny(name, "/:") {
+		writeError(w, http.StatusBadRequest, "invalid_user", "Invalid user name")
+		return
+	}
+	for _, p := range req.Permissions {
+		if !validPermission(p) {
+			writeErrorDetails(w, http.StatusBadRequest, "invalid_user", "Unknown permission", p)
+			return
+		}
+	}
+	if req.Limits != nil {
+		if err := req.Limits.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_user", err.Error())
+			return
+		}
+	}
+	if req.MaxSessions < 0 {
+		writeError(w, http.StatusBadRequest, "invalid_user", "max_sessions must not be negative")
+		return
+	}
+	var hash string
+	if req.Password != "" {
+		h, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_user", err.Error())
+			return
+		}
+		hash = string(h)
+	}
+
+	usersLock.Lock()
+	u := getUserLocked(name)
+	created := u == nil
+	if created {
+		u = &userAccount{Name: name}
+		users = append(users, u)
+	}
+	if hash != "" {
+		u.PasswordHash = hash
+	}
+	u.OIDCSubject = req.OIDCSubject
+	u.Email = req.Email
+	u.Permissions = req.Permissions
+	if u.Permissions == nil {
+		u.Permissions = []string{}
+	}
+	u.Limits = req.Limits
+	u.MaxSessions = req.MaxSessions
+	if err := saveUsers(); err != nil {
+		log.Printf("Error saving users: %v", err)
+	}
+	account := *u
+	usersLock.Unlock()
+
+	log.Printf("User %s saved (permissions %v)", account.Name, account.Permissions)
+	auditRequest(r, "user_put", account.Name, map[string]interface{}{
+		"permissions":      account.Permissions,
+		"password_changed": hash != "",
+	})
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(userInfo(&account))
+}
+
+func handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Users can only be managed from the host")
+		return
+	}
+
+	name := r.PathValue("name")
+	usersLock.Lock()
+	kept := users[:0]
+	for _, u := range users {
+		if !strings.EqualFold(u.Name, name) {
+			kept = append(kept, u)
+		}
+	}
+	removed := len(kept) < len(users)
+	users = kept
+	if removed {
+		if err := saveUsers(); err != nil {
+			log.Printf("Error saving users: %v", err)
+		}
+	}
+	usersLock.Unlock()
+
+	if !removed {
+		writeError(w, http.StatusNotFound, "user_not_found", "User not found")
+		return
+	}
+	log.Printf("User %s deleted", name)
+	auditRequest(r, "user_delete", name, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
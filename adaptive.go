@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Adaptive encoding follows the packet loss the browser reports in RTCP
+// receiver reports. Lossy links get short GOPs, so a broken picture heals
+// sooner, and more FEC; clean ones get long GOPs and no FEC, leaving the
+// bitrate to picture quality. FEC changes at once, but a new GOP restarts
+// FFmpeg, a stall of its own, so the GOP follows the level at most once
+// every adaptiveGOPInterval, and a better level needs loss well under its
+// limit so a link hovering at one does not flap.
+
+// lossLevel is how a session encodes while smoothed loss stays below
+// maxLoss
+type lossLevel struct {
+	name       string
+	maxLoss    float64
+	gop        time.Duration
+	fecPercent int32
+}
+
+var lossLevels = []lossLevel{
+	{name: "clean", maxLoss: 0.005, gop: 4 * time.Second, fecPercent: 0},
+	{name: "moderate", maxLoss: 0.03, gop: 2 * time.Second, fecPercent: 10},
+	{name: "lossy", maxLoss: 1.01, gop: time.Second, fecPercent: 30},
+}
+
+// Sessions start at moderate, which matches the default two second GOP
+const initialLossLevel = 1
+
+const (
+	adaptiveInterval = 5 * time.Second
+	// A worse level applies at once, a better one only after loss has
+	// stayed low this long
+	adaptiveUpgradeDelay = 30 * time.Second
+	// Weight of each new receiver report in the smoothed loss
+	lossSmoothing = 0.2
+	// A better level needs loss under this share of its maxLoss
+	adaptiveHysteresis = 0.5
+	// Least time between the FFmpeg restarts of GOP changes
+	adaptiveGOPInterval = time.Minute
+)
+
+// adaptiveEncoder smooths the loss reported for a session's video
+type adaptiveEncoder struct {
+	mu       sync.Mutex
+	loss     float64
+	reported bool
+}
+
+func (a *adaptiveEncoder) observe(fractionLost float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.reported {
+		a.loss = fractionLost
+		a.reported = true
+		return
+	}
+	a.loss += lossSmoothing * (fractionLost - a.loss)
+}
+
+// smoothedLoss returns false until the first receiver report
+func (a *adaptiveEncoder) smoothedLoss() (float64, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.loss, a.reported
+}
+
+func levelForLoss(loss float64) int {
+	for i, level := range lossLevels {
+		if loss < level.maxLoss {
+			return i
+		}
+	}
+	return len(lossLevels) - 1
+}
+
+// encoderControl holds the config a session's capture runs with. Adaptive
+// encoding and the bitrate ladder each change their part of it.
+type encoderControl struct {
+	mu      sync.Mutex
+	capture CaptureSource
+	cfg     CaptureConfig
+}
+
+func (e *encoderControl) start(capture CaptureSource, cfg CaptureConfig) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.capture, e.cfg = capture, cfg
+}
+
+func (e *encoderControl) config() CaptureConfig {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.cfg
+}
+
+// updateEncoding applies change to the session's capture config and
+// reconfigures the source if anything changed
+func (s *StreamSession) updateEncoding(change func(cfg *CaptureConfig)) error {
+	e := &s.encoder
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.capture == nil {
+		return errCaptureNotStarted
+	}
+	updated := e.cfg
+	change(&updated)
+	if updated == e.cfg {
+		return nil
+	}
+	if err := e.capture.Reconfigure(updated); err != nil {
+		return err
+	}
+	e.cfg = updated
+	s.Stats.gopFrames.Store(int32(updated.gop()))
+	return nil
+}
+
+// adaptEncoding moves the session between loss levels until ctx ends
+func (s *StreamSession) adaptEncoding(ctx context.Context) {
+	current := initialLossLevel
+	s.Stats.fecPercent.Store(lossLevels[current].fecPercent)
+	// The level whose GOP the encoder runs with, and when it last changed
+	encoded := current
+	var encodedAt time.Time
+
+	ticker := time.NewTicker(adaptiveInterval)
+	defer ticker.Stop()
+	var betterSince time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		loss, ok := s.adaptive.smoothedLoss()
+		if !ok {
+			continue
+		}
+		s.Stats.packetLoss.Store(int32(loss * 1000))
+
+		next := levelForLoss(loss)
+		switch {
+		case next > current:
+			betterSince = time.Time{}
+		case next < current && loss < lossLevels[current-1].maxLoss*adaptiveHysteresis:
+			if betterSince.IsZero() {
+				betterSince = time.Now()
+			}
+			next = current
+			if time.Since(betterSince) >= adaptiveUpgradeDelay {
+				betterSince = time.Time{}
+				next = current - 1 // One step at a time
+			}
+		default:
+			betterSince = time.Time{}
+			next = current
+		}
+
+		if next != current {
+			level := lossLevels[next]
+			log.Printf("[Session %s] Packet loss %.1f%%, switching to %s encoding", s.ID, loss*100, level.name)
+			s.Stats.fecPercent.Store(level.fecPercent)
+			current = next
+		}
+		gop := lossLevels[current].gop
+		if gop != lossLevels[encoded].gop && time.Since(encodedAt) >= adaptiveGOPInterval {
+			encodedAt = time.Now()
+			if err := s.updateEncoding(func(cfg *CaptureConfig) { cfg.GOP = gop }); err != nil {
+				log.Printf("[Session %s] Error changing GOP: %v", s.ID, err)
+				continue
+			}
+			encoded = current
+		}
+	}
+}
+
+// readRTCP feeds receiver reports for the session's video to adaptive
+// encoding and answers the peer's PLIs and FIRs with a keyframe. Reading
+// also lets the interceptors answer NACKs.
+func (s *StreamSession) readRTCP(sender *webrtc.RTPSender) {
+	var ssrc webrtc.SSRC
+	if encodings := sender.GetParameters().Encodings; len(encodings) > 0 {
+		ssrc = encodings[0].SSRC
+	}
+
+	var lastPLI time.Time
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return // Closed with the peer connection
+		}
+		keyframe := false
+		for _, packet := range packets {
+			switch p := packet.(type) {
+			case *rtcp.ReceiverReport:
+				for _, report := range p.Reports {
+					if report.SSRC == uint32(ssrc) {
+						s.adaptive.observe(float64(report.FractionLost) / 256)
+					}
+				}
+			case *rtcp.PictureLossIndication:
+				keyframe = keyframe || p.MediaSSRC == uint32(ssrc)
+			case *rtcp.FullIntraRequest:
+				for _, entry := range p.FIR {
+					keyframe = keyframe || entry.SSRC == uint32(ssrc)
+				}
+			}
+		}
+		if keyframe && time.Since(lastPLI) >= pliMinInterval {
+			lastPLI = time.Now()
+			if err := s.requestKeyframe(); err == nil {
+				log.Printf("[Session %s] Keyframe requested by the peer", s.ID)
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// The host is dual-stack by default: its servers bind IPv6 and IPv4 on
+// wildcard addresses and ICE gathers candidates of both. On a network
+// where one family is broken, or an IPv6-first home connection where IPv4
+// goes through a congested carrier NAT, address-families.json lists the
+// families to use, most preferred first:
+//
+//	{"families": ["ipv6", "ipv4"]}
+//
+// A family left out is off. With both on, the host's connectivity checks
+// try the preferred family's candidates first, as RFC 8421 has dual-stack
+// ICE agents do; candidates with mDNS names are left as they come, as
+// their family is unknown.
+
+var addressFamiliesFile = "address-families.json"
+
+type addressFamilies struct {
+	ipv4, ipv6 bool
+	// prefer is "ipv4" or "ipv6" when both are on and one comes first
+	prefer string
+}
+
+var hostFamilies = addressFamilies{ipv4: true, ipv6: true}
+
+func parseAddressFamilies(data []byte) (addressFamilies, error) {
+	var cfg struct {
+		Families []string `json:"families"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return addressFamilies{}, err
+	}
+	if len(cfg.Families) == 0 {
+		return addressFamilies{}, errors.New("families must list ipv4, ipv6 or both")
+	}
+
+	var f addressFamilies
+	for _, family := range cfg.Families {
+		switch strings.ToLower(family) {
+		case "ipv4":
+			f.ipv4 = true
+		case "ipv6":
+			f.ipv6 = true
+		default:
+			return addressFamilies{}, fmt.Errorf("unknown address family %q", family)
+		}
+	}
+	if f.ipv4 && f.ipv6 {
+		f.prefer = strings.ToLower(cfg.Families[0])
+	}
+	return f, nil
+}
+
+func loadAddressFamilies() {
+	data, err := os.ReadFile(addressFamiliesFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading address families: %v", err)
+		}
+		return
+	}
+	f, err := parseAddressFamilies(data)
+	if err != nil {
+		log.Printf("Ignoring %s: %v", addressFamiliesFile, err)
+		return
+	}
+	hostFamilies = f
+	settingEngine.SetNetworkTypes(f.networkTypes())
+	log.Printf("Address families: %s", f)
+}
+
+func (f addressFamilies) String() string {
+	switch {
+	case !f.ipv6:
+		return "IPv4 only"
+	case !f.ipv4:
+		return "IPv6 only"
+	case f.prefer == "ipv6":
+		return "IPv6 preferred over IPv4"
+	}
+	return "IPv4 preferred over IPv6"
+}
+
+// networkTypes are the ICE candidates to gather
+func (f addressFamilies) networkTypes() []webrtc.NetworkType {
+	var types []webrtc.NetworkType
+	if f.ipv4 {
+		types = append(types, webrtc.NetworkTypeUDP4, webrtc.NetworkTypeTCP4)
+	}
+	if f.ipv6 {
+		types = append(types, webrtc.NetworkTypeUDP6, webrtc.NetworkTypeTCP6)
+	}
+	return types
+}
+
+// network narrows network, "tcp" or "udp", to the family that is on when
+// addr is a wildcard one; an address given in full is bound as it is
+func (f addressFamilies) network(network, addr string) string {
+	if f.ipv4 == f.ipv6 {
+		return network
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); err != nil || (host != "" && (ip == nil || !ip.IsUnspecified())) {
+		return network
+	}
+	if f.ipv4 {
+		return network + "4"
+	}
+	return network + "6"
+}
+
+// preferCandidates puts the preferred family's candidates in a remote
+// description before the other family's of the same type, so the host
+// checks them first: the top bit of the local preference is set for one
+// and cleared for the other. The type preference above it is kept, so a
+// preferred relay still comes after a host candidate of either family.
+func (f addressFamilies) preferCandidates(sdp string) string {
+	if f.prefer == "" {
+		return sdp
+	}
+	lines := strings.SplitAfter(sdp, "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+		// foundation component transport priority address port typ type ...
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			continue
+		}
+		priority, err := strconv.ParseUint(fields[3], 10, 32)
+		ip := net.ParseIP(fields[4])
+		if err != nil || ip == nil {
+			continue
+		}
+		const topLocalPreference = 0x8000 << 8
+		if (ip.To4() == nil) == (f.prefer == "ipv6") {
+			priority |= topLocalPreference
+		} else {
+			priority &^= topLocalPreference
+		}
+		fields[3] = strconv.FormatUint(priority, 10)
+		lines[i] = strings.Join(fields, " ") + line[len(strings.TrimRight(line, "\r\n")):]
+	}
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+)
+
+// The API is also served on a Unix domain socket, so scripts on the host
+// can manage the server with no credentials to keep:
+//
+//	curl --unix-socket chimera-admin.sock http://chimera/api/v1/sessions
+//
+// Requests on it are the host's own, with every permission, as from the
+// loopback address. The socket is made readable and writable by the user
+// the server runs as only; on Windows, which has Unix domain sockets
+// since Windows 10 1803, the folder's permissions apply instead.
+
+var adminSocketPath = "chimera-admin.sock"
+
+type adminSocketKey struct{}
+
+func startAdminSocket() {
+	listener, err := listenUnix("admin", adminSocketPath)
+	if err != nil {
+		log.Printf("[Admin] Error listening on %s: %v", adminSocketPath, err)
+		return
+	}
+	if err := os.Chmod(adminSocketPath, 0600); err != nil {
+		log.Printf("[Admin] Error restricting %s: %v", adminSocketPath, err)
+	}
+
+	server := &http.Server{
+		Handler: http.DefaultServeMux,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, adminSocketKey{}, true)
+		},
+	}
+	onHandover(func() { server.SetKeepAlivesEnabled(false) })
+
+	log.Printf("[Admin] API on unix socket %s", listener.Addr())
+	go func() {
+		if err := server.Serve(listener); err != nil && !handedOver.Load() {
+			log.Printf("[Admin] Server error: %v", err)
+		}
+	}()
+}
+
+// isAdminSocketRequest reports whether r came over the admin socket
+func isAdminSocketRequest(r *http.Request) bool {
+	local, _ := r.Context().Value(adminSocketKey{}).(bool)
+	return local
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Prefix of every API route. Static files and the systemd and service
+// plumbing stay outside it.
+const apiPrefix = "/api/v1"
+
+// APIError is the body of every failed API response. Code is stable for
+// clients to switch on; Message is for people.
+type APIError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+	// RequestID is the X-Request-ID of the response, for reports
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeErrorDetails(w, status, code, message, nil)
+}
+
+func writeErrorDetails(w http.ResponseWriter, status int, code, message string, details interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(APIError{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: w.Header().Get(requestIDHeader),
+	})
+}
+
+// handleAPI registers handler for "METHOD /path" under apiPrefix, behind
+// the network policy
+func handleAPI(pattern string, handler http.HandlerFunc) {
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok {
+		method, path = "", pattern
+	} else {
+		method += " "
+	}
+	// Sessions and queued offers of other cluster hosts are theirs to serve
+	if strings.HasPrefix(path, "/sessions/{id}") || path == "/queue/{id}" {
+		handler = clusterForwarded(handler)
+	}
+	http.HandleFunc(method+apiPrefix+path, compressed(logRequests(policyChecked(handler))))
+}
+
+// handleAPINotFound answers API paths no route matches
+func handleAPINotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, "not_found", "No such API endpoint")
+}
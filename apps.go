@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var appsFile = "apps.json"
+
+// App is a catalog entry a session can launch when it starts
+type App struct {
+	Name       string   `json:"name"`
+	Command    string   `json:"command"`
+	Args       []string `json:"args,omitempty"`
+	WorkingDir string   `json:"working_dir,omitempty"`
+	URI        string   `json:"uri,omitempty"`    // Launcher URI, e.g. steam://rungameid/570
+	Icon       string   `json:"icon,omitempty"`   // Artwork file on the host
+	Source     string   `json:"source,omitempty"` // Launcher the app was discovered in
+	// OnDisconnect decides what happens to the app when its session ends;
+	// empty means terminate
+	OnDisconnect string `json:"on_disconnect,omitempty"`
+}
+
+// What happens to a session's app when the session ends
+const (
+	appOnDisconnectTerminate = "terminate" // Stop it, killing it after appTerminateGrace
+	appOnDisconnectSuspend   = "suspend"   // Freeze it until a session launches it again
+	appOnDisconnectKeep      = "keep"      // Leave it running
+)
+
+// How long a terminated app gets to exit before it is killed
+const appTerminateGrace = 5 * time.Second
+
+func validAppOnDisconnect(policy string) bool {
+	switch policy {
+	case appOnDisconnectTerminate, appOnDisconnectSuspend, appOnDisconnectKeep:
+		return true
+	}
+	return false
+}
+
+// Names appear in URLs and on clients: no slashes or control characters
+var appNamePattern = regexp.MustCompile(`^[^/\x00-\x1f]{1,64}$`)
+
+func (a *App) validate() error {
+	if !appNamePattern.MatchString(a.Name) {
+		return errors.New("app name must be 1-64 characters without '/'")
+	}
+	if a.Command == "" {
+		return errors.New("command is required")
+	}
+	if a.OnDisconnect != "" && !validAppOnDisconnect(a.OnDisconnect) {
+		return errors.New("on_disconnect must be terminate, suspend or keep")
+	}
+	return nil
+}
+
+// App catalog, persisted to appsFile
+var (
+	apps     = make(map[string]*App)
+	appsLock sync.RWMutex
+)
+
+func loadApps() {
+	data, err := os.ReadFile(appsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading app catalog: %v", err)
+		}
+		return
+	}
+
+	var list []*App
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("Error parsing %s: %v", appsFile, err)
+		return
+	}
+
+	appsLock.Lock()
+	defer appsLock.Unlock()
+	for _, a := range list {
+		if err := a.validate(); err != nil {
+			log.Printf("Skipping invalid app %q: %v", a.Name, err)
+			continue
+		}
+		apps[a.Name] = a
+	}
+	log.Printf("Loaded %d apps", len(apps))
+}
+
+// saveApps must be called with appsLock held
+func saveApps() error {
+	data, err := json.MarshalIndent(sortedApps(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(appsFile, data, 0644)
+}
+
+// sortedApps must be called with appsLock held
+func sortedApps() []*App {
+	list := make([]*App, 0, len(apps))
+	for _, a := range apps {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func getApp(name string) (*App, bool) {
+	appsLock.RLock()
+	defer appsLock.RUnlock()
+	a, ok := apps[name]
+	return a, ok
+}
+
+// HTTP handlers for the app catalog. Clients see names only; commands are
+// shown to and changed from the host alone since they run on it.
+func handleListApps(w http.ResponseWriter, r *http.Request) {
+	appsLock.RLock()
+	list := sortedApps()
+	appsLock.RUnlock()
+
+	host := isHostRequest(r)
+	entries := make([]interface{}, 0, len(list))
+	for _, a := range list {
+		if host {
+			entries = append(entries, a)
+			continue
+		}
+		entry := map[string]interface{}{"name": a.Name}
+		if a.Icon != "" {
+			entry["icon_url"] = apiPrefix + "/apps/" + url.PathEscape(a.Name) + "/icon"
+		}
+		if a.Source != "" {
+			entry["source"] = a.Source
+		}
+		entries = append(entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"apps": entries,
+	})
+}
+
+func handlePutApp(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Apps can only be changed from the host")
+		return
+	}
+
+	var app App
+	if err := json.NewDecoder(r.Body).Decode(&app); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+	app.Name = r.PathValue("name")
+	if err := app.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_app", err.Error())
+		return
+	}
+
+	appsLock.Lock()
+	apps[app.Name] = &app
+	err := saveApps()
+	appsLock.Unlock()
+	if err != nil {
+		log.Printf("Error saving app catalog: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	log.Printf("App %q saved", app.Name)
+	auditRequest(r, "app_put", app.Name, nil)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app)
+}
+
+func handleDeleteApp(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Apps can only be changed from the host")
+		return
+	}
+
+	name := r.PathValue("name")
+	appsLock.Lock()
+	_, exists := apps[name]
+	delete(apps, name)
+	err := saveApps()
+	appsLock.Unlock()
+
+	if !exists {
+		writeError(w, http.StatusNotFound, "app_not_found", "App not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving app catalog: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	auditRequest(r, "app_delete", name, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAppIcon serves the artwork of an app that has some
+func handleAppIcon(w http.ResponseWriter, r *http.Request) {
+	app, ok := getApp(r.PathValue("name"))
+	if !ok || app.Icon == "" {
+		writeError(w, http.StatusNotFound, "icon_not_found", "Icon not found")
+		return
+	}
+	w.Header().Set("Cache-Control", "max-age=86400")
+	http.ServeFile(w, r, app.Icon)
+}
+
+// handleScanApps rescans the launcher libraries on the host
+func handleScanApps(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Apps can only be changed from the host")
+		return
+	}
+
+	counts, err := scanLibraries()
+	if errors.Is(err, errNoLibraries) {
+		writeError(w, http.StatusNotFound, "no_libraries", err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error scanning libraries: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"found": counts,
+	})
+}
+
+// AppProcess is an app launched by a session
+type AppProcess struct {
+	Name      string
+	Cmd       *exec.Cmd
+	StartTime time.Time
+
+	owner    atomic.Pointer[StreamSession] // Session the app runs for; nil once it ended
+	done     chan struct{}                 // Closed when the process exits
+	exitCode int                           // Valid once done is closed; -1 if killed by a signal
+}
+
+// AppMessage reports the session's app on the "input" DataChannel when it
+// opens and when the app exits
+type AppMessage struct {
+	Type     string `json:"type"` // "app"
+	Name     string `json:"name"`
+	State    string `json:"state"` // "running" or "exited"
+	ExitCode *int   `json:"exit_code,omitempty"`
+}
+
+// Apps suspended by a session that ended, by app name. The next session
+// launching the same app resumes the process instead of starting another.
+var (
+	suspendedApps     = make(map[string]*AppProcess)
+	suspendedAppsLock sync.Mutex
+)
+
+func (p *AppProcess) running() bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (p *AppProcess) info() map[string]interface{} {
+	info := map[string]interface{}{
+		"name":       p.Name,
+		"pid":        p.Cmd.Process.Pid,
+		"start_time": p.StartTime.Format(time.RFC3339),
+		"running":    p.running(),
+	}
+	if !p.running() {
+		info["exit_code"] = p.exitCode
+	}
+	return info
+}
+
+func (p *AppProcess) message() AppMessage {
+	msg := AppMessage{Type: "app", Name: p.Name, State: "running"}
+	if !p.running() {
+		msg.State = "exited"
+		msg.ExitCode = &p.exitCode
+	}
+	return msg
+}
+
+// terminate asks the app to exit and kills it if it has not after
+// appTerminateGrace
+func (p *AppProcess) terminate() {
+	if err := stopProcess(p.Cmd.Process.Pid); err != nil {
+		log.Printf("Error stopping app %q: %v", p.Name, err)
+	}
+	select {
+	case <-p.done:
+	case <-time.After(appTerminateGrace):
+		log.Printf("App %q did not exit in %v; killing it", p.Name, appTerminateGrace)
+		if err := killProcess(p.Cmd.Process.Pid); err != nil {
+			log.Printf("Error killing app %q: %v", p.Name, err)
+		}
+	}
+}
+
+// launchApp starts app for the session, or resumes it if an earlier
+// session left it suspended. policy overrides the app's OnDisconnect. On
+// failure the session just streams the desktop.
+func (s *StreamSession) launchApp(app *App, policy string) {
+	if policy == "" {
+		policy = app.OnDisconnect
+	}
+	if policy == "" {
+		policy = appOnDisconnectTerminate
+	}
+
+	proc := resumeSuspendedApp(app.Name)
+	if proc != nil {
+		log.Printf("[Session %s] Resumed app %q (PID %d)", s.ID, app.Name, proc.Cmd.Process.Pid)
+	} else {
+		cmd := exec.Command(app.Command, app.Args...)
+		cmd.Dir = app.WorkingDir
+		release := configureAppCmd(cmd)
+		err := cmd.Start()
+		release()
+		if err != nil {
+			log.Printf("[Session %s] Error launching app %q: %v", s.ID, app.Name, err)
+			return
+		}
+
+		proc = &AppProcess{
+			Name:      app.Name,
+			Cmd:       cmd,
+			StartTime: time.Now(),
+			done:      make(chan struct{}),
+		}
+		log.Printf("[Session %s] Launched app %q (PID %d)", s.ID, app.Name, cmd.Process.Pid)
+		go proc.wait()
+	}
+
+	proc.owner.Store(s)
+	s.mutex.Lock()
+	s.App = proc
+	s.mutex.Unlock()
+
+	go s.watchApp(proc, policy)
+}
+
+// wait reaps the process and tells the session it ran for, if any
+func (p *AppProcess) wait() {
+	p.Cmd.Wait()
+	p.exitCode = p.Cmd.ProcessState.ExitCode()
+	close(p.done)
+
+	suspendedAppsLock.Lock()
+	if suspendedApps[p.Name] == p {
+		delete(suspendedApps, p.Name)
+	}
+	suspendedAppsLock.Unlock()
+
+	owner := p.owner.Load()
+	if owner == nil {
+		log.Printf("App %q exited with code %d", p.Name, p.exitCode)
+		return
+	}
+	log.Printf("[Session %s] App %q exited with code %d", owner.ID, p.Name, p.exitCode)
+	owner.sendAppState(p)
+}
+
+// watchApp applies the disconnect policy once the session ends
+func (s *StreamSession) watchApp(proc *AppProcess, policy string) {
+	select {
+	case <-proc.done:
+		return
+	case <-s.ctx.Done():
+	}
+	proc.owner.CompareAndSwap(s, nil)
+
+	switch policy {
+	case appOnDisconnectKeep:
+		log.Printf("[Session %s] Session ended; leaving app %q running", s.ID, proc.Name)
+	case appOnDisconnectSuspend:
+		if err := suspendProcess(proc.Cmd.Process.Pid); err != nil {
+			log.Printf("[Session %s] Error suspending app %q, terminating it: %v", s.ID, proc.Name, err)
+			proc.terminate()
+			return
+		}
+		log.Printf("[Session %s] Session ended; suspended app %q", s.ID, proc.Name)
+
+		// Only one suspended copy of each app is kept
+		suspendedAppsLock.Lock()
+		previous := suspendedApps[proc.Name]
+		suspendedApps[proc.Name] = proc
+		suspendedAppsLock.Unlock()
+		if previous != nil && previous != proc {
+			resumeProcess(previous.Cmd.Process.Pid)
+			go previous.terminate()
+		}
+	default:
+		log.Printf("[Session %s] Session ended; terminating app %q", s.ID, proc.Name)
+		proc.terminate()
+	}
+}
+
+// resumeSuspendedApp takes the suspended process of the named app, if it
+// is still alive, and lets it run again
+func resumeSuspendedApp(name string) *AppProcess {
+	suspendedAppsLock.Lock()
+	proc := suspendedApps[name]
+	delete(suspendedApps, name)
+	suspendedAppsLock.Unlock()
+
+	if proc == nil || !proc.running() {
+		return nil
+	}
+	if err := resumeProcess(proc.Cmd.Process.Pid); err != nil {
+		log.Printf("Error resuming app %q, starting it again: %v", name, err)
+		go proc.terminate()
+		return nil
+	}
+	return proc
+}
+
+// sendAppState reports the app's state to the client
+func (s *StreamSession) sendAppState(proc *AppProcess) {
+	s.mutex.RLock()
+	dc := s.inputChannel
+	s.mutex.RUnlock()
+	if dc != nil {
+		sendJSON(dc, proc.message())
+	}
+}
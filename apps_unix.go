@@ -0,0 +1,37 @@
+//go:build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Apps get their own process group so signals reach the launchers and
+// helpers they spawn too. The returned func releases what the command
+// needed once it started.
+func configureAppCmd(cmd *exec.Cmd) func() {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return func() {}
+}
+
+func suspendProcess(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGSTOP)
+}
+
+func resumeProcess(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGCONT)
+}
+
+// stopProcess asks the app to exit. A stopped group must be continued to
+// see the signal.
+func stopProcess(pid int) error {
+	if err := syscall.Kill(-pid, syscall.SIGTERM); err != nil {
+		return err
+	}
+	return syscall.Kill(-pid, syscall.SIGCONT)
+}
+
+func killProcess(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGKILL)
+}
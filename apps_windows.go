@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+const processSuspendResume = 0x0800
+
+var (
+	ntdll                = syscall.NewLazyDLL("ntdll.dll")
+	procNtSuspendProcess = ntdll.NewProc("NtSuspendProcess")
+	procNtResumeProcess  = ntdll.NewProc("NtResumeProcess")
+)
+
+// configureAppCmd runs apps as the signed-in user when the server runs as
+// SYSTEM under the service, so games get the user's profile and saves
+func configureAppCmd(cmd *exec.Cmd) func() {
+	var session uint32
+	if err := windows.ProcessIdToSessionId(windows.GetCurrentProcessId(), &session); err != nil {
+		return func() {}
+	}
+	var token windows.Token
+	if err := windows.WTSQueryUserToken(session, &token); err != nil {
+		// Not SYSTEM: apps already run as the server's user
+		return func() {}
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Token: syscall.Token(token)}
+	return func() { token.Close() }
+}
+
+// suspendProcess freezes every thread of the process; unlike the Unix
+// version, processes it spawned keep running
+func suspendProcess(pid int) error {
+	return callProcess(procNtSuspendProcess, pid)
+}
+
+func resumeProcess(pid int) error {
+	return callProcess(procNtResumeProcess, pid)
+}
+
+func callProcess(proc *syscall.LazyProc, pid int) error {
+	handle, err := syscall.OpenProcess(processSuspendResume, false, uint32(pid))
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(handle)
+
+	if status, _, _ := proc.Call(uintptr(handle)); status != 0 {
+		return fmt.Errorf("%s failed with status 0x%x", proc.Name, status)
+	}
+	return nil
+}
+
+// stopProcess asks the process tree to close its windows
+func stopProcess(pid int) error {
+	return exec.Command("taskkill", "/T", "/PID", strconv.Itoa(pid)).Run()
+}
+
+func killProcess(pid int) error {
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(pid)).Run()
+}
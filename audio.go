@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+)
+
+// Audio-only sessions stream what the host is playing and nothing else:
+// no video track is created and FFmpeg never captures the screen. They
+// are meant for listening to music remotely and for debugging audio.
+//
+// FFmpeg records the host's output device and encodes it to Opus in Ogg,
+// one 20ms packet per page, so each page is one sample for the track.
+//
+// On a jittery link audio glitches long before video visibly stutters, so
+// its buffering is set apart from the video's: audio_buffer_ms, in the
+// offer or pipeline.json, is both the capture buffer FFmpeg reads the
+// device with and the jitter buffer target the client is told to give the
+// track. A few tens of ms more latency buys audio that plays through the
+// jitter; 0 keeps FFmpeg's and the browser's own, which aim low.
+
+const (
+	audioSampleRate = 48000
+	audioChannels   = 2
+	audioBitrate    = "128k"
+	// Past a second, buffered audio is out of sync with anything
+	maxAudioBufferMs = 1000
+)
+
+var audioCodec = webrtc.RTPCodecCapability{
+	MimeType:  webrtc.MimeTypeOpus,
+	ClockRate: audioSampleRate,
+	Channels:  audioChannels,
+}
+
+// audioInputArgs are FFmpeg's input options for what the host plays,
+// read bufferMs at a time if it is set
+func audioInputArgs(bufferMs int) []string {
+	switch runtime.GOOS {
+	case "windows":
+		// Needs a loopback device such as virtual-audio-capturer
+		args := []string{"-f", "dshow"}
+		if bufferMs > 0 {
+			args = append(args, "-audio_buffer_size", strconv.Itoa(bufferMs))
+		}
+		return append(args, "-i", "audio=virtual-audio-capturer")
+	case "darwin":
+		// Needs a loopback device such as BlackHole as the default input.
+		// avfoundation has no buffer size to set.
+		return []string{"-f", "avfoundation", "-i", ":default"}
+	default:
+		args := []string{"-f", "pulse"}
+		if bufferMs > 0 {
+			// In bytes of 16-bit samples
+			size := bufferMs * audioSampleRate / 1000 * audioChannels * 2
+			args = append(args, "-fragment_size", strconv.Itoa(size))
+		}
+		return append(args, "-i", "@DEFAULT_MONITOR@")
+	}
+}
+
+func audioArgs(bufferMs int) []string {
+	args := append([]string{"-hide_banner", "-loglevel", "warning"}, audioInputArgs(bufferMs)...)
+	return append(args,
+		"-vn",
+		"-ac", "2",
+		"-ar", "48000",
+		"-c:a", "libopus",
+		"-b:a", audioBitrate,
+		"-application", "audio",
+		"-frame_duration", "20",
+		"-f", "ogg",
+		"-page_duration", "20000", // One packet per page
+		"pipe:1",
+	)
+}
+
+// runAudioCapture feeds the host's audio into the session's audio track
+func runAudioCapture(ctx context.Context, session *StreamSession, track *webrtc.TrackLocalStaticSample, bufferMs int) {
+	sessionID := session.ID
+	if ctx.Err() != nil {
+		log.Printf("[Session %s] Context already canceled, not starting audio capture", sessionID)
+		return
+	}
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", audioArgs(bufferMs)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Printf("[Session %s] Error starting audio capture: %v", sessionID, err)
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		log.Printf("[Session %s] Error starting audio capture: %v", sessionID, err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("[Session %s] Error starting audio capture: %v", sessionID, err)
+		return
+	}
+	defer cmd.Wait()
+	log.Printf("[Session %s] FFmpeg audio capture started (PID: %d)", sessionID, cmd.Process.Pid)
+	session.trackProcess(cmd.Process, "audio")
+
+	session.goSafe("FFmpeg log reader", func() {
+		scanner := newLogScanner(stderr)
+		for scanner.Scan() {
+			if line := scanner.Text(); len(line) > 0 {
+				session.logFFmpeg("audio", line)
+			}
+		}
+	})
+
+	if err := writeOggSamples(session, track, stdout); err != nil && ctx.Err() == nil {
+		log.Printf("[Session %s] Audio capture ended: %v", sessionID, err)
+	}
+}
+
+// writeOggSamples sends each Opus packet of an Ogg stream as a sample,
+// timed by the page's granule position
+func writeOggSamples(session *StreamSession, track *webrtc.TrackLocalStaticSample, r io.Reader) error {
+	ogg, _, err := oggreader.NewWith(r)
+	if err != nil {
+		return err
+	}
+
+	var granule uint64
+	for {
+		packet, page, err := ogg.ParseNextPage()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// The OpusTags page ahead of the audio has no samples
+		if page.GranulePosition <= granule {
+			continue
+		}
+		duration := time.Duration(page.GranulePosition-granule) * time.Second / audioSampleRate
+		granule = page.GranulePosition
+
+		session.Stats.samplesProcessed.Add(1)
+		if err := track.WriteSample(media.Sample{Data: packet, Duration: duration}); err != nil {
+			session.Stats.samplesDropped.Add(1)
+			continue
+		}
+		session.Stats.samplesSent.Add(1)
+		session.Stats.bytesSent.Add(int64(len(packet)))
+	}
+}
+
+// track is what the session streams: its video, or the host's audio in an
+// audio-only session. Spectators and co-op guests share it.
+func (s *StreamSession) track() *webrtc.TrackLocalStaticSample {
+	if s.audioTrack != nil {
+		return s.audioTrack
+	}
+	return s.videoTrack
+}
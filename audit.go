@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The audit log records who did what on the host: sessions started and
+// ended, control changes, clipboard syncs, sign-ins and changes to users,
+// devices and settings. Entries are appended to audit.log as JSON lines
+// and never rewritten; admins query them with GET /audit.
+
+var auditLogFile = "audit.log"
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Who did it, as far as it is known
+	User      string `json:"user,omitempty"`
+	Device    string `json:"device,omitempty"` // Paired device ID
+	Remote    string `json:"remote,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	// What it was done to
+	Session string                 `json:"session,omitempty"`
+	Target  string                 `json:"target,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+var auditLog = struct {
+	sync.Mutex
+	file *os.File
+}{}
+
+// audit appends the entry to the log, opening it on first use
+func audit(entry auditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("[Audit] Error encoding entry: %v", err)
+		return
+	}
+
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	if auditLog.file == nil {
+		f, err := os.OpenFile(auditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Printf("[Audit] Error opening %s, %s not recorded: %v", auditLogFile, entry.Action, err)
+			return
+		}
+		auditLog.file = f
+	}
+	if _, err := auditLog.file.Write(append(line, '\n')); err != nil {
+		log.Printf("[Audit] Error writing %s: %v", entry.Action, err)
+	}
+}
+
+// auditRequest records an action taken through the API request r
+func auditRequest(r *http.Request, action, target string, details map[string]interface{}) {
+	entry := auditEntry{
+		Action:    action,
+		RequestID: requestID(r),
+		Target:    target,
+		Details:   details,
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		entry.Remote = host
+	}
+	if u := currentUser(r); u != nil {
+		entry.User = u.Name
+	}
+	if device := deviceForToken(r.Header.Get(deviceTokenHeader)); device != nil {
+		entry.Device = device.ID
+	}
+	if id := r.PathValue("id"); id != "" && strings.HasPrefix(r.URL.Path, apiPrefix+"/sessions/") {
+		entry.Session = id
+	}
+	audit(entry)
+}
+
+// auditSession records an action of a session's peer
+func auditSession(session *StreamSession, action string, details map[string]interface{}) {
+	audit(auditEntry{
+		Action:  action,
+		User:    session.user,
+		Session: session.ID,
+		Details: details,
+	})
+}
+
+func auditSessionEnd(session *StreamSession) {
+	auditSession(session, "session_end", map[string]interface{}{
+		"duration": time.Since(session.StartTime).Round(time.Second).String(),
+	})
+}
+
+// handleAuditLog returns the newest entries, oldest first, filtered by the
+// action, user, session and since (RFC 3339) query parameters. Admin only.
+func handleAuditLog(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		writeError(w, http.StatusForbidden, "admin_only", "Only admins can read the audit log")
+		return
+	}
+
+	q := r.URL.Query()
+	limit := defaultAuditLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			writeErrorDetails(w, http.StatusBadRequest, "invalid_limit", "Invalid limit", map[string]int{"max": maxAuditLimit})
+			return
+		}
+		limit = n
+	}
+	var since time.Time
+	if s := q.Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_since", "since must be an RFC 3339 time")
+			return
+		}
+		since = t
+	}
+	action, user, session := q.Get("action"), q.Get("user"), q.Get("session")
+
+	f, err := os.Open(auditLogFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("[Audit] Error reading %s: %v", auditLogFile, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading the audit log")
+		return
+	}
+	entries := make([]auditEntry, 0, limit)
+	if f != nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for scanner.Scan() {
+			var entry auditEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+				continue
+			}
+			if entry.Time.Before(since) ||
+				(action != "" && entry.Action != action) ||
+				(user != "" && !strings.EqualFold(entry.User, user)) ||
+				(session != "" && entry.Session != session) {
+				continue
+			}
+			if len(entries) == limit {
+				entries = append(entries[:0], entries[1:]...)
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"entries": entries})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// chimera-go bench captures and encodes at each rung of the bitrate ladder,
+// with no peer to send to, and reports the frame rate and bitrate the host
+// sustains and how busy its CPU was meanwhile. The top rung is the primary
+// monitor's own size and refresh rate, so the first line says whether the
+// host can stream its screen as it is. The ladder, scaler and colors are
+// the host's, read from their files as the server would.
+
+const (
+	benchStartTimeout = 10 * time.Second
+	// A rung is sustained when its frame rate reaches this share of the
+	// rung's
+	benchSustainedShare = 0.95
+)
+
+type benchResult struct {
+	rung       ladderRung
+	width      int
+	height     int
+	fps, kbps  float64
+	cpuPercent float64 // Of every core, -1 when unknown
+	err        error
+	sustained  bool
+}
+
+func runBenchCommand(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	source := flags.String("source", captureSource, "capture source")
+	codec := flags.String("codec", defaultVideoCodec, "video codec")
+	preset := flags.String("preset", defaultEncoderPreset, "encoder preset")
+	seconds := flags.Int("seconds", 10, "seconds to encode each rung for")
+	verbose := flags.Bool("v", false, "log what the capture sources log")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return errors.New("usage: chimera-go bench [-source name] [-codec name] [-preset name] [-seconds n] [-v]")
+	}
+	if !captureSourceAvailable(*source) {
+		return fmt.Errorf("capture source %q is not available", *source)
+	}
+	if _, ok := videoCodecs[*codec]; !ok || !captureSourceEncodes(*source, *codec) {
+		return fmt.Errorf("capture source %q cannot encode %q", *source, *codec)
+	}
+	p, ok := encoderPresets[*preset]
+	if !ok {
+		return fmt.Errorf("unknown encoder preset %q", *preset)
+	}
+	if *seconds < 1 {
+		return errors.New("seconds must be at least 1")
+	}
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	loadBitrateLadder()
+	loadScaler()
+	loadColors()
+
+	base := CaptureConfig{
+		Codec:        *codec,
+		Width:        1920,
+		Height:       1080,
+		IntraRefresh: p.IntraRefresh,
+		Colors:       hostColors,
+	}
+	if !captureSourceTypes[*source].caps.Colors {
+		base.Colors = inProcessColors
+	}
+	topFPS := 60
+	if captureSourceTypes[*source].caps.Live {
+		if monitor, ok := primaryMonitor(); ok {
+			base.Monitor = &monitor
+			base.Width, base.Height = monitor.Width, monitor.Height
+			if monitor.RefreshHz > 0 {
+				topFPS = int(monitor.RefreshHz + 0.5)
+			}
+		}
+	}
+
+	fmt.Printf("Benchmarking %s with %s (%s), %ds per rung\n\n", *source, *codec, *preset, *seconds)
+	fmt.Printf(benchRowFormat, "rung", "size", "fps", "kbps", "cpu", "")
+	// The ladder's rungs below the top, like a session's without its cap
+	rungs := sessionLadder(base.Height, topFPS, 0)[:1]
+	for _, r := range bitrateLadder {
+		if r.Height <= base.Height && r.FPS <= topFPS && r.String() != rungs[0].String() {
+			rungs = append(rungs, r)
+		}
+	}
+
+	var best *benchResult
+	for _, rung := range rungs {
+		cfg := base
+		rung.apply(&cfg)
+		result := benchRung(*source, cfg, rung, time.Duration(*seconds)*time.Second)
+		result.print()
+		if result.sustained && best == nil {
+			best = &result
+		}
+	}
+
+	fmt.Println()
+	if best == nil {
+		fmt.Println("No rung was sustained; try a lighter codec or preset, or a hardware capture source")
+		return nil
+	}
+	fmt.Printf("Highest sustained: %s at %dx%d\n", best.rung, best.width, best.height)
+	return nil
+}
+
+// primaryMonitor returns the primary monitor, or the first
+func primaryMonitor() (Monitor, bool) {
+	monitors, err := listMonitors()
+	if err != nil || len(monitors) == 0 {
+		return Monitor{}, false
+	}
+	for _, m := range monitors {
+		if m.Primary {
+			return m, true
+		}
+	}
+	return monitors[0], true
+}
+
+// benchRung encodes cfg for duration, timed from the first frame so the
+// source's start is left out
+func benchRung(source string, cfg CaptureConfig, rung ladderRung, duration time.Duration) benchResult {
+	result := benchResult{rung: rung, cpuPercent: -1}
+	result.width, result.height = cfg.outputSize()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	session := &StreamSession{ID: "bench-" + rung.String(), Cancel: cancel, ctx: ctx}
+	capture, err := newCaptureSource(source, session, &session.Stats)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	if err := capture.Start(ctx, cfg); err != nil {
+		result.err = err
+		return result
+	}
+	defer capture.Stop()
+
+	// Stopping the source ends a blocked ReadAccessUnit
+	timeout := time.AfterFunc(benchStartTimeout, func() { capture.Stop() })
+	if _, err := capture.ReadAccessUnit(); err != nil {
+		timeout.Stop()
+		result.err = fmt.Errorf("no frames: %v", err)
+		return result
+	}
+	timeout.Stop()
+
+	start := time.Now()
+	busyBefore, totalBefore, cpuErr := cpuTimes()
+	time.AfterFunc(duration, func() { capture.Stop() })
+	var frames, bytes int64
+	for {
+		au, err := capture.ReadAccessUnit()
+		if err != nil {
+			break
+		}
+		frames++
+		bytes += int64(len(au.Data))
+	}
+	elapsed := time.Since(start).Seconds()
+	busyAfter, totalAfter, err := cpuTimes()
+	if cpuErr == nil && err == nil && totalAfter > totalBefore {
+		result.cpuPercent = float64(busyAfter-busyBefore) / float64(totalAfter-totalBefore) * 100
+	}
+
+	result.fps = float64(frames) / elapsed
+	result.kbps = float64(bytes) * 8 / 1000 / elapsed
+	result.sustained = result.fps >= benchSustainedShare*float64(rung.FPS)
+	return result
+}
+
+// benchRowFormat lines up the rows, which are printed as each rung ends
+const benchRowFormat = "%-10s %-11s %-11s %-12s %-5s %s\n"
+
+func (r benchResult) print() {
+	size := fmt.Sprintf("%dx%d", r.width, r.height)
+	if r.err != nil {
+		fmt.Printf(benchRowFormat, r.rung, size, "", "", "", "failed: "+r.err.Error())
+		return
+	}
+	cpu := "-"
+	if r.cpuPercent >= 0 {
+		cpu = fmt.Sprintf("%.0f%%", r.cpuPercent)
+	}
+	verdict := "ok"
+	if !r.sustained {
+		verdict = "too slow"
+	}
+	fmt.Printf(benchRowFormat, r.rung, size, fmt.Sprintf("%.1f/%d", r.fps, r.rung.FPS),
+		fmt.Sprintf("%.0f/%d", r.kbps, r.rung.Kbps), cpu, verdict)
+}
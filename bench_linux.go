@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cpuTimes returns the time every core spent busy and in all, from the
+// first line of /proc/stat:
+//
+//	cpu  user nice system idle iowait irq softirq steal ...
+func cpuTimes() (busy, total time.Duration, err error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 9 || fields[0] != "cpu" {
+		return 0, 0, errors.New("unexpected /proc/stat")
+	}
+	var ticks [8]int64
+	for i := range ticks {
+		if ticks[i], err = strconv.ParseInt(fields[i+1], 10, 64); err != nil {
+			return 0, 0, err
+		}
+	}
+	// Kernels count in USER_HZ, 100 on every architecture
+	const tick = 10 * time.Millisecond
+	var all int64
+	for _, t := range ticks {
+		all += t
+	}
+	idle := ticks[3] + ticks[4]
+	return time.Duration(all-idle) * tick, time.Duration(all) * tick, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+func cpuTimes() (busy, total time.Duration, err error) {
+	return 0, 0, fmt.Errorf("CPU times are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	kernel32           = syscall.NewLazyDLL("kernel32.dll")
+	procGetSystemTimes = kernel32.NewProc("GetSystemTimes")
+)
+
+// cpuTimes returns the time every core spent busy and in all; kernel time
+// includes idle time
+func cpuTimes() (busy, total time.Duration, err error) {
+	var idle, kernel, user windows.Filetime
+	if r, _, err := procGetSystemTimes.Call(uintptr(unsafe.Pointer(&idle)),
+		uintptr(unsafe.Pointer(&kernel)), uintptr(unsafe.Pointer(&user))); r == 0 {
+		return 0, 0, fmt.Errorf("GetSystemTimes: %v", err)
+	}
+	ticks := func(t windows.Filetime) time.Duration {
+		return time.Duration(int64(t.HighDateTime)<<32|int64(t.LowDateTime)) * 100
+	}
+	total = ticks(kernel) + ticks(user)
+	return total - ticks(idle), total, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+)
+
+// The buffers between FFmpeg and the track are sized for the picture: a
+// 4K keyframe is many times a 1080p one and would not fit what suits
+// 1080p, while a queue of 64 4K frames holds more memory than the session
+// needs. pipeline.json overrides any of the sizes for every session,
+//
+//	{"read_buffer_kb": 1024, "max_frame_mb": 16, "sample_queue": 32}
+//
+// and 0 or a missing field keeps the size the resolution calls for. It
+// also sets the FFmpeg startup deadline, see watchdog.go, and the audio
+// buffering of audio-only sessions, see audio.go.
+
+var pipelineFile = "pipeline.json"
+
+const (
+	minReadBuffer   = 256 << 10
+	minMaxFrameSize = 4 << 20
+	// Frames queued for the track at 1080p and below; larger pictures
+	// queue fewer, down to minSampleQueue
+	defaultSampleQueue = 64
+	minSampleQueue     = 16
+	// FFmpeg log lines longer than this are dropped
+	defaultLogLineSize = 64 << 10
+	// Limits on pipeline.json, past which a value is surely a typo
+	maxReadBufferKB = 64 << 10
+	maxMaxFrameMB   = 1 << 10
+	maxSampleQueue  = 1024
+	maxLogLineKB    = 16 << 10
+)
+
+type pipelineConfig struct {
+	// ReadBufferKB buffers FFmpeg's output as it is read
+	ReadBufferKB int `json:"read_buffer_kb"`
+	// MaxFrameMB is the largest encoded frame read; a larger one fails
+	// the capture as corrupt
+	MaxFrameMB int `json:"max_frame_mb"`
+	// SampleQueue is the frames waiting for the track before they drop
+	SampleQueue int `json:"sample_queue"`
+	// LogLineKB is the longest FFmpeg log line kept
+	LogLineKB int `json:"log_line_kb"`
+	// StartupTimeoutSeconds is how long FFmpeg has to write its first
+	// output before the watchdog kills it
+	StartupTimeoutSeconds int `json:"startup_timeout_seconds"`
+	// AudioBufferMs is the audio buffering of sessions whose offers do
+	// not set it
+	AudioBufferMs int `json:"audio_buffer_ms"`
+}
+
+var hostPipeline pipelineConfig
+
+func loadPipeline() {
+	data, err := os.ReadFile(pipelineFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading pipeline config: %v", err)
+		}
+		return
+	}
+
+	var cfg pipelineConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Printf("Error parsing %s: %v", pipelineFile, err)
+		return
+	}
+	if err := cfg.validate(); err != nil {
+		log.Printf("Ignoring %s: %v", pipelineFile, err)
+		return
+	}
+	hostPipeline = cfg
+	log.Printf("Pipeline buffers set by %s", pipelineFile)
+}
+
+func (c pipelineConfig) validate() error {
+	switch {
+	case c.ReadBufferKB < 0 || c.ReadBufferKB > maxReadBufferKB:
+		return errors.New("read_buffer_kb must be between 0 and 65536")
+	case c.MaxFrameMB < 0 || c.MaxFrameMB > maxMaxFrameMB:
+		return errors.New("max_frame_mb must be between 0 and 1024")
+	case c.SampleQueue < 0 || c.SampleQueue > maxSampleQueue:
+		return errors.New("sample_queue must be between 0 and 1024")
+	case c.LogLineKB < 0 || c.LogLineKB > maxLogLineKB:
+		return errors.New("log_line_kb must be between 0 and 16384")
+	case c.StartupTimeoutSeconds < 0:
+		return errors.New("startup_timeout_seconds cannot be negative")
+	case c.AudioBufferMs < 0 || c.AudioBufferMs > maxAudioBufferMs:
+		return errors.New("audio_buffer_ms must be between 0 and 1000")
+	}
+	return nil
+}
+
+// pipelineBuffers are the sizes of one capture's buffers, in bytes and
+// frames
+type pipelineBuffers struct {
+	readBuffer  int
+	maxFrame    int
+	sampleQueue int
+}
+
+// buffers returns the sizes for the picture cfg encodes, unless
+// pipeline.json sets them
+func (c CaptureConfig) buffers() pipelineBuffers {
+	width, height := c.outputSize()
+	pixels := max(width*height, 1)
+	// An uncompressed frame, which no encoded one should come near
+	raw := pixels * 3 / 2
+	if c.Format.chroma444 {
+		raw = pixels * 3
+	}
+	if c.Format.tenBit {
+		raw *= 2
+	}
+
+	b := pipelineBuffers{
+		readBuffer:  max(minReadBuffer, raw/8),
+		maxFrame:    max(minMaxFrameSize, raw),
+		sampleQueue: max(minSampleQueue, min(defaultSampleQueue, defaultSampleQueue*1920*1080/pixels)),
+	}
+	if hostPipeline.ReadBufferKB > 0 {
+		b.readBuffer = hostPipeline.ReadBufferKB << 10
+	}
+	if hostPipeline.MaxFrameMB > 0 {
+		b.maxFrame = hostPipeline.MaxFrameMB << 20
+	}
+	if hostPipeline.SampleQueue > 0 {
+		b.sampleQueue = hostPipeline.SampleQueue
+	}
+	return b
+}
+
+// newLogScanner scans FFmpeg's log lines, skipping any longer than the
+// limit; a bufio.Scanner would stop at one, and FFmpeg would then block on
+// the full pipe
+func newLogScanner(r io.Reader) *bufio.Scanner {
+	limit := defaultLogLineSize
+	if hostPipeline.LogLineKB > 0 {
+		limit = hostPipeline.LogLineKB << 10
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, min(limit, 4<<10)), limit)
+	skipping := false // The rest of a long line
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if !atEOF && len(data) >= limit && bytes.IndexByte(data, '\n') < 0 {
+			skipping = true
+			return len(data), nil, nil
+		}
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if skipping && advance > 0 {
+			skipping = false
+			return advance, nil, nil
+		}
+		return advance, token, err
+	})
+	return scanner
+}
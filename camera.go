@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lightsyr/chimera-go/chimeraclient"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+// chimera-go camera streams a server's desktop into a v4l2loopback device
+// on this machine, where OBS, a browser or a video call picks it up as a
+// webcam. It joins with the view role, so it runs alongside the player's
+// session without taking input. FFmpeg decodes the stream and writes the
+// frames to the device, which has to exist first:
+//
+//	modprobe v4l2loopback video_nr=10 card_label=chimera-go exclusive_caps=1
+
+const (
+	cameraConnectTimeout = 15 * time.Second
+	// Packets a frame may wait for its missing ones before it is given up
+	cameraMaxLate = 64
+)
+
+func runCameraCommand(args []string) error {
+	flags := flag.NewFlagSet("camera", flag.ContinueOnError)
+	url := flags.String("url", "http://127.0.0.1:8080", "server to stream from")
+	device := flags.String("device", "/dev/video10", "v4l2loopback device to write to")
+	codec := flags.String("codec", defaultVideoCodec, "video codec: h264, vp8 or vp9")
+	width := flags.Int("width", 1280, "video width")
+	height := flags.Int("height", 720, "video height")
+	fps := flags.Int("fps", 30, "frame rate")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return errors.New("usage: chimera-go camera [-url url] [-device path] [-codec name] [-width n] [-height n] [-fps n]")
+	}
+	if runtime.GOOS != "linux" {
+		return errors.New("virtual cameras are written through v4l2loopback, which only Linux has")
+	}
+	if *codec != "h264" && *codec != "vp8" && *codec != "vp9" {
+		return fmt.Errorf("camera takes h264, vp8 or vp9, not %q", *codec)
+	}
+	if _, err := os.Stat(*device); err != nil {
+		return fmt.Errorf("%v; is v4l2loopback loaded?", err)
+	}
+	if ffmpegVersion() == "" {
+		return errors.New("FFmpeg, which decodes the stream, is not on PATH")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	tracks := make(chan *webrtc.TrackRemote, 1)
+	connectCtx, cancel := context.WithTimeout(ctx, cameraConnectTimeout)
+	defer cancel()
+	session, err := chimeraclient.New(*url).Connect(connectCtx, chimeraclient.Options{
+		Width:  *width,
+		Height: *height,
+		FPS:    *fps,
+		Codec:  *codec,
+		Role:   "view",
+		OnTrack: func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+			select {
+			case tracks <- track:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	go func() {
+		<-ctx.Done()
+		session.Close() // Ends the track, which ends the frames
+	}()
+
+	var track *webrtc.TrackRemote
+	select {
+	case track = <-tracks:
+	case <-connectCtx.Done():
+		return errors.New("no video track")
+	}
+
+	mime := strings.ToLower(track.Codec().MimeType)
+	input := []string{"-f", "h264", "-framerate", strconv.Itoa(*fps)}
+	if mime != strings.ToLower(webrtc.MimeTypeH264) {
+		input = []string{"-f", "ivf"}
+	}
+	args = append([]string{"-hide_banner", "-loglevel", "error",
+		"-fflags", "nobuffer", "-flags", "low_delay", "-probesize", "32", "-analyzeduration", "0"}, input...)
+	args = append(args, "-i", "pipe:0", "-pix_fmt", "yuv420p", "-f", "v4l2", *device)
+	ffmpeg := exec.CommandContext(ctx, "ffmpeg", args...)
+	ffmpeg.Stderr = os.Stderr
+	stdin, err := ffmpeg.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := ffmpeg.Start(); err != nil {
+		return err
+	}
+	defer ffmpeg.Wait()
+	defer stdin.Close()
+
+	fmt.Printf("Streaming session %s into %s, %s %dx%d at %d fps; Ctrl+C stops\n",
+		session.ID, *device, track.Codec().MimeType, *width, *height, *fps)
+	frames, err := writeCameraFrames(track, stdin, session, *width, *height)
+	if ctx.Err() != nil {
+		err = nil // Stopped
+	}
+	fmt.Printf("%d frames written\n", frames)
+	return err
+}
+
+// writeCameraFrames puts the track's packets together into frames and
+// writes them to FFmpeg until the track or FFmpeg ends. Frames after a lost
+// packet are skipped up to the next keyframe, which is asked for, rather
+// than handing the decoder a picture it would smear.
+func writeCameraFrames(track *webrtc.TrackRemote, w io.Writer, session *chimeraclient.Session, width, height int) (int, error) {
+	mime := track.Codec().MimeType
+	builder := samplebuilder.New(cameraMaxLate, trackDepacketizer(mime), track.Codec().ClockRate)
+
+	write := func(frame []byte, _ uint32) error {
+		_, err := w.Write(frame)
+		return err
+	}
+	if !strings.EqualFold(mime, webrtc.MimeTypeH264) {
+		fourcc := "VP80"
+		if strings.EqualFold(mime, webrtc.MimeTypeVP9) {
+			fourcc = "VP90"
+		}
+		ivf, err := newIVFWriter(w, fourcc, width, height, track.Codec().ClockRate)
+		if err != nil {
+			return 0, err
+		}
+		var first uint32
+		started := false
+		write = func(frame []byte, timestamp uint32) error {
+			if !started {
+				first, started = timestamp, true
+			}
+			return ivf.writeFrame(uint64(timestamp-first), frame)
+		}
+	}
+
+	frames := 0
+	waiting := true // For a keyframe to start or resume on
+	requestKeyframe := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cameraConnectTimeout)
+		defer cancel()
+		session.RequestKeyframe(ctx) // Too soon is fine: one is coming
+	}
+	go requestKeyframe()
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return frames, nil // The session ended
+		}
+		builder.Push(packet)
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			if sample.PrevDroppedPackets > 0 && !waiting {
+				waiting = true
+				go requestKeyframe()
+			}
+			if waiting {
+				if !receivedKeyframe(mime, sample.Data) {
+					continue
+				}
+				waiting = false
+			}
+			if err := write(sample.Data, sample.PacketTimestamp); err != nil {
+				return frames, fmt.Errorf("writing to FFmpeg: %v", err)
+			}
+			frames++
+		}
+	}
+}
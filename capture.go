@@ -0,0 +1,596 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A CaptureSource produces the session's encoded video. Sources are chosen
+// by name per offer, defaulting to captureSource; the ones in this file run
+// FFmpeg with a different input, inprocess.go adds sources that encode
+// without a subprocess.
+type CaptureSource interface {
+	Start(ctx context.Context, cfg CaptureConfig) error
+	// ReadAccessUnit returns the next encoded frame, or io.EOF once the
+	// source has ended
+	ReadAccessUnit() (AccessUnit, error)
+	Stop() error
+	// RequestKeyframe makes the next frame a keyframe
+	RequestKeyframe() error
+	// Reconfigure switches the running source to cfg
+	Reconfigure(cfg CaptureConfig) error
+	Capabilities() CaptureCapabilities
+}
+
+// AccessUnit is one encoded frame. H.264 is NAL units with start codes,
+// with SPS and PPS ahead of every keyframe; VP8, VP9 and AV1 are frames as
+// IVF holds them.
+type AccessUnit struct {
+	Data []byte
+	// PTS counts from the source's first frame
+	PTS      time.Duration
+	Keyframe bool
+	// Grabbed and Encoded are when the frame was captured and finished
+	// encoding, for sources that see it happen; FFmpeg's leave them zero
+	Grabbed, Encoded time.Time
+	// Read is when runCapture read it from the source
+	Read time.Time
+}
+
+type CaptureConfig struct {
+	// Codec is a key of videoCodecs
+	Codec              string
+	Width, Height, FPS int
+	// Format is one the codec has a profile for
+	Format pixelFormat
+	// Colors are converted to and signaled by sources that can
+	Colors colorSettings
+	// LatencyOverlay burns the capture time into the picture
+	LatencyOverlay bool
+	// StatsOverlay is a text file drawn over the picture, empty for none
+	StatsOverlay string
+	// Watermark is drawn over the picture by sources that can
+	Watermark watermarkOverlay
+	// Paused sources capture and encode nothing until reconfigured
+	// without it, and start again on a keyframe
+	Paused bool
+	// IntraRefresh is set by the session's encoder preset
+	IntraRefresh bool
+	// Slices per H.264 frame and encoder threads; 0 leaves the encoder's
+	// default
+	Slices, Threads int
+	// GOP is the time between keyframes, two seconds when 0
+	GOP time.Duration
+	// OutputWidth and OutputHeight scale the picture for encoding; 0 keeps
+	// the captured size
+	OutputWidth, OutputHeight int
+	// MaxKbps caps the encoder's bitrate, defaultMaxKbps when 0
+	MaxKbps int
+	// Monitor is the area of the desktop to capture, scaled to Width by
+	// Height when its size differs; nil captures Width by Height at the
+	// desktop's top-left. Files and test patterns ignore it.
+	Monitor *Monitor
+}
+
+const defaultMaxKbps = 8000
+
+// gop returns the GOP in frames
+func (c CaptureConfig) gop() int {
+	gop := 2 * time.Second
+	if c.GOP > 0 {
+		gop = c.GOP
+	}
+	return max(1, int(gop.Seconds()*float64(c.FPS)))
+}
+
+// outputSize returns the size frames are encoded at
+func (c CaptureConfig) outputSize() (width, height int) {
+	if c.OutputWidth > 0 && c.OutputHeight > 0 {
+		return c.OutputWidth, c.OutputHeight
+	}
+	return c.Width, c.Height
+}
+
+// area returns the part of the desktop the picture shows
+func (c CaptureConfig) area() (x, y, width, height int) {
+	if m := c.Monitor; m != nil {
+		return m.X, m.Y, m.Width, m.Height
+	}
+	return 0, 0, c.Width, c.Height
+}
+
+// areaFilters scale the captured area to the picture size
+func (c CaptureConfig) areaFilters() []string {
+	if _, _, w, h := c.area(); w != c.Width || h != c.Height {
+		return []string{scaleFilter(c.Width, c.Height)}
+	}
+	return nil
+}
+
+func (c CaptureConfig) maxKbps() int {
+	if c.MaxKbps > 0 {
+		return c.MaxKbps
+	}
+	return defaultMaxKbps
+}
+
+type CaptureCapabilities struct {
+	Codecs []string `json:"codecs"`
+	// Live sources show the host's screen; files and test patterns do not
+	Live bool `json:"live"`
+	// Cursor is drawn into the picture
+	Cursor bool `json:"cursor"`
+	// Desktop sources can capture every monitor as one picture
+	Desktop bool `json:"desktop"`
+	// PixelFormats sources encode 4:4:4 and 10-bit where the codec can
+	PixelFormats bool `json:"pixel_formats"`
+	// Colors sources convert to the session's colorspace and range;
+	// others are BT.601 limited
+	Colors bool `json:"colors"`
+	// StatsOverlay sources can draw the session's stats over the picture
+	StatsOverlay bool `json:"stats_overlay"`
+	// Watermark sources can draw the host's watermark, which sessions on
+	// other sources are refused while one is set
+	Watermark bool `json:"watermark"`
+}
+
+var (
+	// captureSource is used when the offer names none
+	captureSource = defaultCaptureSource()
+	// captureFile is what the "file" source plays, looped
+	captureFile = "capture.mp4"
+	// x11Display is captured by x11grab, $DISPLAY when set
+	x11Display = ":0"
+)
+
+func defaultCaptureSource() string {
+	if runtime.GOOS == "windows" {
+		return "gdigrab"
+	}
+	return "x11grab"
+}
+
+// captureSourceType describes one source; goos limits it to a platform.
+// Sources with open run in process, the others are FFmpeg inputs.
+type captureSourceType struct {
+	goos  string
+	caps  CaptureCapabilities
+	input func(cfg CaptureConfig) (args, filters []string)
+	open  func(session *StreamSession, stats *PipelineStats) CaptureSource
+}
+
+var captureSourceTypes = map[string]captureSourceType{
+	"gdigrab": {
+		goos: "windows",
+		caps: CaptureCapabilities{Codecs: videoCodecNames(), Live: true, Cursor: true, Desktop: true, PixelFormats: true, Colors: true, StatsOverlay: true, Watermark: true},
+		input: func(cfg CaptureConfig) ([]string, []string) {
+			// Offsets are from the primary monitor's corner, so negative
+			// for monitors left of or above it
+			x, y, w, h := cfg.area()
+			return []string{
+				"-f", "gdigrab",
+				"-framerate", fmt.Sprint(cfg.FPS),
+				"-offset_x", fmt.Sprint(x),
+				"-offset_y", fmt.Sprint(y),
+				"-video_size", fmt.Sprintf("%dx%d", w, h),
+				"-i", "desktop",
+			}, cfg.areaFilters()
+		},
+	},
+	// Desktop Duplication: GPU frames, cheaper than gdigrab at high rates
+	"ddagrab": {
+		goos: "windows",
+		caps: CaptureCapabilities{Codecs: videoCodecNames(), Live: true, Cursor: true, PixelFormats: true, Colors: true, StatsOverlay: true, Watermark: true},
+		input: func(cfg CaptureConfig) ([]string, []string) {
+			// One output per capture: it cannot span monitors
+			output := 0
+			if cfg.Monitor != nil {
+				output = cfg.Monitor.Index
+			}
+			_, _, w, h := cfg.area()
+			return []string{
+				"-f", "lavfi",
+				"-i", fmt.Sprintf("ddagrab=output_idx=%d:framerate=%d:video_size=%dx%d", output, cfg.FPS, w, h),
+			}, append([]string{"hwdownload", "format=bgra"}, cfg.areaFilters()...)
+		},
+	},
+	"x11grab": {
+		goos: "linux",
+		caps: CaptureCapabilities{Codecs: videoCodecNames(), Live: true, Cursor: true, Desktop: true, PixelFormats: true, Colors: true, StatsOverlay: true, Watermark: true},
+		input: func(cfg CaptureConfig) ([]string, []string) {
+			display := x11Display
+			if env := os.Getenv("DISPLAY"); env != "" {
+				display = env
+			}
+			x, y, w, h := cfg.area()
+			if x != 0 || y != 0 {
+				display += fmt.Sprintf("+%d,%d", x, y)
+			}
+			return []string{
+				"-f", "x11grab",
+				"-framerate", fmt.Sprint(cfg.FPS),
+				"-video_size", fmt.Sprintf("%dx%d", w, h),
+				"-i", display,
+			}, cfg.areaFilters()
+		},
+	},
+	"file": {
+		caps: CaptureCapabilities{Codecs: videoCodecNames(), PixelFormats: true, Colors: true, StatsOverlay: true, Watermark: true},
+		input: func(cfg CaptureConfig) ([]string, []string) {
+			return []string{"-re", "-stream_loop", "-1", "-i", captureFile},
+				[]string{scaleFilter(cfg.Width, cfg.Height), fmt.Sprintf("fps=%d", cfg.FPS)}
+		},
+	},
+	"testsrc": {
+		caps: CaptureCapabilities{Codecs: videoCodecNames(), PixelFormats: true, Colors: true, StatsOverlay: true, Watermark: true},
+		input: func(cfg CaptureConfig) ([]string, []string) {
+			return []string{
+				"-re", "-f", "lavfi",
+				"-i", fmt.Sprintf("testsrc2=size=%dx%d:rate=%d", cfg.Width, cfg.Height, cfg.FPS),
+			}, nil
+		},
+	},
+}
+
+func captureSourceAvailable(name string) bool {
+	t, ok := captureSourceTypes[name]
+	return ok && (t.goos == "" || t.goos == runtime.GOOS)
+}
+
+// captureSourceEncodes reports whether the named source can produce codec
+func captureSourceEncodes(name, codec string) bool {
+	for _, c := range captureSourceTypes[name].caps.Codecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// errWaylandCapture refuses x11grab in a Wayland session, where it would
+// capture a black picture: there is no PipeWire source to capture it with
+var errWaylandCapture = errors.New("x11grab cannot capture a Wayland session; log in to an X11 session or choose a source that does not capture the screen")
+
+// newCaptureSource returns the named source for session, counting what it
+// encodes in stats
+func newCaptureSource(name string, session *StreamSession, stats *PipelineStats) (CaptureSource, error) {
+	if !captureSourceAvailable(name) {
+		return nil, fmt.Errorf("capture source %q is not available", name)
+	}
+	if name == "x11grab" && os.Getenv("XDG_SESSION_TYPE") == "wayland" {
+		return nil, errWaylandCapture
+	}
+	t := captureSourceTypes[name]
+	if t.open != nil {
+		return t.open(session, stats), nil
+	}
+	return &ffmpegSource{name: name, caps: t.caps, input: t.input, session: session, stats: stats}, nil
+}
+
+// ffmpegSource runs FFmpeg with one capture input and the session's encoder
+type ffmpegSource struct {
+	name    string
+	caps    CaptureCapabilities
+	input   func(cfg CaptureConfig) (args, filters []string)
+	session *StreamSession
+	stats   *PipelineStats
+
+	mu   sync.Mutex
+	ctx  context.Context
+	args []string
+	// newReader reads the container args select
+	newReader func(r io.Reader) accessUnitReader
+	interval  time.Duration // Between frames
+	cmd       *exec.Cmd
+	reader    accessUnitReader
+	stopped   bool
+	// resumed is closed when a pause ends; nil while running
+	resumed chan struct{}
+	// stalled is set when the startup watchdog killed FFmpeg
+	stalled *ffmpegStalledError
+
+	// Used by ReadAccessUnit only: PTS continues across restarts
+	current accessUnitReader
+	ptsBase time.Duration
+	lastPTS time.Duration
+}
+
+func (f *ffmpegSource) Capabilities() CaptureCapabilities {
+	return f.caps
+}
+
+func (f *ffmpegSource) Start(ctx context.Context, cfg CaptureConfig) error {
+	args, newReader, err := f.buildArgs(cfg)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ctx = ctx
+	f.args = args
+	f.newReader = newReader
+	f.interval = time.Second / time.Duration(cfg.FPS)
+	return f.launchLocked()
+}
+
+// buildArgs returns FFmpeg's arguments for cfg and a reader for its output
+func (f *ffmpegSource) buildArgs(cfg CaptureConfig) ([]string, func(io.Reader) accessUnitReader, error) {
+	inputArgs, filters := f.input(cfg)
+
+	if w, h := cfg.outputSize(); w != cfg.Width || h != cfg.Height {
+		// Ahead of the overlay, which keeps its block size
+		filters = append(filters, scaleFilter(w, h))
+	}
+	if cfg.StatsOverlay != "" {
+		_, h := cfg.outputSize()
+		filters = append(filters, statsOverlayFilter(cfg.StatsOverlay, h))
+	}
+	if cfg.Watermark != (watermarkOverlay{}) {
+		_, h := cfg.outputSize()
+		filters = append(filters, cfg.Watermark.filters(h)...)
+	}
+	var args []string
+	if cfg.LatencyOverlay {
+		args = append(args, "-use_wallclock_as_timestamps", "1")
+		filters = append(filters, latencyOverlayFilters()...)
+	}
+	if cfg.Colors != (colorSettings{}) {
+		filters = append(filters, cfg.Colors.filter())
+	}
+	args = append(args, inputArgs...)
+	if len(filters) > 0 {
+		args = append(args, "-vf", strings.Join(filters, ","))
+		if cfg.LatencyOverlay {
+			args = append(args, "-copyts") // Keep wallclock timestamps visible to the filters
+		}
+	}
+	codec, ok := videoCodecs[cfg.Codec]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported codec %q", cfg.Codec)
+	}
+	args = append(args, codec.encoderArgs(cfg)...)
+	if cfg.Colors != (colorSettings{}) {
+		args = append(args, cfg.Colors.encoderArgs()...)
+	}
+	args = append(args,
+		"-an", // No audio
+		"-nostats",
+		"-progress", "pipe:2", // Machine-readable progress for PipelineStats
+		"pipe:1",
+	)
+	buffers := cfg.buffers()
+	return args, func(r io.Reader) accessUnitReader { return codec.newReader(r, buffers) }, nil
+}
+
+// launchLocked starts an FFmpeg process and makes it the one read from
+func (f *ffmpegSource) launchLocked() error {
+	sessionID := f.session.ID
+	cmd := exec.CommandContext(f.ctx, "ffmpeg", f.args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("[Session %s] FFmpeg %s capture started (PID: %d)", sessionID, f.name, cmd.Process.Pid)
+	f.session.trackProcess(cmd.Process, f.name)
+
+	// FFmpeg logging goroutine
+	base := f.stats.progressBase()
+	var lastLine atomic.Pointer[string]
+	f.session.goSafe("FFmpeg log reader", func() {
+		scanner := newLogScanner(stderr)
+		for scanner.Scan() {
+			select {
+			case <-f.ctx.Done():
+				return
+			default:
+				line := scanner.Text()
+				if f.stats.parseProgressLine(line, base) {
+					continue
+				}
+				if len(line) > 0 {
+					lastLine.Store(&line)
+					f.session.logFFmpeg(f.name, line)
+				}
+			}
+		}
+	})
+
+	output := newOutputReader(stdout)
+	timeout := ffmpegStartupTimeout()
+	f.session.goSafe("FFmpeg startup watchdog", func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-output.output:
+			return
+		case <-f.ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.cmd != cmd || f.stopped || f.resumed != nil {
+			return // Replaced, stopped or paused meanwhile
+		}
+		f.stalled = &ffmpegStalledError{capture: f.name, timeout: timeout}
+		if line := lastLine.Load(); line != nil {
+			f.stalled.lastLine = *line
+		}
+		log.Printf("[Session %s] FFmpeg %s capture wrote nothing in %v, killing it", sessionID, f.name, timeout)
+		cmd.Process.Kill()
+	})
+
+	f.cmd = cmd
+	f.reader = f.newReader(output)
+	return nil
+}
+
+var errCaptureNotStarted = errors.New("capture source not started")
+
+func (f *ffmpegSource) ReadAccessUnit() (AccessUnit, error) {
+	for {
+		f.mu.Lock()
+		reader, interval := f.reader, f.interval
+		f.mu.Unlock()
+		if reader == nil {
+			return AccessUnit{}, errCaptureNotStarted
+		}
+		if reader != f.current {
+			if f.current != nil {
+				f.ptsBase = f.lastPTS + interval
+			}
+			f.current = reader
+		}
+
+		au, err := reader.next()
+		if err != nil {
+			f.mu.Lock()
+			replaced := f.reader != reader && !f.stopped
+			resumed := f.resumed
+			stalled := f.stalled
+			f.mu.Unlock()
+			if replaced {
+				continue // Killed by a restart
+			}
+			if resumed != nil {
+				<-resumed // Killed by a pause
+				continue
+			}
+			if stalled != nil {
+				return AccessUnit{}, stalled // Killed by the watchdog
+			}
+			return AccessUnit{}, err
+		}
+		au.PTS += f.ptsBase
+		f.lastPTS = au.PTS
+		return au, nil
+	}
+}
+
+// RequestKeyframe restarts FFmpeg, whose first frame is a keyframe: the
+// CLI's encoders cannot be asked for one while running. It is the fallback
+// for sources without an in-process encoder, which force an IDR instead,
+// and the picture pauses for as long as FFmpeg takes to start.
+func (f *ffmpegSource) RequestKeyframe() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.restartLocked()
+}
+
+// Reconfigure restarts FFmpeg with arguments for cfg
+func (f *ffmpegSource) Reconfigure(cfg CaptureConfig) error {
+	args, newReader, err := f.buildArgs(cfg)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.args = args
+	f.newReader = newReader
+	f.interval = time.Second / time.Duration(cfg.FPS)
+	if f.cmd == nil || f.stopped {
+		return errCaptureNotStarted
+	}
+	switch {
+	case cfg.Paused && f.resumed == nil:
+		// FFmpeg exits, and with it any hardware encoder session
+		f.cmd.Process.Kill()
+		go f.cmd.Wait()
+		f.resumed = make(chan struct{})
+		return nil
+	case cfg.Paused:
+		return nil // The arguments apply on resuming
+	case f.resumed != nil:
+		if err := f.launchLocked(); err != nil {
+			return err
+		}
+		close(f.resumed)
+		f.resumed = nil
+		return nil
+	}
+	return f.restartLocked()
+}
+
+// restartLocked replaces the running FFmpeg with a new one
+func (f *ffmpegSource) restartLocked() error {
+	if f.cmd == nil || f.stopped {
+		return errCaptureNotStarted
+	}
+	if f.resumed != nil {
+		return nil // Paused; FFmpeg starts on a keyframe when resumed
+	}
+	old := f.cmd
+	if err := f.launchLocked(); err != nil {
+		return err
+	}
+	old.Process.Kill()
+	go old.Wait()
+	return nil
+}
+
+// Stop kills FFmpeg; safe to call more than once
+func (f *ffmpegSource) Stop() error {
+	f.mu.Lock()
+	cmd := f.cmd
+	stopped := f.stopped
+	f.stopped = true
+	if f.resumed != nil {
+		// FFmpeg exited with the pause; ends a ReadAccessUnit waiting it out
+		close(f.resumed)
+		f.resumed = nil
+		cmd = nil
+	}
+	f.mu.Unlock()
+	if cmd == nil || stopped {
+		return nil
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	return nil
+}
+
+// handleListCaptureSources lists the sources this host can use
+func handleListCaptureSources(w http.ResponseWriter, r *http.Request) {
+	var names []string
+	for name := range captureSourceTypes {
+		if captureSourceAvailable(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	list := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		list = append(list, map[string]interface{}{
+			"name":         name,
+			"default":      name == captureSource,
+			"capabilities": captureSourceTypes[name].caps,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"sources": list})
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+)
+
+func TestNewCaptureSourceWayland(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("x11grab is only available on Linux")
+	}
+
+	t.Setenv("XDG_SESSION_TYPE", "wayland")
+	if _, err := newCaptureSource("x11grab", nil, nil); !errors.Is(err, errWaylandCapture) {
+		t.Errorf("x11grab in a Wayland session: error = %v, want errWaylandCapture", err)
+	}
+	if _, err := newCaptureSource("testsrc", nil, nil); err != nil {
+		t.Errorf("testsrc in a Wayland session: %v", err)
+	}
+
+	t.Setenv("XDG_SESSION_TYPE", "x11")
+	if _, err := newCaptureSource("x11grab", nil, nil); err != nil {
+		t.Errorf("x11grab in an X11 session: %v", err)
+	}
+}
@@ -0,0 +1,851 @@
+// Package chimeraclient connects Go programs to a chimera-go host: it
+// performs the signaling handshake, waits in the host's queue when it is
+// full, controls the session through the HTTP API and sends input, encoded
+// by package input, on the "input" DataChannel.
+//
+//	client := chimeraclient.New("http://host:8080")
+//	session, err := client.Connect(ctx, chimeraclient.Options{
+//		Width: 1280, Height: 720, FPS: 60,
+//		OnTrack: func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) { ... },
+//	})
+//	...
+//	err = session.Send(ctx, chimeraclient.Button(0, true))
+package chimeraclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const apiPrefix = "/api/v1"
+
+// Client talks to one host
+type Client struct {
+	// BaseURL is the host's address, e.g. "http://192.168.1.10:8080"
+	BaseURL string
+	// DeviceToken is sent on offers when the host requires paired devices
+	DeviceToken string
+	// UserToken is sent when the host requires users to sign in; Login
+	// sets it
+	UserToken  string
+	HTTPClient *http.Client
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// Login signs in with a password of the host's user store and keeps the
+// token for the client's requests
+func (c *Client) Login(ctx context.Context, username, password string) error {
+	body, err := json.Marshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+apiPrefix+"/auth/login", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return readAPIError(resp)
+	}
+	var login struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&login); err != nil {
+		return err
+	}
+	c.UserToken = login.Token
+	return nil
+}
+
+// APIError is an error response of the host's API
+type APIError struct {
+	Status  int             `json:"-"`
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Details json.RawMessage `json:"details,omitempty"`
+	// RequestID finds the request in the host's logs
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("chimera-go: %s (%s, request %s)", e.Message, e.Code, e.RequestID)
+	}
+	return fmt.Sprintf("chimera-go: %s (%s)", e.Message, e.Code)
+}
+
+// Options are the parameters of a new session. Zero values leave the
+// choice to the host, which captures at its display's refresh rate when
+// FPS is 0.
+type Options struct {
+	Width, Height, FPS int
+
+	// Codec is "h264" (default), "vp8", "vp9" or "av1"
+	Codec          string
+	Clipboard      bool
+	LatencyOverlay bool
+	// GamepadSlot requests a virtual controller slot (0-3)
+	GamepadSlot *int
+	// MappingProfile, "default" when empty
+	MappingProfile string
+	// ControllerType is "xbox360" or "ds4"
+	ControllerType string
+	// Role is "control" or "view"
+	Role string
+	// ShortcutPolicy is "block", "inject" or "translate"
+	ShortcutPolicy string
+	// App names a catalog app to launch with the session
+	App             string
+	AppOnDisconnect string
+	// Capture names the host's capture source (see GET /capture/sources),
+	// its default when empty
+	Capture string
+	// Preset is the encoder preset, "balanced" or "competitive"
+	Preset string
+	// Slices per H.264 frame and encoder threads, 0 for the host's default
+	Slices, Threads int
+	// DropPolicy is "none" or "latency", which skips to a fresh keyframe
+	// when the host falls behind
+	DropPolicy string
+	// MaxKbps caps the session's bitrate, 0 for the most the host allows.
+	// Offers over the host's limits fail with the code "over_limit".
+	MaxKbps int
+	// ViewportWidth and ViewportHeight are the pixels the video is shown
+	// in; the host downscales a larger picture to fit them before encoding
+	ViewportWidth, ViewportHeight int
+	// AllMonitors captures every monitor of the host as one picture, the
+	// whole desktop scaled to Width by Height
+	AllMonitors bool
+	// E2EE asks the host to encrypt the video end to end; it needs Codec
+	// "vp8", and frames are read with a FrameDecryptor
+	E2EE bool
+	// Chroma "444" and BitDepth 10 ask for sharper or deeper video than
+	// 8-bit 4:2:0, with the codec profile for it: "h264", "vp9" or "av1"
+	Chroma   string
+	BitDepth int
+	// ColorSpace ("bt709" or "bt601") and ColorRange ("limited" or
+	// "full") override the host's default colors
+	ColorSpace, ColorRange string
+	// AudioOnly streams the host's audio instead of its screen; the video
+	// options are ignored and OnTrack receives an Opus track
+	AudioOnly bool
+	// AudioBufferMs is how much audio the host buffers against jitter;
+	// 0 leaves it to the host. Session.AudioBufferMs is the result.
+	AudioBufferMs int
+	// LockOnEnd locks the host's desktop session once this session, or
+	// the last one still streaming, ends
+	LockOnEnd bool
+	// Netsim has the host simulate a worse link for the session
+	Netsim *Netsim
+	// Host names the host of a cluster to stream from; empty leaves it to
+	// the cluster, by App and free room
+	Host string
+	// Publish has the host push the session to its SFU, where viewers
+	// watch instead of spectating the host
+	Publish bool
+	// Macros lets the session run the host's input macros with RunMacro
+	Macros bool
+
+	// WebRTC is the peer connection configuration, Google's STUN servers
+	// when empty
+	WebRTC webrtc.Configuration
+
+	// OnTrack receives the video track, or the audio track of audio-only
+	// sessions
+	OnTrack func(*webrtc.TrackRemote, *webrtc.RTPReceiver)
+	// OnEvent receives the messages the host sends on the input channel
+	OnEvent func(Event)
+	// OnQueuePosition is called while the offer waits for a free session
+	OnQueuePosition func(position, length int)
+}
+
+// Event is a message from the host on the input channel: "control" when
+// input is granted or revoked, "video" when the host mutes or unmutes the
+// video, "app" when the session's app changes state, "macro" as a macro
+// runs, "encoding" when the host steps the video along its bitrate ladder,
+// "time_limit" before the session's time runs out and "error" when the
+// host ends the session on a fault
+type Event struct {
+	Type     string `json:"type"`
+	Control  bool   `json:"control"`
+	Muted    bool   `json:"muted"`
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	ExitCode *int   `json:"exit_code"`
+	Error    string `json:"error"`
+
+	// Set on "encoding" events
+	Width        int `json:"width"`
+	Height       int `json:"height"`
+	FPS          int `json:"fps"`
+	Kbps         int `json:"kbps"`
+	EstimateKbps int `json:"estimate_kbps"`
+
+	// Set on "time_limit" events, which warn that the host ends the
+	// session at EndsAt; Reason is "max_duration" or "schedule"
+	EndsAt           time.Time `json:"ends_at"`
+	RemainingSeconds int       `json:"remaining_seconds"`
+	Reason           string    `json:"reason"`
+}
+
+// Netsim is the link the host simulates for a session, to test how the
+// stream copes: a share of its packets lost, each delayed by up to
+// JitterMs, and a bandwidth cap. The zero value is the real link.
+type Netsim struct {
+	LossPercent float64 `json:"loss_percent"`
+	JitterMs    int     `json:"jitter_ms"`
+	Kbps        int     `json:"kbps"`
+}
+
+// Session is a connected stream
+type Session struct {
+	ID          string
+	GamepadSlot int // -1 when the host had no free controller slot
+	Role        string
+	// E2EEKeyID is the key the host encrypts the video with, nil when it
+	// is not encrypted
+	E2EEKeyID *uint64
+	// AudioBufferMs is the jitter buffer target the host suggests for the
+	// audio track, 0 for none; a player of OnTrack's audio can hold that
+	// much back
+	AudioBufferMs int
+	PC            *webrtc.PeerConnection
+
+	client      *Client
+	ownerToken  string
+	input       *webrtc.DataChannel
+	inputOpen   chan struct{}
+	inputClosed chan struct{}
+	openOnce    sync.Once
+	closeOnce   sync.Once
+	control     atomic.Bool
+	negotiation sync.Mutex // Held while AddMonitor or Reconnect renegotiates
+}
+
+// ErrInputClosed is returned by Send once the input channel has closed,
+// for example because the host could not create its input devices
+var ErrInputClosed = errors.New("chimera-go: input channel closed")
+
+type offerRequest struct {
+	SDP             string  `json:"sdp"`
+	Codec           string  `json:"codec,omitempty"`
+	Width           int     `json:"width"`
+	Height          int     `json:"height"`
+	FPS             int     `json:"fps"`
+	Clipboard       bool    `json:"clipboard,omitempty"`
+	LatencyOverlay  bool    `json:"latency_overlay,omitempty"`
+	GamepadSlot     *int    `json:"gamepad_slot,omitempty"`
+	MappingProfile  string  `json:"mapping_profile,omitempty"`
+	ControllerType  string  `json:"controller_type,omitempty"`
+	Role            string  `json:"role,omitempty"`
+	ShortcutPolicy  string  `json:"shortcut_policy,omitempty"`
+	App             string  `json:"app,omitempty"`
+	AppOnDisconnect string  `json:"app_on_disconnect,omitempty"`
+	Capture         string  `json:"capture,omitempty"`
+	Preset          string  `json:"preset,omitempty"`
+	Slices          int     `json:"slices,omitempty"`
+	Threads         int     `json:"threads,omitempty"`
+	DropPolicy      string  `json:"drop_policy,omitempty"`
+	MaxKbps         int     `json:"max_kbps,omitempty"`
+	ViewportWidth   int     `json:"viewport_width,omitempty"`
+	ViewportHeight  int     `json:"viewport_height,omitempty"`
+	AllMonitors     bool    `json:"all_monitors,omitempty"`
+	E2EE            bool    `json:"e2ee,omitempty"`
+	AudioOnly       bool    `json:"audio_only,omitempty"`
+	AudioBufferMs   int     `json:"audio_buffer_ms,omitempty"`
+	Chroma          string  `json:"chroma,omitempty"`
+	BitDepth        int     `json:"bit_depth,omitempty"`
+	ColorSpace      string  `json:"color_space,omitempty"`
+	ColorRange      string  `json:"color_range,omitempty"`
+	LockOnEnd       bool    `json:"lock_on_end,omitempty"`
+	Netsim          *Netsim `json:"netsim,omitempty"`
+	Host            string  `json:"host,omitempty"`
+	Publish         bool    `json:"publish,omitempty"`
+	Macros          bool    `json:"macros,omitempty"`
+}
+
+type offerResponse struct {
+	webrtc.SessionDescription
+	SessionID     string  `json:"session_id"`
+	GamepadSlot   int     `json:"gamepad_slot"`
+	Role          string  `json:"role"`
+	OwnerToken    string  `json:"owner_token"`
+	E2EEKeyID     *uint64 `json:"e2ee_kid"`
+	AudioBufferMs int     `json:"audio_buffer_ms"`
+}
+
+type queuedResponse struct {
+	QueueID  string `json:"queue_id"`
+	Position int    `json:"position"`
+}
+
+// Connect offers a new session and returns once the host has answered. The
+// media and DataChannels connect in the background; Send waits for the
+// input channel.
+func (c *Client) Connect(ctx context.Context, opts Options) (*Session, error) {
+	config := opts.WebRTC
+	if len(config.ICEServers) == 0 {
+		config.ICEServers = []webrtc.ICEServer{
+			{URLs: []string{"stun:stun.l.google.com:19302"}},
+		}
+	}
+	pc, err := newPeerConnection(config, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &Session{
+		PC:          pc,
+		client:      c,
+		inputOpen:   make(chan struct{}),
+		inputClosed: make(chan struct{}),
+	}
+	if err := session.setup(opts); err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	// The host takes no trickled candidates, so the offer carries them all
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		pc.Close()
+		return nil, ctx.Err()
+	}
+
+	answer, err := c.offer(ctx, offerRequest{
+		SDP:             pc.LocalDescription().SDP,
+		Codec:           opts.Codec,
+		Width:           opts.Width,
+		Height:          opts.Height,
+		FPS:             opts.FPS,
+		Clipboard:       opts.Clipboard,
+		LatencyOverlay:  opts.LatencyOverlay,
+		GamepadSlot:     opts.GamepadSlot,
+		MappingProfile:  opts.MappingProfile,
+		ControllerType:  opts.ControllerType,
+		Role:            opts.Role,
+		ShortcutPolicy:  opts.ShortcutPolicy,
+		App:             opts.App,
+		AppOnDisconnect: opts.AppOnDisconnect,
+		Capture:         opts.Capture,
+		Preset:          opts.Preset,
+		Slices:          opts.Slices,
+		Threads:         opts.Threads,
+		DropPolicy:      opts.DropPolicy,
+		MaxKbps:         opts.MaxKbps,
+		ViewportWidth:   opts.ViewportWidth,
+		ViewportHeight:  opts.ViewportHeight,
+		AllMonitors:     opts.AllMonitors,
+		E2EE:            opts.E2EE,
+		AudioOnly:       opts.AudioOnly,
+		AudioBufferMs:   opts.AudioBufferMs,
+		Chroma:          opts.Chroma,
+		BitDepth:        opts.BitDepth,
+		ColorSpace:      opts.ColorSpace,
+		ColorRange:      opts.ColorRange,
+		LockOnEnd:       opts.LockOnEnd,
+		Netsim:          opts.Netsim,
+		Host:            opts.Host,
+		Publish:         opts.Publish,
+		Macros:          opts.Macros,
+	}, opts.OnQueuePosition)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	if err := pc.SetRemoteDescription(answer.SessionDescription); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	session.ID = answer.SessionID
+	session.GamepadSlot = answer.GamepadSlot
+	session.Role = answer.Role
+	session.E2EEKeyID = answer.E2EEKeyID
+	session.AudioBufferMs = answer.AudioBufferMs
+	session.ownerToken = answer.OwnerToken
+	return session, nil
+}
+
+// setup adds what the host expects in the offer: a receive-only video
+// transceiver, audio for audio-only sessions, and the input and heartbeat
+// channels
+func (s *Session) setup(opts Options) error {
+	kind := webrtc.RTPCodecTypeVideo
+	if opts.AudioOnly {
+		kind = webrtc.RTPCodecTypeAudio
+	}
+	if _, err := s.PC.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	}); err != nil {
+		return err
+	}
+	if opts.OnTrack != nil {
+		s.PC.OnTrack(opts.OnTrack)
+	}
+
+	ordered := true
+	input, err := s.PC.CreateDataChannel("input", &webrtc.DataChannelInit{Ordered: &ordered})
+	if err != nil {
+		return err
+	}
+	s.input = input
+	input.OnOpen(func() { s.openOnce.Do(func() { close(s.inputOpen) }) })
+	input.OnClose(func() { s.closeOnce.Do(func() { close(s.inputClosed) }) })
+	input.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var ev Event
+		if !msg.IsString || json.Unmarshal(msg.Data, &ev) != nil {
+			return
+		}
+		if ev.Type == "control" {
+			s.control.Store(ev.Control)
+		}
+		if opts.OnEvent != nil {
+			opts.OnEvent(ev)
+		}
+	})
+
+	// Beats let the host pause the stream soon after this process dies
+	unordered, retransmits := false, uint16(0)
+	heartbeat, err := s.PC.CreateDataChannel("heartbeat", &webrtc.DataChannelInit{Ordered: &unordered, MaxRetransmits: &retransmits})
+	if err != nil {
+		return err
+	}
+	heartbeat.OnOpen(func() { go beat(heartbeat) })
+	return nil
+}
+
+// heartbeatInterval is how often the host hears from a session
+const heartbeatInterval = 500 * time.Millisecond
+
+// beat sends heartbeats until the channel closes
+func beat(dc *webrtc.DataChannel) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := dc.SendText("beat"); err != nil {
+			return
+		}
+	}
+}
+
+// offer posts the offer and, if the host queues it, waits to be admitted
+func (c *Client) offer(ctx context.Context, req offerRequest, onPosition func(int, int)) (*offerResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+apiPrefix+"/offer", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if c.DeviceToken != "" {
+		httpReq.Header.Set("X-Device-Token", c.DeviceToken)
+	}
+	if c.UserToken != "" {
+		httpReq.Header.Set("X-User-Token", c.UserToken)
+	}
+
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var answer offerResponse
+		if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+			return nil, err
+		}
+		return &answer, nil
+	case http.StatusAccepted:
+		var queued queuedResponse
+		if err := json.NewDecoder(resp.Body).Decode(&queued); err != nil {
+			return nil, err
+		}
+		if onPosition != nil {
+			onPosition(queued.Position, 0)
+		}
+		return c.waitInQueue(ctx, queued.QueueID, onPosition)
+	}
+	return nil, readAPIError(resp)
+}
+
+// waitInQueue follows the queue's Server-Sent Events until the offer is
+// admitted. Cancelling ctx leaves the queue.
+func (c *Client) waitInQueue(ctx context.Context, queueID string, onPosition func(int, int)) (*offerResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+apiPrefix+"/queue/"+url.PathEscape(queueID), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, readAPIError(resp)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	var event, data string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			event = name
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, "data: "); ok {
+			data = value
+			continue
+		}
+		if line != "" {
+			continue
+		}
+
+		switch event {
+		case "position":
+			var pos struct {
+				Position    int `json:"position"`
+				QueueLength int `json:"queue_length"`
+			}
+			if json.Unmarshal([]byte(data), &pos) == nil && onPosition != nil {
+				onPosition(pos.Position, pos.QueueLength)
+			}
+		case "admitted":
+			var answer offerResponse
+			if err := json.Unmarshal([]byte(data), &answer); err != nil {
+				return nil, err
+			}
+			return &answer, nil
+		case "error":
+			var msg struct {
+				Error string `json:"error"`
+			}
+			json.Unmarshal([]byte(data), &msg)
+			return nil, fmt.Errorf("chimera-go: %s", msg.Error)
+		}
+		event, data = "", ""
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("chimera-go: queue closed before the offer was admitted")
+}
+
+// Control reports whether the host currently accepts this session's input
+func (s *Session) Control() bool {
+	return s.control.Load()
+}
+
+// SetControl grants or revokes the session's input control; only the
+// client that created the session may
+func (s *Session) SetControl(ctx context.Context, control bool) error {
+	return s.call(ctx, http.MethodPut, "/control", map[string]bool{"control": control}, nil)
+}
+
+// SetMappingProfile switches the session to another input mapping profile
+func (s *Session) SetMappingProfile(ctx context.Context, profile string) error {
+	return s.call(ctx, http.MethodPut, "/mapping", map[string]string{"profile": profile}, nil)
+}
+
+// SetStatsOverlay draws the session's frame rate, bitrate and encoding
+// into its video, or stops; only the client that created the session may
+func (s *Session) SetStatsOverlay(ctx context.Context, on bool) error {
+	return s.call(ctx, http.MethodPut, "/overlay", map[string]bool{"stats": on}, nil)
+}
+
+// SetNetsim changes the link the host simulates for the session; the zero
+// Netsim ends the simulation
+func (s *Session) SetNetsim(ctx context.Context, netsim Netsim) error {
+	return s.call(ctx, http.MethodPut, "/netsim", netsim, nil)
+}
+
+// Publish pushes the session to the host's SFU, if it has one configured,
+// for viewers to watch there
+func (s *Session) Publish(ctx context.Context) error {
+	return s.call(ctx, http.MethodPost, "/publish", nil, nil)
+}
+
+// Unpublish ends the session's stream on the SFU
+func (s *Session) Unpublish(ctx context.Context) error {
+	return s.call(ctx, http.MethodDelete, "/publish", nil, nil)
+}
+
+// RequestKeyframe asks the host for a keyframe now, for decoders that
+// cannot recover on their own. The host allows about one per second.
+func (s *Session) RequestKeyframe(ctx context.Context) error {
+	return s.call(ctx, http.MethodPost, "/keyframe", nil, nil)
+}
+
+// AddMonitor streams another of the host's monitors, by its index in
+// GET /monitors, as a further video track. It renegotiates the connection;
+// the track reaches OnTrack with the stream ID "monitor-<index>".
+func (s *Session) AddMonitor(ctx context.Context, index int) error {
+	s.negotiation.Lock()
+	defer s.negotiation.Unlock()
+
+	if _, err := s.PC.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	}); err != nil {
+		return err
+	}
+	offer, err := s.PC.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(s.PC)
+	if err := s.PC.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var answer webrtc.SessionDescription
+	req := map[string]interface{}{"monitor": index, "sdp": s.PC.LocalDescription().SDP}
+	if err := s.call(ctx, http.MethodPost, "/monitors", req, &answer); err != nil {
+		// pion cannot roll back; the host's last answer ends the offer
+		// with the new transceiver left unused
+		if current := s.PC.CurrentRemoteDescription(); current != nil {
+			s.PC.SetRemoteDescription(*current)
+		}
+		return err
+	}
+	return s.PC.SetRemoteDescription(answer)
+}
+
+// Reconnect restarts ICE, for a session whose connection dropped when the
+// network changed; the host keeps the session for its disconnect grace
+func (s *Session) Reconnect(ctx context.Context) error {
+	s.negotiation.Lock()
+	defer s.negotiation.Unlock()
+
+	offer, err := s.PC.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(s.PC)
+	if err := s.PC.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var answer webrtc.SessionDescription
+	if err := s.call(ctx, http.MethodPost, "/reconnect", map[string]string{"sdp": s.PC.LocalDescription().SDP}, &answer); err != nil {
+		return err
+	}
+	return s.PC.SetRemoteDescription(answer)
+}
+
+// SetMacros lets the session run the host's macros, or stops it
+func (s *Session) SetMacros(ctx context.Context, enabled bool) error {
+	return s.call(ctx, http.MethodPut, "/macros", map[string]bool{"enabled": enabled}, nil)
+}
+
+// StartInputRecording records the input sent on the session to a file on
+// the host, whose name it returns. Only clients on the host may record.
+func (s *Session) StartInputRecording(ctx context.Context) (string, error) {
+	var out struct {
+		File string `json:"file"`
+	}
+	err := s.call(ctx, http.MethodPost, "/input-recording", nil, &out)
+	return out.File, err
+}
+
+// StopInputRecording ends the session's input recording
+func (s *Session) StopInputRecording(ctx context.Context) error {
+	return s.call(ctx, http.MethodDelete, "/input-recording", nil, nil)
+}
+
+// ReplayInput has the host send a recording's input into the session,
+// speed times as fast as it was recorded; 0 is as recorded. It returns
+// once the replay starts.
+func (s *Session) ReplayInput(ctx context.Context, file string, speed float64) error {
+	return s.call(ctx, http.MethodPost, "/input-replay", map[string]interface{}{"file": file, "speed": speed}, nil)
+}
+
+// StopInputReplay stops a replay into the session before its end
+func (s *Session) StopInputReplay(ctx context.Context) error {
+	return s.call(ctx, http.MethodDelete, "/input-replay", nil, nil)
+}
+
+// call sends v to the session's API at path and decodes the response into
+// out, unless it is nil
+func (s *Session) call(ctx context.Context, method, path string, v, out interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method,
+		s.client.BaseURL+apiPrefix+"/sessions/"+url.PathEscape(s.ID)+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.ownerToken)
+	if s.client.DeviceToken != "" {
+		req.Header.Set("X-Device-Token", s.client.DeviceToken)
+	}
+	if s.client.UserToken != "" {
+		req.Header.Set("X-User-Token", s.client.UserToken)
+	}
+
+	resp, err := s.client.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return readAPIError(resp)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// Send delivers input to the host, waiting for the input channel to open
+func (s *Session) Send(ctx context.Context, input Input) error {
+	if err := s.waitInput(ctx); err != nil {
+		return err
+	}
+	return s.input.Send(input.Encode())
+}
+
+// SetViewport tells the host the size in pixels the video is now shown
+// at, such as after a window resize or a rotation; the host fits the
+// encoding to it within about a second
+func (s *Session) SetViewport(ctx context.Context, width, height int) error {
+	if err := s.waitInput(ctx); err != nil {
+		return err
+	}
+	data, err := json.Marshal(map[string]interface{}{"type": "viewport", "width": width, "height": height})
+	if err != nil {
+		return err
+	}
+	return s.input.SendText(string(data))
+}
+
+// SetVisible tells the host whether the video is on screen. While it is
+// not and no input is sent, the host may pause the capture; it resumes on
+// the next input or SetVisible(true).
+func (s *Session) SetVisible(ctx context.Context, visible bool) error {
+	if err := s.waitInput(ctx); err != nil {
+		return err
+	}
+	data, err := json.Marshal(map[string]interface{}{"type": "visibility", "visible": visible})
+	if err != nil {
+		return err
+	}
+	return s.input.SendText(string(data))
+}
+
+// RunMacro has the host run one of its macros (GET /macros) as this
+// session's input. How it went arrives as "macro" events: "running", then
+// "done", "stopped" or "error".
+func (s *Session) RunMacro(ctx context.Context, name string) error {
+	return s.sendMacro(ctx, map[string]interface{}{"type": "macro", "name": name})
+}
+
+// StopMacro stops the macro running, releasing what it holds pressed
+func (s *Session) StopMacro(ctx context.Context) error {
+	return s.sendMacro(ctx, map[string]interface{}{"type": "macro", "stop": true})
+}
+
+func (s *Session) sendMacro(ctx context.Context, msg map[string]interface{}) error {
+	if err := s.waitInput(ctx); err != nil {
+		return err
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.input.SendText(string(data))
+}
+
+// ResetGamepad returns the session's controller to its neutral state
+func (s *Session) ResetGamepad(ctx context.Context) error {
+	if err := s.waitInput(ctx); err != nil {
+		return err
+	}
+	return s.input.SendText("reset")
+}
+
+func (s *Session) waitInput(ctx context.Context) error {
+	select {
+	case <-s.inputClosed:
+		return ErrInputClosed
+	default:
+	}
+	select {
+	case <-s.inputOpen:
+		return nil
+	case <-s.inputClosed:
+		return ErrInputClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close ends the session
+func (s *Session) Close() error {
+	return s.PC.Close()
+}
+
+func readAPIError(resp *http.Response) error {
+	apiErr := &APIError{Status: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if json.Unmarshal(data, apiErr) != nil || apiErr.Code == "" {
+		apiErr.Code = "http_error"
+		apiErr.Message = resp.Status
+	}
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = resp.Header.Get("X-Request-ID")
+	}
+	return apiErr
+}
@@ -0,0 +1,120 @@
+package chimeraclient
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// FrameDecryptor decrypts the VP8 frames of sessions offered with E2EE.
+// The host encrypts them with SFrame (RFC 9605) after the first clear bytes
+// of each frame; key is the host's E2EE key as GET /e2ee shows it.
+// Decrypt takes whole depacketized frames, e.g. from samplebuilder.
+type FrameDecryptor struct {
+	key  []byte
+	mu   sync.Mutex
+	keys map[uint64]sframeKey
+}
+
+type sframeKey struct {
+	aead cipher.AEAD
+	salt []byte
+}
+
+var errInvalidFrame = errors.New("chimera-go: invalid SFrame frame")
+
+func NewFrameDecryptor(key string) (*FrameDecryptor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != 16 {
+		return nil, errors.New("chimera-go: E2EE keys are 16 bytes")
+	}
+	return &FrameDecryptor{key: raw, keys: make(map[uint64]sframeKey)}, nil
+}
+
+// Decrypt returns the frame as the host encoded it
+func (d *FrameDecryptor) Decrypt(frame []byte) ([]byte, error) {
+	clear := 3
+	if len(frame) > 0 && frame[0]&0x01 == 0 {
+		clear = 10 // Keyframe start code and size
+	}
+	if len(frame) <= clear {
+		return nil, errInvalidFrame
+	}
+	config := frame[clear]
+	offset := clear + 1
+	field := func(bits byte) (uint64, bool) {
+		if bits&0x8 == 0 {
+			return uint64(bits & 0x7), true
+		}
+		n := int(bits&0x7) + 1
+		if offset+n > len(frame) {
+			return 0, false
+		}
+		var v uint64
+		for _, b := range frame[offset : offset+n] {
+			v = v<<8 | uint64(b)
+		}
+		offset += n
+		return v, true
+	}
+	keyID, ok1 := field(config >> 4)
+	ctr, ok2 := field(config & 0xf)
+	if !ok1 || !ok2 {
+		return nil, errInvalidFrame
+	}
+
+	k, err := d.keyFor(keyID)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, len(k.salt))
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], ctr)
+	for i := range nonce {
+		nonce[i] ^= k.salt[i]
+	}
+	aad := append(append([]byte{}, frame[clear:offset]...), frame[:clear]...)
+	out := append([]byte{}, frame[:clear]...)
+	return k.aead.Open(out, nonce, frame[offset:], aad)
+}
+
+func (d *FrameDecryptor) keyFor(keyID uint64) (sframeKey, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if k, ok := d.keys[keyID]; ok {
+		return k, nil
+	}
+
+	suffix := binary.BigEndian.AppendUint64(nil, keyID)
+	suffix = binary.BigEndian.AppendUint16(suffix, 0x0004) // AES_128_GCM_SHA256_128
+	secret, err := hkdf.Extract(sha256.New, d.key, nil)
+	if err != nil {
+		return sframeKey{}, err
+	}
+	key, err := hkdf.Expand(sha256.New, secret, "SFrame 1.0 Secret key "+string(suffix), 16)
+	if err != nil {
+		return sframeKey{}, err
+	}
+	salt, err := hkdf.Expand(sha256.New, secret, "SFrame 1.0 Secret salt "+string(suffix), 12)
+	if err != nil {
+		return sframeKey{}, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return sframeKey{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return sframeKey{}, err
+	}
+	k := sframeKey{aead, salt}
+	d.keys[keyID] = k
+	return k, nil
+}
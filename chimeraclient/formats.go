@@ -0,0 +1,47 @@
+package chimeraclient
+
+import (
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+// The host only sends 4:4:4 or 10-bit video to clients that offer the
+// codec profile for it, which pion's default codecs lack but for VP9
+// profile 2. Payload types are the host's, though any free one would do.
+var pixelFormatCodecs = []webrtc.RTPCodecParameters{
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=f4001f"}, PayloadType: 114},
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=6e001f"}, PayloadType: 115},
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000,
+		SDPFmtpLine: "profile-id=1"}, PayloadType: 118},
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000,
+		SDPFmtpLine: "profile-id=3"}, PayloadType: 119},
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000,
+		SDPFmtpLine: "profile=1"}, PayloadType: 120},
+}
+
+// newPeerConnection is webrtc.NewPeerConnection, with the profiles above
+// when opts ask for more than 8-bit 4:2:0
+func newPeerConnection(config webrtc.Configuration, opts Options) (*webrtc.PeerConnection, error) {
+	if opts.Chroma == "" && opts.BitDepth == 0 {
+		return webrtc.NewPeerConnection(config)
+	}
+
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	feedback := []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+	for _, c := range pixelFormatCodecs {
+		c.RTCPFeedback = feedback
+		if err := m.RegisterCodec(c, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i)).NewPeerConnection(config)
+}
@@ -0,0 +1,27 @@
+package chimeraclient
+
+import "github.com/lightsyr/chimera-go/input"
+
+// Input is a binary message for the "input" DataChannel. The event types
+// of package input implement it: input.KeyEvent, input.MouseEvent,
+// input.TouchEvent, input.MotionEvent and input.GamepadEvent, which Axis
+// and Button build.
+type Input interface {
+	Encode() []byte
+}
+
+// Axis moves a gamepad axis, -32767 to 32767; triggers go from 0. Index is
+// the browser Gamepad API axis, before the session's mapping profile
+// applies.
+func Axis(index uint8, value int16) input.GamepadEvent {
+	return input.GamepadEvent{Type: input.TypeAxis, Index: index, Value: value}
+}
+
+// Button presses or releases a gamepad button by its Gamepad API index
+func Button(index uint8, pressed bool) input.GamepadEvent {
+	ev := input.GamepadEvent{Type: input.TypeButton, Index: index}
+	if pressed {
+		ev.Value = 1
+	}
+	return ev
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// chimera-go is run with a command; without one it serves, which is how
+// the systemd unit and the Windows service start it. The commands for
+// operating a host stand in for editing the constants the server starts
+// with.
+
+// command is one of chimera-go's commands
+type command struct {
+	name  string
+	args  string // Synopsis of the arguments
+	about string
+	run   func(args []string) error
+}
+
+// commands is filled in by init, since help lists it
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "[flags]", "run the server, the default", runServeCommand},
+		{"probe", "", "report what this host can capture, encode and inject", runProbeCommand},
+		{"bench", "[flags]", "encode each bitrate ladder rung and report what the host sustains", runBenchCommand},
+		{"selftest", "[flags]", "stream from a running server and check the frames", runSelftestCommand},
+		{"camera", "[flags]", "stream a server's desktop into a v4l2loopback virtual camera", runCameraCommand},
+		{"config", "validate", "check the configuration files in the working directory", runConfigCommand},
+		{"cert", "lan", "create a local CA and an HTTPS certificate for the host's LAN addresses", runCertCommand},
+		{"service", "install|uninstall|run", "run the server as a system service", runServiceCommand},
+		{"update", "[check]", "update to the latest release", runUpdateCommand},
+		{"version", "", "print the version of chimera-go and FFmpeg", runVersionCommand},
+		{"help", "", "list the commands", runHelpCommand},
+	}
+}
+
+func runCommand(name string, args []string) error {
+	if name == "-h" || name == "-help" || name == "--help" {
+		name = "help"
+	}
+	for _, c := range commands {
+		if c.name == name {
+			if err := c.run(args); !errors.Is(err, flag.ErrHelp) {
+				return err
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown command %q; see chimera-go help", name)
+}
+
+func runHelpCommand(args []string) error {
+	fmt.Println("Usage: chimera-go [command] [arguments]")
+	fmt.Println()
+	for _, c := range commands {
+		fmt.Printf("  %-34s %s\n", strings.TrimSpace(c.name+" "+c.args), c.about)
+	}
+	fmt.Println()
+	fmt.Println("Commands with flags list them with -h.")
+	return nil
+}
+
+func runVersionCommand(args []string) error {
+	info := buildInfo()
+	fmt.Printf("chimera-go %s (commit %v, built %v, %v, %v)\n", version,
+		info["commit"], info["build_date"], info["go_version"], info["platform"])
+	if v := ffmpegVersion(); v != "" {
+		fmt.Println("FFmpeg", v)
+	} else {
+		fmt.Println("FFmpeg not found")
+	}
+	return nil
+}
+
+// runServeCommand sets what the flags override and serves. The server
+// keeps its files in the working directory.
+func runServeCommand(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.StringVar(&httpAddr, "addr", httpAddr, "address of the web client and API")
+	flags.StringVar(&httpsAddr, "https-addr", httpsAddr, "address of HTTPS and HTTP/3, served once "+tlsCertFile+" exists")
+	flags.StringVar(&grpcAddr, "grpc-addr", grpcAddr, "address of the gRPC control plane")
+	flags.BoolVar(&grpcEnabled, "grpc", grpcEnabled, "serve the gRPC control plane")
+	flags.StringVar(&adminSocketPath, "admin-socket", adminSocketPath, "Unix domain socket serving the API to the host, \"\" for none")
+	flags.BoolVar(&libraryDiscovery, "library-scan", libraryDiscovery, "add the games of installed launchers to the app catalog")
+	flags.StringVar(&captureSource, "capture", captureSource, "capture source of offers that name none")
+	flags.StringVar(&captureFile, "capture-file", captureFile, "video the file capture source plays")
+	flags.StringVar(&x11Display, "display", x11Display, "X display x11grab captures when $DISPLAY is unset")
+	flags.BoolVar(&webUIEnabled, "web-ui", webUIEnabled, "serve the built-in web client")
+	flags.StringVar(&webRoot, "web-root", webRoot, "directory the web client is served from")
+	flags.StringVar(&webPrefix, "web-prefix", webPrefix, "path the web client is served at")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return errors.New("usage: chimera-go serve [flags]")
+	}
+	if !captureSourceAvailable(captureSource) {
+		return fmt.Errorf("capture source %q is not available", captureSource)
+	}
+	if err := checkWebUI(); err != nil {
+		return err
+	}
+	serve()
+	return nil
+}
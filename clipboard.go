@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Clipboard sync protocol, JSON text messages on the "clipboard" DataChannel:
+//
+//	{"type":"text","data":"..."}      clipboard content, sent in both directions
+//	{"type":"error","message":"..."}  sent by the server when a message is rejected
+//
+// Only text is supported for now; "image" is reserved for a later revision.
+// Only the owner's peer syncs: the channel is refused to co-op guests and
+// view-only peers.
+const (
+	maxClipboardTextSize  = 256 * 1024 // Stay under the browsers' SCTP message limit
+	clipboardPollInterval = 2 * time.Second
+)
+
+type ClipboardMessage struct {
+	Type    string `json:"type"`
+	Data    string `json:"data,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func handleClipboardChannel(ctx context.Context, session *StreamSession, dc *webrtc.DataChannel) {
+	refusal := ""
+	switch {
+	case !session.Clipboard:
+		refusal = "clipboard sync is disabled for this session"
+	case session.parent != nil || session.viewer:
+		// The host clipboard is the owner's; co-op guests and view-only
+		// peers neither see it nor set it
+		refusal = "clipboard sync is only available to the session owner"
+	}
+	if refusal != "" {
+		dc.OnOpen(func() {
+			defer session.recoverPanic("clipboard channel")
+			sendJSON(dc, ClipboardMessage{Type: "error", Message: refusal})
+			dc.Close()
+		})
+		return
+	}
+
+	// lastText is the content both sides are known to share, so neither
+	// direction echoes back what it just received.
+	var (
+		lastText string
+		lastMu   sync.Mutex
+	)
+
+	pollCtx, stopPolling := context.WithCancel(ctx)
+
+	dc.OnOpen(func() {
+		defer session.recoverPanic("clipboard channel")
+		log.Printf("[Session %s] Clipboard sync enabled", session.ID)
+
+		// Seed with the current host clipboard so we don't push stale content on connect
+		if text, err := readHostClipboard(); err == nil {
+			lastMu.Lock()
+			lastText = text
+			lastMu.Unlock()
+		}
+
+		session.goSafe("clipboard poll", func() {
+			pollHostClipboard(pollCtx, session, dc, &lastText, &lastMu)
+		})
+	})
+
+	dc.OnClose(func() {
+		defer session.recoverPanic("clipboard channel")
+		stopPolling()
+		log.Printf("[Session %s] Clipboard channel closed", session.ID)
+	})
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		defer session.recoverPanic("clipboard channel")
+		if !msg.IsString {
+			sendJSON(dc, ClipboardMessage{Type: "error", Message: "binary clipboard messages are not supported"})
+			return
+		}
+
+		var m ClipboardMessage
+		if err := json.Unmarshal(msg.Data, &m); err != nil {
+			sendJSON(dc, ClipboardMessage{Type: "error", Message: "invalid clipboard message"})
+			return
+		}
+
+		switch m.Type {
+		case "text":
+			if !session.acceptsInput() {
+				sendJSON(dc, ClipboardMessage{Type: "error", Message: "view-only peers cannot set the host clipboard"})
+				return
+			}
+			if len(m.Data) > maxClipboardTextSize {
+				sendJSON(dc, ClipboardMessage{
+					Type:    "error",
+					Message: fmt.Sprintf("clipboard text exceeds %d bytes", maxClipboardTextSize),
+				})
+				return
+			}
+
+			lastMu.Lock()
+			defer lastMu.Unlock()
+			if m.Data == lastText {
+				return
+			}
+			if err := writeHostClipboard(m.Data); err != nil {
+				log.Printf("[Session %s] Error writing host clipboard: %v", session.ID, err)
+				sendJSON(dc, ClipboardMessage{Type: "error", Message: "failed to update host clipboard"})
+				return
+			}
+			lastText = m.Data
+			auditSession(session, "clipboard_sync", map[string]interface{}{"direction": "to_host", "bytes": len(m.Data)})
+
+		default:
+			sendJSON(dc, ClipboardMessage{Type: "error", Message: fmt.Sprintf("unsupported clipboard type %q", m.Type)})
+		}
+	})
+}
+
+// pollHostClipboard pushes host clipboard changes to the owner's client
+func pollHostClipboard(ctx context.Context, session *StreamSession, dc *webrtc.DataChannel, lastText *string, lastMu *sync.Mutex) {
+	ticker := time.NewTicker(clipboardPollInterval)
+	defer ticker.Stop()
+
+	errorLogged := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		text, err := readHostClipboard()
+		if err != nil {
+			if !errorLogged {
+				log.Printf("[Session %s] Error reading host clipboard: %v", session.ID, err)
+				errorLogged = true
+			}
+			continue
+		}
+		errorLogged = false
+
+		if len(text) > maxClipboardTextSize {
+			continue
+		}
+
+		lastMu.Lock()
+		if text != *lastText {
+			if err := sendJSON(dc, ClipboardMessage{Type: "text", Data: text}); err == nil {
+				*lastText = text
+				auditSession(session, "clipboard_sync", map[string]interface{}{"direction": "to_peer", "bytes": len(text)})
+			}
+		}
+		lastMu.Unlock()
+	}
+}
+
+// Host clipboard access through the platform's command line tools
+func readHostClipboard() (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command",
+			"[Console]::OutputEncoding=[Text.Encoding]::UTF8; Get-Clipboard -Raw")
+	case "darwin":
+		cmd = exec.Command("pbpaste")
+	default:
+		cmd = exec.Command("xclip", "-selection", "clipboard", "-o")
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	text := string(out)
+	if runtime.GOOS == "windows" {
+		// PowerShell terminates its output with a newline that isn't part of the clipboard
+		text = strings.TrimSuffix(text, "\r\n")
+	}
+	return text, nil
+}
+
+func writeHostClipboard(text string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command",
+			"[Console]::InputEncoding=[Text.Encoding]::UTF8; Set-Clipboard -Value ([Console]::In.ReadToEnd())")
+	case "darwin":
+		cmd = exec.Command("pbcopy")
+	default:
+		cmd = exec.Command("xclip", "-selection", "clipboard", "-i")
+	}
+
+	cmd.Stdin = strings.NewReader(text)
+	return cmd.Run()
+}
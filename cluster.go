@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cluster mode runs a lab's gaming machines as one: each host publishes
+// itself and its sessions to a shared Redis, and any of them takes offers
+// for all. An offer naming a host ("host": "rig-2") goes to that host, one
+// naming an app to a host whose catalog has it, preferring this one, and
+// the others stay here while there is room, else go to the host with the
+// most. The host the client asked forwards the offer and, later, the
+// client's calls about the session, so clients only know one address;
+// WebRTC runs directly between the client and the host streaming to it.
+//
+// It is on with cluster.json,
+//
+//	{"redis": "redis://:password@10.0.0.5:6379/0", "host_id": "rig-1", "url": "http://10.0.0.21:8080"}
+//
+// where url is how the other hosts reach this one and host_id defaults to
+// the hostname. Forwarded requests carry the client's headers, so hosts
+// should share users.json, user-token-key and trusted-devices.json. The
+// network policy that applies is the asked host's.
+
+var clusterFile = "cluster.json"
+
+const (
+	clusterHeartbeat = 5 * time.Second
+	// A host missing this many heartbeats drops out of the registry
+	clusterTTL       = 3 * clusterHeartbeat
+	clusterKeyPrefix = "chimera:"
+	// clusterRouteTTL is how long the IDs of forwarded sessions and queued
+	// offers are remembered; older sessions are found in the registry
+	clusterRouteTTL = time.Hour
+	// clusterRoutedHeader marks a request forwarded by another host, which
+	// is served here whatever it asks for
+	clusterRoutedHeader  = "X-Chimera-Routed-By"
+	maxClusterOfferBytes = 1 << 20
+)
+
+type clusterConfig struct {
+	Redis  string `json:"redis"`
+	HostID string `json:"host_id"`
+	URL    string `json:"url"`
+}
+
+// clusterHost is a host's entry in the registry
+type clusterHost struct {
+	ID       string           `json:"id"`
+	URL      string           `json:"url"`
+	Version  string           `json:"version"`
+	Apps     []string         `json:"apps"`
+	Sessions []clusterSession `json:"sessions"`
+	// HostSessions counts the sessions with a capture of their own, of
+	// MaxSessions
+	HostSessions int       `json:"host_sessions"`
+	MaxSessions  int       `json:"max_sessions"`
+	Draining     bool      `json:"draining"`
+	Updated      time.Time `json:"updated"`
+}
+
+type clusterSession struct {
+	ID      string    `json:"id"`
+	App     string    `json:"app,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Started time.Time `json:"started"`
+}
+
+func (h *clusterHost) room() int {
+	return h.MaxSessions - h.HostSessions
+}
+
+func (h *clusterHost) hasApp(name string) bool {
+	for _, app := range h.Apps {
+		if app == name {
+			return true
+		}
+	}
+	return false
+}
+
+type clusterNode struct {
+	config  clusterConfig
+	redis   *redisClient
+	changed chan struct{}
+
+	mu sync.Mutex
+	// routes are the sessions and queued offers this host forwarded, by ID
+	routes map[string]clusterRoute
+}
+
+type clusterRoute struct {
+	host string
+	at   time.Time
+}
+
+// cluster is nil unless cluster mode is on
+var cluster *clusterNode
+
+func loadCluster() {
+	data, err := os.ReadFile(clusterFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading cluster config: %v", err)
+		}
+		return
+	}
+
+	var cfg clusterConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Printf("Error parsing %s: %v", clusterFile, err)
+		return
+	}
+	if cfg.Redis == "" || cfg.URL == "" {
+		log.Printf("Ignoring %s: redis and url are required", clusterFile)
+		return
+	}
+	target, err := url.Parse(cfg.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		log.Printf("Ignoring %s: url must be an http or https URL", clusterFile)
+		return
+	}
+	client, err := newRedisClient(cfg.Redis)
+	if err != nil {
+		log.Printf("Ignoring %s: %v", clusterFile, err)
+		return
+	}
+	if cfg.HostID == "" {
+		if cfg.HostID, err = os.Hostname(); err != nil {
+			log.Printf("Ignoring %s: host_id is required: %v", clusterFile, err)
+			return
+		}
+	}
+
+	cluster = &clusterNode{
+		config:  cfg,
+		redis:   client,
+		changed: make(chan struct{}, 1),
+		routes:  make(map[string]clusterRoute),
+	}
+	log.Printf("Cluster: host %s at %s, registry %s", cfg.HostID, cfg.URL, client.addr)
+}
+
+func (c *clusterNode) hostKey(id string) string {
+	return clusterKeyPrefix + "host:" + id
+}
+
+// run publishes this host every heartbeat and whenever its sessions change
+func (c *clusterNode) run() {
+	ticker := time.NewTicker(clusterHeartbeat)
+	defer ticker.Stop()
+	failing := false
+	for {
+		if err := c.publish(); err != nil {
+			if !failing {
+				log.Printf("[Cluster] Error publishing to the registry: %v", err)
+			}
+			failing = true
+		} else if failing {
+			log.Printf("[Cluster] Registry reachable again")
+			failing = false
+		}
+		c.pruneRoutes()
+
+		select {
+		case <-ticker.C:
+		case <-c.changed:
+		}
+	}
+}
+
+func (c *clusterNode) publish() error {
+	data, err := json.Marshal(c.localHost())
+	if err != nil {
+		return err
+	}
+	if _, err := c.redis.do("SET", c.hostKey(c.config.HostID), string(data), "PX", strconv.FormatInt(clusterTTL.Milliseconds(), 10)); err != nil {
+		return err
+	}
+	_, err = c.redis.do("SADD", clusterKeyPrefix+"hosts", c.config.HostID)
+	return err
+}
+
+// leave takes the host out of the registry on shutdown
+func (c *clusterNode) leave() {
+	c.redis.do("DEL", c.hostKey(c.config.HostID))
+	c.redis.do("SREM", clusterKeyPrefix+"hosts", c.config.HostID)
+	c.redis.close()
+}
+
+// clusterChanged publishes this host's sessions without waiting for the
+// heartbeat
+func clusterChanged() {
+	if cluster == nil {
+		return
+	}
+	select {
+	case cluster.changed <- struct{}{}:
+	default:
+	}
+}
+
+// localHost is this host's registry entry
+func (c *clusterNode) localHost() clusterHost {
+	h := clusterHost{
+		ID:          c.config.HostID,
+		URL:         c.config.URL,
+		Version:     version,
+		Apps:        []string{},
+		Sessions:    []clusterSession{},
+		MaxSessions: maxSessions,
+		Draining:    admissionError() != nil,
+		Updated:     time.Now().UTC(),
+	}
+
+	appsLock.RLock()
+	for _, app := range sortedApps() {
+		h.Apps = append(h.Apps, app.Name)
+	}
+	appsLock.RUnlock()
+
+	sessionsLock.RLock()
+	for _, session := range sessions {
+		s := clusterSession{ID: session.ID, User: session.user, Started: session.StartTime.UTC()}
+		session.mutex.RLock()
+		if session.App != nil {
+			s.App = session.App.Name
+		}
+		session.mutex.RUnlock()
+		h.Sessions = append(h.Sessions, s)
+		if session.parent == nil {
+			h.HostSessions++
+		}
+	}
+	sessionsLock.RUnlock()
+	sort.Slice(h.Sessions, func(i, j int) bool { return h.Sessions[i].Started.Before(h.Sessions[j].Started) })
+	return h
+}
+
+// hosts reads the registry, with this host as it is now
+func (c *clusterNode) hosts() ([]clusterHost, error) {
+	reply, err := c.redis.do("SMEMBERS", clusterKeyPrefix+"hosts")
+	if err != nil {
+		return nil, err
+	}
+	members, _ := reply.([]interface{})
+	ids := make([]string, 0, len(members))
+	keys := []string{"MGET"}
+	for _, m := range members {
+		if id, ok := m.(string); ok && id != c.config.HostID {
+			ids = append(ids, id)
+			keys = append(keys, c.hostKey(id))
+		}
+	}
+
+	hosts := []clusterHost{c.localHost()}
+	if len(ids) == 0 {
+		return hosts, nil
+	}
+	reply, err = c.redis.do(keys...)
+	if err != nil {
+		return nil, err
+	}
+	values, _ := reply.([]interface{})
+	for i, id := range ids {
+		var data string
+		if i < len(values) {
+			data, _ = values[i].(string)
+		}
+		if data == "" {
+			// Expired: the host stopped without leaving
+			c.redis.do("SREM", clusterKeyPrefix+"hosts", id)
+			continue
+		}
+		var h clusterHost
+		if err := json.Unmarshal([]byte(data), &h); err != nil {
+			log.Printf("[Cluster] Error parsing the entry of host %s: %v", id, err)
+			continue
+		}
+		hosts = append(hosts, h)
+	}
+	sort.Slice(hosts[1:], func(i, j int) bool { return hosts[1+i].ID < hosts[1+j].ID })
+	return hosts, nil
+}
+
+var (
+	errClusterHostUnknown = errors.New("No such host in the cluster")
+	errClusterNoHost      = errors.New("No host in the cluster can take the offer")
+)
+
+// route picks the host for an offer naming app and host, either of which
+// may be empty; nil is this host
+func (c *clusterNode) route(app, host string) (*clusterHost, error) {
+	if host == c.config.HostID {
+		return nil, nil
+	}
+	hosts, err := c.hosts()
+	if err != nil {
+		return nil, err
+	}
+	if host != "" {
+		for i := range hosts {
+			if hosts[i].ID == host {
+				return &hosts[i], nil
+			}
+		}
+		return nil, errClusterHostUnknown
+	}
+
+	var candidates []*clusterHost
+	for i := range hosts {
+		if !hosts[i].Draining && (app == "" || hosts[i].hasApp(app)) {
+			candidates = append(candidates, &hosts[i])
+		}
+	}
+	if len(candidates) == 0 {
+		if app != "" {
+			// Let this host refuse the unknown app
+			return nil, nil
+		}
+		return nil, errClusterNoHost
+	}
+	// This host first while it has room, then the roomiest; when all are
+	// full, the offer queues at the first
+	best := candidates[0]
+	if best.ID == c.config.HostID && best.room() > 0 {
+		return nil, nil
+	}
+	for _, h := range candidates[1:] {
+		if h.room() > best.room() {
+			best = h
+		}
+	}
+	if best.ID == c.config.HostID {
+		return nil, nil
+	}
+	return best, nil
+}
+
+// owner finds the host running a session, or holding a queued offer,
+// that is not here
+func (c *clusterNode) owner(id string) *clusterHost {
+	c.mu.Lock()
+	route, ok := c.routes[id]
+	c.mu.Unlock()
+
+	hosts, err := c.hosts()
+	if err != nil {
+		log.Printf("[Cluster] Error reading the registry: %v", err)
+		return nil
+	}
+	for i := range hosts[1:] {
+		h := &hosts[1+i]
+		if ok && h.ID == route.host {
+			return h
+		}
+		for _, s := range h.Sessions {
+			if s.ID == id {
+				return h
+			}
+		}
+	}
+	return nil
+}
+
+func (c *clusterNode) pruneRoutes() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, route := range c.routes {
+		if time.Since(route.at) > clusterRouteTTL {
+			delete(c.routes, id)
+		}
+	}
+}
+
+// forward proxies r to host, remembering the session or queued offer an
+// offer's answer names
+func (c *clusterNode) forward(w http.ResponseWriter, r *http.Request, host *clusterHost) {
+	target, err := url.Parse(host.URL)
+	if err != nil {
+		writeErrorDetails(w, http.StatusBadGateway, "host_unreachable", "Error reaching the cluster host", err.Error())
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			pr.Out.Header.Set(clusterRoutedHeader, c.config.HostID)
+		},
+		// Queued offers follow their position over Server-Sent Events
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			if !strings.HasSuffix(r.URL.Path, "/offer") || resp.StatusCode >= 300 {
+				return nil
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return err
+			}
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			var answer struct {
+				SessionID string `json:"session_id"`
+				QueueID   string `json:"queue_id"`
+			}
+			if json.Unmarshal(body, &answer) == nil {
+				c.mu.Lock()
+				for _, id := range []string{answer.SessionID, answer.QueueID} {
+					if id != "" {
+						c.routes[id] = clusterRoute{host: host.ID, at: time.Now()}
+					}
+				}
+				c.mu.Unlock()
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("[Cluster] Error forwarding %s to host %s: %v", r.URL.Path, host.ID, err)
+			writeErrorDetails(w, http.StatusBadGateway, "host_unreachable", "Error reaching the cluster host", err.Error())
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// clusterRouted sends offers to the host the cluster picks
+func clusterRouted(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cluster == nil || r.Method != http.MethodPost || r.Header.Get(clusterRoutedHeader) != "" {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxClusterOfferBytes))
+		if err != nil {
+			writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error reading the offer", err.Error())
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// A malformed offer is refused here by next
+		var offer struct {
+			App  string `json:"app"`
+			Host string `json:"host"`
+		}
+		json.Unmarshal(body, &offer)
+		host, err := cluster.route(offer.App, offer.Host)
+		switch {
+		case errors.Is(err, errClusterHostUnknown):
+			writeError(w, http.StatusNotFound, "host_not_found", err.Error())
+		case errors.Is(err, errClusterNoHost):
+			writeDraining(w, err)
+		case err != nil:
+			log.Printf("[Cluster] Error routing offer: %v", err)
+			writeErrorDetails(w, http.StatusServiceUnavailable, "registry_unavailable", "Error reading the cluster registry", err.Error())
+		case host == nil:
+			next(w, r)
+		default:
+			log.Printf("[Cluster] Offer for app %q forwarded to host %s", offer.App, host.ID)
+			cluster.forward(w, r, host)
+		}
+	}
+}
+
+// clusterForwarded sends calls about a session or queued offer on another
+// host to it
+func clusterForwarded(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if cluster == nil || r.Header.Get(clusterRoutedHeader) != "" || isLocalID(id) {
+			next(w, r)
+			return
+		}
+		if host := cluster.owner(id); host != nil {
+			cluster.forward(w, r, host)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// isLocalID reports whether id is a session or queued offer of this host
+func isLocalID(id string) bool {
+	if _, ok := getSession(id); ok {
+		return true
+	}
+	waitQueueLock.Lock()
+	defer waitQueueLock.Unlock()
+	for _, entry := range waitQueue {
+		if entry.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// handleCluster lists the cluster's hosts and their sessions; admins only
+func handleCluster(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		writeError(w, http.StatusForbidden, "admin_only", "Only admins can list the cluster")
+		return
+	}
+	if cluster == nil {
+		writeError(w, http.StatusNotFound, "cluster_disabled", "Cluster mode is off")
+		return
+	}
+	hosts, err := cluster.hosts()
+	if err != nil {
+		writeErrorDetails(w, http.StatusServiceUnavailable, "registry_unavailable", "Error reading the cluster registry", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"host_id": cluster.config.HostID,
+		"hosts":   hosts,
+	})
+}
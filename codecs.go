@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// videoCodec is one codec a session can request in its offer
+type videoCodec struct {
+	capability webrtc.RTPCodecCapability
+	// encoderArgs are FFmpeg's output options, container included
+	encoderArgs func(cfg CaptureConfig) []string
+	// newReader reads the container encoderArgs selects, with buffers
+	// sized for the picture
+	newReader func(r io.Reader, buffers pipelineBuffers) accessUnitReader
+	// formats are the profiles for pixel formats past 8-bit 4:2:0, which
+	// capability is; a format the codec cannot encode is missing
+	formats map[pixelFormat]webrtc.RTPCodecParameters
+}
+
+// ffmpegEncoder is the FFmpeg encoder that encodes cfg, empty when the
+// arguments name none
+func (c videoCodec) ffmpegEncoder(cfg CaptureConfig) string {
+	args := c.encoderArgs(cfg)
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "-c:v" {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// pixelFormat is the chroma subsampling and bit depth a session encodes.
+// Full chroma keeps small text sharp where 4:2:0 blurs its colored edges.
+type pixelFormat struct {
+	chroma444 bool
+	tenBit    bool
+}
+
+// parsePixelFormat reads an offer's chroma ("420" or "444", "" for 420)
+// and bit depth (8 or 10, 0 for 8)
+func parsePixelFormat(chroma string, bitDepth int) (pixelFormat, bool) {
+	var f pixelFormat
+	switch chroma {
+	case "", "420":
+	case "444":
+		f.chroma444 = true
+	default:
+		return f, false
+	}
+	switch bitDepth {
+	case 0, 8:
+	case 10:
+		f.tenBit = true
+	default:
+		return f, false
+	}
+	return f, true
+}
+
+// pixFmt is FFmpeg's name for the format
+func (f pixelFormat) pixFmt() string {
+	name := "yuv420p"
+	if f.chroma444 {
+		name = "yuv444p"
+	}
+	if f.tenBit {
+		name += "10le"
+	}
+	return name
+}
+
+// capabilityFor returns the track capability of the codec's format
+func (c videoCodec) capabilityFor(f pixelFormat) (webrtc.RTPCodecCapability, bool) {
+	if f == (pixelFormat{}) {
+		return c.capability, true
+	}
+	p, ok := c.formats[f]
+	return p.RTPCodecCapability, ok
+}
+
+// registerPixelFormatCodecs adds the profiles of the formats past 4:2:0
+// to m, which pion's defaults lack but for VP9 profile 2
+func registerPixelFormatCodecs(m *webrtc.MediaEngine) error {
+	registered := make(map[webrtc.PayloadType]bool)
+	for _, name := range videoCodecNames() {
+		for _, p := range videoCodecs[name].formats {
+			if p.PayloadType == 0 || registered[p.PayloadType] {
+				continue
+			}
+			registered[p.PayloadType] = true
+			if err := m.RegisterCodec(p, webrtc.RTPCodecTypeVideo); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// codecProfile is what tells a codec's profiles apart in its fmtp line:
+// profile_idc for H.264, profile-id for VP9 and profile for AV1
+func codecProfile(mimeType, fmtp string) string {
+	params := make(map[string]string)
+	for _, p := range strings.Split(fmtp, ";") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(p), "="); ok {
+			params[strings.ToLower(k)] = strings.ToLower(v)
+		}
+	}
+	var key string
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		id := params["profile-level-id"]
+		return id[:min(2, len(id))]
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		key = "profile-id"
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		key = "profile"
+	default:
+		return ""
+	}
+	if profile, ok := params[key]; ok {
+		return profile
+	}
+	return "0" // Either defaults to profile 0
+}
+
+// offersProfile reports whether an SDP offer can receive capability's
+// profile, which pion would otherwise send under whatever profile of the
+// codec the client has
+func offersProfile(offer string, capability webrtc.RTPCodecCapability) bool {
+	desc := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return false
+	}
+	want := codecProfile(capability.MimeType, capability.SDPFmtpLine)
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+		for _, format := range media.MediaName.Formats {
+			var pt uint8
+			if _, err := fmt.Sscan(format, &pt); err != nil {
+				continue
+			}
+			codec, err := parsed.GetCodecForPayloadType(pt)
+			if err != nil || !strings.EqualFold("video/"+codec.Name, capability.MimeType) {
+				continue
+			}
+			if codecProfile(capability.MimeType, codec.Fmtp) == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// accessUnitReader reads encoded frames from FFmpeg's stdout
+type accessUnitReader interface {
+	next() (AccessUnit, error)
+}
+
+const defaultVideoCodec = "h264"
+
+// encoderPreset tunes encoding for a use; offers pick one by name
+type encoderPreset struct {
+	// IntraRefresh replaces periodic keyframes with a column of intra
+	// blocks that sweeps the picture once per GOP, so no frame is much
+	// larger than the others. H.264 only.
+	IntraRefresh bool
+}
+
+const defaultEncoderPreset = "balanced"
+
+// Limits on the offer's slices and threads
+const (
+	maxEncoderSlices  = 32
+	maxEncoderThreads = 64
+)
+
+var encoderPresets = map[string]encoderPreset{
+	"balanced": {},
+	// Competitive games: steady frame sizes over fast recovery from loss
+	"competitive": {IntraRefresh: true},
+}
+
+// videoFeedback is what pion's default video codecs ask for
+var videoFeedback = []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+
+// Profiles for the pixel formats past 4:2:0. Payload type 0 marks those
+// among pion's default codecs.
+var (
+	h264High444 = webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeH264,
+			ClockRate:    90000,
+			SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=f4001f",
+			RTCPFeedback: videoFeedback,
+		},
+		PayloadType: 114,
+	}
+	h264High10 = webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeH264,
+			ClockRate:    90000,
+			SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=6e001f",
+			RTCPFeedback: videoFeedback,
+		},
+		PayloadType: 115,
+	}
+	av1High = webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000, SDPFmtpLine: "profile=1", RTCPFeedback: videoFeedback},
+		PayloadType:        120,
+	}
+)
+
+// vp9Profile is VP9 profile id: 1 is 4:4:4, 2 is 10-bit, 3 is both
+func vp9Profile(id int, pt webrtc.PayloadType) webrtc.RTPCodecParameters {
+	return webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeVP9,
+			ClockRate:    90000,
+			SDPFmtpLine:  fmt.Sprintf("profile-id=%d", id),
+			RTCPFeedback: videoFeedback,
+		},
+		PayloadType: pt,
+	}
+}
+
+// Rate control and threading shared by every encoder
+func rateControlArgs(cfg CaptureConfig) []string {
+	args := []string{
+		"-maxrate", fmt.Sprintf("%dk", cfg.maxKbps()),
+		"-bufsize", fmt.Sprintf("%dk", 2*cfg.maxKbps()),
+		"-g", fmt.Sprintf("%d", cfg.gop()),
+		"-keyint_min", fmt.Sprintf("%d", min(cfg.FPS, cfg.gop())),
+		"-pix_fmt", cfg.Format.pixFmt(),
+	}
+	if cfg.Threads > 0 {
+		args = append(args, "-threads", fmt.Sprint(cfg.Threads))
+	}
+	return args
+}
+
+var videoCodecs = map[string]videoCodec{
+	"h264": {
+		capability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH264,
+			ClockRate:   90000,
+			SDPFmtpLine: "level-id=1;profile-level-id=42e01e;packetization-mode=1",
+		},
+		encoderArgs: func(cfg CaptureConfig) []string {
+			args := []string{
+				"-c:v", "libx264", // Use software encoder for compatibility
+				"-preset", "ultrafast",
+				"-tune", "zerolatency",
+				"-crf", "23",
+			}
+			if cfg.IntraRefresh {
+				args = append(args, "-x264-params", "intra-refresh=1")
+			}
+			if cfg.Slices > 0 {
+				args = append(args, "-slices", fmt.Sprint(cfg.Slices))
+			}
+			args = append(args, rateControlArgs(cfg)...)
+			return append(args,
+				"-f", "flv", // Framed, see flv.go
+				"-flvflags", "no_duration_filesize",
+			)
+		},
+		newReader: func(r io.Reader, b pipelineBuffers) accessUnitReader { return newFLVReader(r, b) },
+		formats: map[pixelFormat]webrtc.RTPCodecParameters{
+			{chroma444: true}:               h264High444,
+			{tenBit: true}:                  h264High10,
+			{chroma444: true, tenBit: true}: h264High444,
+		},
+	},
+	"vp8": {
+		capability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		encoderArgs: func(cfg CaptureConfig) []string {
+			return libvpxArgs(cfg, "libvpx")
+		},
+		newReader: func(r io.Reader, b pipelineBuffers) accessUnitReader { return newIVFReader(r, b) },
+	},
+	"vp9": {
+		capability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0"},
+		encoderArgs: func(cfg CaptureConfig) []string {
+			return append(libvpxArgs(cfg, "libvpx-vp9"), "-row-mt", "1")
+		},
+		newReader: func(r io.Reader, b pipelineBuffers) accessUnitReader { return newIVFReader(r, b) },
+		formats: map[pixelFormat]webrtc.RTPCodecParameters{
+			{chroma444: true}:               vp9Profile(1, 118),
+			{tenBit: true}:                  vp9Profile(2, 0),
+			{chroma444: true, tenBit: true}: vp9Profile(3, 119),
+		},
+	},
+	"av1": {
+		capability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000},
+		encoderArgs: func(cfg CaptureConfig) []string {
+			args := []string{
+				"-c:v", "libaom-av1",
+				"-usage", "realtime",
+				"-cpu-used", "10",
+				"-lag-in-frames", "0",
+				"-b:v", fmt.Sprintf("%dk", cfg.maxKbps()),
+			}
+			args = append(args, rateControlArgs(cfg)...)
+			return append(args, "-f", "ivf")
+		},
+		newReader: func(r io.Reader, b pipelineBuffers) accessUnitReader { return newIVFReader(r, b) },
+		formats: map[pixelFormat]webrtc.RTPCodecParameters{
+			{chroma444: true}: av1High,
+			// Main profile covers 10-bit 4:2:0
+			{tenBit: true}:                  {RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000}},
+			{chroma444: true, tenBit: true}: av1High,
+		},
+	},
+}
+
+// libvpxArgs configures VP8 or VP9 for realtime with no frame lag
+func libvpxArgs(cfg CaptureConfig, encoder string) []string {
+	args := []string{
+		"-c:v", encoder,
+		"-deadline", "realtime",
+		"-cpu-used", "8",
+		"-lag-in-frames", "0",
+		"-error-resilient", "1",
+		"-b:v", fmt.Sprintf("%dk", cfg.maxKbps()),
+	}
+	args = append(args, rateControlArgs(cfg)...)
+	return append(args, "-f", "ivf")
+}
+
+// videoCodecNames lists the codecs for capture source capabilities
+func videoCodecNames() []string {
+	names := make([]string, 0, len(videoCodecs))
+	for name := range videoCodecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Colors are converted to one colorspace and range and signaled twice:
+// in the bitstream, and in the color-space RTP header extension browsers
+// render by. Left unsignaled, a browser guesses, and a wrong guess washes
+// out or crushes the picture. The host's defaults come from colors.json,
+//
+//	{"space": "bt709", "range": "full"}
+//
+// and offers may override them with color_space and color_range.
+
+var colorsFile = "colors.json"
+
+const colorSpaceURI = "http://www.webrtc.org/experiments/rtp-hdrext/color-space"
+
+// colorSettings are a colorspace, "bt709" or "bt601", and a range,
+// "limited" or "full"
+type colorSettings struct {
+	Space string `json:"space"`
+	Range string `json:"range"`
+}
+
+var hostColors = colorSettings{Space: "bt709", Range: "limited"}
+
+// inProcessColors are what the in-process sources convert to
+var inProcessColors = colorSettings{Space: "bt601", Range: "limited"}
+
+// colorSpaces maps a colorspace to FFmpeg's names for its matrix and tags
+// and to its H.273 code for primaries, transfer and matrix alike
+var colorSpaces = map[string]struct {
+	matrix, tag string
+	code        byte
+}{
+	"bt709": {"bt709", "bt709", 1},
+	"bt601": {"bt601", "smpte170m", 6},
+}
+
+func (c colorSettings) validate() error {
+	if _, ok := colorSpaces[c.Space]; !ok {
+		return fmt.Errorf("unknown colorspace %q", c.Space)
+	}
+	if c.Range != "limited" && c.Range != "full" {
+		return fmt.Errorf("unknown color range %q", c.Range)
+	}
+	return nil
+}
+
+func loadColors() {
+	data, err := os.ReadFile(colorsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading colors: %v", err)
+		}
+		return
+	}
+
+	colors := hostColors
+	if err := json.Unmarshal(data, &colors); err != nil {
+		log.Printf("Error parsing %s: %v", colorsFile, err)
+		return
+	}
+	if err := colors.validate(); err != nil {
+		log.Printf("Ignoring %s: %v", colorsFile, err)
+		return
+	}
+	hostColors = colors
+	log.Printf("Colors: %s, %s range", colors.Space, colors.Range)
+}
+
+// ffmpegRange is FFmpeg's name for the range
+func (c colorSettings) ffmpegRange() string {
+	if c.Range == "full" {
+		return "pc"
+	}
+	return "tv"
+}
+
+// filter converts the picture to the colorspace and range
+func (c colorSettings) filter() string {
+	return fmt.Sprintf("scale=out_color_matrix=%s:out_range=%s", colorSpaces[c.Space].matrix, c.ffmpegRange())
+}
+
+// encoderArgs tag the bitstream with the colorspace and range
+func (c colorSettings) encoderArgs() []string {
+	tag := colorSpaces[c.Space].tag
+	return []string{
+		"-colorspace", tag,
+		"-color_primaries", tag,
+		"-color_trc", tag,
+		"-color_range", c.ffmpegRange(),
+	}
+}
+
+// extension is the color-space header extension's short form: primaries,
+// transfer and matrix, then the range in bits 5-4 with chroma siting left
+// unspecified
+func (c colorSettings) extension() []byte {
+	code := colorSpaces[c.Space].code
+	rangeCode := byte(1)
+	if c.Range == "full" {
+		rangeCode = 2
+	}
+	return []byte{code, code, code, rangeCode << 4}
+}
+
+// registerColorSpaceExtension lets answers accept the header extension
+func registerColorSpaceExtension(m *webrtc.MediaEngine) error {
+	return m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: colorSpaceURI}, webrtc.RTPCodecTypeVideo)
+}
+
+// colorSpaceFactory adds the header extension to every video packet,
+// where receivers read it from whichever packet of a frame arrives
+type colorSpaceFactory struct{ colors colorSettings }
+
+func (f colorSpaceFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &colorSpaceInterceptor{extension: f.colors.extension()}, nil
+}
+
+type colorSpaceInterceptor struct {
+	interceptor.NoOp
+	extension []byte
+}
+
+func (c *colorSpaceInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !strings.HasPrefix(strings.ToLower(info.MimeType), "video/") {
+		return writer
+	}
+	var id uint8
+	for _, ext := range info.RTPHeaderExtensions {
+		if ext.URI == colorSpaceURI {
+			id = uint8(ext.ID)
+		}
+	}
+	if id == 0 {
+		return writer // Not negotiated
+	}
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		// Tracks share headers between their peers
+		tagged := *header
+		tagged.Extensions = append([]rtp.Extension(nil), header.Extensions...)
+		if err := tagged.SetExtension(id, c.extension); err != nil {
+			return writer.Write(header, payload, attributes)
+		}
+		return writer.Write(&tagged, payload, attributes)
+	})
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Responses whose type compresses well, the web client and the API's
+// JSON, are gzipped for clients that accept it. A web asset with a
+// brotli-compressed copy next to it, index.html.br, is served from the
+// copy to clients that accept br, as the server does not compress brotli
+// itself.
+//
+// Web assets are cached by content hash: the ETag is the hash, so a client
+// connecting again revalidates and gets a 304 instead of the whole client,
+// and a URL with the hash in ?v= may be cached for good.
+
+// compressibleTypes are the Content-Types gzipped, less their parameters
+var compressibleTypes = map[string]bool{
+	"text/html":              true,
+	"text/css":               true,
+	"text/plain":             true,
+	"text/javascript":        true,
+	"application/javascript": true,
+	"application/json":       true,
+	"image/svg+xml":          true,
+}
+
+// Smaller responses gain too little to be worth a gzip header
+const minCompressSize = 512
+
+// acceptsEncoding reports whether r accepts the content coding
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), coding) {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err != nil || weight > 0
+	}
+	return false
+}
+
+// compressed gzips what next writes when the client accepts it and the
+// type is worth it
+func compressed(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		// Ranges are of the uncompressed body
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" || !acceptsEncoding(r, "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	}
+}
+
+// gzipResponseWriter decides on the first write whether to compress, by
+// the headers the handler set by then, and holds back the status until it
+// has
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	started bool
+	gz      *gzip.Writer
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	gz, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+	return gz
+}}
+
+func (g *gzipResponseWriter) start(first []byte) {
+	if g.started {
+		return
+	}
+	g.started = true
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	if g.worthCompressing(first) {
+		h := g.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			// The compressed body differs from the one the tag names
+			h.Set("ETag", "W/"+etag)
+		}
+		g.gz = gzipWriters.Get().(*gzip.Writer)
+		g.gz.Reset(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+}
+
+func (g *gzipResponseWriter) worthCompressing(first []byte) bool {
+	h := g.Header()
+	if h.Get("Content-Encoding") != "" || g.status == http.StatusNoContent || g.status == http.StatusNotModified {
+		return false
+	}
+	contentType := h.Get("Content-Type")
+	if contentType == "" && first != nil {
+		contentType = http.DetectContentType(first)
+		h.Set("Content-Type", contentType)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if !compressibleTypes[mediaType] {
+		return false
+	}
+	// The whole body, or its first write when the length is not set
+	size := len(first)
+	if length, err := strconv.Atoi(h.Get("Content-Length")); err == nil {
+		size = length
+	}
+	return size >= minCompressSize
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if !g.started && g.status == 0 {
+		g.status = status
+	}
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	g.start(b)
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+func (g *gzipResponseWriter) Flush() {
+	g.start(nil)
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// Close ends the response, once the handler has returned
+func (g *gzipResponseWriter) Close() {
+	g.start(nil)
+	if g.gz == nil {
+		return
+	}
+	g.gz.Close()
+	gzipWriters.Put(g.gz)
+	g.gz = nil
+}
+
+// assetHash is the hash of a web asset as it was when hashed
+type assetHash struct {
+	modTime time.Time
+	size    int64
+	hash    string
+}
+
+var assetHashes sync.Map // File name to assetHash
+
+// hashAsset returns the hex SHA-256 prefix of the file, "" for a directory
+// or a file it cannot read
+func hashAsset(name string) string {
+	f, err := os.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return ""
+	}
+	if h, ok := assetHashes.Load(name); ok {
+		if h := h.(assetHash); h.modTime.Equal(info.ModTime()) && h.size == info.Size() {
+			return h.hash
+		}
+	}
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return ""
+	}
+	hash := hex.EncodeToString(sum.Sum(nil)[:8])
+	assetHashes.Store(name, assetHash{info.ModTime(), info.Size(), hash})
+	return hash
+}
+
+// cachedAssets serves the files of root with their hash as ETag, and
+// their brotli copies where there are
+func cachedAssets(root string) http.Handler {
+	files := http.FileServer(http.Dir(root))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		urlPath := path.Clean("/" + r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/") {
+			urlPath = path.Join(urlPath, "index.html")
+		}
+		name := filepath.Join(root, filepath.FromSlash(urlPath))
+
+		hash := hashAsset(name)
+		if hash == "" {
+			files.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Query().Get("v") == hash {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+
+		if acceptsEncoding(r, "br") && r.Header.Get("Range") == "" {
+			if br, err := os.Open(name + ".br"); err == nil {
+				defer br.Close()
+				// A copy older than the asset is out of date
+				info, err := br.Stat()
+				if asset, statErr := os.Stat(name); err == nil && statErr == nil && !info.IsDir() && !info.ModTime().Before(asset.ModTime()) {
+					if contentType := mime.TypeByExtension(path.Ext(urlPath)); contentType != "" {
+						w.Header().Set("Content-Type", contentType)
+					}
+					w.Header().Set("Content-Encoding", "br")
+					w.Header().Set("ETag", `"`+hash+`-br"`)
+					http.ServeContent(w, r, urlPath, info.ModTime(), br)
+					return
+				}
+			}
+		}
+		w.Header().Set("ETag", `"`+hash+`"`)
+		files.ServeHTTP(w, r)
+	})
+}
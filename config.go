@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// chimera-go config validate reads each configuration file in the working
+// directory the way the server would at startup and reports what it would
+// skip or ignore, so a typo is found before a restart rather than after a
+// session misbehaves. Most loaders only log their problems, so their log
+// is collected and its problem lines reported.
+
+type configFile struct {
+	name *string
+	// check loads the file and returns its problems
+	check func(data []byte) []string
+}
+
+var configFiles = []configFile{
+	{&mappingProfilesFile, loaded(loadMappingProfiles)},
+	{&macrosFile, loaded(loadMacros)},
+	{&trustedDevicesFile, loaded(loadTrustedDevices)},
+	{&usageFile, loaded(loadUsage)},
+	{&appsFile, loaded(loadApps)},
+	{&bitrateLadderFile, loaded(loadBitrateLadder)},
+	{&offerLimitsFile, loaded(loadOfferLimits)},
+	{&usersFile, loaded(loadUserAccounts)},
+	{&oidcConfigFile, loaded(loadOIDCConfig)},
+	{&networkPolicyFile, func(data []byte) []string {
+		_, err := parseNetworkPolicy(data)
+		return configProblems(err)
+	}},
+	{&dtlsConfigFile, func(data []byte) []string {
+		_, err := parseDTLSConfig(data, &webrtc.SettingEngine{})
+		return configProblems(err)
+	}},
+	{&addressFamiliesFile, func(data []byte) []string {
+		_, err := parseAddressFamilies(data)
+		return configProblems(err)
+	}},
+	{&colorsFile, loaded(loadColors)},
+	{&scalerFile, loaded(loadScaler)},
+	{&watermarkFile, loaded(loadWatermark)},
+	{&idleFile, loaded(loadIdlePause)},
+	{&privacyFile, loaded(loadPrivacy)},
+	{&clusterFile, loaded(loadCluster)},
+	{&sfuFile, loaded(loadSFU)},
+	{&loggingFile, loaded(func() { closeLogSinks(loadLogSinks()) })},
+	{&crashReportFile, func(data []byte) []string {
+		_, err := parseCrashReportConfig(data)
+		return configProblems(err)
+	}},
+	{&resourcesFile, func(data []byte) []string {
+		_, err := parseResourceLimits(data)
+		return configProblems(err)
+	}},
+	{&pipelineFile, loaded(loadPipeline)},
+	{&sessionTimeoutsFile, loaded(loadSessionTimeouts)},
+	{&monitorsFile, func(data []byte) []string {
+		_, err := listMonitors()
+		return configProblems(err)
+	}},
+}
+
+// configProblemPrefixes start the log lines of a loader that mean it
+// skipped or ignored something
+var configProblemPrefixes = []string{"Error", "Invalid", "Ignoring", "Skipping"}
+
+// loaded checks a file with its loader, by what the loader logs
+func loaded(load func()) func(data []byte) []string {
+	return func([]byte) []string {
+		var out bytes.Buffer
+		log.SetOutput(&out)
+		log.SetFlags(0)
+		defer func() {
+			log.SetOutput(os.Stderr)
+			log.SetFlags(log.LstdFlags)
+		}()
+		load()
+
+		var problems []string
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			for _, prefix := range configProblemPrefixes {
+				if strings.HasPrefix(line, prefix) {
+					problems = append(problems, line)
+					break
+				}
+			}
+		}
+		return problems
+	}
+}
+
+func configProblems(err error) []string {
+	if err == nil {
+		return nil
+	}
+	return []string{err.Error()}
+}
+
+func runConfigCommand(args []string) error {
+	if len(args) != 1 || args[0] != "validate" {
+		return errors.New("usage: chimera-go config validate")
+	}
+
+	problems := 0
+	for _, f := range configFiles {
+		data, err := os.ReadFile(*f.name)
+		if os.IsNotExist(err) {
+			fmt.Printf("%-24s not present, defaults apply\n", *f.name)
+			continue
+		}
+		found := configProblems(err)
+		if err == nil {
+			found = f.check(data)
+		}
+		if len(found) == 0 {
+			fmt.Printf("%-24s ok\n", *f.name)
+			continue
+		}
+		problems += len(found)
+		for _, p := range found {
+			fmt.Printf("%-24s %s\n", *f.name, p)
+		}
+	}
+
+	fmt.Println()
+	if problems > 0 {
+		return fmt.Errorf("%d problems found", problems)
+	}
+	fmt.Println("Configuration is valid")
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/lightsyr/chimera-go/input"
+	"github.com/pion/webrtc/v3"
+)
+
+// JoinRequest adds a co-op player to a running session. The player gets the
+// host's video and drives its own virtual controller slot.
+type JoinRequest struct {
+	SDP            string `json:"sdp"`
+	GamepadSlot    *int   `json:"gamepad_slot,omitempty"`
+	ControllerType string `json:"controller_type"`
+	MappingProfile string `json:"mapping_profile"`
+}
+
+// handleJoin creates a co-op guest session sharing the host session's
+// pipeline. Guests are regular sessions with a parent: input, rumble and
+// permissions work unchanged, but only gamepad input is accepted and they
+// end with the host. The host's owner token controls guests too.
+//
+// Joining takes the owner, an admin or a control share link for the
+// session in X-Share-Token. Guests start without control, which the owner
+// grants with PUT /sessions/{id}/guests/{guest}/control.
+func handleJoin(w http.ResponseWriter, r *http.Request) {
+	host, ok := getSession(r.PathValue("id"))
+	if !ok || host.parent != nil || host.ctx.Err() != nil {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	if !host.canManage(r) {
+		if claims := sessionShare(r, host); claims == nil || claims.Role != peerRoleControl {
+			writeError(w, http.StatusForbidden, "not_owner", "Joining takes the session owner or a control share link")
+			return
+		}
+	}
+
+	var req JoinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+	mapping, err := validateJoin(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	resp, err := joinSession(host, req, mapping, false)
+	if errors.Is(err, errNoFreeSlot) {
+		writeError(w, http.StatusServiceUnavailable, "no_free_slot", "No free controller slot")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleSetGuestControl lets the host session's owner or an admin grant or
+// revoke a co-op guest's control
+func handleSetGuestControl(w http.ResponseWriter, r *http.Request) {
+	host, ok := getSession(r.PathValue("id"))
+	if !ok || host.parent != nil {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	if !host.canManage(r) {
+		writeError(w, http.StatusForbidden, "not_owner", "Only the session owner can change a guest's control")
+		return
+	}
+	guest, ok := getSession(r.PathValue("guest"))
+	if !ok || guest.parent != host {
+		writeError(w, http.StatusNotFound, "guest_not_found", "Co-op player not found")
+		return
+	}
+
+	var req struct {
+		Control bool `json:"control"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+
+	if err := guest.setControl(req.Control); err != nil {
+		writeError(w, http.StatusForbidden, "viewer", err.Error())
+		return
+	}
+	log.Printf("[Session %s] Co-op player %s control set to %v", host.ID, guest.ID, req.Control)
+	auditRequest(r, "control", guest.ID, map[string]interface{}{"control": req.Control})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id": guest.ID,
+		"control":    req.Control,
+	})
+}
+
+// validateJoin fills in the controller type and returns the mapping profile
+func validateJoin(req *JoinRequest) (*MappingProfile, error) {
+	if req.ControllerType == "" {
+		req.ControllerType = controllerXbox360
+	}
+	if req.ControllerType != controllerXbox360 && req.ControllerType != controllerDS4 {
+		return nil, errors.New("Invalid controller type")
+	}
+	mapping, ok := getMappingProfile(req.MappingProfile)
+	if !ok {
+		return nil, errors.New("Unknown mapping profile")
+	}
+	return mapping, nil
+}
+
+var errNoFreeSlot = errors.New("no free controller slot")
+
+// joinSession adds a co-op guest to host and answers its offer. control
+// decides whether the guest's input reaches the host from the start.
+func joinSession(host *StreamSession, req JoinRequest, mapping *MappingProfile, control bool) (*OfferResponse, error) {
+	guestID := generateSessionID()
+	preferredSlot := -1
+	if req.GamepadSlot != nil {
+		preferredSlot = *req.GamepadSlot
+	}
+	slot := acquireGamepadSlot(guestID, preferredSlot)
+	if slot < 0 {
+		return nil, errNoFreeSlot
+	}
+
+	pc, err := newPeerConnection(webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{URLs: []string{"stun:stun.l.google.com:19302"}},
+			{URLs: []string{"stun:stun1.l.google.com:19302"}},
+		},
+	}, host.colors)
+	if err != nil {
+		releaseGamepadSlot(guestID)
+		log.Printf("[Session %s] Error creating co-op PeerConnection: %v", host.ID, err)
+		return nil, err
+	}
+
+	guestCtx, guestCancel := context.WithCancel(host.ctx)
+	guest := &StreamSession{
+		ID:             guestID,
+		PC:             pc,
+		Cancel:         guestCancel,
+		StartTime:      time.Now(),
+		Width:          host.Width,
+		Height:         host.Height,
+		FPS:            host.FPS,
+		GamepadSlot:    slot,
+		ControllerType: req.ControllerType,
+		ctx:            guestCtx,
+		parent:         host,
+		videoTrack:     host.videoTrack,
+		audioTrack:     host.audioTrack,
+		shortcuts:      newShortcutFilter(shortcutPolicyBlock),
+		ownerToken:     host.ownerToken,
+		mapping:        mapping,
+		bytesAtStart:   host.Stats.bytesSent.Load(),
+	}
+	guest.control.Store(control)
+
+	registerSession(guest)
+	setupDataChannels(guestCtx, guest)
+
+	// Guests leave with the host or when their own connection drops
+	go func() {
+		<-guestCtx.Done()
+		unregisterSession(guestID)
+		pc.Close()
+	}()
+	guest.followConnectionState(webrtc.PeerConnectionStateNew, guestCancel)
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		defer guest.recoverPanic("connection state handler")
+		log.Printf("[Session %s] Co-op player connection state: %s", guestID, state.String())
+		if state == webrtc.PeerConnectionStateConnected {
+			guest.connected.Store(true)
+			guest.goSafe("co-op keyframe", guest.viewerKeyframe)
+		}
+		guest.followConnectionState(state, guestCancel)
+	})
+
+	fail := func(msg string, err error) (*OfferResponse, error) {
+		guestCancel()
+		log.Printf("[Session %s] %s: %v", guestID, msg, err)
+		return nil, err
+	}
+
+	if _, err := pc.AddTrack(host.track()); err != nil {
+		return fail("Error adding track for co-op player", err)
+	}
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: hostFamilies.preferCandidates(req.SDP)}
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return fail("Error setting remote description", err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return fail("Error creating answer", err)
+	}
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return fail("Error setting local description", err)
+	}
+
+	log.Printf("[Session %s] Co-op player joined session %s on slot %d", guestID, host.ID, slot)
+	auditSession(guest, "session_start", map[string]interface{}{"host_session": host.ID, "control": control})
+	return &OfferResponse{
+		SessionDescription: answer,
+		SessionID:          guestID,
+		GamepadSlot:        slot,
+		Role:               peerRoleControl,
+	}, nil
+}
+
+// pipeline returns the capture/encode stats the session's video comes from
+func (s *StreamSession) pipeline() *PipelineStats {
+	if s.parent != nil {
+		return &s.parent.Stats
+	}
+	return &s.Stats
+}
+
+// InputStats counts one client's input events by kind
+type InputStats struct {
+	gamepad  atomic.Int64
+	motion   atomic.Int64
+	touch    atomic.Int64
+	keyboard atomic.Int64
+	mouse    atomic.Int64
+	rejected atomic.Int64 // Invalid, not permitted, or failed to inject
+	lastAt   atomic.Int64 // Unix milliseconds of the last accepted event
+}
+
+func (s *InputStats) count(inputType uint8) {
+	switch inputType {
+	case input.TypeAxis, input.TypeButton:
+		s.gamepad.Add(1)
+	case input.TypeMotion:
+		s.motion.Add(1)
+	case input.TypeTouch:
+		s.touch.Add(1)
+	case input.TypeKey:
+		s.keyboard.Add(1)
+	case input.TypeMouse:
+		s.mouse.Add(1)
+	}
+	s.lastAt.Store(time.Now().UnixMilli())
+}
+
+func (s *InputStats) summary() map[string]interface{} {
+	summary := map[string]interface{}{
+		"gamepad":  s.gamepad.Load(),
+		"motion":   s.motion.Load(),
+		"touch":    s.touch.Load(),
+		"keyboard": s.keyboard.Load(),
+		"mouse":    s.mouse.Load(),
+		"rejected": s.rejected.Load(),
+	}
+	if last := s.lastAt.Load(); last > 0 {
+		summary["last_event"] = time.UnixMilli(last).Format(time.RFC3339)
+	}
+	return summary
+}
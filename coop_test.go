@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addTestSession registers a session with only what the API handlers look
+// at before they touch its peer connection
+func addTestSession(t *testing.T, id, ownerToken string) *StreamSession {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &StreamSession{ID: id, ownerToken: ownerToken, ctx: ctx, Cancel: cancel, StartTime: time.Now()}
+	sessionsLock.Lock()
+	sessions[id] = s
+	sessionsLock.Unlock()
+	t.Cleanup(func() {
+		cancel()
+		sessionsLock.Lock()
+		delete(sessions, id)
+		sessionsLock.Unlock()
+	})
+	return s
+}
+
+// apiRequest runs handler on a request from a remote client, so it is
+// neither the host nor an admin
+func apiRequest(handler http.HandlerFunc, method, pattern, path, body string, header map[string]string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc(method+" "+pattern, handler)
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.RemoteAddr = "192.0.2.2:50000"
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestJoinRequiresOwnerOrControlLink(t *testing.T) {
+	addTestSession(t, "host1", "owner-token")
+	addTestSession(t, "host2", "other-token")
+	link := func(session, role string) string {
+		return signShareToken(shareClaims{Session: session, Role: role, Expires: time.Now().Add(time.Hour).Unix()})
+	}
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		status int
+	}{
+		{"no credentials", nil, http.StatusForbidden},
+		{"another session's owner token", map[string]string{"Authorization": "Bearer other-token"}, http.StatusForbidden},
+		{"view link", map[string]string{shareTokenHeader: link("host1", peerRoleView)}, http.StatusForbidden},
+		{"another session's link", map[string]string{shareTokenHeader: link("host2", peerRoleControl)}, http.StatusForbidden},
+		{"forged link", map[string]string{shareTokenHeader: link("host1", peerRoleControl) + "x"}, http.StatusForbidden},
+		// Past the check, the empty body is refused
+		{"owner token", map[string]string{"Authorization": "Bearer owner-token"}, http.StatusBadRequest},
+		{"control link", map[string]string{shareTokenHeader: link("host1", peerRoleControl)}, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		w := apiRequest(handleJoin, "POST", "/sessions/{id}/join", "/sessions/host1/join", "", test.header)
+		if w.Code != test.status {
+			t.Errorf("%s: status %d, want %d: %s", test.name, w.Code, test.status, w.Body)
+		}
+	}
+}
+
+func TestSetGuestControlRequiresOwner(t *testing.T) {
+	host := addTestSession(t, "host1", "owner-token")
+	guest := addTestSession(t, "guest1", "owner-token")
+	guest.parent = host
+	addTestSession(t, "other", "owner-token")
+
+	tests := []struct {
+		name, guest string
+		header      map[string]string
+		status      int
+	}{
+		{"no credentials", "guest1", nil, http.StatusForbidden},
+		{"guest's share link", "guest1", map[string]string{shareTokenHeader: signShareToken(shareClaims{Session: "host1", Role: peerRoleControl, Expires: time.Now().Add(time.Hour).Unix()})}, http.StatusForbidden},
+		{"not a guest of the session", "other", map[string]string{"Authorization": "Bearer owner-token"}, http.StatusNotFound},
+		{"owner", "guest1", map[string]string{"Authorization": "Bearer owner-token"}, http.StatusOK},
+	}
+	for _, test := range tests {
+		w := apiRequest(handleSetGuestControl, "PUT", "/sessions/{id}/guests/{guest}/control",
+			"/sessions/host1/guests/"+test.guest+"/control", `{"control":true}`, test.header)
+		if w.Code != test.status {
+			t.Errorf("%s: status %d, want %d: %s", test.name, w.Code, test.status, w.Body)
+		}
+	}
+	if !guest.control.Load() {
+		t.Error("the owner's grant did not give the guest control")
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Crash reporting is opt-in: with crashreport.json, panics go to a
+// Sentry-compatible service (Sentry, GlitchTip) as events. A session's
+// panic is sent as it is recovered, with the session's capture state and
+// the end of its FFmpeg log; a panic that takes the whole process down is
+// written to chimera-go.crash by the runtime and sent on the next start.
+// Paths under the home directory, the user and host names and IP addresses
+// are scrubbed from everything sent.
+
+var crashReportFile = "crashreport.json"
+
+const (
+	crashOutputFile    = "chimera-go.crash"
+	crashReportTimeout = 10 * time.Second
+	// Reports a run sends at most, should something panic in a loop
+	crashReportLimit = 20
+	// FFmpeg log lines sent with a session's panic
+	crashReportLogLines = 20
+)
+
+type crashReportConfig struct {
+	// DSN is the project's client key URL, https://<key>@<host>/<project>
+	DSN         string `json:"dsn"`
+	Environment string `json:"environment"`
+}
+
+type crashReporter struct {
+	storeURL    string
+	key         string
+	environment string
+	scrubber    *strings.Replacer
+	sent        atomic.Int32
+}
+
+// crashReports is nil unless crash reporting is on
+var crashReports *crashReporter
+
+var ipAddressPattern = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}\b|\[[0-9a-fA-F:]+\]`)
+
+func parseCrashReportConfig(data []byte) (*crashReporter, error) {
+	var cfg crashReportConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	dsn, err := url.Parse(cfg.DSN)
+	if err != nil || (dsn.Scheme != "http" && dsn.Scheme != "https") || dsn.User.Username() == "" {
+		return nil, errors.New("dsn must be https://<key>@<host>/<project>")
+	}
+	// A DSN may put the project under a path: <host>/<path>/<project>
+	cut := strings.LastIndex(dsn.Path, "/")
+	if cut < 0 || cut == len(dsn.Path)-1 {
+		return nil, errors.New("dsn has no project")
+	}
+	store := url.URL{Scheme: dsn.Scheme, Host: dsn.Host, Path: dsn.Path[:cut] + "/api/" + dsn.Path[cut+1:] + "/store/"}
+
+	var pairs []string
+	if home, err := os.UserHomeDir(); err == nil && home != "" {
+		pairs = append(pairs, home, "~")
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		pairs = append(pairs, host, "<host>")
+	}
+	for _, name := range []string{"USER", "USERNAME"} {
+		if user := os.Getenv(name); len(user) > 2 {
+			pairs = append(pairs, user, "<user>")
+		}
+	}
+	return &crashReporter{
+		storeURL:    store.String(),
+		key:         dsn.User.Username(),
+		environment: cfg.Environment,
+		scrubber:    strings.NewReplacer(pairs...),
+	}, nil
+}
+
+// loadCrashReporting turns crash reporting on when crashreport.json asks
+// for it, sends the crash the last run left, if any, and has the runtime
+// write the next one
+func loadCrashReporting() {
+	data, err := os.ReadFile(crashReportFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading crash report config: %v", err)
+		}
+		return
+	}
+	reporter, err := parseCrashReportConfig(data)
+	if err != nil {
+		log.Printf("Ignoring %s: %v", crashReportFile, err)
+		return
+	}
+	crashReports = reporter
+
+	if crash, err := os.ReadFile(crashOutputFile); err == nil && len(bytes.TrimSpace(crash)) > 0 {
+		go reporter.reportCrash(string(crash))
+	}
+	file, err := os.OpenFile(crashOutputFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("Error opening %s, process crashes will not be reported: %v", crashOutputFile, err)
+	} else {
+		debug.SetCrashOutput(file, debug.CrashOptions{})
+		file.Close() // The runtime keeps its own descriptor
+	}
+	log.Printf("Crash reporting to %s", reporter.storeURL)
+}
+
+// reportCrash sends the panic a previous run died of
+func (c *crashReporter) reportCrash(output string) {
+	kind, value := "fatal error", ""
+	first, rest, _ := strings.Cut(output, "\n")
+	if msg, ok := strings.CutPrefix(first, "panic: "); ok {
+		kind, value = "panic", msg
+	} else if msg, ok := strings.CutPrefix(first, "fatal error: "); ok {
+		value = msg
+	} else {
+		value = first
+	}
+	event := c.event("fatal", kind, value, rest)
+	event["tags"].(map[string]string)["where"] = "process"
+	c.send(event)
+}
+
+// reportSessionPanic sends a panic a session recovered from, with the
+// session's state; it runs in the panicking goroutine, so the session
+// mutex is only tried
+func (c *crashReporter) reportSessionPanic(s *StreamSession, where string, r interface{}, stack []byte) {
+	event := c.event("error", "panic", fmt.Sprint(r), string(stack))
+	tags := event["tags"].(map[string]string)
+	tags["where"] = where
+	tags["capture"] = s.source
+
+	state := map[string]interface{}{
+		"id":         s.ID,
+		"duration":   time.Since(s.StartTime).Round(time.Second).String(),
+		"resolution": fmt.Sprintf("%dx%d@%d", s.Width, s.Height, s.FPS),
+		"audio_only": s.audioTrack != nil,
+		"guest":      s.parent != nil,
+		"connected":  s.connected.Load(),
+		"hidden":     s.hidden.Load(),
+		"video_mute": s.videoMuted.Load(),
+	}
+	if s.PC != nil {
+		state["connection"] = s.PC.ConnectionState().String()
+	}
+	if s.mutex.TryRLock() {
+		state["capture_started"] = s.Capture != nil
+		state["spectators"] = len(s.spectators)
+		s.mutex.RUnlock()
+	}
+	extra := event["extra"].(map[string]interface{})
+	extra["session"] = state
+	if s.ffmpegLog != nil {
+		if lines := s.ffmpegLog.tail(crashReportLogLines); len(lines) > 0 {
+			extra["ffmpeg_log"] = c.scrub(strings.Join(lines, "\n"))
+		}
+	}
+	go c.send(event)
+}
+
+// event builds a Sentry event of a panic and the Go stack trace it printed
+func (c *crashReporter) event(level, kind, value, stack string) map[string]interface{} {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return map[string]interface{}{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   time.Now().UTC().Format(time.RFC3339),
+		"platform":    "go",
+		"level":       level,
+		"logger":      "chimera-go",
+		"release":     "chimera-go@" + version,
+		"environment": c.environment,
+		"tags": map[string]string{
+			"os":   runtime.GOOS,
+			"arch": runtime.GOARCH,
+		},
+		"contexts": map[string]interface{}{
+			"runtime": map[string]string{"name": "go", "version": runtime.Version()},
+			"os":      map[string]string{"name": runtime.GOOS},
+		},
+		"exception": map[string]interface{}{
+			"values": []interface{}{map[string]interface{}{
+				"type":       kind,
+				"value":      c.scrub(value),
+				"stacktrace": map[string]interface{}{"frames": c.frames(stack)},
+			}},
+		},
+		"extra": map[string]interface{}{},
+	}
+}
+
+// frames turns the first goroutine of a Go stack trace into Sentry frames,
+// outermost call first
+func (c *crashReporter) frames(stack string) []map[string]interface{} {
+	// "goroutine 1 [running]:", then a function line and a "\tfile:line
+	// +0x1f" line per call, and a blank line before the next goroutine
+	_, stack, _ = strings.Cut(stack, "goroutine ")
+	stack, _, _ = strings.Cut(stack, "\n\n")
+	lines := strings.Split(stack, "\n")
+
+	var frames []map[string]interface{}
+	for i := 1; i+1 < len(lines) && strings.HasPrefix(lines[i+1], "\t"); i += 2 {
+		function := strings.TrimPrefix(lines[i], "created by ")
+		if cut := strings.Index(function, " in goroutine "); cut >= 0 {
+			function = function[:cut]
+		}
+		if cut := strings.LastIndex(function, "("); cut > 0 && strings.HasSuffix(function, ")") {
+			function = function[:cut] // Arguments
+		}
+		location := strings.TrimSpace(lines[i+1])
+		if cut := strings.LastIndex(location, " +0x"); cut >= 0 {
+			location = location[:cut]
+		}
+		file, lineNo := location, 0
+		if cut := strings.LastIndex(location, ":"); cut >= 0 {
+			file = location[:cut]
+			fmt.Sscan(location[cut+1:], &lineNo)
+		}
+
+		module := function
+		if slash := strings.LastIndex(module, "/"); slash >= 0 {
+			if dot := strings.Index(module[slash:], "."); dot >= 0 {
+				module = module[:slash+dot]
+			}
+		} else if dot := strings.Index(module, "."); dot >= 0 {
+			module = module[:dot]
+		} else {
+			module = "runtime" // panic and the other builtins
+		}
+		frames = append([]map[string]interface{}{{
+			"function": function,
+			"module":   module,
+			"filename": c.scrub(file),
+			"lineno":   lineNo,
+			"in_app":   module == "main" || strings.HasPrefix(module, "github.com/lightsyr/chimera-go"),
+		}}, frames...)
+	}
+	return frames
+}
+
+func (c *crashReporter) scrub(s string) string {
+	return ipAddressPattern.ReplaceAllString(c.scrubber.Replace(s), "<ip>")
+}
+
+func (c *crashReporter) send(event map[string]interface{}) {
+	if c.sent.Add(1) > crashReportLimit {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), crashReportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.storeURL, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=chimera-go/%s, sentry_key=%s", version, c.key))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("[Crash] Error sending report: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("[Crash] Report refused: %s", resp.Status)
+		return
+	}
+	log.Printf("[Crash] Reported %s as event %s", event["level"], event["event_id"])
+}
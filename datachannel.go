@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// DataChannel labels opened by the client before sending its offer
+const (
+	clipboardChannelLabel = "clipboard"
+	statsChannelLabel     = "stats"
+	pingChannelLabel      = "ping"
+	rumbleChannelLabel    = "rumble"
+	inputChannelLabel     = "input"
+	heartbeatChannelLabel = "heartbeat"
+)
+
+// setupDataChannels routes client-created DataChannels to their protocol
+// handlers by label. Must be called before SetRemoteDescription.
+func setupDataChannels(ctx context.Context, session *StreamSession) {
+	session.PC.OnDataChannel(func(dc *webrtc.DataChannel) {
+		defer session.recoverPanic("DataChannel setup")
+		log.Printf("[Session %s] DataChannel opened by client: %s", session.ID, dc.Label())
+
+		switch dc.Label() {
+		case clipboardChannelLabel:
+			handleClipboardChannel(ctx, session, dc)
+		case statsChannelLabel:
+			handleStatsChannel(ctx, session, dc)
+		case pingChannelLabel:
+			handlePingChannel(ctx, session, dc)
+		case rumbleChannelLabel:
+			handleRumbleChannel(ctx, session, dc)
+		case inputChannelLabel:
+			handleInputChannel(ctx, session, dc)
+		case heartbeatChannelLabel:
+			handleHeartbeatChannel(ctx, session, dc)
+		default:
+			log.Printf("[Session %s] Unknown DataChannel %q, closing", session.ID, dc.Label())
+			dc.Close()
+		}
+	})
+}
+
+// sendJSON marshals v and sends it as a text message on dc
+func sendJSON(dc *webrtc.DataChannel, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return dc.SendText(string(data))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Maintenance drain stops the host admitting sessions while the running
+// ones play on, so it can be taken down by hand once they have ended.
+// Updates drain the same way on their own, see runUpdate.
+
+const defaultDrainRetryAfter = 5 * time.Minute
+
+var (
+	maintenanceDraining atomic.Bool
+	// Seconds refused clients are told to wait before offering again
+	drainRetryAfter atomic.Int64
+)
+
+var errMaintenance = errors.New("Server is draining for maintenance")
+
+func init() {
+	drainRetryAfter.Store(int64(defaultDrainRetryAfter.Seconds()))
+}
+
+// admissionError returns why the host is not admitting new sessions, or
+// nil when it is
+func admissionError() error {
+	if err := drainError(); err != nil {
+		return err
+	}
+	return overloaded()
+}
+
+// drainError returns why the host is draining, or nil
+func drainError() error {
+	switch {
+	case updateDraining.Load(), handedOver.Load():
+		return errDraining
+	case maintenanceDraining.Load():
+		return errMaintenance
+	}
+	return nil
+}
+
+// isDraining reports whether err refuses a session for the host's sake,
+// draining or overloaded, rather than for anything in the offer
+func isDraining(err error) bool {
+	var overload *overloadError
+	return errors.Is(err, errDraining) || errors.Is(err, errMaintenance) || errors.As(err, &overload)
+}
+
+// writeDraining refuses an offer while the host drains or is overloaded
+func writeDraining(w http.ResponseWriter, err error) {
+	var overload *overloadError
+	if errors.As(err, &overload) {
+		writeOverloaded(w, overload)
+		return
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(drainRetryAfter.Load(), 10))
+	writeError(w, http.StatusServiceUnavailable, "draining", err.Error())
+}
+
+// DrainRequest starts a maintenance drain. RetryAfter, in seconds, is what
+// refused clients are told to wait; it defaults to five minutes.
+type DrainRequest struct {
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// HTTP handlers, host only: POST /admin/drain stops admitting sessions and
+// fails queued offers, POST /admin/undrain admits them again
+func handleDrain(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Draining can only be managed from the host")
+		return
+	}
+
+	var req DrainRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+			return
+		}
+	}
+	if req.RetryAfter < 0 {
+		writeError(w, http.StatusBadRequest, "invalid_retry_after", "retry_after must not be negative")
+		return
+	}
+
+	retryAfter := int64(defaultDrainRetryAfter.Seconds())
+	if req.RetryAfter > 0 {
+		retryAfter = int64(req.RetryAfter)
+	}
+	drainRetryAfter.Store(retryAfter)
+	if maintenanceDraining.CompareAndSwap(false, true) {
+		log.Printf("[Drain] Draining for maintenance, %d sessions running", hostSessionCount())
+		auditRequest(r, "drain", "", nil)
+		failQueuedOffers(errMaintenance.Error())
+	}
+	writeDrainStatus(w)
+}
+
+func handleUndrain(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Draining can only be managed from the host")
+		return
+	}
+
+	if maintenanceDraining.CompareAndSwap(true, false) {
+		log.Printf("[Drain] Admitting sessions again")
+		auditRequest(r, "undrain", "", nil)
+	}
+	writeDrainStatus(w)
+}
+
+func writeDrainStatus(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"draining":    maintenanceDraining.Load(),
+		"updating":    updateDraining.Load(),
+		"sessions":    hostSessionCount(),
+		"retry_after": drainRetryAfter.Load(),
+	})
+}
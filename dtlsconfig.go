@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pion/dtls/v2"
+	dtlsElliptic "github.com/pion/dtls/v2/pkg/crypto/elliptic"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+// DTLS and SRTP settings for deployments that need more than pion's
+// defaults, read from dtls.json:
+//
+//	{
+//	  "srtp_profiles": ["SRTP_AEAD_AES_256_GCM", "SRTP_AEAD_AES_128_GCM"],
+//	  "dtls_curves": ["X25519", "P-256"],
+//	  "require_extended_master_secret": true
+//	}
+//
+// srtp_profiles are offered in order; listing only the AEAD ones requires
+// AES-GCM for the media. The DTLS cipher suite itself follows from the
+// host's ECDSA certificate (ECDHE-ECDSA with AES-GCM preferred); pion
+// offers no way to narrow it further.
+
+var dtlsConfigFile = "dtls.json"
+
+type dtlsConfig struct {
+	SRTPProfiles                []string `json:"srtp_profiles"`
+	DTLSCurves                  []string `json:"dtls_curves"`
+	RequireExtendedMasterSecret bool     `json:"require_extended_master_secret"`
+}
+
+var srtpProfileNames = map[string]dtls.SRTPProtectionProfile{
+	"SRTP_AEAD_AES_256_GCM":       dtls.SRTP_AEAD_AES_256_GCM,
+	"SRTP_AEAD_AES_128_GCM":       dtls.SRTP_AEAD_AES_128_GCM,
+	"SRTP_AES128_CM_HMAC_SHA1_80": dtls.SRTP_AES128_CM_HMAC_SHA1_80,
+	"SRTP_AES128_CM_HMAC_SHA1_32": dtls.SRTP_AES128_CM_HMAC_SHA1_32,
+}
+
+var dtlsCurveNames = map[string]dtlsElliptic.Curve{
+	"X25519": dtlsElliptic.X25519,
+	"P-256":  dtlsElliptic.P256,
+	"P-384":  dtlsElliptic.P384,
+}
+
+// settingEngine applies to every peer connection the host creates
+var settingEngine webrtc.SettingEngine
+
+func loadDTLSConfig() {
+	data, err := os.ReadFile(dtlsConfigFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading DTLS config: %v", err)
+		}
+		return
+	}
+
+	// Falling back to weaker defaults than configured would go unnoticed,
+	// so a broken config stops the server
+	cfg, err := parseDTLSConfig(data, &settingEngine)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("DTLS: SRTP profiles %s, curves %s, extended master secret required: %v",
+		strings.Join(cfg.SRTPProfiles, ", "), strings.Join(cfg.DTLSCurves, ", "), cfg.RequireExtendedMasterSecret)
+}
+
+// parseDTLSConfig parses dtls.json and applies it to e
+func parseDTLSConfig(data []byte, e *webrtc.SettingEngine) (dtlsConfig, error) {
+	var cfg dtlsConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("Error parsing %s: %v", dtlsConfigFile, err)
+	}
+	if err := cfg.apply(e); err != nil {
+		return cfg, fmt.Errorf("Invalid %s: %v", dtlsConfigFile, err)
+	}
+	return cfg, nil
+}
+
+func (cfg dtlsConfig) apply(e *webrtc.SettingEngine) error {
+	if len(cfg.SRTPProfiles) > 0 {
+		profiles := make([]dtls.SRTPProtectionProfile, 0, len(cfg.SRTPProfiles))
+		for _, name := range cfg.SRTPProfiles {
+			profile, ok := srtpProfileNames[name]
+			if !ok {
+				return fmt.Errorf("unknown SRTP profile %q", name)
+			}
+			profiles = append(profiles, profile)
+		}
+		e.SetSRTPProtectionProfiles(profiles...)
+	}
+	if len(cfg.DTLSCurves) > 0 {
+		curves := make([]dtlsElliptic.Curve, 0, len(cfg.DTLSCurves))
+		for _, name := range cfg.DTLSCurves {
+			curve, ok := dtlsCurveNames[name]
+			if !ok {
+				return fmt.Errorf("unknown DTLS curve %q", name)
+			}
+			curves = append(curves, curve)
+		}
+		e.SetDTLSEllipticCurves(curves...)
+	}
+	if cfg.RequireExtendedMasterSecret {
+		e.SetDTLSExtendedMasterSecret(dtls.RequireExtendedMasterSecret)
+	}
+	return nil
+}
+
+// newPeerConnection is webrtc.NewPeerConnection with the host's settings,
+// for the peers of co-op guests and spectators, who get the colors of the
+// session they watch
+func newPeerConnection(config webrtc.Configuration, colors colorSettings) (*webrtc.PeerConnection, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	if err := registerPixelFormatCodecs(m); err != nil {
+		return nil, err
+	}
+	if err := registerColorSpaceExtension(m); err != nil {
+		return nil, err
+	}
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+	i.Add(colorSpaceFactory{colors})
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(settingEngine))
+	return api.NewPeerConnection(config)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// End-to-end encryption of video frames with SFrame (RFC 9605), so media
+// relayed through an SFU or TURN server run by someone else stays private.
+// Sessions that offer "e2ee" encrypt every frame with the host's E2EE key
+// before it is packetized. The key never travels with signaling: the host
+// shows it at GET /e2ee and users bring it to their clients themselves,
+// e.g. in the #e2ee= fragment of the web client's URL.
+//
+// Only VP8 is supported. Receivers depacketize VP8 by its payload header,
+// so the first bytes of each frame stay in the clear, as in other WebRTC
+// E2EE schemes, and are authenticated as SFrame metadata.
+
+var e2eeKeyFile = "e2ee-key.json"
+
+// The SFrame cipher suite AES_128_GCM_SHA256_128
+const (
+	sframeSuite    = 0x0004
+	sframeKeySize  = 16
+	sframeSaltSize = 12
+)
+
+// e2eeKey is the key sessions encrypt with; rotating it gives it a new ID
+// so clients holding several keys can tell frames apart
+type e2eeKey struct {
+	KeyID uint64 `json:"kid"`
+	Key   []byte `json:"key"`
+}
+
+var (
+	currentE2EEKey *e2eeKey
+	e2eeKeyLock    sync.Mutex
+)
+
+// getE2EEKey returns the host's key, creating it on first use
+func getE2EEKey() (*e2eeKey, error) {
+	e2eeKeyLock.Lock()
+	defer e2eeKeyLock.Unlock()
+	if currentE2EEKey != nil {
+		return currentE2EEKey, nil
+	}
+
+	data, err := os.ReadFile(e2eeKeyFile)
+	if err == nil {
+		var key e2eeKey
+		if err := json.Unmarshal(data, &key); err != nil || len(key.Key) != sframeKeySize {
+			return nil, errors.New("invalid " + e2eeKeyFile)
+		}
+		currentE2EEKey = &key
+		return currentE2EEKey, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return rotateE2EEKeyLocked(0)
+}
+
+// rotateE2EEKeyLocked must be called with e2eeKeyLock held
+func rotateE2EEKeyLocked(keyID uint64) (*e2eeKey, error) {
+	key := &e2eeKey{KeyID: keyID, Key: make([]byte, sframeKeySize)}
+	rand.Read(key.Key)
+	data, _ := json.Marshal(key)
+	if err := os.WriteFile(e2eeKeyFile, data, 0600); err != nil {
+		return nil, err
+	}
+	currentE2EEKey = key
+	log.Printf("[E2EE] Key %d created", keyID)
+	return key, nil
+}
+
+// sframeEncryptor encrypts the frames of one session. Its tracks share
+// the counter, so no two frames get the same nonce.
+type sframeEncryptor struct {
+	keyID uint64
+	aead  cipher.AEAD
+	salt  []byte
+	ctr   atomic.Uint64
+}
+
+func newSFrameEncryptor(key *e2eeKey) (*sframeEncryptor, error) {
+	// Labels end in the key ID and cipher suite, big-endian
+	suffix := binary.BigEndian.AppendUint64(nil, key.KeyID)
+	suffix = binary.BigEndian.AppendUint16(suffix, sframeSuite)
+
+	secret, err := hkdf.Extract(sha256.New, key.Key, nil)
+	if err != nil {
+		return nil, err
+	}
+	sframeKey, err := hkdf.Expand(sha256.New, secret, "SFrame 1.0 Secret key "+string(suffix), sframeKeySize)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := hkdf.Expand(sha256.New, secret, "SFrame 1.0 Secret salt "+string(suffix), sframeSaltSize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(sframeKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sframeEncryptor{keyID: key.KeyID, aead: aead, salt: salt}, nil
+}
+
+// sframeHeader encodes the key ID and counter: values up to 7 fit in the
+// config byte, larger ones follow it in as few bytes as they need
+func sframeHeader(keyID, ctr uint64) []byte {
+	header := []byte{0}
+	field := func(v uint64, shift uint) {
+		if v < 8 {
+			header[0] |= byte(v) << shift
+			return
+		}
+		b := binary.BigEndian.AppendUint64(nil, v)
+		for len(b) > 1 && b[0] == 0 {
+			b = b[1:]
+		}
+		header[0] |= (0x8 | byte(len(b)-1)) << shift
+		header = append(header, b...)
+	}
+	field(keyID, 4)
+	field(ctr, 0)
+	return header
+}
+
+// encrypt returns the frame with its first clear bytes as they are,
+// followed by the SFrame header and the encrypted rest
+func (e *sframeEncryptor) encrypt(frame []byte, clear int) []byte {
+	clear = min(clear, len(frame))
+	ctr := e.ctr.Add(1) - 1
+	header := sframeHeader(e.keyID, ctr)
+	nonce := make([]byte, sframeSaltSize)
+	binary.BigEndian.PutUint64(nonce[sframeSaltSize-8:], ctr)
+	for i := range nonce {
+		nonce[i] ^= e.salt[i]
+	}
+
+	// The clear bytes are the frame's metadata, authenticated with the
+	// header
+	aad := append(append([]byte{}, header...), frame[:clear]...)
+	out := make([]byte, 0, len(frame)+len(header)+e.aead.Overhead())
+	out = append(out, frame[:clear]...)
+	out = append(out, header...)
+	return e.aead.Seal(out, nonce, frame[clear:], aad)
+}
+
+// vp8ClearBytes is how much of a VP8 frame stays readable: the frame tag,
+// plus the start code and size on keyframes
+func vp8ClearBytes(frame []byte) int {
+	if len(frame) > 0 && frame[0]&0x01 == 0 {
+		return 10
+	}
+	return 3
+}
+
+// handleE2EEKey shows the host's E2EE key to bring to clients; POST
+// replaces it. Host only.
+func handleE2EEKey(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "The E2EE key can only be read from the host")
+		return
+	}
+
+	key, err := getE2EEKey()
+	if err == nil && r.Method == http.MethodPost {
+		e2eeKeyLock.Lock()
+		key, err = rotateE2EEKeyLocked(key.KeyID + 1)
+		e2eeKeyLock.Unlock()
+		if err == nil {
+			auditRequest(r, "e2ee_rotate", "", map[string]interface{}{"kid": key.KeyID})
+		}
+	}
+	if err != nil {
+		log.Printf("[E2EE] Error loading key: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error loading the E2EE key")
+		return
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(key.Key)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"kid":      key.KeyID,
+		"key":      encoded,
+		"fragment": "#e2ee=" + encoded,
+	})
+}
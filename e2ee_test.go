@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestSFrameHeader(t *testing.T) {
+	// The config byte is X K K K Y C C C: values up to 7 go in K or C,
+	// longer ones set X or Y and K or C holds their length less one
+	tests := []struct {
+		keyID, ctr uint64
+		want       string
+	}{
+		{0, 0, "00"},
+		{0, 7, "07"},
+		{7, 0, "70"},
+		{5, 3, "53"},
+		{0, 8, "0808"},
+		{0, 0xff, "08ff"},
+		{0, 0x100, "090100"},
+		{8, 0, "8008"},
+		{0xffff, 1, "91ffff"},
+		{1, 0x0123456789abcdef, "1f0123456789abcdef"},
+		{0x0123456789abcdef, 0xffffffffffffffff, "ff0123456789abcdefffffffffffffffff"},
+	}
+	for _, test := range tests {
+		if got := hex.EncodeToString(sframeHeader(test.keyID, test.ctr)); got != test.want {
+			t.Errorf("sframeHeader(%#x, %#x) = %s, want %s", test.keyID, test.ctr, got, test.want)
+		}
+	}
+}
+
+// sframeOpen decrypts a frame as a receiver does, following RFC 9605
+func sframeOpen(key *e2eeKey, data []byte, clear int) (plain []byte, keyID, ctr uint64, err error) {
+	if len(data) < clear+1 {
+		return nil, 0, 0, errors.New("short frame")
+	}
+	metadata, rest := data[:clear], data[clear:]
+	config := rest[0]
+	read := func(v byte, extended bool) (uint64, error) {
+		if !extended {
+			return uint64(v), nil
+		}
+		n := int(v) + 1
+		if len(rest) < 1+n {
+			return 0, errors.New("short header")
+		}
+		var x uint64
+		for _, b := range rest[1 : 1+n] {
+			x = x<<8 | uint64(b)
+		}
+		rest = rest[n:]
+		return x, nil
+	}
+	header := rest
+	if keyID, err = read(config>>4&0x7, config&0x80 != 0); err != nil {
+		return nil, 0, 0, err
+	}
+	if ctr, err = read(config&0x7, config&0x08 != 0); err != nil {
+		return nil, 0, 0, err
+	}
+	rest = rest[1:]
+	header = header[:len(header)-len(rest)]
+	if keyID != key.KeyID {
+		return nil, 0, 0, errors.New("unknown key ID")
+	}
+
+	suffix := []byte{
+		byte(keyID >> 56), byte(keyID >> 48), byte(keyID >> 40), byte(keyID >> 32),
+		byte(keyID >> 24), byte(keyID >> 16), byte(keyID >> 8), byte(keyID),
+		0x00, 0x04, // AES_128_GCM_SHA256_128
+	}
+	secret, _ := hkdf.Extract(sha256.New, key.Key, nil)
+	sframeKey, _ := hkdf.Expand(sha256.New, secret, "SFrame 1.0 Secret key "+string(suffix), 16)
+	salt, _ := hkdf.Expand(sha256.New, secret, "SFrame 1.0 Secret salt "+string(suffix), 12)
+	nonce := append([]byte(nil), salt...)
+	for i := 0; i < 8; i++ {
+		nonce[11-i] ^= byte(ctr >> (8 * i))
+	}
+
+	block, _ := aes.NewCipher(sframeKey)
+	aead, _ := cipher.NewGCM(block)
+	aad := append(append([]byte(nil), header...), metadata...)
+	plain, err = aead.Open(nil, nonce, rest, aad)
+	return plain, keyID, ctr, err
+}
+
+func TestSFrameEncrypt(t *testing.T) {
+	key := &e2eeKey{KeyID: 9, Key: bytes.Repeat([]byte{0x42}, sframeKeySize)}
+	e, err := newSFrameEncryptor(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyframe := append([]byte{0x50, 0x42, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01}, bytes.Repeat([]byte{0xaa}, 100)...)
+	interframe := append([]byte{0x31, 0x05, 0x00}, bytes.Repeat([]byte{0xbb}, 50)...)
+	tests := []struct {
+		name  string
+		frame []byte
+		clear int
+	}{
+		{"keyframe", keyframe, 10},
+		{"interframe", interframe, 3},
+		{"all clear", []byte{0x31, 0x05}, 3},
+		{"none clear", []byte{0x01, 0x02, 0x03}, 0},
+	}
+	for i, test := range tests {
+		sealed := e.encrypt(test.frame, test.clear)
+		clear := min(test.clear, len(test.frame))
+		if !bytes.Equal(sealed[:clear], test.frame[:clear]) {
+			t.Errorf("%s: clear bytes %x, want %x", test.name, sealed[:clear], test.frame[:clear])
+		}
+		if want := len(test.frame) + len(sframeHeader(key.KeyID, uint64(i))) + 16; len(sealed) != want {
+			t.Errorf("%s: %d bytes encrypted, want %d", test.name, len(sealed), want)
+		}
+
+		plain, keyID, ctr, err := sframeOpen(key, sealed, clear)
+		if err != nil {
+			t.Errorf("%s: decrypting: %v", test.name, err)
+			continue
+		}
+		if keyID != key.KeyID || ctr != uint64(i) {
+			t.Errorf("%s: key %d counter %d, want key %d counter %d", test.name, keyID, ctr, key.KeyID, i)
+		}
+		if !bytes.Equal(plain, test.frame[clear:]) {
+			t.Errorf("%s: decrypted %x, want %x", test.name, plain, test.frame[clear:])
+		}
+	}
+}
+
+func TestVP8ClearBytes(t *testing.T) {
+	tests := []struct {
+		frame []byte
+		want  int
+	}{
+		{[]byte{0x50, 0x42, 0x00, 0x9d, 0x01, 0x2a}, 10}, // Keyframe
+		{[]byte{0x31, 0x05, 0x00}, 3},
+		{nil, 3},
+	}
+	for _, test := range tests {
+		if got := vp8ClearBytes(test.frame); got != test.want {
+			t.Errorf("vp8ClearBytes(%x) = %d, want %d", test.frame, got, test.want)
+		}
+	}
+}
+
+func TestSFrameAuthenticates(t *testing.T) {
+	key := &e2eeKey{KeyID: 1, Key: bytes.Repeat([]byte{0x17}, sframeKeySize)}
+	e, _ := newSFrameEncryptor(key)
+	frame := append([]byte{0x31, 0x05, 0x00}, bytes.Repeat([]byte{0xcc}, 20)...)
+	sealed := e.encrypt(frame, 3)
+
+	for _, i := range []int{
+		0,               // The clear VP8 payload header
+		3,               // The SFrame header
+		len(sealed) / 2, // The ciphertext
+		len(sealed) - 1, // The tag
+	} {
+		tampered := append([]byte(nil), sealed...)
+		tampered[i] ^= 0x01
+		if _, _, _, err := sframeOpen(key, tampered, 3); err == nil {
+			t.Errorf("changing byte %d went unnoticed", i)
+		}
+	}
+
+	other := &e2eeKey{KeyID: 1, Key: bytes.Repeat([]byte{0x18}, sframeKeySize)}
+	if _, _, _, err := sframeOpen(other, sealed, 3); err == nil {
+		t.Error("decrypting with another key succeeded")
+	}
+}
+
+func TestSFrameNoncesDiffer(t *testing.T) {
+	key := &e2eeKey{KeyID: 0, Key: make([]byte, sframeKeySize)}
+	e, _ := newSFrameEncryptor(key)
+	frame := []byte{0x31, 0x05, 0x00, 0x01, 0x02, 0x03}
+	seen := make(map[string]bool)
+	for i := 0; i < 300; i++ {
+		sealed := string(e.encrypt(frame, 3))
+		if seen[sealed] {
+			t.Fatalf("frame %d encrypted the same as an earlier one", i)
+		}
+		seen[sealed] = true
+	}
+}
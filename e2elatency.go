@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Glass-to-glass latency mode burns the capture wallclock into every frame as
+// a strip of black/white blocks in the top-left corner. Block i (left to
+// right) is white when bit i of the capture time in Unix milliseconds is set;
+// only the low latencyCodeBits bits are encoded, the server recovers the rest
+// from its own clock. The client samples the strip when the frame is shown
+// and reports it to POST /sessions/{id}/latency.
+const (
+	latencyCodeBits      = 24 // Wraps every ~4.6 hours
+	latencyCodeBlockSize = 16 // Pixels per block edge
+	maxGlassToGlassMs    = 10000
+)
+
+// latencyOverlayFilters returns the filter chain drawing the capture-time
+// barcode. Requires input timestamps to be wallclock (-use_wallclock_as_timestamps)
+// and preserved through the graph (-copyts).
+func latencyOverlayFilters() []string {
+	filters := []string{
+		fmt.Sprintf("drawbox=x=0:y=0:w=%d:h=%d:color=black:t=fill",
+			latencyCodeBits*latencyCodeBlockSize, latencyCodeBlockSize),
+	}
+	for bit := 0; bit < latencyCodeBits; bit++ {
+		filters = append(filters, fmt.Sprintf(
+			"drawbox=x=%d:y=0:w=%d:h=%d:color=white:t=fill:enable='eq(mod(floor(t*1000/%d),2),1)'",
+			bit*latencyCodeBlockSize, latencyCodeBlockSize, latencyCodeBlockSize, 1<<bit))
+	}
+	return filters
+}
+
+// decodeCaptureTime expands a latency code back to a full Unix millisecond
+// timestamp, assuming the frame was captured less than one wrap ago
+func decodeCaptureTime(code int64, now time.Time) int64 {
+	const wrap = int64(1) << latencyCodeBits
+	nowMs := now.UnixMilli()
+	age := ((nowMs%wrap - code) + wrap) % wrap
+	return nowMs - age
+}
+
+type LatencyReport struct {
+	Code      int64   `json:"code"`       // Barcode value read from the frame
+	DisplayTS float64 `json:"display_ts"` // Client clock, Unix epoch milliseconds
+}
+
+func handleLatencyReport(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+
+	session, exists := getSession(sessionID)
+	if !exists {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	if !session.canManage(r) {
+		writeError(w, http.StatusForbidden, "not_owner", "Only the session owner can report its latency")
+		return
+	}
+	if !session.LatencyOverlay {
+		writeError(w, http.StatusConflict, "latency_overlay_disabled", "Latency overlay not enabled for this session")
+		return
+	}
+
+	var report LatencyReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+	if report.Code < 0 || report.Code >= 1<<latencyCodeBits {
+		writeError(w, http.StatusBadRequest, "invalid_latency_code", "Invalid latency code")
+		return
+	}
+
+	displayedAt, ok := session.Latency.toServerTime(report.DisplayTS)
+	if !ok {
+		writeError(w, http.StatusConflict, "clock_offset_unknown", "Clock offset unknown; open the ping channel first")
+		return
+	}
+
+	capturedAt := decodeCaptureTime(report.Code, time.Now())
+	latency := displayedAt - float64(capturedAt)
+	if latency < 0 || latency > maxGlassToGlassMs || math.IsNaN(latency) {
+		// Most likely a misread barcode
+		writeError(w, http.StatusUnprocessableEntity, "implausible_sample", "Implausible latency sample")
+		return
+	}
+
+	session.Latency.addGlassToGlass(latency)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id":        sessionID,
+		"glass_to_glass_ms": latency,
+		"captured_at_ms":    capturedAt,
+		"displayed_at_ms":   displayedAt,
+	})
+}
@@ -0,0 +1,127 @@
+//go:build cgo && x264
+
+package main
+
+/*
+#cgo pkg-config: x264
+#include <stdint.h>
+#include <stdlib.h>
+#include <x264.h>
+
+// x264_encoder_open is a macro naming the build's ABI version
+static x264_t *open_encoder(x264_param_t *param) {
+	return x264_encoder_open(param);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+func init() {
+	registerInProcessSource("testsrc-x264", "", newTestPatternGrabber, newX264Encoder)
+}
+
+// x264Encoder calls libx264 with the settings the FFmpeg sources use
+type x264Encoder struct {
+	handle *C.x264_t
+	pic    C.x264_picture_t
+	width  int
+	height int
+}
+
+func newX264Encoder(cfg CaptureConfig) (videoEncoder, error) {
+	width, height := cfg.outputSize()
+	e := &x264Encoder{width: width &^ 1, height: height &^ 1}
+
+	preset := C.CString("ultrafast")
+	tune := C.CString("zerolatency")
+	profile := C.CString("baseline") // What the track's SDP announces
+	defer C.free(unsafe.Pointer(preset))
+	defer C.free(unsafe.Pointer(tune))
+	defer C.free(unsafe.Pointer(profile))
+
+	var param C.x264_param_t
+	if C.x264_param_default_preset(&param, preset, tune) < 0 {
+		return nil, errors.New("x264: invalid preset")
+	}
+	param.i_csp = C.X264_CSP_I420
+	param.i_width = C.int(e.width)
+	param.i_height = C.int(e.height)
+	param.i_fps_num = C.uint32_t(cfg.FPS)
+	param.i_fps_den = 1
+	param.i_keyint_max = C.int(cfg.gop())
+	param.i_keyint_min = C.int(min(cfg.FPS, cfg.gop()))
+	param.b_repeat_headers = 1 // SPS/PPS before every keyframe for late joiners
+	param.b_annexb = 1
+	if cfg.IntraRefresh {
+		param.b_intra_refresh = 1
+	}
+	if cfg.Threads > 0 {
+		param.i_threads = C.int(cfg.Threads)
+	}
+	if cfg.Slices > 0 {
+		param.i_slice_count = C.int(cfg.Slices)
+	}
+	param.rc.i_rc_method = C.X264_RC_CRF
+	param.rc.f_rf_constant = 23
+	param.rc.i_vbv_max_bitrate = C.int(cfg.maxKbps())
+	param.rc.i_vbv_buffer_size = C.int(2 * cfg.maxKbps())
+	if C.x264_param_apply_profile(&param, profile) < 0 {
+		return nil, errors.New("x264: invalid profile")
+	}
+
+	e.handle = C.open_encoder(&param)
+	if e.handle == nil {
+		return nil, errors.New("x264: error opening encoder")
+	}
+	if C.x264_picture_alloc(&e.pic, C.X264_CSP_I420, C.int(e.width), C.int(e.height)) < 0 {
+		C.x264_encoder_close(e.handle)
+		return nil, errors.New("x264: error allocating picture")
+	}
+	return e, nil
+}
+
+func (e *x264Encoder) encode(frame *rawFrame, pts int64, keyframe bool) ([][]byte, error) {
+	// Copy into x264's planes; its strides may be padded
+	planes := [][]byte{frame.y, frame.u, frame.v}
+	for i, plane := range planes {
+		width, height := e.width, e.height
+		if i > 0 {
+			width, height = width/2, height/2
+		}
+		stride := int(e.pic.img.i_stride[i])
+		dst := unsafe.Slice((*byte)(unsafe.Pointer(e.pic.img.plane[i])), stride*height)
+		for y := 0; y < height; y++ {
+			copy(dst[y*stride:y*stride+width], plane[y*width:])
+		}
+	}
+	e.pic.i_pts = C.int64_t(pts)
+	// A requested keyframe is forced here rather than by reopening the
+	// encoder, so the picture does not pause
+	e.pic.i_type = C.X264_TYPE_AUTO
+	if keyframe {
+		e.pic.i_type = C.X264_TYPE_IDR
+	}
+
+	var nals *C.x264_nal_t
+	var count C.int
+	var out C.x264_picture_t
+	if C.x264_encoder_encode(e.handle, &nals, &count, &e.pic, &out) < 0 {
+		return nil, errors.New("x264: error encoding frame")
+	}
+
+	result := make([][]byte, 0, int(count))
+	for _, nal := range unsafe.Slice(nals, int(count)) {
+		result = append(result, unsafe.Slice((*byte)(unsafe.Pointer(nal.p_payload)), int(nal.i_payload)))
+	}
+	return result, nil
+}
+
+func (e *x264Encoder) close() error {
+	C.x264_picture_clean(&e.pic)
+	C.x264_encoder_close(e.handle)
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Forward error correction for the session's video: when the browser
+// negotiates red and ulpfec, every media packet is wrapped in RED (RFC 2198)
+// and after each frame ULPFEC (RFC 5109) parity packets follow, so the
+// receiver can rebuild lost packets without waiting for a retransmission.
+// Adaptive encoding sets how many.
+//
+// Two interceptors share the work. The outer one sees packets first: it
+// wraps them and numbers them, leaving sequence numbers free for the parity
+// packets. The inner one sees them as they go on the wire, header
+// extensions included, computes the parity and sends it in the gaps.
+
+const (
+	mimeTypeRED    = "video/red"
+	mimeTypeULPFEC = "video/ulpfec"
+
+	// Offered only if the browser offers none; answers use its types
+	redPayloadType    = 116
+	ulpfecPayloadType = 117
+
+	// ULPFEC's short mask covers 16 packets
+	fecMaxGroup = 16
+)
+
+// registerFECCodecs lets answers accept red and ulpfec for video
+func registerFECCodecs(m *webrtc.MediaEngine) error {
+	for _, c := range []webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeRED, ClockRate: 90000}, PayloadType: redPayloadType},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeULPFEC, ClockRate: 90000}, PayloadType: ulpfecPayloadType},
+	} {
+		if err := m.RegisterCodec(c, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ulpfec protects one peer connection's video
+type ulpfec struct {
+	// Negotiated payload types, 0 until known or if not negotiated
+	red, fec atomic.Uint32
+
+	// stats holds the FEC percentage to send and counts what was sent
+	stats *PipelineStats
+}
+
+// fecMark tells the inner interceptor where groups of media packets start
+// and, on the last packet of one, how many parity packets follow
+type fecMark struct {
+	start  bool
+	parity int
+}
+
+type fecAttributeKey struct{}
+
+// setPayloadTypes reads the negotiated red and ulpfec types from sender
+func (f *ulpfec) setPayloadTypes(sender *webrtc.RTPSender) {
+	var red, fec webrtc.PayloadType
+	for _, c := range sender.GetParameters().Codecs {
+		switch strings.ToLower(c.MimeType) {
+		case mimeTypeRED:
+			red = c.PayloadType
+		case mimeTypeULPFEC:
+			fec = c.PayloadType
+		}
+	}
+	if red != 0 && fec != 0 {
+		f.red.Store(uint32(red))
+		f.fec.Store(uint32(fec))
+	}
+}
+
+func (f *ulpfec) payloadTypes() (red, fec uint8, ok bool) {
+	red, fec = uint8(f.red.Load()), uint8(f.fec.Load())
+	return red, fec, red != 0 && fec != 0 && f.stats != nil
+}
+
+// outer and inner are the interceptor factories, registered last and
+// first so the NACK, report and TWCC interceptors sit between them
+func (f *ulpfec) outer() interceptor.Factory { return fecFactory{&fecOuter{ulpfec: f}} }
+func (f *ulpfec) inner() interceptor.Factory { return fecFactory{&fecInner{ulpfec: f}} }
+
+type fecFactory struct{ i interceptor.Interceptor }
+
+func (f fecFactory) NewInterceptor(string) (interceptor.Interceptor, error) { return f.i, nil }
+
+type fecOuter struct {
+	interceptor.NoOp
+	*ulpfec
+}
+
+func (o *fecOuter) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !strings.HasPrefix(strings.ToLower(info.MimeType), "video/") {
+		return writer
+	}
+
+	var (
+		mu      sync.Mutex
+		started bool
+		seq     uint16
+		grouped int
+		owed    int // Parity owed, in hundredths of a packet
+	)
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		red, _, ok := o.payloadTypes()
+		if !ok {
+			return writer.Write(header, payload, attributes)
+		}
+
+		mu.Lock()
+		if !started {
+			seq = header.SequenceNumber
+			started = true
+		}
+		wrapped := *header
+		wrapped.SequenceNumber = seq
+		wrapped.PayloadType = red
+		seq++
+
+		// Groups end with a frame once the parity owed reaches a whole
+		// packet, so small frames share one
+		mark := fecMark{start: grouped == 0}
+		grouped++
+		percent := int(o.stats.fecPercent.Load())
+		switch {
+		case percent <= 0:
+			grouped, owed = 0, 0
+		default:
+			owed += percent
+			if header.Marker || grouped == fecMaxGroup {
+				mark.parity = min(owed/100, grouped)
+				owed -= mark.parity * 100
+				if mark.parity > 0 || grouped == fecMaxGroup {
+					seq += uint16(mark.parity)
+					grouped = 0
+				}
+			}
+		}
+		mu.Unlock()
+
+		if attributes == nil {
+			attributes = interceptor.Attributes{}
+		}
+		attributes.Set(fecAttributeKey{}, mark)
+
+		body := make([]byte, 1+len(payload))
+		body[0] = header.PayloadType & 0x7f // Last block: F bit clear
+		copy(body[1:], payload)
+		if _, err := writer.Write(&wrapped, body, attributes); err != nil {
+			return 0, err
+		}
+		return len(payload), nil
+	})
+}
+
+type fecInner struct {
+	interceptor.NoOp
+	*ulpfec
+}
+
+func (in *fecInner) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !strings.HasPrefix(strings.ToLower(info.MimeType), "video/") {
+		return writer
+	}
+
+	var (
+		mu    sync.Mutex
+		group [][]byte // Media packets as the receiver sees them after RED
+		base  uint16
+	)
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		n, err := writer.Write(header, payload, attributes)
+
+		// Retransmissions and unwrapped packets carry no mark
+		mark, ok := attributes.Get(fecAttributeKey{}).(fecMark)
+		red, fecType, negotiated := in.payloadTypes()
+		if !ok || !negotiated || len(payload) == 0 {
+			return n, err
+		}
+
+		media := *header
+		media.PayloadType = payload[0] & 0x7f
+		raw, marshalErr := media.Marshal()
+		if marshalErr != nil {
+			return n, err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if mark.start {
+			group = group[:0]
+			base = header.SequenceNumber
+		}
+		if len(group) == fecMaxGroup {
+			return n, err // Lost a group start; wait for the next
+		}
+		group = append(group, append(raw, payload[1:]...))
+
+		if mark.parity > 0 {
+			for i := 0; i < mark.parity; i++ {
+				fecHeader := rtp.Header{
+					Version:        2,
+					PayloadType:    red,
+					SequenceNumber: header.SequenceNumber + uint16(i) + 1,
+					Timestamp:      header.Timestamp,
+					SSRC:           header.SSRC,
+				}
+				body := append([]byte{fecType}, ulpfecPayload(group, base, i, mark.parity)...)
+				if _, fecErr := writer.Write(&fecHeader, body, interceptor.Attributes{}); fecErr == nil {
+					in.stats.fecSent.Add(1)
+				}
+			}
+			group = group[:0]
+		}
+		return n, err
+	})
+}
+
+// ulpfecPayload builds parity packet index of count over group, whose
+// first packet has sequence number base. Parity packet i covers every
+// count-th packet starting at i, which suits scattered loss.
+func ulpfecPayload(group [][]byte, base uint16, index, count int) []byte {
+	var protected [][]byte
+	var mask uint16
+	protectionLength := 0
+	for j := index; j < len(group); j += count {
+		protected = append(protected, group[j])
+		mask |= 1 << (15 - j)
+		if l := len(group[j]) - 12; l > protectionLength {
+			protectionLength = l
+		}
+	}
+
+	// FEC header (10 bytes) and level 0 header with a 16-bit mask (4 bytes)
+	out := make([]byte, 14+protectionLength)
+	var lengthRecovery uint16
+	for _, p := range protected {
+		out[0] ^= p[0]
+		out[1] ^= p[1]
+		for k := 0; k < 4; k++ {
+			out[4+k] ^= p[4+k] // Timestamp
+		}
+		lengthRecovery ^= uint16(len(p) - 12)
+		for k, b := range p[12:] {
+			out[14+k] ^= b
+		}
+	}
+	out[0] &= 0x3f // E and L clear, P, X and CC recovered
+	out[2], out[3] = byte(base>>8), byte(base)
+	out[8], out[9] = byte(lengthRecovery>>8), byte(lengthRecovery)
+	out[10], out[11] = byte(protectionLength>>8), byte(protectionLength)
+	out[12], out[13] = byte(mask>>8), byte(mask)
+	return out
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each session's FFmpeg output goes to a file of its own in logs/, so one
+// session's encoder can be followed without the others' interleaved. A
+// file rotates to .1 once it passes ffmpegLogMaxSize, and files untouched
+// for ffmpegLogMaxAge are removed when the next session's log opens.
+
+var ffmpegLogDir = "logs"
+
+const (
+	ffmpegLogMaxSize = 4 << 20
+	ffmpegLogMaxAge  = 7 * 24 * time.Hour
+)
+
+// ffmpegLog is a session's FFmpeg log file, opened on its first line
+type ffmpegLog struct {
+	path string
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	failed bool // Could not be written; lines go to the main log
+	closed bool // The session is over; FFmpeg's last lines still come
+}
+
+func newFFmpegLog(sessionID string) *ffmpegLog {
+	return &ffmpegLog{path: filepath.Join(ffmpegLogDir, sessionID+".ffmpeg.log")}
+}
+
+// logFFmpeg writes a line of a session's FFmpeg, from the named capture,
+// to the session's log; sessions without one log it with the rest
+func (s *StreamSession) logFFmpeg(source, line string) {
+	if s.ffmpegLog != nil && s.ffmpegLog.write(source, line) {
+		return
+	}
+	log.Printf("[Session %s] FFMPEG: %s", s.ID, line)
+}
+
+// write reports whether the line was written
+func (l *ffmpegLog) write(source, line string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failed {
+		return false
+	}
+	if err := l.writeLocked(source, line); err != nil {
+		log.Printf("Error writing %s, logging FFmpeg here: %v", l.path, err)
+		l.failed = true
+		return false
+	}
+	if l.closed {
+		l.file.Close()
+		l.file = nil
+	}
+	return true
+}
+
+func (l *ffmpegLog) writeLocked(source, line string) error {
+	if l.file == nil {
+		if err := os.MkdirAll(ffmpegLogDir, 0o755); err != nil {
+			return err
+		}
+		pruneFFmpegLogs()
+		if err := l.openLocked(); err != nil {
+			return err
+		}
+	}
+	entry := fmt.Sprintf("%s [%s] %s\n", time.Now().Format("2006/01/02 15:04:05"), source, line)
+	if l.size+int64(len(entry)) > ffmpegLogMaxSize {
+		l.file.Close()
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+		if err := l.openLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.WriteString(entry)
+	l.size += int64(n)
+	return err
+}
+
+func (l *ffmpegLog) openLocked() error {
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		l.file = nil
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		l.file = nil
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+func (l *ffmpegLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// tail returns the last n lines of the log
+func (l *ffmpegLog) tail(n int) []string {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	const window = 16 << 10
+	if info, err := file.Stat(); err == nil && info.Size() > window {
+		file.Seek(info.Size()-window, io.SeekStart)
+	}
+	data, _ := io.ReadAll(file)
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// pruneFFmpegLogs removes the logs of sessions long over
+func pruneFFmpegLogs() {
+	entries, err := os.ReadDir(ffmpegLogDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !strings.Contains(entry.Name(), ".ffmpeg.log") {
+			continue
+		}
+		info, err := entry.Info()
+		if err == nil && time.Since(info.ModTime()) > ffmpegLogMaxAge {
+			os.Remove(filepath.Join(ffmpegLogDir, entry.Name()))
+		}
+	}
+}
+
+// handleFFmpegLog serves a session's FFmpeg log. Its owner reads it while
+// the session runs; admins read it until it is pruned.
+func handleFFmpegLog(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	session, ok := getSession(id)
+	switch {
+	case ok && !session.canManage(r):
+		writeError(w, http.StatusForbidden, "not_owner", "Only the session owner can read its FFmpeg log")
+		return
+	case !ok && !isAdmin(r):
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	case !strings.HasPrefix(id, "session_") || filepath.Base(id) != id:
+		writeError(w, http.StatusNotFound, "log_not_found", "No FFmpeg log for the session")
+		return
+	}
+
+	file, err := os.Open(newFFmpegLog(id).path)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "log_not_found", "No FFmpeg log for the session")
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
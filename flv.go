@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// FFmpeg sources write FLV rather than a raw H.264 stream: every tag
+// carries its size and timestamp, and the video inside is length-prefixed,
+// so frames are read whole instead of searching for start codes.
+
+const (
+	flvTagVideo = 9
+
+	flvCodecAVC = 7
+
+	flvAVCSequenceHeader = 0
+	flvAVCNALU           = 1
+)
+
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// flvReader turns an FLV stream of H.264 video into access units
+type flvReader struct {
+	r        *bufio.Reader
+	hdr      [11]byte
+	buf      []byte
+	maxFrame int
+
+	headerRead bool
+	lengthSize int
+	sps, pps   [][]byte // From the sequence header, repeated before keyframes
+
+	started bool
+	lastTS  uint32
+	dts     time.Duration
+}
+
+func newFLVReader(r io.Reader, buffers pipelineBuffers) *flvReader {
+	return &flvReader{r: bufio.NewReaderSize(r, buffers.readBuffer), maxFrame: buffers.maxFrame}
+}
+
+// next returns the next video frame as Annex-B NAL units
+func (f *flvReader) next() (AccessUnit, error) {
+	if !f.headerRead {
+		if err := f.readHeader(); err != nil {
+			return AccessUnit{}, err
+		}
+		f.headerRead = true
+	}
+
+	for {
+		if _, err := io.ReadFull(f.r, f.hdr[:]); err != nil {
+			return AccessUnit{}, flvReadError(err)
+		}
+		tagType := f.hdr[0] & 0x1f
+		size := int(f.hdr[1])<<16 | int(f.hdr[2])<<8 | int(f.hdr[3])
+		ts := uint32(f.hdr[7])<<24 | uint32(f.hdr[4])<<16 | uint32(f.hdr[5])<<8 | uint32(f.hdr[6])
+
+		// Tags are at most 16 MB, so even 4K keyframes fit in one read
+		if size > f.maxFrame {
+			return AccessUnit{}, fmt.Errorf("FLV tag of %d bytes is over the %d byte frame limit", size, f.maxFrame)
+		}
+		if cap(f.buf) < size+4 {
+			f.buf = make([]byte, size+4)
+		}
+		data := f.buf[:size+4] // Plus the trailing previous tag size
+		if _, err := io.ReadFull(f.r, data); err != nil {
+			return AccessUnit{}, flvReadError(err)
+		}
+		data = data[:size]
+
+		if tagType != flvTagVideo {
+			continue // onMetaData; there is no audio
+		}
+		au, ok, err := f.parseVideo(data, f.timestamp(ts))
+		if err != nil || ok {
+			return au, err
+		}
+	}
+}
+
+func (f *flvReader) readHeader() error {
+	var hdr [9]byte
+	if _, err := io.ReadFull(f.r, hdr[:]); err != nil {
+		return flvReadError(err)
+	}
+	if string(hdr[:3]) != "FLV" {
+		return errors.New("not an FLV stream")
+	}
+	// Skip any header extension and the first previous tag size
+	skip := int(binary.BigEndian.Uint32(hdr[5:9])) - len(hdr) + 4
+	if skip < 4 {
+		return errors.New("invalid FLV header size")
+	}
+	if _, err := f.r.Discard(skip); err != nil {
+		return flvReadError(err)
+	}
+	return nil
+}
+
+// timestamp unwraps FLV's 32-bit milliseconds, which -copyts fills with
+// wall clock time, into time since the first tag
+func (f *flvReader) timestamp(ts uint32) time.Duration {
+	if f.started {
+		f.dts += time.Duration(int32(ts-f.lastTS)) * time.Millisecond
+	}
+	f.started = true
+	f.lastTS = ts
+	return f.dts
+}
+
+func (f *flvReader) parseVideo(data []byte, dts time.Duration) (AccessUnit, bool, error) {
+	if len(data) < 5 {
+		return AccessUnit{}, false, errors.New("short FLV video tag")
+	}
+	if codec := data[0] & 0x0f; codec != flvCodecAVC {
+		return AccessUnit{}, false, fmt.Errorf("unsupported FLV video codec %d", codec)
+	}
+	keyframe := data[0]>>4 == 1
+	// Composition time offset, signed 24 bits
+	cts := int32(uint32(data[2])<<16|uint32(data[3])<<8|uint32(data[4])) << 8 >> 8
+	payload := data[5:]
+
+	switch data[1] {
+	case flvAVCSequenceHeader:
+		return AccessUnit{}, false, f.parseDecoderConfig(payload)
+	case flvAVCNALU:
+	default:
+		return AccessUnit{}, false, nil // End of sequence
+	}
+	if f.lengthSize == 0 {
+		return AccessUnit{}, false, errors.New("H.264 frame before sequence header")
+	}
+
+	au := AccessUnit{
+		PTS:      dts + time.Duration(cts)*time.Millisecond,
+		Keyframe: keyframe,
+	}
+	var out []byte
+	if keyframe {
+		for _, sets := range [][][]byte{f.sps, f.pps} {
+			for _, ps := range sets {
+				out = append(append(out, annexBStartCode...), ps...)
+			}
+		}
+	}
+	for len(payload) > 0 {
+		if len(payload) < f.lengthSize {
+			return AccessUnit{}, false, errors.New("truncated NAL unit length")
+		}
+		n := 0
+		for _, b := range payload[:f.lengthSize] {
+			n = n<<8 | int(b)
+		}
+		payload = payload[f.lengthSize:]
+		if n > len(payload) {
+			return AccessUnit{}, false, errors.New("truncated NAL unit")
+		}
+		out = append(append(out, annexBStartCode...), payload[:n]...)
+		payload = payload[n:]
+	}
+	au.Data = out
+	return au, len(out) > 0, nil
+}
+
+// parseDecoderConfig reads an AVCDecoderConfigurationRecord
+func (f *flvReader) parseDecoderConfig(b []byte) error {
+	errShort := errors.New("short AVC decoder configuration")
+	if len(b) < 6 {
+		return errShort
+	}
+	f.lengthSize = int(b[4]&0x03) + 1
+
+	readSets := func(count int) ([][]byte, error) {
+		var sets [][]byte
+		for i := 0; i < count; i++ {
+			if len(b) < 2 {
+				return nil, errShort
+			}
+			n := int(binary.BigEndian.Uint16(b))
+			if len(b) < 2+n {
+				return nil, errShort
+			}
+			sets = append(sets, append([]byte(nil), b[2:2+n]...))
+			b = b[2+n:]
+		}
+		return sets, nil
+	}
+
+	numSPS := int(b[5] & 0x1f)
+	b = b[6:]
+	sps, err := readSets(numSPS)
+	if err != nil {
+		return err
+	}
+	if len(b) < 1 {
+		return errShort
+	}
+	numPPS := int(b[0])
+	b = b[1:]
+	pps, err := readSets(numPPS)
+	if err != nil {
+		return err
+	}
+	f.sps, f.pps = sps, pps
+	return nil
+}
+
+// flvReadError keeps io.EOF for a stream that ends between tags
+func flvReadError(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("FLV stream cut short: %w", err)
+	}
+	return err
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flvStream builds an FLV stream the way FFmpeg writes one
+type flvStream struct {
+	bytes.Buffer
+}
+
+func newFLVStream() *flvStream {
+	s := &flvStream{}
+	s.Write([]byte{'F', 'L', 'V', 1, 0x01, 0, 0, 0, 9})
+	s.Write([]byte{0, 0, 0, 0}) // The first previous tag size
+	return s
+}
+
+func (s *flvStream) tag(tagType byte, ts uint32, data []byte) {
+	size := len(data)
+	s.Write([]byte{
+		tagType,
+		byte(size >> 16), byte(size >> 8), byte(size),
+		byte(ts >> 16), byte(ts >> 8), byte(ts), byte(ts >> 24),
+		0, 0, 0,
+	})
+	s.Write(data)
+	prev := 11 + size
+	s.Write([]byte{byte(prev >> 24), byte(prev >> 16), byte(prev >> 8), byte(prev)})
+}
+
+// sequenceHeader writes an AVCDecoderConfigurationRecord with NAL unit
+// lengths of lengthSize bytes; FFmpeg stamps it with the first frame's time
+func (s *flvStream) sequenceHeader(ts uint32, lengthSize int, sps, pps []byte) {
+	data := []byte{0x17, flvAVCSequenceHeader, 0, 0, 0}
+	data = append(data, 1, 0x64, 0, 0x1f, 0xfc|byte(lengthSize-1), 0xe1)
+	data = append(data, byte(len(sps)>>8), byte(len(sps)))
+	data = append(data, sps...)
+	data = append(data, 1, byte(len(pps)>>8), byte(len(pps)))
+	data = append(data, pps...)
+	s.tag(flvTagVideo, ts, data)
+}
+
+func (s *flvStream) frame(ts uint32, cts int32, keyframe bool, lengthSize int, nalus ...[]byte) {
+	frameType := byte(2)
+	if keyframe {
+		frameType = 1
+	}
+	data := []byte{frameType<<4 | flvCodecAVC, flvAVCNALU, byte(cts >> 16), byte(cts >> 8), byte(cts)}
+	for _, nalu := range nalus {
+		for i := lengthSize - 1; i >= 0; i-- {
+			data = append(data, byte(len(nalu)>>(8*i)))
+		}
+		data = append(data, nalu...)
+	}
+	s.tag(flvTagVideo, ts, data)
+}
+
+func annexB(nalus ...[]byte) []byte {
+	var out []byte
+	for _, nalu := range nalus {
+		out = append(append(out, annexBStartCode...), nalu...)
+	}
+	return out
+}
+
+var flvTestBuffers = pipelineBuffers{readBuffer: 4096, maxFrame: 1 << 16}
+
+func TestFLVReader(t *testing.T) {
+	sps := []byte{0x67, 0x64, 0x00, 0x1f}
+	pps := []byte{0x68, 0xee, 0x3c, 0x80}
+	idr := []byte{0x65, 0x88, 0x84}
+	sei := []byte{0x06, 0x05, 0x01}
+	slice := []byte{0x41, 0x9a}
+
+	tests := []struct {
+		name       string
+		lengthSize int
+		start      uint32
+	}{
+		{"four byte lengths", 4, 0},
+		{"two byte lengths", 2, 0},
+		// -copyts fills timestamps with wall clock time, which wraps
+		{"timestamps wrapping", 4, 0xffffffff - 20},
+	}
+	for _, test := range tests {
+		s := newFLVStream()
+		s.tag(18, test.start, []byte("onMetaData")) // Skipped
+		s.sequenceHeader(test.start, test.lengthSize, sps, pps)
+		s.frame(test.start, 0, true, test.lengthSize, sei, idr)
+		s.frame(test.start+33, 66, false, test.lengthSize, slice)
+		s.frame(test.start+66, -33, false, test.lengthSize, slice)
+		s.tag(flvTagVideo, test.start+66, []byte{0x17, 2, 0, 0, 0}) // End of sequence
+
+		want := []AccessUnit{
+			{Data: annexB(sps, pps, sei, idr), PTS: 0, Keyframe: true},
+			{Data: annexB(slice), PTS: 99 * time.Millisecond},
+			{Data: annexB(slice), PTS: 33 * time.Millisecond},
+		}
+		f := newFLVReader(s, flvTestBuffers)
+		for i, w := range want {
+			au, err := f.next()
+			if err != nil {
+				t.Fatalf("%s: frame %d: %v", test.name, i, err)
+			}
+			if !bytes.Equal(au.Data, w.Data) || au.PTS != w.PTS || au.Keyframe != w.Keyframe {
+				t.Errorf("%s: frame %d = %x at %v (key %v), want %x at %v (key %v)",
+					test.name, i, au.Data, au.PTS, au.Keyframe, w.Data, w.PTS, w.Keyframe)
+			}
+		}
+		if _, err := f.next(); err != io.EOF {
+			t.Errorf("%s: after the last frame, error = %v, want io.EOF", test.name, err)
+		}
+	}
+}
+
+func TestFLVReaderErrors(t *testing.T) {
+	sps, pps := []byte{0x67}, []byte{0x68}
+	tests := []struct {
+		name   string
+		stream func() []byte
+		err    string
+	}{
+		{"not FLV", func() []byte {
+			return []byte("RIFF\x00\x00\x00\x00\x09\x00\x00\x00\x00")
+		}, "not an FLV stream"},
+		{"frame before sequence header", func() []byte {
+			s := newFLVStream()
+			s.frame(0, 0, true, 4, []byte{0x65})
+			return s.Bytes()
+		}, "before sequence header"},
+		{"tag over the frame limit", func() []byte {
+			s := newFLVStream()
+			s.tag(flvTagVideo, 0, make([]byte, flvTestBuffers.maxFrame+1))
+			return s.Bytes()
+		}, "over the"},
+		{"truncated NAL unit", func() []byte {
+			s := newFLVStream()
+			s.sequenceHeader(0, 4, sps, pps)
+			s.tag(flvTagVideo, 0, []byte{0x17, flvAVCNALU, 0, 0, 0, 0, 0, 0, 9, 0x65})
+			return s.Bytes()
+		}, "truncated NAL unit"},
+		{"short sequence header", func() []byte {
+			s := newFLVStream()
+			s.tag(flvTagVideo, 0, []byte{0x17, flvAVCSequenceHeader, 0, 0, 0, 1, 0x64, 0, 0x1f, 0xff, 0xe1, 0, 9, 0x67})
+			return s.Bytes()
+		}, "short AVC decoder configuration"},
+		{"other codec", func() []byte {
+			s := newFLVStream()
+			s.tag(flvTagVideo, 0, []byte{0x12, 0, 0, 0, 0})
+			return s.Bytes()
+		}, "unsupported FLV video codec"},
+		{"cut short", func() []byte {
+			s := newFLVStream()
+			s.sequenceHeader(0, 4, sps, pps)
+			s.frame(0, 0, true, 4, []byte{0x65, 0x88})
+			return s.Bytes()[:s.Len()-6]
+		}, "cut short"},
+	}
+	for _, test := range tests {
+		f := newFLVReader(bytes.NewReader(test.stream()), flvTestBuffers)
+		_, err := f.next()
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error = %v, want one containing %q", test.name, err, test.err)
+		}
+		if test.name == "cut short" && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%s: error = %v, want io.ErrUnexpectedEOF", test.name, err)
+		}
+	}
+}
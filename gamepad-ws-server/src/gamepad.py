@@ -1,6 +1,6 @@
 import logging
 import time
-from typing import Dict, Optional
+from typing import Callable, Dict, Optional
 import sys
 
 # Setup logger
@@ -15,10 +15,23 @@ except ImportError as e:
     logger.error(f"vgamepad not available: {e}")
     logger.error("Install with: pip install vgamepad")
 
+# Supported virtual controller models
+CONTROLLER_XBOX360 = "xbox360"
+CONTROLLER_DS4 = "ds4"  # Has motion sensors for gyro aiming
+
+# Motion wire units match the DualShock 4 sensors
+GYRO_LSB_PER_DPS = 16.0
+# Gyro rate giving full right-stick deflection on controllers without sensors
+GYRO_STICK_FULL_SCALE_DPS = 180.0
+
+# D-pad button indices
+DPAD_UP, DPAD_DOWN, DPAD_LEFT, DPAD_RIGHT = 10, 11, 12, 13
+
 class Gamepad:
-    def __init__(self):
-        """Initialize the Xbox 360 virtual gamepad with comprehensive error handling."""
+    def __init__(self, controller_type: str = CONTROLLER_XBOX360):
+        """Initialize the virtual gamepad with comprehensive error handling."""
         self.vgpad = None
+        self.controller_type = controller_type
         self.axes = {
             'lx': 0.0, 'ly': 0.0,  # Left Stick
             'rx': 0.0, 'ry': 0.0,  # Right Stick
@@ -27,17 +40,28 @@ class Gamepad:
         self.buttons_state = {}  # Track button states
         self.last_update = 0
         self.update_threshold = 1.0 / 120.0  # 120 Hz max update rate
+        self.stick_deadzone = 0.08  # Set to 0 when the Go server applies a mapping profile
         self.initialized = False
+        self.feedback_callback: Optional[Callable[[int, int], None]] = None  # (large_motor, small_motor)
         
         if not VGAMEPAD_AVAILABLE:
             logger.error("[Gamepad] Cannot initialize: vgamepad not available")
             raise ImportError("vgamepad library not available. Install with: pip install vgamepad")
         
+        if controller_type not in (CONTROLLER_XBOX360, CONTROLLER_DS4):
+            raise ValueError(f"Unknown controller type: {controller_type}")
+
         try:
-            logger.info("[Gamepad] Attempting to create Xbox 360 virtual controller...")
-            self.vgpad = vg.VX360Gamepad()
+            logger.info(f"[Gamepad] Attempting to create {controller_type} virtual controller...")
+            if controller_type == CONTROLLER_DS4:
+                self.vgpad = vg.VDS4Gamepad()
+            else:
+                self.vgpad = vg.VX360Gamepad()
             self.initialized = True
-            logger.info("[Gamepad] Xbox 360 virtual controller initialized successfully")
+            logger.info(f"[Gamepad] {controller_type} virtual controller initialized successfully")
+
+            # Force feedback reported by games through the ViGEm driver
+            self.vgpad.register_notification(callback_function=self._on_notification)
             
             # Test the controller by sending a neutral state
             self._send_neutral_state()
@@ -48,6 +72,15 @@ class Gamepad:
             logger.error("[Gamepad] On Windows, you may need to install ViGEm Bus Driver")
             raise RuntimeError(f"Failed to initialize virtual gamepad: {e}")
 
+    def _on_notification(self, client, target, large_motor, small_motor, led_number, user_data):
+        """Called from the ViGEm thread when a game changes rumble motor levels."""
+        logger.debug(f"[Gamepad] Rumble: large={large_motor}, small={small_motor}")
+        if self.feedback_callback:
+            try:
+                self.feedback_callback(large_motor, small_motor)
+            except Exception as e:
+                logger.error(f"[Gamepad] Error in feedback callback: {e}")
+
     def _send_neutral_state(self):
         """Send neutral state to ensure controller is working."""
         try:
@@ -61,6 +94,103 @@ class Gamepad:
             logger.error(f"[Gamepad] Error sending neutral state: {e}")
             raise
 
+    def _button_mapping(self) -> Dict:
+        """Mapping of received button IDs to vgamepad buttons for this controller model."""
+        if self.controller_type == CONTROLLER_DS4:
+            # D-pad is a hat on the DS4, see _update_ds4_dpad
+            return {
+                0: vg.DS4_BUTTONS.DS4_BUTTON_CROSS,
+                1: vg.DS4_BUTTONS.DS4_BUTTON_CIRCLE,
+                2: vg.DS4_BUTTONS.DS4_BUTTON_SQUARE,
+                3: vg.DS4_BUTTONS.DS4_BUTTON_TRIANGLE,
+                4: vg.DS4_BUTTONS.DS4_BUTTON_SHOULDER_LEFT,
+                5: vg.DS4_BUTTONS.DS4_BUTTON_SHOULDER_RIGHT,
+                6: vg.DS4_BUTTONS.DS4_BUTTON_SHARE,
+                7: vg.DS4_BUTTONS.DS4_BUTTON_OPTIONS,
+                8: vg.DS4_BUTTONS.DS4_BUTTON_THUMB_LEFT,
+                9: vg.DS4_BUTTONS.DS4_BUTTON_THUMB_RIGHT,
+            }
+
+        return {
+                0: vg.XUSB_BUTTON.XUSB_GAMEPAD_A,
+                1: vg.XUSB_BUTTON.XUSB_GAMEPAD_B,
+                2: vg.XUSB_BUTTON.XUSB_GAMEPAD_X,
+                3: vg.XUSB_BUTTON.XUSB_GAMEPAD_Y,
+                4: vg.XUSB_BUTTON.XUSB_GAMEPAD_LEFT_SHOULDER,    # L1
+                5: vg.XUSB_BUTTON.XUSB_GAMEPAD_RIGHT_SHOULDER,   # R1
+                6: vg.XUSB_BUTTON.XUSB_GAMEPAD_BACK,             # Select/Share
+                7: vg.XUSB_BUTTON.XUSB_GAMEPAD_START,            # Start/Options
+                8: vg.XUSB_BUTTON.XUSB_GAMEPAD_LEFT_THUMB,       # L3
+                9: vg.XUSB_BUTTON.XUSB_GAMEPAD_RIGHT_THUMB,      # R3
+                10: vg.XUSB_BUTTON.XUSB_GAMEPAD_DPAD_UP,
+                11: vg.XUSB_BUTTON.XUSB_GAMEPAD_DPAD_DOWN,
+                12: vg.XUSB_BUTTON.XUSB_GAMEPAD_DPAD_LEFT,
+                13: vg.XUSB_BUTTON.XUSB_GAMEPAD_DPAD_RIGHT,
+            }
+
+    def _update_ds4_dpad(self):
+        """Translate the four d-pad buttons into the DS4 hat direction."""
+        up = self.buttons_state.get(DPAD_UP, False)
+        down = self.buttons_state.get(DPAD_DOWN, False)
+        left = self.buttons_state.get(DPAD_LEFT, False)
+        right = self.buttons_state.get(DPAD_RIGHT, False)
+
+        directions = vg.DS4_DPAD_DIRECTIONS
+        direction = {
+            (True, False, False, False): directions.DS4_BUTTON_DPAD_NORTH,
+            (True, False, False, True): directions.DS4_BUTTON_DPAD_NORTHEAST,
+            (False, False, False, True): directions.DS4_BUTTON_DPAD_EAST,
+            (False, True, False, True): directions.DS4_BUTTON_DPAD_SOUTHEAST,
+            (False, True, False, False): directions.DS4_BUTTON_DPAD_SOUTH,
+            (False, True, True, False): directions.DS4_BUTTON_DPAD_SOUTHWEST,
+            (False, False, True, False): directions.DS4_BUTTON_DPAD_WEST,
+            (True, False, True, False): directions.DS4_BUTTON_DPAD_NORTHWEST,
+        }.get((up, down, left, right), directions.DS4_BUTTON_DPAD_NONE)
+        self.vgpad.directional_pad(direction=direction)
+
+    def handle_motion(self, gyro, accel) -> bool:
+        """
+        Apply motion sensor data: gyro (x, y, z) in 1/16 deg/s and accel
+        (x, y, z) in 1/8192 g, DualShock 4 raw units.
+        """
+        if not self.initialized or not self.vgpad:
+            return False
+
+        try:
+            if self.controller_type == CONTROLLER_DS4:
+                self._send_ds4_motion(gyro, accel)
+            else:
+                self._gyro_to_right_stick(gyro)
+            return True
+        except Exception as e:
+            logger.error(f"[Gamepad] Error handling motion: {e}")
+            return False
+
+    def _send_ds4_motion(self, gyro, accel):
+        """Send an extended DS4 report carrying the current state plus motion."""
+        report = self.vgpad.report
+        ex = vg.DS4_REPORT_EX()
+        ex.Report.bThumbLX = report.bThumbLX
+        ex.Report.bThumbLY = report.bThumbLY
+        ex.Report.bThumbRX = report.bThumbRX
+        ex.Report.bThumbRY = report.bThumbRY
+        ex.Report.wButtons = report.wButtons
+        ex.Report.bSpecial = report.bSpecial
+        ex.Report.bTriggerL = report.bTriggerL
+        ex.Report.bTriggerR = report.bTriggerR
+        ex.Report.wGyroX, ex.Report.wGyroY, ex.Report.wGyroZ = gyro
+        ex.Report.wAccelX, ex.Report.wAccelY, ex.Report.wAccelZ = accel
+        self.vgpad.update_extended_report(ex)
+
+    def _gyro_to_right_stick(self, gyro):
+        """Xbox 360 controllers have no sensors: aim with the right stick instead."""
+        pitch_dps = gyro[0] / GYRO_LSB_PER_DPS
+        yaw_dps = gyro[1] / GYRO_LSB_PER_DPS
+        self.axes['rx'] = max(-1.0, min(1.0, -yaw_dps / GYRO_STICK_FULL_SCALE_DPS))
+        self.axes['ry'] = max(-1.0, min(1.0, pitch_dps / GYRO_STICK_FULL_SCALE_DPS))
+        self.vgpad.right_joystick_float(x_value_float=self.axes['rx'], y_value_float=self.axes['ry'])
+        self.vgpad.update()
+
     def handle_input(self, input_type: int, idx: int, value: int) -> bool:
         """
         Process input from WebSocket and translate to virtual controller.
@@ -143,8 +273,8 @@ class Gamepad:
                 normalized_value = max(-1.0, min(1.0, value / 32767.0))
             
             # Apply deadzone for analog sticks
-            if axis_name in ['lx', 'ly', 'rx', 'ry']:
-                deadzone = 0.08
+            if axis_name in ['lx', 'ly', 'rx', 'ry'] and self.stick_deadzone > 0:
+                deadzone = self.stick_deadzone
                 if abs(normalized_value) < deadzone:
                     normalized_value = 0.0
                 else:
@@ -183,25 +313,10 @@ class Gamepad:
     def _handle_button_input(self, idx: int, value: int) -> bool:
         """Handle button input."""
         try:
-            # Mapping of received button IDs to vgamepad buttons
-            button_mapping = {
-                0: vg.XUSB_BUTTON.XUSB_GAMEPAD_A,
-                1: vg.XUSB_BUTTON.XUSB_GAMEPAD_B,
-                2: vg.XUSB_BUTTON.XUSB_GAMEPAD_X,
-                3: vg.XUSB_BUTTON.XUSB_GAMEPAD_Y,
-                4: vg.XUSB_BUTTON.XUSB_GAMEPAD_LEFT_SHOULDER,    # L1
-                5: vg.XUSB_BUTTON.XUSB_GAMEPAD_RIGHT_SHOULDER,   # R1
-                6: vg.XUSB_BUTTON.XUSB_GAMEPAD_BACK,             # Select/Share
-                7: vg.XUSB_BUTTON.XUSB_GAMEPAD_START,            # Start/Options
-                8: vg.XUSB_BUTTON.XUSB_GAMEPAD_LEFT_THUMB,       # L3
-                9: vg.XUSB_BUTTON.XUSB_GAMEPAD_RIGHT_THUMB,      # R3
-                10: vg.XUSB_BUTTON.XUSB_GAMEPAD_DPAD_UP,
-                11: vg.XUSB_BUTTON.XUSB_GAMEPAD_DPAD_DOWN,
-                12: vg.XUSB_BUTTON.XUSB_GAMEPAD_DPAD_LEFT,
-                13: vg.XUSB_BUTTON.XUSB_GAMEPAD_DPAD_RIGHT,
-            }
-            
-            if idx not in button_mapping:
+            button_mapping = self._button_mapping()
+            is_dpad = self.controller_type == CONTROLLER_DS4 and idx in (DPAD_UP, DPAD_DOWN, DPAD_LEFT, DPAD_RIGHT)
+
+            if idx not in button_mapping and not is_dpad:
                 logger.warning(f"[Gamepad] Unknown button index: {idx}")
                 return False
                 
@@ -213,8 +328,10 @@ class Gamepad:
                 return True  # Not an error, just no change needed
                 
             self.buttons_state[idx] = is_pressed
-            
-            if is_pressed:
+
+            if is_dpad:
+                self._update_ds4_dpad()
+            elif is_pressed:
                 self.vgpad.press_button(button=button)
                 logger.debug(f"[Gamepad] Button {idx} pressed")
             else:
@@ -244,28 +361,15 @@ class Gamepad:
             self.vgpad.right_trigger_float(value_float=0.0)
             
             # Reset all buttons
-            button_mapping = {
-                0: vg.XUSB_BUTTON.XUSB_GAMEPAD_A,
-                1: vg.XUSB_BUTTON.XUSB_GAMEPAD_B,
-                2: vg.XUSB_BUTTON.XUSB_GAMEPAD_X,
-                3: vg.XUSB_BUTTON.XUSB_GAMEPAD_Y,
-                4: vg.XUSB_BUTTON.XUSB_GAMEPAD_LEFT_SHOULDER,
-                5: vg.XUSB_BUTTON.XUSB_GAMEPAD_RIGHT_SHOULDER,
-                6: vg.XUSB_BUTTON.XUSB_GAMEPAD_BACK,
-                7: vg.XUSB_BUTTON.XUSB_GAMEPAD_START,
-                8: vg.XUSB_BUTTON.XUSB_GAMEPAD_LEFT_THUMB,
-                9: vg.XUSB_BUTTON.XUSB_GAMEPAD_RIGHT_THUMB,
-                10: vg.XUSB_BUTTON.XUSB_GAMEPAD_DPAD_UP,
-                11: vg.XUSB_BUTTON.XUSB_GAMEPAD_DPAD_DOWN,
-                12: vg.XUSB_BUTTON.XUSB_GAMEPAD_DPAD_LEFT,
-                13: vg.XUSB_BUTTON.XUSB_GAMEPAD_DPAD_RIGHT,
-            }
+            button_mapping = self._button_mapping()
             
             for button_id, is_pressed in self.buttons_state.items():
                 if is_pressed and button_id in button_mapping:
                     self.vgpad.release_button(button=button_mapping[button_id])
             
             self.buttons_state = {}
+            if self.controller_type == CONTROLLER_DS4:
+                self._update_ds4_dpad()
             self.vgpad.update()
             logger.info("[Gamepad] Controller reset to neutral state successfully")
             return True
@@ -278,6 +382,8 @@ class Gamepad:
         """Get current controller status."""
         return {
             "initialized": self.initialized,
+            "controller_type": self.controller_type,
+            "stick_deadzone": self.stick_deadzone,
             "axes": self.axes.copy(),
             "buttons_pressed": [k for k, v in self.buttons_state.items() if v],
             "last_update": self.last_update,
@@ -0,0 +1,135 @@
+import logging
+import sys
+import ctypes
+from ctypes import wintypes
+
+logger = logging.getLogger(__name__)
+
+# Mouse button bits sent by the Go server
+MOUSE_BUTTON_LEFT = 1 << 0
+MOUSE_BUTTON_RIGHT = 1 << 1
+MOUSE_BUTTON_MIDDLE = 1 << 2
+
+# --- Windows SendInput ---
+
+INPUT_MOUSE = 0
+INPUT_KEYBOARD = 1
+
+KEYEVENTF_EXTENDEDKEY = 0x0001
+KEYEVENTF_KEYUP = 0x0002
+
+MOUSEEVENTF_MOVE = 0x0001
+MOUSEEVENTF_WHEEL = 0x0800
+WHEEL_DELTA = 120
+
+# (down, up) flags per button bit
+MOUSE_BUTTON_FLAGS = {
+    MOUSE_BUTTON_LEFT: (0x0002, 0x0004),
+    MOUSE_BUTTON_RIGHT: (0x0008, 0x0010),
+    MOUSE_BUTTON_MIDDLE: (0x0020, 0x0040),
+}
+
+# Keys that need KEYEVENTF_EXTENDEDKEY to not be read as their numpad twin
+EXTENDED_KEYS = {
+    0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x27, 0x28,  # Navigation and arrows
+    0x2D, 0x2E,  # Insert, Delete
+    0x5B, 0x5C, 0x5D,  # Windows keys, Menu
+    0x6F,  # Numpad divide
+    0xA3, 0xA5,  # Right Ctrl, Right Alt
+}
+
+
+class _MOUSEINPUT(ctypes.Structure):
+    _fields_ = [
+        ("dx", wintypes.LONG),
+        ("dy", wintypes.LONG),
+        ("mouseData", wintypes.DWORD),
+        ("dwFlags", wintypes.DWORD),
+        ("time", wintypes.DWORD),
+        ("dwExtraInfo", ctypes.c_void_p),
+    ]
+
+
+class _KEYBDINPUT(ctypes.Structure):
+    _fields_ = [
+        ("wVk", wintypes.WORD),
+        ("wScan", wintypes.WORD),
+        ("dwFlags", wintypes.DWORD),
+        ("time", wintypes.DWORD),
+        ("dwExtraInfo", ctypes.c_void_p),
+    ]
+
+
+class _INPUT_UNION(ctypes.Union):
+    _fields_ = [("mi", _MOUSEINPUT), ("ki", _KEYBDINPUT)]
+
+
+class _INPUT(ctypes.Structure):
+    _fields_ = [("type", wintypes.DWORD), ("u", _INPUT_UNION)]
+
+
+class KeyboardMouseInjector:
+    """Injects keyboard and relative mouse input into the host desktop.
+
+    Only Windows is supported here; Linux hosts inject through uinput in the
+    Go server instead.
+    """
+
+    def __init__(self):
+        if sys.platform != "win32":
+            raise OSError("keyboard/mouse injection requires Windows")
+        self.user32 = ctypes.windll.user32
+        self.mouse_buttons = 0
+
+    def _send(self, inputs):
+        if not inputs:
+            return
+        array = (_INPUT * len(inputs))(*inputs)
+        if self.user32.SendInput(len(inputs), array, ctypes.sizeof(_INPUT)) != len(inputs):
+            raise OSError(f"SendInput failed: {ctypes.GetLastError()}")
+
+    def _mouse(self, flags: int, dx: int = 0, dy: int = 0, data: int = 0) -> _INPUT:
+        inp = _INPUT(type=INPUT_MOUSE)
+        inp.u.mi = _MOUSEINPUT(dx, dy, data & 0xFFFFFFFF, flags, 0, None)
+        return inp
+
+    def handle_key(self, down: bool, vk: int) -> bool:
+        """Press or release one virtual-key code."""
+        try:
+            flags = 0 if down else KEYEVENTF_KEYUP
+            if vk in EXTENDED_KEYS:
+                flags |= KEYEVENTF_EXTENDEDKEY
+            inp = _INPUT(type=INPUT_KEYBOARD)
+            inp.u.ki = _KEYBDINPUT(vk, 0, flags, 0, None)
+            self._send([inp])
+            return True
+        except Exception as e:
+            logger.error(f"[KeyboardMouse] Error injecting key {vk}: {e}")
+            return False
+
+    def handle_mouse(self, buttons: int, dx: int, dy: int, wheel: int) -> bool:
+        """Apply relative motion, wheel steps and the full button state."""
+        try:
+            inputs = []
+            if dx or dy:
+                inputs.append(self._mouse(MOUSEEVENTF_MOVE, dx, dy))
+
+            changed = buttons ^ self.mouse_buttons
+            for bit, (down_flag, up_flag) in MOUSE_BUTTON_FLAGS.items():
+                if changed & bit:
+                    inputs.append(self._mouse(down_flag if buttons & bit else up_flag))
+            self.mouse_buttons = buttons
+
+            if wheel:
+                # Browsers report wheel down as positive, Windows as negative
+                inputs.append(self._mouse(MOUSEEVENTF_WHEEL, data=-wheel * WHEEL_DELTA))
+
+            self._send(inputs)
+            return True
+        except Exception as e:
+            logger.error(f"[KeyboardMouse] Error injecting mouse input: {e}")
+            return False
+
+    def reset(self):
+        """Release held mouse buttons."""
+        self.handle_mouse(0, 0, 0, 0)
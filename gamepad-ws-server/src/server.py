@@ -5,9 +5,12 @@ import signal
 import sys
 import time
 import struct
+import json
 from typing import Set, Dict, Any, Optional
 from websockets.server import WebSocketServerProtocol
-from gamepad import Gamepad
+from gamepad import Gamepad, CONTROLLER_XBOX360, CONTROLLER_DS4
+from touch import TouchInjector
+from keyboard_mouse import KeyboardMouseInjector
 
 # Configure logging with more detail
 logging.basicConfig(
@@ -20,14 +23,28 @@ logging.basicConfig(
 )
 logger = logging.getLogger(__name__)
 
+# Virtual controllers one host can expose (XInput supports four)
+MAX_GAMEPAD_SLOTS = 4
+
+# Binary message types beyond gamepad axes/buttons (0 and 1)
+INPUT_TYPE_TOUCH = 2
+INPUT_TYPE_MOTION = 3  # Gyro and accelerometer, DualShock 4 units
+INPUT_TYPE_KEY = 4  # <BBH> type, down, virtual-key code
+INPUT_TYPE_MOUSE = 5  # <BBhhb> type, buttons, dx, dy, wheel
+
 class GamepadServer:
-    def __init__(self, listen_ip: str = "0.0.0.0", listen_port: int = 9000):
+    def __init__(self, listen_ip: str = "127.0.0.1", listen_port: int = 9000):
+        # Only the Go server connects: it enforces per-peer input permissions
         self.listen_ip = listen_ip
         self.listen_port = listen_port
-        self.gamepad: Optional[Gamepad] = None
+        self.gamepads: Dict[int, Gamepad] = {}  # One virtual controller per slot
+        self.client_slots: Dict[WebSocketServerProtocol, int] = {}  # Clients default to slot 0
+        self.touch: Optional[TouchInjector] = None  # Created on first touch event
+        self.keyboard_mouse: Optional[KeyboardMouseInjector] = None  # Created on first key/mouse event
         self.clients: Set[WebSocketServerProtocol] = set()
         self.running = False
         self.server = None
+        self.loop: Optional[asyncio.AbstractEventLoop] = None
         self.stats = {
             'total_connections': 0,
             'active_connections': 0,
@@ -38,10 +55,10 @@ class GamepadServer:
         }
 
     async def initialize_gamepad(self) -> bool:
-        """Initialize the gamepad controller with better error handling."""
+        """Initialize the slot 0 gamepad controller with better error handling."""
         try:
             logger.info("Initializing gamepad controller...")
-            self.gamepad = Gamepad()
+            self.get_gamepad(0)
             logger.info("Gamepad controller initialized successfully.")
             return True
         except ImportError as e:
@@ -53,6 +70,24 @@ class GamepadServer:
             logger.error("Make sure you have the proper drivers installed")
             return False
 
+    def get_gamepad(self, slot: int, controller_type: Optional[str] = None) -> Gamepad:
+        """Return the virtual controller for a slot, creating it on first use.
+
+        A different controller_type replaces the slot's existing controller.
+        """
+        existing = self.gamepads.get(slot)
+        if existing and controller_type and existing.controller_type != controller_type:
+            existing.reset()
+            del self.gamepads[slot]
+            logger.info(f"Replacing {existing.controller_type} controller in slot {slot} with {controller_type}")
+
+        if slot not in self.gamepads:
+            gamepad = Gamepad(controller_type or CONTROLLER_XBOX360)
+            gamepad.feedback_callback = lambda large, small: self.on_gamepad_feedback(slot, large, small)
+            self.gamepads[slot] = gamepad
+            logger.info(f"Virtual controller created for slot {slot}")
+        return self.gamepads[slot]
+
     async def handle_client(self, websocket: WebSocketServerProtocol, path: str = "/"):
         """Handle individual WebSocket client connections with comprehensive error handling."""
         client_address = "unknown"
@@ -105,6 +140,7 @@ class GamepadServer:
             try:
                 if websocket in self.clients:
                     self.clients.remove(websocket)
+                self.client_slots.pop(websocket, None)
                 self.stats['active_connections'] -= 1
                 logger.info(f"Client {client_address} cleanup completed. Active: {self.stats['active_connections']}")
             except Exception as e:
@@ -116,7 +152,7 @@ class GamepadServer:
         
         try:
             if isinstance(message, bytes):
-                await self.handle_binary_message(message, client_address)
+                await self.handle_binary_message(websocket, message, client_address)
             elif isinstance(message, str):
                 await self.handle_text_message(message, client_address, websocket)
             else:
@@ -128,16 +164,28 @@ class GamepadServer:
             self.stats['errors'] += 1
             raise  # Re-raise to be handled by caller
 
-    async def handle_binary_message(self, message: bytes, client_address: str):
+    async def handle_binary_message(self, websocket: WebSocketServerProtocol, message: bytes, client_address: str):
         """Handle binary gamepad input messages with detailed validation."""
+
+        if message and message[0] == INPUT_TYPE_TOUCH:
+            await self.handle_touch_message(message, client_address)
+            return
+        if message and message[0] == INPUT_TYPE_MOTION:
+            await self.handle_motion_message(websocket, message, client_address)
+            return
+        if message and message[0] in (INPUT_TYPE_KEY, INPUT_TYPE_MOUSE):
+            await self.handle_keyboard_mouse_message(message, client_address)
+            return
         
         # Validate message length
         if len(message) != 4:
             logger.warning(f"Invalid binary message length from {client_address}: {len(message)} bytes (expected 4)")
             return
 
-        if not self.gamepad:
-            logger.error(f"Gamepad not initialized, cannot process input from {client_address}")
+        slot = self.client_slots.get(websocket, 0)
+        gamepad = self.gamepads.get(slot)
+        if not gamepad:
+            logger.error(f"Gamepad for slot {slot} not initialized, cannot process input from {client_address}")
             return
 
         try:
@@ -166,7 +214,7 @@ class GamepadServer:
                 return
 
             # Process the input
-            self.gamepad.handle_input(input_type, idx, value)
+            gamepad.handle_input(input_type, idx, value)
             self.stats['messages_processed'] += 1
             
             # Debug logging for first few messages
@@ -179,6 +227,74 @@ class GamepadServer:
             self.stats['errors'] += 1
             raise
 
+    async def handle_touch_message(self, message: bytes, client_address: str):
+        """Handle touch events in host desktop pixels: <BBBHH> type, contact, phase, x, y."""
+        if len(message) != 7:
+            logger.warning(f"Invalid touch message length from {client_address}: {len(message)} bytes (expected 7)")
+            return
+
+        try:
+            _, contact, phase, x, y = struct.unpack('<BBBHH', message)
+        except struct.error as e:
+            logger.error(f"Error unpacking touch message from {client_address}: {e}")
+            return
+
+        if self.touch is None:
+            try:
+                self.touch = TouchInjector()
+            except Exception as e:
+                logger.error(f"Touch injection unavailable: {e}")
+                self.stats['errors'] += 1
+                return
+
+        if self.touch.handle_touch(contact, phase, x, y):
+            self.stats['messages_processed'] += 1
+
+    async def handle_motion_message(self, websocket: WebSocketServerProtocol, message: bytes, client_address: str):
+        """Handle motion sensor data for the client's slot: <Bhhhhhh> type, gyro x/y/z, accel x/y/z."""
+        if len(message) != 13:
+            logger.warning(f"Invalid motion message length from {client_address}: {len(message)} bytes (expected 13)")
+            return
+
+        try:
+            _, gx, gy, gz, ax, ay, az = struct.unpack('<Bhhhhhh', message)
+        except struct.error as e:
+            logger.error(f"Error unpacking motion message from {client_address}: {e}")
+            return
+
+        gamepad = self.gamepads.get(self.client_slots.get(websocket, 0))
+        if not gamepad:
+            return
+
+        if gamepad.handle_motion((gx, gy, gz), (ax, ay, az)):
+            self.stats['messages_processed'] += 1
+
+    async def handle_keyboard_mouse_message(self, message: bytes, client_address: str):
+        """Handle keyboard (<BBH>) and relative mouse (<BBhhb>) events."""
+        try:
+            if message[0] == INPUT_TYPE_KEY:
+                _, down, vk = struct.unpack('<BBH', message)
+            else:
+                _, buttons, dx, dy, wheel = struct.unpack('<BBhhb', message)
+        except struct.error as e:
+            logger.error(f"Error unpacking keyboard/mouse message from {client_address}: {e}")
+            return
+
+        if self.keyboard_mouse is None:
+            try:
+                self.keyboard_mouse = KeyboardMouseInjector()
+            except Exception as e:
+                logger.error(f"Keyboard/mouse injection unavailable: {e}")
+                self.stats['errors'] += 1
+                return
+
+        if message[0] == INPUT_TYPE_KEY:
+            ok = self.keyboard_mouse.handle_key(bool(down), vk)
+        else:
+            ok = self.keyboard_mouse.handle_mouse(buttons, dx, dy, wheel)
+        if ok:
+            self.stats['messages_processed'] += 1
+
     async def handle_text_message(self, message: str, client_address: str, websocket: WebSocketServerProtocol):
         """Handle text messages with proper response handling."""
         try:
@@ -193,10 +309,17 @@ class GamepadServer:
             elif message == "status":
                 await self.send_status_to_client(websocket, client_address)
                 
+            elif message.startswith("slot "):
+                await self.handle_slot_command(websocket, message, client_address)
+
+            elif message.startswith("deadzone "):
+                await self.handle_deadzone_command(websocket, message, client_address)
+
             elif message == "reset":
-                if self.gamepad:
+                gamepad = self.gamepads.get(self.client_slots.get(websocket, 0))
+                if gamepad:
                     try:
-                        self.gamepad.reset()
+                        gamepad.reset()
                         logger.info(f"Gamepad reset requested by {client_address}")
                         await websocket.send("Gamepad reset successfully")
                     except Exception as e:
@@ -213,6 +336,78 @@ class GamepadServer:
             logger.error(f"Error handling text message from {client_address}: {e}")
             logger.exception("Full traceback:")
 
+    async def handle_slot_command(self, websocket: WebSocketServerProtocol, message: str, client_address: str):
+        """Bind a client to a controller slot ("slot N [xbox360|ds4]")."""
+        parts = message.split()
+        try:
+            slot = int(parts[1])
+        except (IndexError, ValueError):
+            await websocket.send(f"Invalid slot command: {message}")
+            return
+
+        controller_type = parts[2] if len(parts) > 2 else None
+        if controller_type not in (None, CONTROLLER_XBOX360, CONTROLLER_DS4):
+            await websocket.send(f"Invalid controller type: {controller_type}")
+            return
+
+        if not 0 <= slot < MAX_GAMEPAD_SLOTS:
+            await websocket.send(f"Invalid slot {slot}, expected 0-{MAX_GAMEPAD_SLOTS - 1}")
+            return
+
+        try:
+            gamepad = self.get_gamepad(slot, controller_type)
+        except Exception as e:
+            logger.error(f"Error creating controller for slot {slot}: {e}")
+            await websocket.send(f"Error creating controller for slot {slot}: {e}")
+            return
+
+        self.client_slots[websocket] = slot
+        logger.info(f"Client {client_address} bound to gamepad slot {slot} ({gamepad.controller_type})")
+        await websocket.send(f"Bound to slot {slot}")
+
+    async def handle_deadzone_command(self, websocket: WebSocketServerProtocol, message: str, client_address: str):
+        """Set the stick deadzone of the client's slot ("deadzone 0.08")."""
+        try:
+            deadzone = float(message.split()[1])
+        except (IndexError, ValueError):
+            await websocket.send(f"Invalid deadzone command: {message}")
+            return
+
+        if not 0.0 <= deadzone < 1.0:
+            await websocket.send(f"Invalid deadzone {deadzone}, expected 0.0-1.0")
+            return
+
+        slot = self.client_slots.get(websocket, 0)
+        gamepad = self.gamepads.get(slot)
+        if not gamepad:
+            await websocket.send("Gamepad not initialized")
+            return
+
+        gamepad.stick_deadzone = deadzone
+        logger.info(f"Client {client_address} set stick deadzone of slot {slot} to {deadzone}")
+        await websocket.send(f"Deadzone set to {deadzone}")
+
+    def on_gamepad_feedback(self, slot: int, large_motor: int, small_motor: int):
+        """Forward rumble from the ViGEm thread to the event loop."""
+        if self.loop and self.running:
+            asyncio.run_coroutine_threadsafe(self.broadcast_rumble(slot, large_motor, small_motor), self.loop)
+
+    async def broadcast_rumble(self, slot: int, large_motor: int, small_motor: int):
+        """Send a rumble event to every client bound to the slot."""
+        message = json.dumps({
+            'type': 'rumble',
+            'slot': slot,
+            'large_motor': large_motor,
+            'small_motor': small_motor
+        })
+        for client in self.clients.copy():
+            if self.client_slots.get(client, 0) != slot:
+                continue
+            try:
+                await client.send(message)
+            except Exception as e:
+                logger.warning(f"Error sending rumble to client: {e}")
+
     async def send_status_to_client(self, websocket: WebSocketServerProtocol, client_address: str):
         """Send status information back to client."""
         try:
@@ -220,7 +415,7 @@ class GamepadServer:
             
             status = {
                 'server_stats': self.stats.copy(),
-                'gamepad_status': self.gamepad.get_status() if self.gamepad else None,
+                'gamepad_status': {slot: gamepad.get_status() for slot, gamepad in self.gamepads.items()},
                 'uptime_seconds': uptime,
                 'uptime_formatted': f"{uptime:.1f}s"
             }
@@ -236,6 +431,8 @@ class GamepadServer:
     async def start_server(self):
         """Start the WebSocket server with comprehensive error handling."""
         
+        self.loop = asyncio.get_running_loop()
+
         # Initialize gamepad first
         if not await self.initialize_gamepad():
             logger.error("Cannot start server: gamepad initialization failed")
@@ -303,13 +500,18 @@ class GamepadServer:
         logger.info("Starting server shutdown...")
         self.running = False
         
-        # Reset gamepad to default state
-        if self.gamepad:
+        if self.touch:
+            self.touch.reset()
+        if self.keyboard_mouse:
+            self.keyboard_mouse.reset()
+
+        # Reset gamepads to default state
+        for slot, gamepad in self.gamepads.items():
             try:
-                self.gamepad.reset()
-                logger.info("Gamepad reset to default state")
+                gamepad.reset()
+                logger.info(f"Gamepad in slot {slot} reset to default state")
             except Exception as e:
-                logger.error(f"Error resetting gamepad during shutdown: {e}")
+                logger.error(f"Error resetting gamepad in slot {slot} during shutdown: {e}")
         
         # Close all client connections
         if self.clients:
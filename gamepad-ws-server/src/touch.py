@@ -0,0 +1,203 @@
+import logging
+import sys
+import ctypes
+from typing import Dict, Tuple
+
+logger = logging.getLogger(__name__)
+
+# Touch phases sent by the Go server
+PHASE_DOWN = 0
+PHASE_MOVE = 1
+PHASE_UP = 2
+PHASE_CANCEL = 3
+
+MAX_TOUCH_CONTACTS = 10
+
+
+class TouchInjector:
+    """Injects touch contacts into the host desktop.
+
+    Uses the Windows touch injection API when available so apps see real
+    multi-touch; otherwise the primary contact drives the mouse pointer.
+    """
+
+    def __init__(self):
+        self.backend = None
+        if sys.platform == "win32":
+            try:
+                self.backend = _WindowsTouchBackend()
+                logger.info("[Touch] Windows touch injection initialized")
+            except Exception as e:
+                logger.warning(f"[Touch] Windows touch injection unavailable: {e}")
+
+        if self.backend is None:
+            self.backend = _PointerBackend()
+            logger.info("[Touch] Using absolute pointer emulation for touch input")
+
+    def handle_touch(self, contact: int, phase: int, x: int, y: int) -> bool:
+        """Process one touch event in host desktop pixels."""
+        if not 0 <= contact < MAX_TOUCH_CONTACTS or phase not in (PHASE_DOWN, PHASE_MOVE, PHASE_UP, PHASE_CANCEL):
+            logger.warning(f"[Touch] Invalid touch event: contact={contact}, phase={phase}")
+            return False
+        try:
+            self.backend.handle_touch(contact, phase, x, y)
+            return True
+        except Exception as e:
+            logger.error(f"[Touch] Error injecting touch: {e}")
+            return False
+
+    def reset(self):
+        """Lift every active contact."""
+        try:
+            self.backend.reset()
+        except Exception as e:
+            logger.error(f"[Touch] Error resetting touch state: {e}")
+
+
+class _PointerBackend:
+    """Maps the first contact to the mouse pointer."""
+
+    def __init__(self):
+        import pyautogui
+        pyautogui.FAILSAFE = False
+        pyautogui.PAUSE = 0
+        self.pyautogui = pyautogui
+        self.primary = None
+
+    def handle_touch(self, contact: int, phase: int, x: int, y: int):
+        if self.primary is None and phase == PHASE_DOWN:
+            self.primary = contact
+        if contact != self.primary:
+            return
+
+        self.pyautogui.moveTo(x, y)
+        if phase == PHASE_DOWN:
+            self.pyautogui.mouseDown()
+        elif phase in (PHASE_UP, PHASE_CANCEL):
+            self.pyautogui.mouseUp()
+            self.primary = None
+
+    def reset(self):
+        if self.primary is not None:
+            self.pyautogui.mouseUp()
+            self.primary = None
+
+
+# --- Windows touch injection (user32 InjectTouchInput) ---
+
+PT_TOUCH = 0x00000002
+
+POINTER_FLAG_INRANGE = 0x00000002
+POINTER_FLAG_INCONTACT = 0x00000004
+POINTER_FLAG_CANCELED = 0x00008000
+POINTER_FLAG_DOWN = 0x00010000
+POINTER_FLAG_UPDATE = 0x00020000
+POINTER_FLAG_UP = 0x00040000
+
+TOUCH_FEEDBACK_DEFAULT = 0x1
+TOUCH_MASK_CONTACTAREA = 0x00000001
+CONTACT_RADIUS = 2
+
+
+class _POINT(ctypes.Structure):
+    _fields_ = [("x", ctypes.c_long), ("y", ctypes.c_long)]
+
+
+class _RECT(ctypes.Structure):
+    _fields_ = [("left", ctypes.c_long), ("top", ctypes.c_long),
+                ("right", ctypes.c_long), ("bottom", ctypes.c_long)]
+
+
+class _POINTER_INFO(ctypes.Structure):
+    _fields_ = [
+        ("pointerType", ctypes.c_uint32),
+        ("pointerId", ctypes.c_uint32),
+        ("frameId", ctypes.c_uint32),
+        ("pointerFlags", ctypes.c_uint32),
+        ("sourceDevice", ctypes.c_void_p),
+        ("hwndTarget", ctypes.c_void_p),
+        ("ptPixelLocation", _POINT),
+        ("ptHimetricLocation", _POINT),
+        ("ptPixelLocationRaw", _POINT),
+        ("ptHimetricLocationRaw", _POINT),
+        ("dwTime", ctypes.c_uint32),
+        ("historyCount", ctypes.c_uint32),
+        ("InputData", ctypes.c_int32),
+        ("dwKeyStates", ctypes.c_uint32),
+        ("PerformanceCount", ctypes.c_uint64),
+        ("ButtonChangeType", ctypes.c_int),
+    ]
+
+
+class _POINTER_TOUCH_INFO(ctypes.Structure):
+    _fields_ = [
+        ("pointerInfo", _POINTER_INFO),
+        ("touchFlags", ctypes.c_uint32),
+        ("touchMask", ctypes.c_uint32),
+        ("rcContact", _RECT),
+        ("rcContactRaw", _RECT),
+        ("orientation", ctypes.c_uint32),
+        ("pressure", ctypes.c_uint32),
+    ]
+
+
+class _WindowsTouchBackend:
+    """Real multi-touch through InjectTouchInput.
+
+    Windows expects every contact still touching the screen to be reported
+    in each injection frame, so active contacts are tracked here.
+    """
+
+    def __init__(self):
+        self.user32 = ctypes.windll.user32
+        if not self.user32.InitializeTouchInjection(MAX_TOUCH_CONTACTS, TOUCH_FEEDBACK_DEFAULT):
+            raise OSError(f"InitializeTouchInjection failed: {ctypes.GetLastError()}")
+        self.active: Dict[int, Tuple[int, int]] = {}
+
+    def _contact(self, contact: int, x: int, y: int, flags: int) -> _POINTER_TOUCH_INFO:
+        info = _POINTER_TOUCH_INFO()
+        info.pointerInfo.pointerType = PT_TOUCH
+        info.pointerInfo.pointerId = contact
+        info.pointerInfo.pointerFlags = flags
+        info.pointerInfo.ptPixelLocation = _POINT(x, y)
+        info.touchMask = TOUCH_MASK_CONTACTAREA
+        info.rcContact = _RECT(x - CONTACT_RADIUS, y - CONTACT_RADIUS, x + CONTACT_RADIUS, y + CONTACT_RADIUS)
+        return info
+
+    def _inject(self, contacts):
+        if not contacts:
+            return
+        array = (_POINTER_TOUCH_INFO * len(contacts))(*contacts)
+        if not self.user32.InjectTouchInput(len(contacts), array):
+            raise OSError(f"InjectTouchInput failed: {ctypes.GetLastError()}")
+
+    def handle_touch(self, contact: int, phase: int, x: int, y: int):
+        in_contact = POINTER_FLAG_INRANGE | POINTER_FLAG_INCONTACT
+
+        if phase == PHASE_DOWN:
+            changed = self._contact(contact, x, y, POINTER_FLAG_DOWN | in_contact)
+            self.active[contact] = (x, y)
+        elif phase == PHASE_MOVE:
+            if contact not in self.active:
+                return
+            changed = self._contact(contact, x, y, POINTER_FLAG_UPDATE | in_contact)
+            self.active[contact] = (x, y)
+        else:
+            if contact not in self.active:
+                return
+            flags = POINTER_FLAG_UP
+            if phase == PHASE_CANCEL:
+                flags |= POINTER_FLAG_CANCELED
+            changed = self._contact(contact, x, y, flags)
+            del self.active[contact]
+
+        frame = [changed]
+        for other, (ox, oy) in self.active.items():
+            if other != contact:
+                frame.append(self._contact(other, ox, oy, POINTER_FLAG_UPDATE | in_contact))
+        self._inject(frame)
+
+    def reset(self):
+        frame = [self._contact(c, x, y, POINTER_FLAG_UP) for c, (x, y) in self.active.items()]
+        self.active.clear()
+        self._inject(frame)
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sync"
+)
+
+// Virtual controllers one host can expose; XInput supports four
+const maxGamepadSlots = 4
+
+// Virtual controller models the gamepad server can create
+const (
+	controllerXbox360 = "xbox360"
+	controllerDS4     = "ds4" // Has motion sensors for gyro aiming
+)
+
+var (
+	gamepadSlots     [maxGamepadSlots]string // Session ID holding each slot
+	gamepadSlotsLock sync.Mutex
+)
+
+// acquireGamepadSlot assigns the preferred slot if it is free, otherwise the
+// first free one. Returns -1 when every slot is taken.
+func acquireGamepadSlot(sessionID string, preferred int) int {
+	gamepadSlotsLock.Lock()
+	defer gamepadSlotsLock.Unlock()
+
+	if preferred >= 0 && preferred < maxGamepadSlots && gamepadSlots[preferred] == "" {
+		gamepadSlots[preferred] = sessionID
+		return preferred
+	}
+	for slot, owner := range gamepadSlots {
+		if owner == "" {
+			gamepadSlots[slot] = sessionID
+			return slot
+		}
+	}
+	return -1
+}
+
+func releaseGamepadSlot(sessionID string) {
+	gamepadSlotsLock.Lock()
+	defer gamepadSlotsLock.Unlock()
+
+	for slot, owner := range gamepadSlots {
+		if owner == sessionID {
+			gamepadSlots[slot] = ""
+		}
+	}
+}
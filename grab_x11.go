@@ -0,0 +1,74 @@
+//go:build cgo && linux && x264
+
+package main
+
+/*
+#cgo pkg-config: x11
+#include <stdlib.h>
+#include <X11/Xlib.h>
+#include <X11/Xutil.h>
+
+static unsigned long all_planes(void) { return AllPlanes; }
+static void destroy_image(XImage *image) { XDestroyImage(image); }
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+func init() {
+	registerInProcessSource("x11-x264", "linux", newX11Grabber, newX264Encoder)
+}
+
+// x11Grabber reads a region of the root window, like x11grab: the
+// top-left one, or the configured monitor's
+type x11Grabber struct {
+	display *C.Display
+	root    C.Window
+	x, y    int
+}
+
+func newX11Grabber(cfg CaptureConfig) (frameGrabber, error) {
+	name := x11Display
+	if env := os.Getenv("DISPLAY"); env != "" {
+		name = env
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+
+	display := C.XOpenDisplay(cname)
+	if display == nil {
+		return nil, fmt.Errorf("cannot open X display %s", name)
+	}
+	g := &x11Grabber{display: display, root: C.XDefaultRootWindow(display)}
+	if m := cfg.Monitor; m != nil {
+		g.x, g.y = m.X, m.Y
+	}
+	return g, nil
+}
+
+func (g *x11Grabber) grab(frame *rawFrame) error {
+	image := C.XGetImage(g.display, C.Drawable(g.root), C.int(g.x), C.int(g.y),
+		C.uint(frame.width), C.uint(frame.height), C.all_planes(), C.ZPixmap)
+	if image == nil {
+		return errors.New("XGetImage failed")
+	}
+	defer C.destroy_image(image)
+
+	if image.bits_per_pixel != 32 {
+		return fmt.Errorf("unsupported X visual depth %d", image.bits_per_pixel)
+	}
+	stride := int(image.bytes_per_line)
+	data := unsafe.Slice((*byte)(unsafe.Pointer(image.data)), stride*frame.height)
+	bgraToI420(data, stride, frame)
+	return nil
+}
+
+func (g *x11Grabber) close() error {
+	C.XCloseDisplay(g.display)
+	return nil
+}
@@ -0,0 +1,383 @@
+package main
+
+//go:generate protoc -I proto --go_out=proto --go_opt=paths=source_relative --go-grpc_out=proto --go-grpc_opt=paths=source_relative chimera/v1/control.proto
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	chimerav1 "github.com/lightsyr/chimera-go/proto/chimera/v1"
+)
+
+// gRPC control plane for orchestration systems, defined in
+// proto/chimera/v1/control.proto. Without a token only the host itself may
+// call it. With CHIMERA_GRPC_TOKEN set callers send "authorization: Bearer
+// <token>", and the token is not sent in the clear: the control plane moves
+// to every interface only over TLS, with the HTTPS certificate (see
+// "chimera-go cert lan"), and otherwise stays on loopback. A -grpc-addr
+// off loopback without a certificate is taken as meant, with a warning.
+const defaultGRPCAddr = "127.0.0.1:50051"
+
+var (
+	grpcEnabled = true
+	grpcAddr    = defaultGRPCAddr
+	grpcToken   = os.Getenv("CHIMERA_GRPC_TOKEN")
+)
+
+func startGRPC() {
+	addr := grpcAddr
+	var options []grpc.ServerOption
+	if grpcToken != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+		switch {
+		case err == nil:
+			options = append(options, grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})))
+			if grpcAddr == defaultGRPCAddr {
+				_, port, _ := net.SplitHostPort(grpcAddr)
+				addr = ":" + port
+			}
+		case !isLoopbackAddr(addr):
+			log.Printf("[gRPC] Warning: no %s, so the token is sent in plaintext to %s", tlsCertFile, addr)
+		default:
+			log.Printf("[gRPC] No %s, staying on %s; chimera-go cert lan makes one for the LAN", tlsCertFile, addr)
+		}
+	}
+	listener, err := listen("grpc", addr)
+	if err != nil {
+		log.Printf("[gRPC] Error listening on %s: %v", addr, err)
+		return
+	}
+
+	server := grpc.NewServer(append(options,
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := authorizeGRPC(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := authorizeGRPC(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)...)
+	chimerav1.RegisterControlPlaneServer(server, &controlPlane{})
+
+	// Clients reconnect to the new process; running calls finish here
+	onHandover(func() { go server.GracefulStop() })
+
+	log.Printf("[gRPC] Control plane listening on %s", listener.Addr())
+	go func() {
+		if err := server.Serve(listener); err != nil && !handedOver.Load() {
+			log.Printf("[gRPC] Server error: %v", err)
+		}
+	}()
+}
+
+// isLoopbackAddr reports whether a listen address only takes connections
+// from the host itself
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// authorizeGRPC is the gRPC counterpart of isHostRequest, widened to token
+// holders when a token is configured
+func authorizeGRPC(ctx context.Context) error {
+	if grpcToken == "" {
+		p, ok := peer.FromContext(ctx)
+		if ok {
+			if addr, ok := p.Addr.(*net.TCPAddr); ok && addr.IP.IsLoopback() {
+				return nil
+			}
+		}
+		return status.Error(codes.PermissionDenied, "only the host may use the control plane")
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		token, ok := strings.CutPrefix(value, "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(grpcToken)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or invalid token")
+}
+
+type controlPlane struct {
+	chimerav1.UnimplementedControlPlaneServer
+}
+
+func (controlPlane) CreateSession(ctx context.Context, req *chimerav1.CreateSessionRequest) (*chimerav1.CreateSessionResponse, error) {
+	// Options the request has no field for keep their zero values, which
+	// validateOffer fills with the host's defaults
+	offer := OfferRequest{
+		SDP:             req.Sdp,
+		Codec:           req.Codec,
+		Width:           int(req.Width),
+		Height:          int(req.Height),
+		FPS:             int(req.Fps),
+		Clipboard:       req.Clipboard,
+		LatencyOverlay:  req.LatencyOverlay,
+		MappingProfile:  req.MappingProfile,
+		ControllerType:  req.ControllerType,
+		Role:            req.Role,
+		ShortcutPolicy:  req.ShortcutPolicy,
+		App:             req.App,
+		AppOnDisconnect: req.AppOnDisconnect,
+	}
+	if req.GamepadSlot != nil {
+		slot := int(*req.GamepadSlot)
+		offer.GamepadSlot = &slot
+	}
+
+	mapping, err := validateOffer(&offer, hostLimits)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	resp, err := startIfRoom(offer, mapping)
+	switch {
+	case errors.Is(err, errHostFull):
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	case isDraining(err):
+		return nil, status.Error(codes.Unavailable, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.Internal, "error starting session")
+	}
+	log.Printf("[Session %s] Created through gRPC", resp.SessionID)
+
+	return &chimerav1.CreateSessionResponse{
+		SessionId:   resp.SessionID,
+		SdpAnswer:   resp.SDP,
+		GamepadSlot: int32(resp.GamepadSlot),
+		Role:        resp.Role,
+		OwnerToken:  resp.OwnerToken,
+	}, nil
+}
+
+func (controlPlane) ListSessions(ctx context.Context, req *chimerav1.ListSessionsRequest) (*chimerav1.ListSessionsResponse, error) {
+	sessionsLock.RLock()
+	list := make([]*StreamSession, 0, len(sessions))
+	for _, session := range sessions {
+		list = append(list, session)
+	}
+	sessionsLock.RUnlock()
+
+	resp := &chimerav1.ListSessionsResponse{}
+	for _, session := range list {
+		resp.Sessions = append(resp.Sessions, sessionProto(session))
+	}
+	return resp, nil
+}
+
+func (controlPlane) GetSession(ctx context.Context, req *chimerav1.GetSessionRequest) (*chimerav1.Session, error) {
+	session, ok := getSession(req.SessionId)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "session not found")
+	}
+	return sessionProto(session), nil
+}
+
+func (controlPlane) UpdateSession(ctx context.Context, req *chimerav1.UpdateSessionRequest) (*chimerav1.Session, error) {
+	session, ok := getSession(req.SessionId)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "session not found")
+	}
+
+	// Check everything before changing anything
+	var profile *MappingProfile
+	if req.MappingProfile != nil {
+		if profile, ok = getMappingProfile(*req.MappingProfile); !ok {
+			return nil, status.Error(codes.NotFound, "mapping profile not found")
+		}
+	}
+
+	if req.Control != nil && *req.Control && session.viewer {
+		return nil, status.Error(codes.FailedPrecondition, errViewerInput.Error())
+	}
+
+	if profile != nil {
+		session.mutex.Lock()
+		session.mapping = profile
+		session.mutex.Unlock()
+		log.Printf("[Session %s] Mapping profile set to %q", session.ID, profile.Name)
+	}
+	if req.Control != nil {
+		session.setControl(*req.Control) // Checked above
+		log.Printf("[Session %s] Input control set to %v", session.ID, *req.Control)
+		audit(auditEntry{Action: "control", Session: session.ID, Details: map[string]interface{}{
+			"control": *req.Control,
+			"via":     "grpc",
+		}})
+	}
+	return sessionProto(session), nil
+}
+
+func (controlPlane) DeleteSession(ctx context.Context, req *chimerav1.DeleteSessionRequest) (*chimerav1.DeleteSessionResponse, error) {
+	session, ok := getSession(req.SessionId)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "session not found")
+	}
+
+	log.Printf("[Session %s] Ended through gRPC", session.ID)
+	audit(auditEntry{Action: "session_kill", Session: session.ID, Details: map[string]interface{}{"via": "grpc"}})
+	endSession(session)
+	return &chimerav1.DeleteSessionResponse{}, nil
+}
+
+func (controlPlane) StreamStats(req *chimerav1.StreamStatsRequest, stream chimerav1.ControlPlane_StreamStatsServer) error {
+	if req.SessionId != "" {
+		if _, ok := getSession(req.SessionId); !ok {
+			return status.Error(codes.NotFound, "session not found")
+		}
+	}
+	interval := statsPushInterval
+	if req.IntervalMs > 0 {
+		interval = max(time.Duration(req.IntervalMs)*time.Millisecond, 100*time.Millisecond)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Rates are measured between ticks, so a session first shows up one
+	// tick after it is seen
+	prev := make(map[string]statsSnapshot)
+	for {
+		update := &chimerav1.StatsUpdate{
+			Timestamp: timestamppb.Now(),
+			Host:      hostStatsProto(),
+		}
+
+		sessionsLock.RLock()
+		list := make([]*StreamSession, 0, len(sessions))
+		for id, session := range sessions {
+			if req.SessionId == "" || id == req.SessionId {
+				list = append(list, session)
+			}
+		}
+		sessionsLock.RUnlock()
+
+		if req.SessionId != "" && len(list) == 0 {
+			return status.Error(codes.NotFound, "session ended")
+		}
+
+		current := make(map[string]statsSnapshot, len(list))
+		for _, session := range list {
+			stats := session.pipeline()
+			cur := stats.snapshot()
+			current[session.ID] = cur
+			if last, ok := prev[session.ID]; ok {
+				update.Sessions = append(update.Sessions, pipelineStatsProto(session.ID, stats.message(last, cur)))
+			}
+		}
+		prev = current
+
+		if err := stream.Send(update); err != nil {
+			return err
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func sessionProto(session *StreamSession) *chimerav1.Session {
+	info := &chimerav1.Session{
+		Id:             session.ID,
+		StartTime:      timestamppb.New(session.StartTime),
+		State:          session.PC.ConnectionState().String(),
+		Width:          int32(session.Width),
+		Height:         int32(session.Height),
+		Fps:            int32(session.FPS),
+		GamepadSlot:    int32(session.GamepadSlot),
+		ShortcutPolicy: session.shortcuts.policy,
+		Control:        session.control.Load(),
+		Spectators:     int32(session.spectatorCount()),
+	}
+	if session.parent != nil {
+		info.CoopHost = session.parent.ID
+	}
+	if session.GamepadSlot >= 0 {
+		info.ControllerType = session.ControllerType
+	}
+
+	session.mutex.RLock()
+	if session.mapping != nil {
+		info.MappingProfile = session.mapping.Name
+	}
+	if session.App != nil {
+		msg := session.App.message()
+		info.App = &chimerav1.App{
+			Name:  msg.Name,
+			Pid:   int32(session.App.Cmd.Process.Pid),
+			State: msg.State,
+		}
+		if msg.ExitCode != nil {
+			info.App.ExitCode = int32(*msg.ExitCode)
+		}
+	}
+	session.mutex.RUnlock()
+
+	if rtt, _, ok := session.Latency.latest(); ok {
+		info.RttMs = &rtt
+	}
+	return info
+}
+
+func hostStatsProto() *chimerav1.HostStats {
+	host := hostStats()
+
+	sessionsLock.RLock()
+	total := len(sessions)
+	sessionsLock.RUnlock()
+
+	return &chimerav1.HostStats{
+		ActiveStreams:   atomic.LoadInt32(&activeStreams),
+		FramesProcessed: host.processed,
+		FramesDropped:   host.dropped,
+		DropRatePercent: host.dropRate(),
+		QueueLength:     int32(queueLength()),
+		SessionPanics:   atomic.LoadInt64(&sessionPanics),
+		TotalSessions:   int32(total),
+	}
+}
+
+func pipelineStatsProto(sessionID string, msg StatsMessage) *chimerav1.PipelineStats {
+	return &chimerav1.PipelineStats{
+		SessionId:         sessionID,
+		CaptureFps:        msg.CaptureFPS,
+		EncodeFps:         msg.EncodeFPS,
+		SendFps:           msg.SendFPS,
+		BitrateKbps:       msg.BitrateKbps,
+		QueueDepth:        msg.QueueDepth,
+		SamplesDropped:    msg.SamplesDropped,
+		SamplesThrottled:  msg.SamplesThrottled,
+		EncoderDropped:    msg.EncoderDropped,
+		EncoderDuplicated: msg.EncoderDuplicated,
+	}
+}
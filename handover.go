@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A handover starts a new binary on the listening sockets of this process,
+// so an upgrade does not refuse a single connection. New sessions go to the
+// new process; the running ones keep streaming from this one, which exits
+// once they have all ended. Their peer connections use their own UDP
+// ports, but API calls for them, such as keyframe requests, now reach the
+// new process and find no session.
+//
+// The sockets are passed like systemd passes them, with LISTEN_FDS and
+// LISTEN_FDNAMES. Under systemd this process then hands MAINPID to the new
+// one.
+
+// Passes the new process the descriptor it signals readiness on
+const handoverReadyEnv = "CHIMERA_HANDOVER_READY_FD"
+
+// How long the new process gets to start serving
+const handoverTimeout = 30 * time.Second
+
+var (
+	// Set once a new process serves the sockets; no sessions start here
+	handedOver atomic.Bool
+
+	handoverState = struct {
+		sync.Mutex
+		sockets []handoverSocket
+		hooks   []func()
+		running bool
+	}{}
+)
+
+// handoverSocket is a listening socket the server bound or was passed
+type handoverSocket struct {
+	name string
+	conn interface {
+		File() (*os.File, error)
+		Close() error
+	}
+}
+
+// keepForHandover records a listening socket to pass on in a handover.
+// Sockets that cannot be passed are skipped.
+func keepForHandover(name string, sock interface{}) {
+	var s handoverSocket
+	switch c := sock.(type) {
+	case *net.TCPListener:
+		s = handoverSocket{name, c}
+	case *net.UDPConn:
+		s = handoverSocket{name, c}
+	case *net.UnixListener:
+		s = handoverSocket{name, c}
+	default:
+		return
+	}
+	handoverState.Lock()
+	defer handoverState.Unlock()
+	handoverState.sockets = append(handoverState.sockets, s)
+}
+
+// onHandover runs f once the new process has taken over, for servers that
+// must stop serving on more than the closed sockets, such as HTTP
+// keep-alive connections
+func onHandover(f func()) {
+	handoverState.Lock()
+	defer handoverState.Unlock()
+	handoverState.hooks = append(handoverState.hooks, f)
+}
+
+// canHandover reports why this process cannot hand over, if it cannot
+func canHandover() error {
+	if useGamepadServer {
+		// Both processes would need server.py, which binds a fixed port
+		return errors.New("the gamepad server cannot be shared between processes")
+	}
+	return nil
+}
+
+// handover starts exe on this process's sockets and waits for it to serve
+// them. On success this process stops accepting and exits once its
+// sessions end; on error it goes on as before.
+func handover(exe string) error {
+	if err := canHandover(); err != nil {
+		return err
+	}
+	handoverState.Lock()
+	if handoverState.running || handedOver.Load() {
+		handoverState.Unlock()
+		return errors.New("a handover is already in progress")
+	}
+	handoverState.running = true
+	sockets := handoverState.sockets
+	handoverState.Unlock()
+	defer func() {
+		handoverState.Lock()
+		handoverState.running = false
+		handoverState.Unlock()
+	}()
+
+	pid, err := startHandoverProcess(exe, sockets)
+	if err != nil {
+		return err
+	}
+	log.Printf("[Handover] PID %d serves new sessions", pid)
+
+	handedOver.Store(true)
+	if os.Getenv("NOTIFY_SOCKET") != "" {
+		if err := sdNotify(fmt.Sprintf("MAINPID=%d", pid)); err != nil {
+			log.Printf("[systemd] Error passing MAINPID: %v", err)
+		}
+	}
+	failQueuedOffers(errDraining.Error())
+
+	handoverState.Lock()
+	hooks := handoverState.hooks
+	handoverState.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+	for _, s := range sockets {
+		s.conn.Close()
+	}
+
+	go exitAfterSessions()
+	return nil
+}
+
+// startHandoverProcess runs exe with the sockets and returns its PID once
+// it signals that it serves them
+func startHandoverProcess(exe string, sockets []handoverSocket) (int, error) {
+	files := make([]*os.File, 0, len(sockets)+1)
+	names := make([]string, 0, len(sockets))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, s := range sockets {
+		f, err := s.conn.File()
+		if err != nil {
+			return 0, fmt.Errorf("passing %s socket: %v", s.name, err)
+		}
+		files = append(files, f)
+		names = append(names, s.name)
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = handoverEnv(len(sockets), names)
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	readyW.Close()
+	files = files[:len(files)-1]
+	go cmd.Wait()
+
+	ready.SetReadDeadline(time.Now().Add(handoverTimeout))
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("new process did not start serving: %v", err)
+	}
+	return cmd.Process.Pid, nil
+}
+
+// handoverEnv is this process's environment for the new process: the
+// passed sockets replace systemd's, and the watchdog follows MAINPID
+func handoverEnv(count int, names []string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", "WATCHDOG_PID", handoverReadyEnv:
+			continue
+		}
+		env = append(env, kv)
+	}
+	return append(env,
+		"LISTEN_FDS="+strconv.Itoa(count),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		fmt.Sprintf("%s=%d", handoverReadyEnv, listenFDsStart+count),
+	)
+}
+
+// signalHandoverReady tells the process that started this one that its
+// sockets are served
+func signalHandoverReady() {
+	fd, err := strconv.Atoi(os.Getenv(handoverReadyEnv))
+	os.Unsetenv(handoverReadyEnv)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "handover")
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.Printf("[Handover] Error signaling readiness: %v", err)
+	}
+}
+
+// exitAfterSessions waits for the sessions left running at a handover
+func exitAfterSessions() {
+	logged := -1
+	for {
+		sessionsLock.RLock()
+		active := len(sessions)
+		sessionsLock.RUnlock()
+		if active == 0 {
+			break
+		}
+		if active != logged {
+			log.Printf("[Handover] Waiting for %d sessions to end", active)
+			logged = active
+		}
+		time.Sleep(10 * time.Second)
+	}
+	log.Printf("[Handover] All sessions ended, exiting")
+	stopServer()
+	os.Exit(0)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Heartbeat protocol, on the "heartbeat" DataChannel, which clients open
+// unordered and without retransmits: the client sends a text message every
+// half second and the server echoes each back, so either side can tell
+// the other is gone. A client that stops beating for heartbeat_timeout_ms
+// (session-timeouts.json) has crashed or been suspended, a laptop lid
+// closed, long before ICE notices: its capture pauses at once, and the
+// session ends after the disconnect grace unless the beats come back.
+// Clients that never open the channel are left to ICE.
+
+var heartbeatTimeout = 2 * time.Second
+
+const heartbeatCheckInterval = 250 * time.Millisecond
+
+func handleHeartbeatChannel(ctx context.Context, session *StreamSession, dc *webrtc.DataChannel) {
+	var lastBeat atomic.Int64
+	beatCtx, stopBeating := context.WithCancel(ctx)
+
+	dc.OnOpen(func() {
+		defer session.recoverPanic("heartbeat channel")
+		lastBeat.Store(time.Now().UnixNano())
+		session.goSafe("heartbeat monitor", func() { session.watchHeartbeat(beatCtx, &lastBeat) })
+	})
+
+	dc.OnClose(stopBeating)
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		defer session.recoverPanic("heartbeat channel")
+		lastBeat.Store(time.Now().UnixNano())
+		if msg.IsString {
+			dc.SendText(string(msg.Data))
+		} else {
+			dc.Send(msg.Data)
+		}
+	})
+}
+
+// watchHeartbeat marks the session's peer lost while its beats are late,
+// until ctx ends
+func (s *StreamSession) watchHeartbeat(ctx context.Context, lastBeat *atomic.Int64) {
+	ticker := time.NewTicker(heartbeatCheckInterval)
+	defer ticker.Stop()
+	defer func() {
+		// Without the channel, ICE is left to tell; an ending session
+		// stays paused
+		if s.ctx.Err() == nil && s.heartbeatLost.Swap(false) {
+			s.wakeIdleCheck()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		silent := time.Since(time.Unix(0, lastBeat.Load()))
+		s.setHeartbeatLost(silent >= heartbeatTimeout, silent)
+	}
+}
+
+func (s *StreamSession) setHeartbeatLost(lost bool, silent time.Duration) {
+	if s.heartbeatLost.Swap(lost) == lost {
+		return
+	}
+	if lost {
+		log.Printf("[Session %s] No heartbeat for %v", s.ID, silent.Round(time.Millisecond))
+		if s.endConnection != nil {
+			s.endAfter(disconnectGrace, "stopped its heartbeat", s.endConnection)
+		}
+	} else {
+		log.Printf("[Session %s] Heartbeat back", s.ID)
+		if s.PC.ConnectionState() == webrtc.PeerConnectionStateConnected {
+			s.stopEndTimer()
+		}
+	}
+	s.wakeIdleCheck()
+}
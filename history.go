@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Recent stats are kept in memory, one point per second for the host and
+// each session, so the web UI can graph them without a metrics server.
+
+// statsHistoryLength is how far back /stats/history goes
+const statsHistoryLength = 10 * time.Minute
+
+// statsPoint is one second of a session's or the host's stats
+type statsPoint struct {
+	Timestamp   int64   `json:"timestamp"` // Unix milliseconds
+	SendFPS     float64 `json:"send_fps"`
+	EncodeFPS   float64 `json:"encode_fps"`
+	BitrateKbps float64 `json:"bitrate_kbps"`
+	// Dropped counts frames dropped during the second
+	Dropped    int64   `json:"dropped"`
+	QueueDepth int32   `json:"queue_depth"`
+	PacketLoss float64 `json:"packet_loss"`
+	// Sessions is set on host points, which sum the sessions' and take
+	// the worst packet loss
+	Sessions *int `json:"sessions,omitempty"`
+}
+
+// statsHistory is a ring of the last statsHistoryLength of points
+type statsHistory struct {
+	mu     sync.Mutex
+	points []statsPoint
+	next   int // Where the next point goes once points is full
+}
+
+func (h *statsHistory) add(p statsPoint) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	size := int(statsHistoryLength / statsPushInterval)
+	if len(h.points) < size {
+		h.points = append(h.points, p)
+		return
+	}
+	h.points[h.next] = p
+	h.next = (h.next + 1) % size
+}
+
+// since returns the points after the Unix millisecond timestamp, oldest
+// first
+func (h *statsHistory) since(after int64) []statsPoint {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	points := make([]statsPoint, 0, len(h.points))
+	for _, p := range append(h.points[h.next:len(h.points):len(h.points)], h.points[:h.next]...) {
+		if p.Timestamp > after {
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+var hostHistory statsHistory
+
+// record adds a second of the session's stats to its history
+func (s *PipelineStats) record(msg StatsMessage, droppedBefore int64) statsPoint {
+	p := statsPoint{
+		Timestamp:   msg.Timestamp,
+		SendFPS:     msg.SendFPS,
+		EncodeFPS:   msg.EncodeFPS,
+		BitrateKbps: msg.BitrateKbps,
+		Dropped:     msg.SamplesDropped - droppedBefore,
+		QueueDepth:  msg.QueueDepth,
+		PacketLoss:  msg.PacketLoss,
+	}
+	s.history.add(p)
+	return p
+}
+
+// recordHostStats sums a second of session points into a host point
+func recordHostStats(at time.Time, points []statsPoint) {
+	sessions := len(points)
+	host := statsPoint{Timestamp: at.UnixMilli(), Sessions: &sessions}
+	for _, p := range points {
+		host.SendFPS += p.SendFPS
+		host.EncodeFPS += p.EncodeFPS
+		host.BitrateKbps += p.BitrateKbps
+		host.Dropped += p.Dropped
+		host.QueueDepth += p.QueueDepth
+		host.PacketLoss = max(host.PacketLoss, p.PacketLoss)
+	}
+	hostHistory.add(host)
+}
+
+// handleStatsHistory returns the host's and the sessions' recent stats, or
+// one session's with ?session=. Like GET /sessions, admins see every
+// session and owners their own. ?since= (Unix milliseconds) returns only
+// newer points, for polling.
+func handleStatsHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var since int64
+	if v := query.Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_since", "since must be Unix milliseconds")
+			return
+		}
+	}
+
+	resp := map[string]interface{}{
+		"interval_ms": statsPushInterval.Milliseconds(),
+		"timestamp":   time.Now().Unix(),
+	}
+	if id := query.Get("session"); id != "" {
+		session, ok := getSession(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+			return
+		}
+		if !session.canManage(r) {
+			writeError(w, http.StatusForbidden, "not_owner", "Only the session owner can see its stats")
+			return
+		}
+		resp["session"] = session.pipeline().history.since(since)
+	} else {
+		resp["host"] = hostHistory.since(since)
+		admin := isAdmin(r)
+		series := make(map[string][]statsPoint)
+		sessionsLock.RLock()
+		for id, session := range sessions {
+			if !admin && !session.canManage(r) {
+				continue
+			}
+			series[id] = session.pipeline().history.since(since)
+		}
+		sessionsLock.RUnlock()
+		resp["sessions"] = series
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
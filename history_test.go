@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// addTestUsers signs in users with the given permissions, returning their
+// tokens
+func addTestUsers(t *testing.T, perms map[string][]string) map[string]string {
+	usersLock.Lock()
+	saved, savedKey := users, userKey
+	users = nil
+	userKey = []byte("test user key")
+	tokens := make(map[string]string)
+	for name, p := range perms {
+		users = append(users, &userAccount{Name: name, Permissions: p})
+		tokens[name] = signUserToken(userClaims{Subject: name, Provider: "password", Expires: time.Now().Add(time.Hour).Unix()})
+	}
+	usersLock.Unlock()
+	t.Cleanup(func() {
+		usersLock.Lock()
+		users, userKey = saved, savedKey
+		usersLock.Unlock()
+	})
+	return tokens
+}
+
+func TestStatsHistoryOnlyShowsOwnSessions(t *testing.T) {
+	tokens := addTestUsers(t, map[string][]string{
+		"alice": {permStream},
+		"bob":   {permStream},
+		"root":  {permAdmin},
+	})
+	addTestSession(t, "alice1", "alice-owner").user = "alice"
+	addTestSession(t, "bob1", "bob-owner").user = "bob"
+
+	listed := func(header map[string]string) map[string]bool {
+		w := apiRequest(handleStatsHistory, "GET", "/stats/history", "/stats/history", "", header)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		var resp struct {
+			Sessions map[string]json.RawMessage `json:"sessions"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		ids := make(map[string]bool)
+		for id := range resp.Sessions {
+			ids[id] = true
+		}
+		return ids
+	}
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   []string
+	}{
+		{"anonymous", nil, nil},
+		{"alice", map[string]string{userTokenHeader: tokens["alice"]}, []string{"alice1"}},
+		{"bob", map[string]string{userTokenHeader: tokens["bob"]}, []string{"bob1"}},
+		{"owner token", map[string]string{"Authorization": "Bearer bob-owner"}, []string{"bob1"}},
+		{"admin", map[string]string{userTokenHeader: tokens["root"]}, []string{"alice1", "bob1"}},
+	}
+	for _, test := range tests {
+		got := listed(test.header)
+		if len(got) != len(test.want) {
+			t.Errorf("%s sees %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for _, id := range test.want {
+			if !got[id] {
+				t.Errorf("%s sees %v, want %v", test.name, got, test.want)
+			}
+		}
+	}
+
+	for _, test := range []struct {
+		name    string
+		session string
+		status  int
+	}{
+		{"bob1", "bob1", http.StatusForbidden},
+		{"alice1", "alice1", http.StatusOK},
+	} {
+		w := apiRequest(handleStatsHistory, "GET", "/stats/history", "/stats/history?session="+test.session, "",
+			map[string]string{userTokenHeader: tokens["alice"]})
+		if w.Code != test.status {
+			t.Errorf("alice asking for %s: status %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
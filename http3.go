@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// HTTPS serves the web client and API over HTTP/1.1 and HTTP/2 on TCP and
+// over HTTP/3 on UDP at the same port; HTTPS responses advertise HTTP/3
+// with Alt-Svc. Browsers only use HTTP/3 with a certificate they trust, so
+// this starts only once tlsCertFile and tlsKeyFile exist, for example from
+// Let's Encrypt or, on a LAN, from "chimera-go cert lan", see lancert.go.
+var (
+	httpsAddr   = ":8443"
+	tlsCertFile = "tls-cert.pem"
+	tlsKeyFile  = "tls-key.pem"
+)
+
+func startHTTPS(handler http.Handler) {
+	if _, err := os.Stat(tlsCertFile); os.IsNotExist(err) {
+		log.Printf("[HTTPS] No %s, HTTPS and HTTP/3 disabled; chimera-go cert lan makes one for the LAN", tlsCertFile)
+		return
+	}
+	renewLANCert()
+	cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		log.Printf("[HTTPS] Error loading certificate: %v", err)
+		return
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	tcpListener, err := listen("https", httpsAddr)
+	if err != nil {
+		log.Printf("[HTTPS] Error listening on %s: %v", httpsAddr, err)
+		return
+	}
+	udpConn, err := listenPacket("http3", httpsAddr)
+	if err != nil {
+		tcpListener.Close()
+		log.Printf("[HTTP/3] Error listening on %s: %v", httpsAddr, err)
+		return
+	}
+
+	h3 := &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+	}
+	go func() {
+		if err := h3.Serve(udpConn); err != nil && !handedOver.Load() {
+			log.Printf("[HTTP/3] Server error: %v", err)
+		}
+	}()
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h3.SetQuicHeaders(w.Header())
+			handler.ServeHTTP(w, r)
+		}),
+		TLSConfig: tlsConfig,
+	}
+	onHandover(func() {
+		server.SetKeepAlivesEnabled(false)
+		h3.Close()
+	})
+	go func() {
+		if err := server.ServeTLS(tcpListener, "", ""); err != nil && !handedOver.Load() {
+			log.Printf("[HTTPS] Server error: %v", err)
+		}
+	}()
+	log.Printf("[Go] HTTPS and HTTP/3 server running on https://%s", tcpListener.Addr())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Idle sessions stop capturing: FFmpeg exits, freeing its hardware encoder
+// session, and in-process sources close their grabber and encoder. A
+// session is idle once, for idle.json's
+//
+//	{"pause_after_seconds": 120}
+//
+// (0 never pauses), it has had no input and nobody watching: its peer is
+// not connected or reports its page hidden, and no spectator or co-op
+// guest is watching either. Input or a viewer coming back resumes it on a
+// keyframe; the player holds the last frame meanwhile.
+
+var idleFile = "idle.json"
+
+const idleCheckInterval = time.Second
+
+var idlePauseAfter = 2 * time.Minute
+
+func loadIdlePause() {
+	data, err := os.ReadFile(idleFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading idle settings: %v", err)
+		}
+		return
+	}
+
+	var cfg struct {
+		PauseAfterSeconds int `json:"pause_after_seconds"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Printf("Error parsing %s: %v", idleFile, err)
+		return
+	}
+	if cfg.PauseAfterSeconds < 0 {
+		log.Printf("Ignoring %s, pause_after_seconds must not be negative", idleFile)
+		return
+	}
+	idlePauseAfter = time.Duration(cfg.PauseAfterSeconds) * time.Second
+	log.Printf("Idle sessions pause after %v", idlePauseAfter)
+}
+
+// VisibilityMessage is sent by the client as text on the "input"
+// DataChannel when its page is hidden or shown again
+type VisibilityMessage struct {
+	Type    string `json:"type"` // "visibility"
+	Visible bool   `json:"visible"`
+}
+
+func (s *StreamSession) handleVisibilityMessage(data []byte) {
+	var m VisibilityMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		s.Input.rejected.Add(1)
+		return
+	}
+	s.hidden.Store(!m.Visible)
+	if m.Visible {
+		s.markActive()
+	}
+}
+
+// markActive records activity in the session, or in the host session of
+// a co-op guest, and wakes it if it was idle
+func (s *StreamSession) markActive() {
+	host := s
+	if s.parent != nil {
+		host = s.parent
+	}
+	host.lastActive.Store(time.Now().UnixNano())
+	host.wakeIdleCheck()
+}
+
+// wakeIdleCheck has pauseWhenIdle look at the session now
+func (s *StreamSession) wakeIdleCheck() {
+	select {
+	case s.activity <- struct{}{}:
+	default:
+	}
+}
+
+// watched reports whether the session's peer, a co-op guest or a
+// spectator is watching its video; a peer whose heartbeat stopped is not
+func (s *StreamSession) watched() bool {
+	if s.spectatorCount() > 0 {
+		return true
+	}
+	sessionsLock.RLock()
+	defer sessionsLock.RUnlock()
+	for _, peer := range sessions {
+		if (peer == s || peer.parent == s) && !peer.hidden.Load() && !peer.heartbeatLost.Load() &&
+			peer.PC.ConnectionState() == webrtc.PeerConnectionStateConnected {
+			return true
+		}
+	}
+	return false
+}
+
+// pauseWhenIdle pauses the session's capture while it is idle, or while
+// its peer's heartbeat has stopped and nobody else watches, until ctx ends
+func (s *StreamSession) pauseWhenIdle(ctx context.Context) {
+	s.lastActive.Store(time.Now().UnixNano())
+
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.activity:
+		}
+
+		watched := s.watched()
+		if watched {
+			s.lastActive.Store(time.Now().UnixNano())
+		}
+		idleFor := time.Since(time.Unix(0, s.lastActive.Load()))
+		unreachable := s.heartbeatLost.Load() && !watched
+		idle := (idlePauseAfter > 0 && idleFor >= idlePauseAfter) || unreachable
+		if idle == s.encoder.config().Paused {
+			continue
+		}
+		if err := s.updateEncoding(func(cfg *CaptureConfig) { cfg.Paused = idle }); err != nil {
+			log.Printf("[Session %s] Error pausing or resuming capture: %v", s.ID, err)
+			continue
+		}
+		switch {
+		case unreachable:
+			log.Printf("[Session %s] Peer unreachable, capture paused", s.ID)
+		case idle:
+			log.Printf("[Session %s] Idle for %v, capture paused", s.ID, idleFor.Round(time.Second))
+		default:
+			log.Printf("[Session %s] Active again, capture resumed", s.ID)
+		}
+	}
+}
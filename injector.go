@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/lightsyr/chimera-go/input"
+)
+
+// inputInjector returns the session's injector, creating it on first use.
+// The injector lives until the session context ends.
+func (s *StreamSession) inputInjector(ctx context.Context) (input.Injector, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.injector != nil {
+		return s.injector, nil
+	}
+
+	injector, err := newInjector(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	s.injector = injector
+
+	s.goSafe("injector cleanup", func() {
+		<-ctx.Done()
+		injector.Close()
+	})
+
+	return injector, nil
+}
+
+// dropInjector forgets a failed injector so the next caller creates a new one
+func (s *StreamSession) dropInjector(injector input.Injector) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.injector == injector {
+		s.injector = nil
+		log.Printf("[Session %s] Input injector released", s.ID)
+	}
+}
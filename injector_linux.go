@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+
+	"github.com/lightsyr/chimera-go/input"
+)
+
+// Input goes straight to uinput devices on Linux; no gamepad server needed
+const useGamepadServer = false
+
+func newInjector(ctx context.Context, s *StreamSession) (input.Injector, error) {
+	inj, err := input.NewUinputInjector(s.ID, s.Width, s.Height, s.GamepadSlot)
+	if err != nil {
+		return nil, err
+	}
+	if s.GamepadSlot >= 0 {
+		s.goSafe("uinput force feedback", func() {
+			err := inj.ForwardRumble(s.sendRumble)
+			if ctx.Err() == nil && !errors.Is(err, os.ErrClosed) {
+				log.Printf("[Session %s] Gamepad force feedback ended: %v", s.ID, err)
+			}
+		})
+	}
+	return inj, nil
+}
+
+// probeInjector reports whether sessions can create their input devices
+func probeInjector() (string, error) {
+	if err := input.ProbeUinput(); err != nil {
+		return "", err
+	}
+	return "uinput", nil
+}
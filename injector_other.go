@@ -0,0 +1,62 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"log"
+	"os/exec"
+
+	"github.com/lightsyr/chimera-go/input"
+)
+
+// The Python gamepad server owns the virtual devices on this platform
+const useGamepadServer = true
+
+// The gamepad server started by main
+var gamepadBridgeURL = "ws://127.0.0.1:9000"
+
+func newInjector(ctx context.Context, s *StreamSession) (input.Injector, error) {
+	bridge, err := connectGamepadBridge(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	return bridge, nil
+}
+
+// probeInjector reports whether sessions can reach their input devices
+func probeInjector() (string, error) {
+	path, err := exec.LookPath(pythonPath)
+	if err != nil {
+		return "", err
+	}
+	return "gamepad server with " + path, nil
+}
+
+// connectGamepadBridge dials the gamepad server for a session and delivers
+// its events until the connection closes
+func connectGamepadBridge(ctx context.Context, s *StreamSession) (*input.GamepadBridge, error) {
+	bridge, err := input.DialGamepadBridge(gamepadBridgeURL, s.GamepadSlot, s.ControllerType)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[Session %s] Connected to gamepad server (slot %d)", s.ID, s.GamepadSlot)
+
+	s.goSafe("gamepad bridge", func() {
+		err := bridge.ReadEvents(s.dispatchGamepadEvent)
+		if ctx.Err() == nil {
+			log.Printf("[Session %s] Gamepad bridge closed: %v", s.ID, err)
+		}
+		// Let the next caller reconnect
+		s.dropInjector(bridge)
+	})
+
+	return bridge, nil
+}
+
+func (s *StreamSession) dispatchGamepadEvent(event input.BridgeEvent) {
+	switch event.Type {
+	case "rumble":
+		s.sendRumble(float64(event.LargeMotor)/255, float64(event.SmallMotor)/255)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// In-process sources grab raw frames and hand them to an encoder library
+// through cgo, with no FFmpeg process or pipe in between. They exist only
+// in builds with an encoder tag, e.g. `go build -tags x264`, which register
+// them from init.
+
+// rawFrame is a picture in I420: full-size Y, quarter-size U and V
+type rawFrame struct {
+	width, height int
+	y, u, v       []byte
+}
+
+func newRawFrame(width, height int) *rawFrame {
+	// I420 needs even dimensions
+	width, height = width&^1, height&^1
+	return &rawFrame{
+		width:  width,
+		height: height,
+		y:      make([]byte, width*height),
+		u:      make([]byte, width*height/4),
+		v:      make([]byte, width*height/4),
+	}
+}
+
+// newScaledFrame returns the frame to encode into when cfg scales the
+// captured picture, nil when it does not
+func newScaledFrame(cfg CaptureConfig) *rawFrame {
+	if w, h := cfg.outputSize(); w != cfg.Width || h != cfg.Height {
+		return newRawFrame(w, h)
+	}
+	return nil
+}
+
+// scaleI420 resizes src into dst, picking the nearest pixel. Cheap enough
+// to run per frame; the ladder only scales down when bandwidth is short.
+func scaleI420(src, dst *rawFrame) {
+	scalePlane(src.y, src.width, src.height, dst.y, dst.width, dst.height)
+	scalePlane(src.u, src.width/2, src.height/2, dst.u, dst.width/2, dst.height/2)
+	scalePlane(src.v, src.width/2, src.height/2, dst.v, dst.width/2, dst.height/2)
+}
+
+func scalePlane(src []byte, srcW, srcH int, dst []byte, dstW, dstH int) {
+	for y := 0; y < dstH; y++ {
+		srcRow := src[y*srcH/dstH*srcW:]
+		dstRow := dst[y*dstW:]
+		for x := 0; x < dstW; x++ {
+			dstRow[x] = srcRow[x*srcW/dstW]
+		}
+	}
+}
+
+// A frameGrabber fills frames with what is on screen
+type frameGrabber interface {
+	grab(frame *rawFrame) error
+	close() error
+}
+
+// A videoEncoder turns frames into H.264 NAL units with start codes,
+// starting an IDR when keyframe is set. The returned slices are only valid
+// until the next call.
+type videoEncoder interface {
+	encode(frame *rawFrame, pts int64, keyframe bool) ([][]byte, error)
+	close() error
+}
+
+// registerInProcessSource adds a source built from a grabber and encoder
+func registerInProcessSource(name, goos string,
+	newGrabber func(cfg CaptureConfig) (frameGrabber, error),
+	newEncoder func(cfg CaptureConfig) (videoEncoder, error)) {
+
+	captureSourceTypes[name] = captureSourceType{
+		goos: goos,
+		caps: CaptureCapabilities{Codecs: []string{"h264"}, Live: goos != ""},
+		open: func(session *StreamSession, stats *PipelineStats) CaptureSource {
+			return &inProcessSource{
+				name:       name,
+				session:    session,
+				stats:      stats,
+				newGrabber: newGrabber,
+				newEncoder: newEncoder,
+			}
+		},
+	}
+}
+
+type inProcessSource struct {
+	name       string
+	session    *StreamSession
+	stats      *PipelineStats
+	newGrabber func(cfg CaptureConfig) (frameGrabber, error)
+	newEncoder func(cfg CaptureConfig) (videoEncoder, error)
+
+	keyframe atomic.Bool        // Requested for the next frame
+	reconfig chan CaptureConfig // Applied before the next frame
+	units    chan AccessUnit
+	err      error // Why units closed; read after it has
+	cancel   context.CancelFunc
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func (s *inProcessSource) Capabilities() CaptureCapabilities {
+	return captureSourceTypes[s.name].caps
+}
+
+func (s *inProcessSource) Start(ctx context.Context, cfg CaptureConfig) error {
+	grabber, err := s.newGrabber(cfg)
+	if err != nil {
+		return err
+	}
+	encoder, err := s.newEncoder(cfg)
+	if err != nil {
+		grabber.close()
+		return err
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.reconfig = make(chan CaptureConfig, 1)
+	s.units = make(chan AccessUnit, 8)
+	s.done = make(chan struct{})
+	log.Printf("[Session %s] In-process %s capture started", s.session.ID, s.name)
+
+	s.session.goSafe("in-process capture", func() {
+		defer close(s.done)
+		defer close(s.units)
+		s.err = s.run(ctx, cfg, grabber, encoder)
+	})
+	return nil
+}
+
+// run grabs and encodes one frame per tick until ctx ends
+func (s *inProcessSource) run(ctx context.Context, cfg CaptureConfig, grabber frameGrabber, encoder videoEncoder) error {
+	defer func() {
+		if grabber != nil {
+			grabber.close()
+		}
+		if encoder != nil {
+			encoder.close()
+		}
+	}()
+
+	frame := newRawFrame(cfg.Width, cfg.Height)
+	scaled := newScaledFrame(cfg)
+	frameDuration := time.Second / time.Duration(cfg.FPS)
+	ticker := time.NewTicker(frameDuration)
+	defer ticker.Stop()
+
+	var ptsBase time.Duration // Of the current encoder's first frame
+	// grabbed holds when the frames the encoder still holds were grabbed
+	var grabbed []time.Time
+	for pts := int64(0); ; pts++ {
+		select {
+		case <-ctx.Done():
+			return io.EOF
+		case next := <-s.reconfig:
+			if next.Paused {
+				// Nothing is grabbed or encoded until a config resumes
+				grabber.close()
+				encoder.close()
+				grabber, encoder = nil, nil
+				for next.Paused {
+					select {
+					case <-ctx.Done():
+						return io.EOF
+					case next = <-s.reconfig:
+					}
+				}
+			}
+			// A new encoder, and a new grabber if the size changed
+			if grabber == nil || next.Width != cfg.Width || next.Height != cfg.Height {
+				g, err := s.newGrabber(next)
+				if err != nil {
+					return err
+				}
+				if grabber != nil {
+					grabber.close()
+				}
+				grabber = g
+				frame = newRawFrame(next.Width, next.Height)
+			}
+			scaled = newScaledFrame(next)
+			e, err := s.newEncoder(next)
+			if err != nil {
+				return err
+			}
+			if encoder != nil {
+				encoder.close()
+			}
+			encoder = e
+			grabbed = grabbed[:0]
+
+			ptsBase += time.Duration(pts) * frameDuration
+			pts = 0
+			cfg = next
+			frameDuration = time.Second / time.Duration(cfg.FPS)
+			ticker.Reset(frameDuration)
+		case <-ticker.C:
+		}
+
+		grabbed = append(grabbed, time.Now())
+		if err := grabber.grab(frame); err != nil {
+			return err
+		}
+		encoded := frame
+		if scaled != nil {
+			scaleI420(frame, scaled)
+			encoded = scaled
+		}
+		if cfg.LatencyOverlay {
+			drawLatencyCode(encoded, time.Now().UnixMilli())
+		}
+
+		nalus, err := encoder.encode(encoded, pts, s.keyframe.Swap(false))
+		if err != nil {
+			return err
+		}
+		if len(nalus) == 0 {
+			continue // Encoder delay
+		}
+		s.stats.encodedFrames.Add(1)
+
+		au := AccessUnit{
+			PTS:     ptsBase + time.Duration(pts)*frameDuration,
+			Grabbed: grabbed[0],
+			Encoded: time.Now(),
+		}
+		grabbed = grabbed[1:]
+		for _, nalu := range nalus {
+			au.Data = append(au.Data, nalu...)
+			au.Keyframe = au.Keyframe || isIDRSlice(nalu)
+		}
+		select {
+		case s.units <- au:
+		case <-ctx.Done():
+			return io.EOF
+		}
+	}
+}
+
+func (s *inProcessSource) ReadAccessUnit() (AccessUnit, error) {
+	if s.units == nil {
+		return AccessUnit{}, errCaptureNotStarted
+	}
+	au, ok := <-s.units
+	if !ok {
+		return AccessUnit{}, s.err
+	}
+	return au, nil
+}
+
+// isIDRSlice reports whether an Annex-B NAL unit is a keyframe slice
+func isIDRSlice(nalu []byte) bool {
+	nalu = bytes.TrimLeft(nalu, "\x00")
+	return len(nalu) > 1 && nalu[0] == 1 && nalu[1]&0x1f == 5
+}
+
+func (s *inProcessSource) RequestKeyframe() error {
+	if s.units == nil {
+		return errCaptureNotStarted
+	}
+	s.keyframe.Store(true)
+	return nil
+}
+
+// Reconfigure replaces the encoder between frames; the new one starts
+// with a keyframe
+func (s *inProcessSource) Reconfigure(cfg CaptureConfig) error {
+	if s.units == nil {
+		return errCaptureNotStarted
+	}
+	select {
+	case <-s.reconfig: // Superseded
+	default:
+	}
+	select {
+	case s.reconfig <- cfg:
+		return nil
+	case <-s.done:
+		return errCaptureNotStarted
+	}
+}
+
+func (s *inProcessSource) Stop() error {
+	if s.cancel == nil {
+		return nil
+	}
+	s.stopOnce.Do(func() {
+		s.cancel()
+		<-s.done
+	})
+	return nil
+}
+
+// drawLatencyCode burns the barcode latencyOverlayFilters draws with
+// FFmpeg: block i is white when bit i of the capture time is set
+func drawLatencyCode(frame *rawFrame, captureMs int64) {
+	size := latencyCodeBlockSize
+	if frame.height < size || frame.width < latencyCodeBits*size {
+		return
+	}
+	for bit := 0; bit < latencyCodeBits; bit++ {
+		luma := byte(16)
+		if captureMs&(1<<bit) != 0 {
+			luma = 235
+		}
+		for y := 0; y < size; y++ {
+			row := frame.y[y*frame.width+bit*size:]
+			for x := 0; x < size; x++ {
+				row[x] = luma
+			}
+		}
+	}
+	// Neutral chroma keeps the blocks grey
+	for y := 0; y < size/2; y++ {
+		for x := 0; x < latencyCodeBits*size/2; x++ {
+			frame.u[y*frame.width/2+x] = 128
+			frame.v[y*frame.width/2+x] = 128
+		}
+	}
+}
+
+// testPatternGrabber draws moving bars, for checking a build's encoder
+// without a display
+type testPatternGrabber struct {
+	frame int
+}
+
+func newTestPatternGrabber(cfg CaptureConfig) (frameGrabber, error) {
+	return &testPatternGrabber{}, nil
+}
+
+func (g *testPatternGrabber) grab(frame *rawFrame) error {
+	g.frame++
+	for y := 0; y < frame.height; y++ {
+		for x := 0; x < frame.width; x++ {
+			frame.y[y*frame.width+x] = byte((x+g.frame*4)*8*219/frame.width%220 + 16)
+		}
+	}
+	for i := range frame.u {
+		frame.u[i] = byte(128 + g.frame%64)
+		frame.v[i] = byte(192 - g.frame%64)
+	}
+	return nil
+}
+
+func (g *testPatternGrabber) close() error {
+	return nil
+}
+
+// bgraToI420 converts a BGRA picture with the given row stride, using
+// BT.601 limited range as the encoder signals by default
+func bgraToI420(src []byte, stride int, frame *rawFrame) {
+	for y := 0; y < frame.height; y++ {
+		row := src[y*stride:]
+		for x := 0; x < frame.width; x++ {
+			b, g, r := int(row[4*x]), int(row[4*x+1]), int(row[4*x+2])
+			frame.y[y*frame.width+x] = byte((66*r+129*g+25*b+128)>>8 + 16)
+		}
+	}
+	for y := 0; y < frame.height/2; y++ {
+		row := src[2*y*stride:]
+		for x := 0; x < frame.width/2; x++ {
+			b, g, r := int(row[8*x]), int(row[8*x+1]), int(row[8*x+2])
+			frame.u[y*frame.width/2+x] = byte((-38*r-74*g+112*b+128)>>8 + 128)
+			frame.v[y*frame.width/2+x] = byte((112*r-94*g-18*b+128)>>8 + 128)
+		}
+	}
+}
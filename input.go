@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/lightsyr/chimera-go/input"
+	"github.com/pion/webrtc/v3"
+)
+
+// handleInputChannel decodes the binary protocol of package input and
+// injects what the session is allowed to send
+func handleInputChannel(ctx context.Context, session *StreamSession, dc *webrtc.DataChannel) {
+	dc.OnOpen(func() {
+		defer session.recoverPanic("input channel")
+		if _, err := session.inputInjector(ctx); err != nil {
+			log.Printf("[Session %s] Error creating input injector: %v", session.ID, err)
+			dc.Close()
+			return
+		}
+		session.trackInputChannel(dc)
+	})
+
+	dc.OnClose(func() {
+		defer session.recoverPanic("input channel")
+		session.mutex.Lock()
+		if session.inputChannel == dc {
+			session.inputChannel = nil
+		}
+		session.mutex.Unlock()
+	})
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		defer session.recoverPanic("input channel")
+		// Not input, so peers without control send them too
+		if msg.IsString && session.handleClientMessage(msg.Data) {
+			return
+		}
+		// Viewers and peers without control: dropped here so no input type
+		// can slip through
+		if !session.acceptsInput() {
+			session.Input.rejected.Add(1)
+			return
+		}
+		session.recordInput(msg.Data, msg.IsString)
+
+		injector, err := session.inputInjector(ctx)
+		if err != nil {
+			return
+		}
+
+		if msg.IsString {
+			if string(msg.Data) == "reset" && session.GamepadSlot >= 0 {
+				injector.Reset()
+				session.markActive()
+			}
+			return
+		}
+		if len(msg.Data) == 0 {
+			return
+		}
+
+		accepted, err := injectInput(session, injector, msg.Data)
+		if err != nil {
+			log.Printf("[Session %s] Error injecting input: %v", session.ID, err)
+		}
+		if accepted && err == nil {
+			session.Input.count(msg.Data[0])
+			session.markActive()
+		} else {
+			session.Input.rejected.Add(1)
+		}
+	})
+}
+
+// handleClientMessage handles the JSON messages clients send on the input
+// channel that are not input, and reports whether data was one
+func (s *StreamSession) handleClientMessage(data []byte) bool {
+	var m struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return false
+	}
+	switch m.Type {
+	case "viewport":
+		s.handleViewportMessage(data)
+	case "visibility":
+		s.handleVisibilityMessage(data)
+	case "macro":
+		s.handleMacroMessage(data)
+	default:
+		return false
+	}
+	return true
+}
+
+// injectInput delivers one binary input message. accepted is false when the
+// message is invalid or not allowed for this session.
+func injectInput(session *StreamSession, injector input.Injector, data []byte) (accepted bool, err error) {
+	switch data[0] {
+	case input.TypeAxis, input.TypeButton:
+		// Sessions without a slot must not drive another player's controller
+		if session.GamepadSlot < 0 {
+			return false, nil
+		}
+
+		ev, ok := input.ParseGamepad(data)
+		if !ok {
+			return false, nil
+		}
+
+		session.mutex.RLock()
+		mapping := session.mapping
+		session.mutex.RUnlock()
+		if mapping != nil {
+			if ev, ok = mapping.apply(ev); !ok {
+				return false, nil
+			}
+		}
+		return true, injector.Gamepad(ev)
+
+	case input.TypeMotion:
+		ev, ok := input.ParseMotion(data)
+		if !ok || session.GamepadSlot < 0 {
+			return false, nil
+		}
+		return true, injector.Motion(ev)
+	}
+
+	// Co-op guests only drive their own controller
+	if session.parent != nil {
+		return false, nil
+	}
+
+	switch data[0] {
+	case input.TypeTouch:
+		ev, ok := input.ParseTouch(data)
+		if !ok {
+			return false, nil
+		}
+		return true, injector.Touch(ev.ToDesktop(session.Width, session.Height))
+
+	case input.TypeKey:
+		ev, ok := input.ParseKey(data)
+		if !ok {
+			return false, nil
+		}
+		for _, ev := range session.shortcuts.filter(ev) {
+			if err := injector.Key(ev); err != nil {
+				return true, err
+			}
+		}
+		return true, nil
+
+	case input.TypeMouse:
+		ev, ok := input.ParseMouse(data)
+		if !ok {
+			return false, nil
+		}
+		return true, injector.Mouse(ev)
+	}
+	return false, nil
+}
@@ -0,0 +1,116 @@
+package input
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// BridgeEvent is a JSON message pushed by the Python gamepad server
+type BridgeEvent struct {
+	Type       string `json:"type"`
+	Slot       int    `json:"slot"`
+	LargeMotor int    `json:"large_motor"` // 0-255
+	SmallMotor int    `json:"small_motor"` // 0-255
+}
+
+// GamepadBridge is one session's connection to the Python gamepad server,
+// which owns the ViGEm virtual controllers and reports force feedback back
+// as JSON text. It is bound to the session's controller slot when it has
+// one; host-level input such as touch, keyboard and mouse goes through the
+// same connection. It is the Injector used on hosts without uinput.
+type GamepadBridge struct {
+	conn    *websocket.Conn
+	slot    int
+	writeMu sync.Mutex
+}
+
+// DialGamepadBridge connects to the gamepad server at url, taking the
+// controller slot unless slot is negative
+func DialGamepadBridge(url string, slot int, controllerType string) (*GamepadBridge, error) {
+	conn, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		return nil, err
+	}
+
+	b := &GamepadBridge{conn: conn, slot: slot}
+	if slot < 0 {
+		return b, nil
+	}
+
+	if err := b.sendText(fmt.Sprintf("slot %d %s", slot, controllerType)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// Input shaping is done by the session's mapping profile
+	if err := b.sendText("deadzone 0"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *GamepadBridge) Close() error {
+	return b.conn.Close()
+}
+
+func (b *GamepadBridge) sendText(text string) error {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	return websocket.Message.Send(b.conn, text)
+}
+
+// sendInput forwards one binary input message
+func (b *GamepadBridge) sendInput(msg []byte) error {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	return websocket.Message.Send(b.conn, msg)
+}
+
+// ReadEvents delivers the server's events until the connection closes
+func (b *GamepadBridge) ReadEvents(onEvent func(BridgeEvent)) error {
+	for {
+		var text string
+		if err := websocket.Message.Receive(b.conn, &text); err != nil {
+			return err
+		}
+
+		// The server also sends plain-text replies (welcome, pong, status)
+		if !strings.HasPrefix(text, "{") {
+			continue
+		}
+
+		var event BridgeEvent
+		if err := json.Unmarshal([]byte(text), &event); err != nil {
+			continue
+		}
+		onEvent(event)
+	}
+}
+
+func (b *GamepadBridge) Gamepad(ev GamepadEvent) error {
+	return b.sendInput(ev.Encode())
+}
+
+func (b *GamepadBridge) Motion(ev MotionEvent) error {
+	return b.sendInput(ev.Encode())
+}
+
+func (b *GamepadBridge) Touch(ev TouchEvent) error {
+	return b.sendInput(ev.Encode())
+}
+
+func (b *GamepadBridge) Key(ev KeyEvent) error {
+	return b.sendInput(ev.Encode())
+}
+
+func (b *GamepadBridge) Mouse(ev MouseEvent) error {
+	return b.sendInput(ev.Encode())
+}
+
+func (b *GamepadBridge) Reset() error {
+	return b.sendText("reset")
+}
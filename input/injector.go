@@ -0,0 +1,15 @@
+package input
+
+// Injector delivers one session's input to the host: uinput devices on
+// Linux, the Python gamepad server (ViGEm and Windows input injection)
+// elsewhere. Embedders can supply their own.
+type Injector interface {
+	Gamepad(ev GamepadEvent) error
+	Motion(ev MotionEvent) error
+	Touch(ev TouchEvent) error // Host desktop pixels
+	Key(ev KeyEvent) error
+	Mouse(ev MouseEvent) error
+	// Reset returns the session's controller to its neutral state
+	Reset() error
+	Close() error
+}
@@ -0,0 +1,371 @@
+package input
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// ProbeUinput reports whether virtual devices can be created
+func ProbeUinput() error {
+	f, err := os.OpenFile("/dev/uinput", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// NewUinputInjector creates a session's uinput injector. The gamepad is
+// created at once when gamepadSlot is not negative; keyboard, mouse and
+// touch devices on first use, touch sized to width by height.
+func NewUinputInjector(sessionID string, width, height, gamepadSlot int) (*UinputInjector, error) {
+	u := &UinputInjector{
+		sessionID: sessionID,
+		width:     width,
+		height:    height,
+	}
+	if gamepadSlot >= 0 {
+		pad, err := newUinputDevice(uinputGamepadConfig(gamepadSlot))
+		if err != nil {
+			return nil, err
+		}
+		u.gamepad = pad
+		log.Printf("[Session %s] Created uinput gamepad (slot %d)", sessionID, gamepadSlot)
+	}
+	return u, nil
+}
+
+// uinputGamepadConfig presents every controller type as an Xbox 360 pad,
+// which SDL and Steam map without extra configuration
+func uinputGamepadConfig(slot int) uinputConfig {
+	stick := absRange{-32768, 32767}
+	trigger := absRange{0, 255}
+	hat := absRange{-1, 1}
+	return uinputConfig{
+		name:    fmt.Sprintf("Chimera Virtual Gamepad %d", slot+1),
+		bus:     busUSB,
+		vendor:  0x045e,
+		product: 0x028e,
+		ff:      []uint16{ffRumble},
+		keys: []uint16{
+			btnSouth, btnEast, btnNorth, btnWest, btnTL, btnTR,
+			btnSelect, btnStart, btnMode, btnThumbL, btnThumbR,
+		},
+		abs: map[uint16]absRange{
+			absX: stick, absY: stick, absRX: stick, absRY: stick,
+			absZ: trigger, absRZ: trigger,
+			absHat0X: hat, absHat0Y: hat,
+		},
+	}
+}
+
+// Protocol button index to evdev code; the d-pad (10-13) is a hat
+var uinputGamepadButtons = [...]uint16{
+	btnSouth, btnEast, btnNorth, btnWest, btnTL, btnTR,
+	btnSelect, btnStart, btnThumbL, btnThumbR,
+}
+
+// Protocol axis index to evdev code
+var uinputGamepadAxes = [NumAxes]uint16{absX, absY, absRX, absRY, absZ, absRZ}
+
+// Gyro rate giving full right-stick deflection, as in the gamepad server
+const gyroStickFullScaleDPS = 180.0
+
+// UinputInjector is the Injector on Linux, writing to virtual devices.
+type UinputInjector struct {
+	sessionID     string
+	width, height int
+
+	mu       sync.Mutex
+	gamepad  *uinputDevice
+	keyboard *uinputDevice
+	mouse    *uinputDevice
+	touch    *uinputDevice
+
+	dpad         [4]bool // Up, down, left, right
+	mouseButtons uint8
+	touchActive  [MaxTouchContacts]bool
+	touchID      int32
+	rumbleStop   *time.Timer // Ends the playing rumble after its length
+}
+
+var errNoGamepad = errors.New("session has no gamepad slot")
+
+func (u *UinputInjector) Gamepad(ev GamepadEvent) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.gamepad == nil {
+		return errNoGamepad
+	}
+
+	switch ev.Type {
+	case TypeAxis:
+		code := uinputGamepadAxes[ev.Index]
+		value := int32(ev.Value)
+		switch {
+		case IsTriggerAxis(int(ev.Index)):
+			value = max(0, value) * 255 / 32767
+		case ev.Index == AxisLeftY || ev.Index == AxisRightY:
+			// The protocol has up positive like XInput; evdev has it negative
+			value = min(-value, 32767)
+		}
+		return u.gamepad.emit(inputEvent{Type: evAbs, Code: code, Value: value})
+
+	case TypeButton:
+		pressed := ev.Value != 0
+		if int(ev.Index) < len(uinputGamepadButtons) {
+			return u.gamepad.emit(keyEvent(uinputGamepadButtons[ev.Index], pressed))
+		}
+		u.dpad[int(ev.Index)-len(uinputGamepadButtons)] = pressed
+		return u.gamepad.emit(u.hatEvents()...)
+	}
+	return nil
+}
+
+// ForwardRumble serves the gamepad's force feedback until the injector is
+// closed, passing each rumble's magnitudes, 0 to 1, to rumble. Clients have
+// no length to give a rumble, so it is stopped here after the effect's.
+func (u *UinputInjector) ForwardRumble(rumble func(strong, weak float64)) error {
+	u.mu.Lock()
+	pad := u.gamepad
+	u.mu.Unlock()
+	if pad == nil {
+		return errNoGamepad
+	}
+
+	return pad.readForceFeedback(func(strong, weak uint16, length time.Duration) {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+
+		if u.rumbleStop != nil {
+			u.rumbleStop.Stop()
+			u.rumbleStop = nil
+		}
+		rumble(float64(strong)/65535, float64(weak)/65535)
+		if length > 0 && (strong != 0 || weak != 0) {
+			u.rumbleStop = time.AfterFunc(length, func() { rumble(0, 0) })
+		}
+	})
+}
+
+func (u *UinputInjector) hatEvents() []inputEvent {
+	axis := func(neg, pos bool) int32 {
+		switch {
+		case neg && !pos:
+			return -1
+		case pos && !neg:
+			return 1
+		}
+		return 0
+	}
+	return []inputEvent{
+		{Type: evAbs, Code: absHat0X, Value: axis(u.dpad[2], u.dpad[3])},
+		{Type: evAbs, Code: absHat0Y, Value: axis(u.dpad[0], u.dpad[1])},
+	}
+}
+
+// Motion has no sensor device to go to, so the gyro aims with the right stick
+func (u *UinputInjector) Motion(ev MotionEvent) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.gamepad == nil {
+		return errNoGamepad
+	}
+
+	stick := func(dps float64) int32 {
+		v := math.Max(-1, math.Min(1, dps/gyroStickFullScaleDPS))
+		return int32(math.Round(v * 32767))
+	}
+	pitch := float64(ev.Gyro[0]) / 16
+	yaw := float64(ev.Gyro[1]) / 16
+	return u.gamepad.emit(
+		inputEvent{Type: evAbs, Code: absRX, Value: stick(-yaw)},
+		inputEvent{Type: evAbs, Code: absRY, Value: -stick(pitch)},
+	)
+}
+
+func (u *UinputInjector) Touch(ev TouchEvent) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.touch == nil {
+		dev, err := newUinputDevice(uinputConfig{
+			name:  "Chimera Virtual Touchscreen",
+			bus:   busVirtual,
+			keys:  []uint16{btnTouch},
+			props: []uint16{inputPropDirect},
+			abs: map[uint16]absRange{
+				absX:          {0, int32(u.width - 1)},
+				absY:          {0, int32(u.height - 1)},
+				absMTSlot:     {0, MaxTouchContacts - 1},
+				absMTTracking: {0, 65535},
+				absMTPosX:     {0, int32(u.width - 1)},
+				absMTPosY:     {0, int32(u.height - 1)},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		u.touch = dev
+		log.Printf("[Session %s] Created uinput touchscreen", u.sessionID)
+	}
+
+	x, y := int32(ev.X), int32(ev.Y)
+	events := []inputEvent{{Type: evAbs, Code: absMTSlot, Value: int32(ev.Contact)}}
+
+	switch ev.Phase {
+	case TouchDown:
+		u.touchID = (u.touchID + 1) % 65536
+		u.touchActive[ev.Contact] = true
+		events = append(events, inputEvent{Type: evAbs, Code: absMTTracking, Value: u.touchID})
+		fallthrough
+	case TouchMove:
+		if !u.touchActive[ev.Contact] {
+			return nil
+		}
+		events = append(events,
+			inputEvent{Type: evAbs, Code: absMTPosX, Value: x},
+			inputEvent{Type: evAbs, Code: absMTPosY, Value: y},
+			inputEvent{Type: evAbs, Code: absX, Value: x},
+			inputEvent{Type: evAbs, Code: absY, Value: y},
+		)
+	default:
+		if !u.touchActive[ev.Contact] {
+			return nil
+		}
+		u.touchActive[ev.Contact] = false
+		events = append(events, inputEvent{Type: evAbs, Code: absMTTracking, Value: -1})
+	}
+
+	touching := false
+	for _, active := range u.touchActive {
+		touching = touching || active
+	}
+	events = append(events, keyEvent(btnTouch, touching))
+	return u.touch.emit(events...)
+}
+
+func (u *UinputInjector) Key(ev KeyEvent) error {
+	code, ok := vkToEvdev[ev.VK]
+	if !ok {
+		return nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.keyboard == nil {
+		keys := make([]uint16, 0, len(vkToEvdev))
+		for _, code := range vkToEvdev {
+			keys = append(keys, code)
+		}
+		dev, err := newUinputDevice(uinputConfig{
+			name: "Chimera Virtual Keyboard",
+			bus:  busVirtual,
+			keys: keys,
+		})
+		if err != nil {
+			return err
+		}
+		u.keyboard = dev
+		log.Printf("[Session %s] Created uinput keyboard", u.sessionID)
+	}
+
+	return u.keyboard.emit(keyEvent(code, ev.Down))
+}
+
+func (u *UinputInjector) Mouse(ev MouseEvent) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.mouse == nil {
+		dev, err := newUinputDevice(uinputConfig{
+			name: "Chimera Virtual Mouse",
+			bus:  busVirtual,
+			keys: []uint16{btnLeft, btnRight, btnMiddle},
+			rels: []uint16{relX, relY, relWheel},
+		})
+		if err != nil {
+			return err
+		}
+		u.mouse = dev
+		log.Printf("[Session %s] Created uinput mouse", u.sessionID)
+	}
+
+	var events []inputEvent
+	for bit, code := range map[uint8]uint16{
+		MouseLeft:   btnLeft,
+		MouseRight:  btnRight,
+		MouseMiddle: btnMiddle,
+	} {
+		if (ev.Buttons^u.mouseButtons)&bit != 0 {
+			events = append(events, keyEvent(code, ev.Buttons&bit != 0))
+		}
+	}
+	u.mouseButtons = ev.Buttons
+
+	if ev.DX != 0 {
+		events = append(events, inputEvent{Type: evRel, Code: relX, Value: int32(ev.DX)})
+	}
+	if ev.DY != 0 {
+		events = append(events, inputEvent{Type: evRel, Code: relY, Value: int32(ev.DY)})
+	}
+	if ev.Wheel != 0 {
+		// Browsers report wheel down as positive, evdev as negative
+		events = append(events, inputEvent{Type: evRel, Code: relWheel, Value: -int32(ev.Wheel)})
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	return u.mouse.emit(events...)
+}
+
+func (u *UinputInjector) Reset() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.gamepad == nil {
+		return errNoGamepad
+	}
+
+	var events []inputEvent
+	for _, code := range uinputGamepadButtons {
+		events = append(events, keyEvent(code, false))
+	}
+	for _, code := range uinputGamepadAxes {
+		events = append(events, inputEvent{Type: evAbs, Code: code})
+	}
+	u.dpad = [4]bool{}
+	events = append(events, u.hatEvents()...)
+	return u.gamepad.emit(events...)
+}
+
+func (u *UinputInjector) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.rumbleStop != nil {
+		u.rumbleStop.Stop()
+	}
+	for _, dev := range []**uinputDevice{&u.gamepad, &u.keyboard, &u.mouse, &u.touch} {
+		if *dev != nil {
+			(*dev).Close()
+			*dev = nil
+		}
+	}
+	return nil
+}
+
+func keyEvent(code uint16, pressed bool) inputEvent {
+	ev := inputEvent{Type: evKey, Code: code}
+	if pressed {
+		ev.Value = 1
+	}
+	return ev
+}
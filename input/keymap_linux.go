@@ -0,0 +1,77 @@
+package input
+
+// vkToEvdev maps Windows virtual-key codes from the input protocol to Linux
+// key codes (linux/input-event-codes.h). Generic Shift/Ctrl/Alt map to the
+// left-hand keys.
+var vkToEvdev = map[uint16]uint16{
+	0x08: 14,  // Backspace
+	0x09: 15,  // Tab
+	0x0D: 28,  // Enter
+	0x10: 42,  // Shift
+	0x11: 29,  // Ctrl
+	0x12: 56,  // Alt
+	0x13: 119, // Pause
+	0x14: 58,  // Caps Lock
+	0x1B: 1,   // Escape
+	0x20: 57,  // Space
+	0x21: 104, // Page Up
+	0x22: 109, // Page Down
+	0x23: 107, // End
+	0x24: 102, // Home
+	0x25: 105, // Left
+	0x26: 103, // Up
+	0x27: 106, // Right
+	0x28: 108, // Down
+	0x2C: 99,  // Print Screen
+	0x2D: 110, // Insert
+	0x2E: 111, // Delete
+
+	// Digits 0-9
+	0x30: 11, 0x31: 2, 0x32: 3, 0x33: 4, 0x34: 5,
+	0x35: 6, 0x36: 7, 0x37: 8, 0x38: 9, 0x39: 10,
+
+	// Letters A-Z
+	0x41: 30, 0x42: 48, 0x43: 46, 0x44: 32, 0x45: 18, 0x46: 33, 0x47: 34,
+	0x48: 35, 0x49: 23, 0x4A: 36, 0x4B: 37, 0x4C: 38, 0x4D: 50, 0x4E: 49,
+	0x4F: 24, 0x50: 25, 0x51: 16, 0x52: 19, 0x53: 31, 0x54: 20, 0x55: 22,
+	0x56: 47, 0x57: 17, 0x58: 45, 0x59: 21, 0x5A: 44,
+
+	0x5B: 125, // Left Windows / Meta
+	0x5C: 126, // Right Windows / Meta
+	0x5D: 127, // Menu
+
+	// Numpad 0-9 and operators
+	0x60: 82, 0x61: 79, 0x62: 80, 0x63: 81, 0x64: 75,
+	0x65: 76, 0x66: 77, 0x67: 71, 0x68: 72, 0x69: 73,
+	0x6A: 55, // *
+	0x6B: 78, // +
+	0x6D: 74, // -
+	0x6E: 83, // .
+	0x6F: 98, // /
+
+	// F1-F12
+	0x70: 59, 0x71: 60, 0x72: 61, 0x73: 62, 0x74: 63, 0x75: 64,
+	0x76: 65, 0x77: 66, 0x78: 67, 0x79: 68, 0x7A: 87, 0x7B: 88,
+
+	0x90: 69,  // Num Lock
+	0x91: 70,  // Scroll Lock
+	0xA0: 42,  // Left Shift
+	0xA1: 54,  // Right Shift
+	0xA2: 29,  // Left Ctrl
+	0xA3: 97,  // Right Ctrl
+	0xA4: 56,  // Left Alt
+	0xA5: 100, // Right Alt
+
+	// OEM punctuation, US layout
+	0xBA: 39, // ;
+	0xBB: 13, // =
+	0xBC: 51, // ,
+	0xBD: 12, // -
+	0xBE: 52, // .
+	0xBF: 53, // /
+	0xC0: 41, // `
+	0xDB: 26, // [
+	0xDC: 43, // \
+	0xDD: 27, // ]
+	0xDE: 40, // '
+}
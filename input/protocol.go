@@ -0,0 +1,246 @@
+// Package input is the wire protocol of the "input" DataChannel, the
+// Injector interface the server delivers decoded input through, and its two
+// implementations: uinput devices on Linux and the Python gamepad server
+// elsewhere. The protocol is shared by the server and by clients such as
+// chimeraclient. Capture, encoding, sessions, signaling and the API are
+// still package main, which keeps only the glue binding an injector to a
+// session.
+//
+// Binary messages start with a type byte; multi-byte fields are
+// little-endian.
+//
+//	axis/button  <type 0|1><index uint8><value int16>                   4 bytes
+//	touch        <type 2><contact uint8><phase uint8><x uint16><y uint16> 7 bytes
+//	motion       <type 3><gyro x,y,z int16><accel x,y,z int16>             13 bytes
+//	key          <type 4><down uint8><vk uint16>                          4 bytes
+//	mouse        <type 5><buttons uint8><dx int16><dy int16><wheel int8>  7 bytes
+//	text         "reset" returns the controller to its neutral state
+//	text         {"type":"viewport",...} reports the client's viewport
+//	text         {"type":"visibility","visible":false} when its page hides
+//
+// The server sends a JSON control message when the channel opens and
+// whenever the session owner grants or revokes control; input is dropped
+// without it, though viewport and visibility reports are not input and
+// always accepted. Gamepad events go through the session's mapping profile to
+// its controller slot; buttons are 1 pressed and 0 released. Motion uses
+// DualShock 4 sensor units: gyro in 1/16 deg/s, accel in 1/8192 g;
+// controllers without sensors turn the gyro into right-stick aim. Touch
+// coordinates are normalized to 0-65535 over the streamed picture. Keys are
+// Windows virtual-key codes filtered by the session's shortcut policy; mouse
+// motion is relative and buttons is the full left/right/middle state as
+// bits 0-2.
+package input
+
+import "encoding/binary"
+
+const (
+	gamepadMessageSize = 4
+	touchMessageSize   = 7
+	motionMessageSize  = 13
+	keyMessageSize     = 4
+	mouseMessageSize   = 7
+)
+
+// Message types, the first byte of every binary message
+const (
+	TypeAxis   = 0
+	TypeButton = 1
+	TypeTouch  = 2
+	TypeMotion = 3
+	TypeKey    = 4
+	TypeMouse  = 5
+)
+
+// Gamepad axis indices, as the browser Gamepad API numbers them
+const (
+	AxisLeftX = iota
+	AxisLeftY
+	AxisRightX
+	AxisRightY
+	AxisLeftTrigger
+	AxisRightTrigger
+	NumAxes
+
+	NumButtons = 14
+)
+
+func IsTriggerAxis(axis int) bool {
+	return axis == AxisLeftTrigger || axis == AxisRightTrigger
+}
+
+// Mouse button bits
+const (
+	MouseLeft   = 1 << 0
+	MouseRight  = 1 << 1
+	MouseMiddle = 1 << 2
+)
+
+// Touch contact phases
+const (
+	TouchDown = iota
+	TouchMove
+	TouchUp
+	TouchCancel
+)
+
+// Contacts the host accepts at once, matching InitializeTouchInjection
+const MaxTouchContacts = 10
+
+// GamepadEvent moves an axis or presses a button; Type is TypeAxis or
+// TypeButton
+type GamepadEvent struct {
+	Type  uint8
+	Index uint8
+	Value int16
+}
+
+func ParseGamepad(data []byte) (GamepadEvent, bool) {
+	if len(data) != gamepadMessageSize {
+		return GamepadEvent{}, false
+	}
+
+	ev := GamepadEvent{
+		Type:  data[0],
+		Index: data[1],
+		Value: int16(binary.LittleEndian.Uint16(data[2:])),
+	}
+	switch ev.Type {
+	case TypeAxis:
+		return ev, ev.Index < NumAxes
+	case TypeButton:
+		return ev, ev.Index < NumButtons
+	}
+	return ev, false
+}
+
+func (ev GamepadEvent) Encode() []byte {
+	buf := make([]byte, gamepadMessageSize)
+	buf[0] = ev.Type
+	buf[1] = ev.Index
+	binary.LittleEndian.PutUint16(buf[2:], uint16(ev.Value))
+	return buf
+}
+
+// TouchEvent positions are normalized on the wire and host pixels once
+// converted by ToDesktop
+type TouchEvent struct {
+	Contact uint8
+	Phase   uint8
+	X, Y    uint16
+}
+
+func ParseTouch(data []byte) (TouchEvent, bool) {
+	if len(data) != touchMessageSize || data[0] != TypeTouch {
+		return TouchEvent{}, false
+	}
+
+	ev := TouchEvent{
+		Contact: data[1],
+		Phase:   data[2],
+		X:       binary.LittleEndian.Uint16(data[3:]),
+		Y:       binary.LittleEndian.Uint16(data[5:]),
+	}
+	return ev, ev.Contact < MaxTouchContacts && ev.Phase <= TouchCancel
+}
+
+// ToDesktop maps normalized coordinates onto the captured desktop region
+func (ev TouchEvent) ToDesktop(width, height int) TouchEvent {
+	ev.X = uint16(int(ev.X) * (width - 1) / 65535)
+	ev.Y = uint16(int(ev.Y) * (height - 1) / 65535)
+	return ev
+}
+
+func (ev TouchEvent) Encode() []byte {
+	buf := make([]byte, touchMessageSize)
+	buf[0] = TypeTouch
+	buf[1] = ev.Contact
+	buf[2] = ev.Phase
+	binary.LittleEndian.PutUint16(buf[3:], ev.X)
+	binary.LittleEndian.PutUint16(buf[5:], ev.Y)
+	return buf
+}
+
+// MotionEvent sensor values pass through unvalidated
+type MotionEvent struct {
+	Gyro, Accel [3]int16
+}
+
+func ParseMotion(data []byte) (MotionEvent, bool) {
+	if len(data) != motionMessageSize || data[0] != TypeMotion {
+		return MotionEvent{}, false
+	}
+
+	var ev MotionEvent
+	for i := 0; i < 3; i++ {
+		ev.Gyro[i] = int16(binary.LittleEndian.Uint16(data[1+2*i:]))
+		ev.Accel[i] = int16(binary.LittleEndian.Uint16(data[7+2*i:]))
+	}
+	return ev, true
+}
+
+func (ev MotionEvent) Encode() []byte {
+	buf := make([]byte, motionMessageSize)
+	buf[0] = TypeMotion
+	for i := 0; i < 3; i++ {
+		binary.LittleEndian.PutUint16(buf[1+2*i:], uint16(ev.Gyro[i]))
+		binary.LittleEndian.PutUint16(buf[7+2*i:], uint16(ev.Accel[i]))
+	}
+	return buf
+}
+
+type KeyEvent struct {
+	Down bool
+	VK   uint16 // Windows virtual-key code
+}
+
+func ParseKey(data []byte) (KeyEvent, bool) {
+	if len(data) != keyMessageSize || data[0] != TypeKey {
+		return KeyEvent{}, false
+	}
+
+	ev := KeyEvent{
+		Down: data[1] != 0,
+		VK:   binary.LittleEndian.Uint16(data[2:]),
+	}
+	return ev, ev.VK > 0 && ev.VK < 0xFF
+}
+
+func (ev KeyEvent) Encode() []byte {
+	buf := make([]byte, keyMessageSize)
+	buf[0] = TypeKey
+	if ev.Down {
+		buf[1] = 1
+	}
+	binary.LittleEndian.PutUint16(buf[2:], ev.VK)
+	return buf
+}
+
+type MouseEvent struct {
+	Buttons uint8
+	DX, DY  int16
+	Wheel   int8
+}
+
+func ParseMouse(data []byte) (MouseEvent, bool) {
+	if len(data) != mouseMessageSize || data[0] != TypeMouse {
+		return MouseEvent{}, false
+	}
+
+	ev := MouseEvent{
+		Buttons: data[1],
+		DX:      int16(binary.LittleEndian.Uint16(data[2:])),
+		DY:      int16(binary.LittleEndian.Uint16(data[4:])),
+		Wheel:   int8(data[6]),
+	}
+	return ev, ev.Buttons&^(MouseLeft|MouseRight|MouseMiddle) == 0
+}
+
+func (ev MouseEvent) Encode() []byte {
+	buf := make([]byte, mouseMessageSize)
+	buf[0] = TypeMouse
+	buf[1] = ev.Buttons
+	binary.LittleEndian.PutUint16(buf[2:], uint16(ev.DX))
+	binary.LittleEndian.PutUint16(buf[4:], uint16(ev.DY))
+	buf[6] = uint8(ev.Wheel)
+	return buf
+}
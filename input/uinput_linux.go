@@ -0,0 +1,324 @@
+package input
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Linux input subsystem constants (linux/input-event-codes.h, linux/uinput.h)
+const (
+	evSyn = 0x00
+	evKey = 0x01
+	evRel = 0x02
+	evAbs = 0x03
+	evFF  = 0x15
+	// evUinput carries the kernel's force feedback requests to the device
+	evUinput = 0x0101
+
+	synReport = 0
+
+	relX     = 0x00
+	relY     = 0x01
+	relWheel = 0x08
+
+	absX          = 0x00
+	absY          = 0x01
+	absZ          = 0x02
+	absRX         = 0x03
+	absRY         = 0x04
+	absRZ         = 0x05
+	absHat0X      = 0x10
+	absHat0Y      = 0x11
+	absMTSlot     = 0x2f
+	absMTPosX     = 0x35
+	absMTPosY     = 0x36
+	absMTTracking = 0x39
+	absCnt        = 0x40
+
+	btnLeft   = 0x110
+	btnRight  = 0x111
+	btnMiddle = 0x112
+	btnSouth  = 0x130
+	btnEast   = 0x131
+	btnNorth  = 0x133
+	btnWest   = 0x134
+	btnTL     = 0x136
+	btnTR     = 0x137
+	btnSelect = 0x13a
+	btnStart  = 0x13b
+	btnMode   = 0x13c
+	btnThumbL = 0x13d
+	btnThumbR = 0x13e
+	btnTouch  = 0x14a
+
+	ffRumble = 0x50
+	// Effects a device holds at once
+	ffEffectsMax = 16
+
+	uiFFUpload = 1
+	uiFFErase  = 2
+
+	inputPropDirect = 0x01
+
+	busUSB     = 0x03
+	busVirtual = 0x06
+
+	uiDevCreate  = 0x5501
+	uiDevDestroy = 0x5502
+	uiSetEvBit   = 0x40045564
+	uiSetKeyBit  = 0x40045565
+	uiSetRelBit  = 0x40045566
+	uiSetAbsBit  = 0x40045567
+	uiSetPropBit = 0x4004556e
+	uiSetFFBit   = 0x4004556b
+)
+
+// _IOWR and _IOW of the force feedback ioctls, whose sizes depend on the
+// architecture's pointer size
+var (
+	uiBeginFFUpload = ioc(3, 200, unsafe.Sizeof(uinputFFUpload{}))
+	uiEndFFUpload   = ioc(1, 201, unsafe.Sizeof(uinputFFUpload{}))
+	uiBeginFFErase  = ioc(3, 202, unsafe.Sizeof(uinputFFErase{}))
+	uiEndFFErase    = ioc(1, 203, unsafe.Sizeof(uinputFFErase{}))
+)
+
+func ioc(dir, nr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | 'U'<<8 | nr
+}
+
+// struct ff_effect. Of its union only a rumble's magnitudes are read; the
+// union is sized and aligned by ff_periodic_effect's custom_data pointer.
+type ffEffect struct {
+	Type            uint16
+	ID              int16
+	Direction       uint16
+	TriggerButton   uint16
+	TriggerInterval uint16
+	ReplayLength    uint16 // ms
+	ReplayDelay     uint16
+	_               uint16
+	Strong          uint16 // ff_rumble_effect
+	Weak            uint16
+	_               [20]byte
+	_               uintptr
+}
+
+// struct uinput_ff_upload
+type uinputFFUpload struct {
+	RequestID uint32
+	Retval    int32
+	Effect    ffEffect
+	Old       ffEffect
+}
+
+// struct uinput_ff_erase
+type uinputFFErase struct {
+	RequestID uint32
+	Retval    int32
+	EffectID  uint32
+}
+
+// struct uinput_user_dev, the legacy setup interface every kernel supports
+type uinputUserDev struct {
+	Name         [80]byte
+	Bustype      uint16
+	Vendor       uint16
+	Product      uint16
+	Version      uint16
+	FFEffectsMax uint32
+	Absmax       [absCnt]int32
+	Absmin       [absCnt]int32
+	Absfuzz      [absCnt]int32
+	Absflat      [absCnt]int32
+}
+
+// struct input_event; the kernel fills in the timestamp
+type inputEvent struct {
+	Time  syscall.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+type absRange struct {
+	min, max int32
+}
+
+// uinputConfig describes the capabilities of a virtual device
+type uinputConfig struct {
+	name            string
+	bus             uint16
+	vendor, product uint16
+	keys            []uint16
+	rels            []uint16
+	abs             map[uint16]absRange
+	props           []uint16
+	ff              []uint16 // Force feedback effects it plays
+}
+
+type uinputDevice struct {
+	file *os.File
+}
+
+func newUinputDevice(cfg uinputConfig) (*uinputDevice, error) {
+	// Read too, for the force feedback requests
+	f, err := os.OpenFile("/dev/uinput", os.O_RDWR|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &uinputDevice{file: f}
+	if err := d.setup(cfg); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *uinputDevice) setup(cfg uinputConfig) error {
+	dev := uinputUserDev{
+		Bustype: cfg.bus,
+		Vendor:  cfg.vendor,
+		Product: cfg.product,
+		Version: 1,
+	}
+	copy(dev.Name[:len(dev.Name)-1], cfg.name)
+	if len(cfg.ff) > 0 {
+		dev.FFEffectsMax = ffEffectsMax
+	}
+
+	type capability struct {
+		ev    uintptr
+		req   uintptr
+		codes []uint16
+	}
+	absCodes := make([]uint16, 0, len(cfg.abs))
+	for code, r := range cfg.abs {
+		absCodes = append(absCodes, code)
+		dev.Absmin[code] = r.min
+		dev.Absmax[code] = r.max
+	}
+
+	for _, c := range []capability{
+		{evKey, uiSetKeyBit, cfg.keys},
+		{evRel, uiSetRelBit, cfg.rels},
+		{evAbs, uiSetAbsBit, absCodes},
+		{evFF, uiSetFFBit, cfg.ff},
+	} {
+		if len(c.codes) == 0 {
+			continue
+		}
+		if err := d.ioctl(uiSetEvBit, c.ev); err != nil {
+			return err
+		}
+		for _, code := range c.codes {
+			if err := d.ioctl(c.req, uintptr(code)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, prop := range cfg.props {
+		if err := d.ioctl(uiSetPropBit, uintptr(prop)); err != nil {
+			return err
+		}
+	}
+
+	if err := binary.Write(d.file, binary.NativeEndian, &dev); err != nil {
+		return err
+	}
+	return d.ioctl(uiDevCreate, 0)
+}
+
+func (d *uinputDevice) ioctl(req, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.file.Fd(), req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (d *uinputDevice) ioctlPtr(req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.file.Fd(), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// readForceFeedback serves the device's force feedback until it is closed.
+// Games upload and erase effects, which the kernel hands the device as
+// requests to answer, then play and stop them with EV_FF events. play is
+// called with a rumble's magnitudes as it starts, and zeros as it stops.
+func (d *uinputDevice) readForceFeedback(play func(strong, weak uint16, length time.Duration)) error {
+	effects := make(map[int16]ffEffect)
+	events := make([]inputEvent, 16)
+	size := int(unsafe.Sizeof(inputEvent{}))
+	buf := make([]byte, len(events)*size)
+	for {
+		n, err := d.file.Read(buf)
+		if err != nil {
+			return err
+		}
+		events := events[:n/size]
+		if err := binary.Read(bytes.NewReader(buf[:len(events)*size]), binary.NativeEndian, events); err != nil {
+			return err
+		}
+
+		for _, ev := range events {
+			switch {
+			case ev.Type == evUinput && ev.Code == uiFFUpload:
+				upload := uinputFFUpload{RequestID: uint32(ev.Value)}
+				if err := d.ioctlPtr(uiBeginFFUpload, unsafe.Pointer(&upload)); err != nil {
+					return err
+				}
+				if upload.Effect.Type == ffRumble {
+					effects[upload.Effect.ID] = upload.Effect
+				} else {
+					upload.Retval = -int32(syscall.EINVAL)
+				}
+				if err := d.ioctlPtr(uiEndFFUpload, unsafe.Pointer(&upload)); err != nil {
+					return err
+				}
+
+			case ev.Type == evUinput && ev.Code == uiFFErase:
+				erase := uinputFFErase{RequestID: uint32(ev.Value)}
+				if err := d.ioctlPtr(uiBeginFFErase, unsafe.Pointer(&erase)); err != nil {
+					return err
+				}
+				delete(effects, int16(erase.EffectID))
+				if err := d.ioctlPtr(uiEndFFErase, unsafe.Pointer(&erase)); err != nil {
+					return err
+				}
+
+			case ev.Type == evFF:
+				// Value is the times to play it, 0 to stop
+				effect, ok := effects[int16(ev.Code)]
+				if !ok {
+					continue
+				}
+				if ev.Value == 0 {
+					play(0, 0, 0)
+				} else {
+					play(effect.Strong, effect.Weak, time.Duration(effect.ReplayLength)*time.Millisecond)
+				}
+			}
+		}
+	}
+}
+
+// emit writes the events followed by a SYN_REPORT so they apply atomically
+func (d *uinputDevice) emit(events ...inputEvent) error {
+	var buf bytes.Buffer
+	for _, ev := range append(events, inputEvent{Type: evSyn, Code: synReport}) {
+		binary.Write(&buf, binary.NativeEndian, &ev)
+	}
+	_, err := d.file.Write(buf.Bytes())
+	return err
+}
+
+func (d *uinputDevice) Close() error {
+	d.ioctl(uiDevDestroy, 0)
+	return d.file.Close()
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A session's input can be recorded to a file in input-recordings/ and
+// replayed into a session later, its own or another, to reproduce an
+// input bug or drive a game in a test. The file holds what the peer sent
+// on the input channel, as JSON lines: a header, then each message with
+// its time from the start. Replay sends the messages through the same
+// checks and mappings as live input, at their recorded pace or faster.
+//
+// Recordings hold keystrokes, passwords among them, so only the host
+// starts them, and the peer is told while one runs.
+
+var inputRecordingDir = "input-recordings"
+
+const (
+	inputRecordingFormat = "chimera-input/1"
+	// A recording stops when it reaches this size
+	maxInputRecordingSize = 64 << 20
+	maxReplaySpeed        = 16
+)
+
+// inputRecordingHeader is the first line of a recording
+type inputRecordingHeader struct {
+	Format         string    `json:"format"`
+	Session        string    `json:"session"`
+	Width          int       `json:"width"`
+	Height         int       `json:"height"`
+	GamepadSlot    int       `json:"gamepad_slot"`
+	ControllerType string    `json:"controller_type,omitempty"`
+	Started        time.Time `json:"started"`
+}
+
+// inputRecordingEvent is a message of the input channel: binary input in
+// Data, or a text command such as "reset" in Text
+type inputRecordingEvent struct {
+	Ms   float64 `json:"ms"`
+	Data []byte  `json:"data,omitempty"`
+	Text string  `json:"text,omitempty"`
+}
+
+// InputRecordingMessage tells the peer its input is being recorded, or no
+// longer is
+type InputRecordingMessage struct {
+	Type      string `json:"type"` // "input_recording"
+	Recording bool   `json:"recording"`
+}
+
+// inputRecorder writes a session's input to its recording
+type inputRecorder struct {
+	name    string
+	started time.Time
+
+	mu     sync.Mutex
+	file   *os.File // nil once closed
+	size   int64
+	events int
+	full   bool // Reached its size or failed to write
+}
+
+func newInputRecorder(s *StreamSession) (*inputRecorder, error) {
+	if err := os.MkdirAll(inputRecordingDir, 0o755); err != nil {
+		return nil, err
+	}
+	started := time.Now()
+	name := fmt.Sprintf("%s-%s.jsonl", s.ID, started.Format("20060102-150405"))
+	file, err := os.OpenFile(filepath.Join(inputRecordingDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	rec := &inputRecorder{name: name, file: file, started: started}
+	header := inputRecordingHeader{
+		Format:         inputRecordingFormat,
+		Session:        s.ID,
+		Width:          s.Width,
+		Height:         s.Height,
+		GamepadSlot:    s.GamepadSlot,
+		ControllerType: s.ControllerType,
+		Started:        started,
+	}
+	if err := rec.writeLine(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (rec *inputRecorder) writeLine(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	n, err := rec.file.Write(append(line, '\n'))
+	rec.size += int64(n)
+	return err
+}
+
+// recordInput adds a message of the input channel to the session's
+// recording, if one runs
+func (s *StreamSession) recordInput(data []byte, isString bool) {
+	s.mutex.RLock()
+	rec := s.inputRecording
+	s.mutex.RUnlock()
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.file == nil || rec.full {
+		return
+	}
+
+	ev := inputRecordingEvent{Ms: float64(time.Since(rec.started).Microseconds()) / 1000}
+	if isString {
+		ev.Text = string(data)
+	} else {
+		ev.Data = data
+	}
+	if err := rec.writeLine(ev); err != nil {
+		log.Printf("[Session %s] Error writing input recording %s: %v", s.ID, rec.name, err)
+		rec.full = true
+		return
+	}
+	rec.events++
+	if rec.size >= maxInputRecordingSize {
+		log.Printf("[Session %s] Input recording %s reached %d MB, no longer recording", s.ID, rec.name, maxInputRecordingSize>>20)
+		rec.full = true
+	}
+}
+
+var errAlreadyRecording = errors.New("already recording")
+
+// startInputRecording begins recording the session's input
+func (s *StreamSession) startInputRecording() (*inputRecorder, error) {
+	s.mutex.RLock()
+	recording := s.inputRecording != nil
+	s.mutex.RUnlock()
+	if recording {
+		return nil, errAlreadyRecording
+	}
+	// The file is created outside the lock, which input and stats take
+	rec, err := newInputRecorder(s)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	if s.inputRecording != nil {
+		s.mutex.Unlock()
+		rec.file.Close()
+		os.Remove(filepath.Join(inputRecordingDir, rec.name))
+		return nil, errAlreadyRecording
+	}
+	s.inputRecording = rec
+	dc := s.inputChannel
+	s.mutex.Unlock()
+
+	log.Printf("[Session %s] Recording input to %s", s.ID, rec.name)
+	if dc != nil {
+		sendJSON(dc, InputRecordingMessage{Type: "input_recording", Recording: true})
+	}
+	return rec, nil
+}
+
+// stopInputRecording ends the session's recording, returning nil if none
+// ran
+func (s *StreamSession) stopInputRecording() *inputRecorder {
+	s.mutex.Lock()
+	rec := s.inputRecording
+	s.inputRecording = nil
+	dc := s.inputChannel
+	s.mutex.Unlock()
+	if rec == nil {
+		return nil
+	}
+
+	rec.mu.Lock()
+	if err := rec.file.Close(); err != nil {
+		log.Printf("[Session %s] Error closing input recording %s: %v", s.ID, rec.name, err)
+	}
+	rec.file = nil
+	rec.mu.Unlock()
+	log.Printf("[Session %s] Recorded %d input events to %s", s.ID, rec.events, rec.name)
+	if dc != nil && !s.ended.Load() {
+		sendJSON(dc, InputRecordingMessage{Type: "input_recording", Recording: false})
+	}
+	return rec
+}
+
+func (rec *inputRecorder) info() map[string]interface{} {
+	return map[string]interface{}{
+		"file":        rec.name,
+		"events":      rec.events,
+		"size_bytes":  rec.size,
+		"duration_ms": time.Since(rec.started).Milliseconds(),
+	}
+}
+
+// readInputRecording reads and checks a recording in inputRecordingDir
+func readInputRecording(name string) ([]inputRecordingEvent, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".jsonl") {
+		return nil, errors.New("not the name of a recording")
+	}
+	f, err := os.Open(filepath.Join(inputRecordingDir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	var header inputRecordingHeader
+	if !scanner.Scan() {
+		return nil, errors.New("empty recording")
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Format != inputRecordingFormat {
+		return nil, fmt.Errorf("not a %s recording", inputRecordingFormat)
+	}
+
+	var events []inputRecordingEvent
+	for line := 2; scanner.Scan(); line++ {
+		var ev inputRecordingEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if len(ev.Data) == 0 && ev.Text == "" {
+			return nil, fmt.Errorf("line %d: no input", line)
+		}
+		events = append(events, ev)
+	}
+	return events, scanner.Err()
+}
+
+// replayInput sends the events into the session, speed times as fast as
+// they were recorded, until they run out or ctx ends
+func (s *StreamSession) replayInput(ctx context.Context, name string, events []inputRecordingEvent, speed float64) {
+	defer func() {
+		s.mutex.Lock()
+		s.inputReplay = nil
+		s.mutex.Unlock()
+	}()
+	injector, err := s.inputInjector(s.ctx)
+	if err != nil {
+		log.Printf("[Session %s] Error creating input injector for replay: %v", s.ID, err)
+		return
+	}
+
+	log.Printf("[Session %s] Replaying %d input events from %s at %gx", s.ID, len(events), name, speed)
+	start := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	sent := 0
+	for _, ev := range events {
+		at := time.Duration(ev.Ms / speed * float64(time.Millisecond))
+		if wait := time.Until(start.Add(at)); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-ctx.Done():
+				log.Printf("[Session %s] Replay of %s stopped after %d of %d events", s.ID, name, sent, len(events))
+				return
+			case <-timer.C:
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+
+		if ev.Text != "" {
+			if ev.Text == "reset" && s.GamepadSlot >= 0 {
+				injector.Reset()
+			}
+		} else if accepted, err := injectInput(s, injector, ev.Data); err != nil {
+			log.Printf("[Session %s] Error injecting replayed input: %v", s.ID, err)
+		} else if accepted {
+			s.Input.count(ev.Data[0])
+		}
+		s.markActive()
+		sent++
+	}
+	log.Printf("[Session %s] Replay of %s done", s.ID, name)
+}
+
+// handleStartInputRecording records a session's input. Host only, like
+// the files it writes.
+func handleStartInputRecording(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Input can only be recorded from the host")
+		return
+	}
+	session, ok := getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	if session.viewer {
+		writeError(w, http.StatusConflict, "viewer_session", "Viewers send no input")
+		return
+	}
+
+	rec, err := session.startInputRecording()
+	if err != nil {
+		if session.inputRecordingActive() {
+			writeError(w, http.StatusConflict, "already_recording", "Session input is already being recorded")
+			return
+		}
+		writeErrorDetails(w, http.StatusInternalServerError, "recording_failed", "Error creating the recording", err.Error())
+		return
+	}
+	auditRequest(r, "input_record", session.ID, map[string]interface{}{"file": rec.name})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id": session.ID,
+		"file":       rec.name,
+	})
+}
+
+func (s *StreamSession) inputRecordingActive() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.inputRecording != nil
+}
+
+// handleStopInputRecording ends a session's recording
+func handleStopInputRecording(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Input can only be recorded from the host")
+		return
+	}
+	session, ok := getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	rec := session.stopInputRecording()
+	if rec == nil {
+		writeError(w, http.StatusNotFound, "not_recording", "Session input is not being recorded")
+		return
+	}
+
+	info := rec.info()
+	info["session_id"] = session.ID
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// handleListInputRecordings lists the recordings there are to replay
+func handleListInputRecordings(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Input recordings are only listed to the host")
+		return
+	}
+	entries, err := os.ReadDir(inputRecordingDir)
+	if err != nil && !os.IsNotExist(err) {
+		writeErrorDetails(w, http.StatusInternalServerError, "read_failed", "Error reading the recordings", err.Error())
+		return
+	}
+	recordings := []map[string]interface{}{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || !strings.HasSuffix(entry.Name(), ".jsonl") {
+			continue
+		}
+		recordings = append(recordings, map[string]interface{}{
+			"file":       entry.Name(),
+			"size_bytes": info.Size(),
+			"modified":   info.ModTime(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recordings": recordings})
+}
+
+// handleStartInputReplay replays a recording into a session, as
+// {"file": "...", "speed": 2}
+func handleStartInputReplay(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Input can only be replayed from the host")
+		return
+	}
+	session, ok := getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+
+	var req struct {
+		File  string  `json:"file"`
+		Speed float64 `json:"speed"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+	if req.Speed == 0 {
+		req.Speed = 1
+	}
+	if req.Speed < 0 || req.Speed > maxReplaySpeed {
+		writeError(w, http.StatusBadRequest, "invalid_speed", fmt.Sprintf("Speed must be above 0 and at most %d", maxReplaySpeed))
+		return
+	}
+	events, err := readInputRecording(req.File)
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, "recording_not_found", "Recording not found")
+		return
+	}
+	if err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_recording", "Error reading the recording", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithCancel(session.ctx)
+	session.mutex.Lock()
+	if session.inputReplay != nil {
+		session.mutex.Unlock()
+		cancel()
+		writeError(w, http.StatusConflict, "already_replaying", "A recording is already being replayed into the session")
+		return
+	}
+	session.inputReplay = cancel
+	session.mutex.Unlock()
+
+	session.goSafe("input replay", func() {
+		defer cancel()
+		session.replayInput(ctx, req.File, events, req.Speed)
+	})
+	auditRequest(r, "input_replay", session.ID, map[string]interface{}{"file": req.File, "speed": req.Speed})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id": session.ID,
+		"file":       req.File,
+		"events":     len(events),
+		"speed":      req.Speed,
+	})
+}
+
+// handleStopInputReplay stops a replay before its end
+func handleStopInputReplay(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Input can only be replayed from the host")
+		return
+	}
+	session, ok := getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	session.mutex.RLock()
+	cancel := session.inputReplay
+	session.mutex.RUnlock()
+	if cancel == nil {
+		writeError(w, http.StatusNotFound, "not_replaying", "No recording is being replayed into the session")
+		return
+	}
+	cancel()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"session_id": session.ID})
+}
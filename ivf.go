@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// VP8, VP9 and AV1 come out of FFmpeg as IVF: a 32-byte file header with
+// the codec and time base, then frames each prefixed with their size and
+// PTS.
+
+const ivfHeaderSize = 32
+
+// ivfReader turns an IVF stream into access units
+type ivfReader struct {
+	r        *bufio.Reader
+	hdr      [12]byte
+	maxFrame int
+
+	headerRead bool
+	fourcc     string
+	timeBase   time.Duration // Per PTS unit
+	started    bool
+	firstPTS   uint64
+}
+
+func newIVFReader(r io.Reader, buffers pipelineBuffers) *ivfReader {
+	return &ivfReader{r: bufio.NewReaderSize(r, buffers.readBuffer), maxFrame: buffers.maxFrame}
+}
+
+func (v *ivfReader) readHeader() error {
+	var hdr [ivfHeaderSize]byte
+	if _, err := io.ReadFull(v.r, hdr[:]); err != nil {
+		return ivfReadError(err)
+	}
+	if string(hdr[:4]) != "DKIF" {
+		return errors.New("not an IVF stream")
+	}
+	if size := int(binary.LittleEndian.Uint16(hdr[6:8])); size > ivfHeaderSize {
+		if _, err := v.r.Discard(size - ivfHeaderSize); err != nil {
+			return ivfReadError(err)
+		}
+	}
+	v.fourcc = string(hdr[8:12])
+	rate := binary.LittleEndian.Uint32(hdr[16:20])
+	scale := binary.LittleEndian.Uint32(hdr[20:24])
+	if rate == 0 || scale == 0 {
+		return errors.New("invalid IVF time base")
+	}
+	v.timeBase = time.Second * time.Duration(scale) / time.Duration(rate)
+	return nil
+}
+
+func (v *ivfReader) next() (AccessUnit, error) {
+	if !v.headerRead {
+		if err := v.readHeader(); err != nil {
+			return AccessUnit{}, err
+		}
+		v.headerRead = true
+	}
+
+	if _, err := io.ReadFull(v.r, v.hdr[:]); err != nil {
+		return AccessUnit{}, ivfReadError(err)
+	}
+	size := int(binary.LittleEndian.Uint32(v.hdr[:4]))
+	pts := binary.LittleEndian.Uint64(v.hdr[4:])
+	if size == 0 {
+		return AccessUnit{}, errors.New("empty IVF frame")
+	}
+	if size > v.maxFrame {
+		return AccessUnit{}, fmt.Errorf("IVF frame of %d bytes is over the %d byte frame limit", size, v.maxFrame)
+	}
+
+	data := make([]byte, size) // Handed on to the sample writer
+	if _, err := io.ReadFull(v.r, data); err != nil {
+		return AccessUnit{}, ivfReadError(err)
+	}
+
+	if !v.started {
+		v.started = true
+		v.firstPTS = pts
+	}
+	return AccessUnit{
+		Data:     data,
+		PTS:      time.Duration(pts-v.firstPTS) * v.timeBase,
+		Keyframe: ivfKeyframe(v.fourcc, data),
+	}, nil
+}
+
+// ivfKeyframe reads the frame type from the start of the bitstream
+func ivfKeyframe(fourcc string, data []byte) bool {
+	switch fourcc {
+	case "VP80":
+		return data[0]&0x01 == 0
+	case "VP90":
+		// frame_marker(2) profile(2) [reserved(1)] show_existing_frame(1) frame_type(1)
+		b := data[0]
+		bit := 5
+		profile := int(b>>bit&1) | int(b>>(bit-1)&1)<<1
+		bit -= 2
+		if profile == 3 {
+			bit--
+		}
+		if b>>bit&1 == 1 {
+			return false // Repeats an earlier frame
+		}
+		bit--
+		return b>>bit&1 == 0
+	case "AV01":
+		// Encoders put a sequence header at every keyframe
+		for _, obu := range splitAV1OBUs(data) {
+			if av1OBUType(obu) == av1OBUSequenceHeader {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const (
+	av1OBUSequenceHeader    = 1
+	av1OBUTemporalDelimiter = 2
+)
+
+func av1OBUType(obu []byte) int {
+	return int(obu[0]>>3) & 0x0f
+}
+
+// splitAV1OBUs splits a temporal unit into its OBUs, each with its header
+// and size field
+func splitAV1OBUs(data []byte) [][]byte {
+	var obus [][]byte
+	for len(data) > 0 {
+		header := 1
+		if data[0]&0x04 != 0 { // obu_extension_flag
+			header++
+		}
+		if data[0]&0x02 == 0 { // No obu_has_size_field: runs to the end
+			obus = append(obus, data)
+			break
+		}
+		if len(data) < header {
+			break
+		}
+		size, n := binary.Uvarint(data[header:]) // leb128
+		end := header + n + int(size)
+		if n <= 0 || end > len(data) {
+			break
+		}
+		obus = append(obus, data[:end])
+		data = data[end:]
+	}
+	return obus
+}
+
+// av1Samples splits an AV1 temporal unit into the OBUs pion's payloader
+// takes one at a time; temporal delimiters are not sent over RTP
+func av1Samples(data []byte) [][]byte {
+	var samples [][]byte
+	for _, obu := range splitAV1OBUs(data) {
+		if av1OBUType(obu) != av1OBUTemporalDelimiter {
+			samples = append(samples, obu)
+		}
+	}
+	return samples
+}
+
+// ivfReadError keeps io.EOF for a stream that ends between frames
+func ivfReadError(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("IVF stream cut short: %w", err)
+	}
+	return err
+}
+
+// ivfWriter writes frames as an IVF stream, for FFmpeg to read VP8 and VP9
+// the way it writes them
+type ivfWriter struct {
+	w   io.Writer
+	hdr [12]byte
+}
+
+// newIVFWriter writes the file header; timestamps count ticks of clockRate
+func newIVFWriter(w io.Writer, fourcc string, width, height int, clockRate uint32) (*ivfWriter, error) {
+	var hdr [ivfHeaderSize]byte
+	copy(hdr[:4], "DKIF")
+	binary.LittleEndian.PutUint16(hdr[6:8], ivfHeaderSize)
+	copy(hdr[8:12], fourcc)
+	binary.LittleEndian.PutUint16(hdr[12:14], uint16(width))
+	binary.LittleEndian.PutUint16(hdr[14:16], uint16(height))
+	binary.LittleEndian.PutUint32(hdr[16:20], clockRate)
+	binary.LittleEndian.PutUint32(hdr[20:24], 1)
+	// The frame count stays 0: the stream is never finished
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &ivfWriter{w: w}, nil
+}
+
+func (v *ivfWriter) writeFrame(pts uint64, frame []byte) error {
+	binary.LittleEndian.PutUint32(v.hdr[:4], uint32(len(frame)))
+	binary.LittleEndian.PutUint64(v.hdr[4:], pts)
+	if _, err := v.w.Write(v.hdr[:]); err != nil {
+		return err
+	}
+	_, err := v.w.Write(frame)
+	return err
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+var ivfTestBuffers = pipelineBuffers{readBuffer: 4096, maxFrame: 1 << 16}
+
+func TestIVFRoundTrip(t *testing.T) {
+	frames := []struct {
+		pts  uint64
+		data []byte
+		at   time.Duration
+		key  bool
+	}{
+		{5000, []byte{0x10, 0x02, 0x00}, 0, true},
+		{5033, []byte{0x11, 0x02}, 33 * time.Millisecond, false},
+		{5066, []byte{0x11, 0x04, 0x05}, 66 * time.Millisecond, false},
+		{6000, []byte{0x50}, time.Second, true},
+	}
+
+	var buf bytes.Buffer
+	w, err := newIVFWriter(&buf, "VP80", 1280, 720, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range frames {
+		if err := w.writeFrame(f.pts, f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v := newIVFReader(&buf, ivfTestBuffers)
+	for i, f := range frames {
+		au, err := v.next()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if !bytes.Equal(au.Data, f.data) || au.PTS != f.at || au.Keyframe != f.key {
+			t.Errorf("frame %d = %x at %v (key %v), want %x at %v (key %v)",
+				i, au.Data, au.PTS, au.Keyframe, f.data, f.at, f.key)
+		}
+	}
+	if _, err := v.next(); err != io.EOF {
+		t.Errorf("after the last frame, error = %v, want io.EOF", err)
+	}
+}
+
+func TestIVFReaderHeader(t *testing.T) {
+	// A longer header than the 32 bytes FFmpeg writes, and a time base of
+	// 1/90000 of a second
+	hdr := make([]byte, 40)
+	copy(hdr, "DKIF")
+	binary.LittleEndian.PutUint16(hdr[6:8], 40)
+	copy(hdr[8:12], "AV01")
+	binary.LittleEndian.PutUint32(hdr[16:20], 90000)
+	binary.LittleEndian.PutUint32(hdr[20:24], 1)
+	stream := append(hdr, 2, 0, 0, 0, 0x5f, 0x01, 0, 0, 0, 0, 0, 0, 0x12, 0x00)
+	stream = append(stream, 2, 0, 0, 0, 0x17, 0x0d, 0, 0, 0, 0, 0, 0, 0x12, 0x00)
+
+	v := newIVFReader(bytes.NewReader(stream), ivfTestBuffers)
+	for _, want := range []time.Duration{0, 3000 * (time.Second / 90000)} {
+		au, err := v.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if au.PTS != want {
+			t.Errorf("PTS = %v, want %v", au.PTS, want)
+		}
+	}
+}
+
+func TestIVFReaderErrors(t *testing.T) {
+	header := func(rate uint32) []byte {
+		var buf bytes.Buffer
+		newIVFWriter(&buf, "VP90", 640, 480, rate)
+		return buf.Bytes()
+	}
+	frame := func(size int, data []byte) []byte {
+		out := binary.LittleEndian.AppendUint32(nil, uint32(size))
+		out = binary.LittleEndian.AppendUint64(out, 0)
+		return append(out, data...)
+	}
+	tests := []struct {
+		name   string
+		stream []byte
+		err    string
+	}{
+		{"not IVF", append([]byte("RIFF"), make([]byte, 28)...), "not an IVF stream"},
+		{"no time base", header(0), "invalid IVF time base"},
+		{"empty frame", append(header(1000), frame(0, nil)...), "empty IVF frame"},
+		{"frame over the limit", append(header(1000), frame(ivfTestBuffers.maxFrame+1, nil)...), "over the"},
+		{"frame cut short", append(header(1000), frame(4, []byte{0x82, 0x49})...), "cut short"},
+		{"header cut short", header(1000)[:20], "cut short"},
+	}
+	for _, test := range tests {
+		_, err := newIVFReader(bytes.NewReader(test.stream), ivfTestBuffers).next()
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error = %v, want one containing %q", test.name, err, test.err)
+		}
+		if test.err == "cut short" && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%s: error = %v, want io.ErrUnexpectedEOF", test.name, err)
+		}
+	}
+}
+
+// AV1 OBUs: a temporal delimiter, a sequence header and a frame, each with
+// its size; and a frame with an extension header and no size field
+var (
+	av1TD       = []byte{0x12, 0x00}
+	av1SeqHdr   = []byte{0x0a, 0x02, 0x00, 0x00}
+	av1Frame    = []byte{0x32, 0x03, 0x10, 0x20, 0x30}
+	av1FrameExt = []byte{0x34, 0x08, 0x10, 0x20}
+)
+
+func TestIVFKeyframe(t *testing.T) {
+	tests := []struct {
+		name   string
+		fourcc string
+		data   []byte
+		key    bool
+	}{
+		{"VP8 key", "VP80", []byte{0x10, 0x02, 0x00}, true},
+		{"VP8 inter", "VP80", []byte{0x11, 0x02, 0x00}, false},
+		{"VP9 profile 0 key", "VP90", []byte{0x82, 0x49}, true},
+		{"VP9 profile 0 inter", "VP90", []byte{0x86}, false},
+		{"VP9 profile 1 key", "VP90", []byte{0xa2, 0x49}, true},
+		{"VP9 profile 2 inter", "VP90", []byte{0x94}, false},
+		{"VP9 profile 3 key", "VP90", []byte{0xb0, 0x49}, true},
+		{"VP9 profile 3 inter", "VP90", []byte{0xb2}, false},
+		{"VP9 shown again", "VP90", []byte{0x88}, false},
+		{"AV1 key", "AV01", bytes.Join([][]byte{av1TD, av1SeqHdr, av1Frame}, nil), true},
+		{"AV1 inter", "AV01", bytes.Join([][]byte{av1TD, av1Frame}, nil), false},
+		{"other codec", "H264", []byte{0x00}, false},
+	}
+	for _, test := range tests {
+		if key := ivfKeyframe(test.fourcc, test.data); key != test.key {
+			t.Errorf("%s: ivfKeyframe = %v, want %v", test.name, key, test.key)
+		}
+	}
+}
+
+func TestAV1Samples(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want [][]byte
+	}{
+		{"key", bytes.Join([][]byte{av1TD, av1SeqHdr, av1Frame}, nil), [][]byte{av1SeqHdr, av1Frame}},
+		{"no size field", bytes.Join([][]byte{av1TD, av1FrameExt}, nil), [][]byte{av1FrameExt}},
+		// What is left of a cut off OBU is dropped
+		{"truncated", bytes.Join([][]byte{av1TD, av1Frame[:3]}, nil), nil},
+		{"empty", nil, nil},
+	}
+	for _, test := range tests {
+		got := av1Samples(test.data)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: av1Samples = %x, want %x", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if !bytes.Equal(got[i], test.want[i]) {
+				t.Errorf("%s: av1Samples = %x, want %x", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Keyframes on demand, for a client that needs a fresh picture now: a
+// spectator or co-op player joining, a decoder showing corruption. Peers ask
+// with RTCP PLI or FIR, see readRTCP, and API clients with
+// POST /sessions/{id}/keyframe. In-process sources make the encoder's next
+// picture an IDR. FFmpeg sources cannot be asked while running, so as a
+// fallback they restart, whose first frame is a keyframe; requests are rate
+// limited for them, and a peer's more so: browsers send PLIs in bursts
+// while packets are lost.
+const (
+	keyframeMinInterval = time.Second
+	pliMinInterval      = 3 * time.Second
+)
+
+var errKeyframeTooSoon = errors.New("keyframe requested too recently")
+
+// requestKeyframe asks the capture source feeding the session for a keyframe
+func (s *StreamSession) requestKeyframe() error {
+	source := s
+	if s.parent != nil {
+		source = s.parent // Co-op guests watch the host's capture
+	}
+
+	source.mutex.Lock()
+	capture := source.Capture
+	if capture == nil {
+		source.mutex.Unlock()
+		return errCaptureNotStarted
+	}
+	if time.Since(source.lastKeyframeRequest) < keyframeMinInterval {
+		source.mutex.Unlock()
+		return errKeyframeTooSoon
+	}
+	source.lastKeyframeRequest = time.Now()
+	source.mutex.Unlock()
+
+	return capture.RequestKeyframe()
+}
+
+// viewerKeyframe asks for a keyframe for a spectator or co-op player that
+// has just connected, which would otherwise wait out the rest of the GOP
+func (s *StreamSession) viewerKeyframe() {
+	err := s.requestKeyframe()
+	if err != nil && !errors.Is(err, errKeyframeTooSoon) && !errors.Is(err, errCaptureNotStarted) {
+		log.Printf("[Session %s] Error requesting keyframe for a new viewer: %v", s.ID, err)
+	}
+}
+
+func handleRequestKeyframe(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	if !session.canManage(r) {
+		writeError(w, http.StatusForbidden, "not_owner", "Only the session owner can request keyframes")
+		return
+	}
+
+	err := session.requestKeyframe()
+	switch {
+	case errors.Is(err, errKeyframeTooSoon):
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusTooManyRequests, "keyframe_too_soon", "Keyframe requested too recently")
+		return
+	case errors.Is(err, errCaptureNotStarted):
+		writeError(w, http.StatusConflict, "capture_not_started", "Capture has not started")
+		return
+	case err != nil:
+		log.Printf("[Session %s] Error requesting keyframe: %v", session.ID, err)
+		writeErrorDetails(w, http.StatusInternalServerError, "keyframe_failed", "Error requesting keyframe", err.Error())
+		return
+	}
+	log.Printf("[Session %s] Keyframe requested", session.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id": session.ID,
+		"keyframe":   true,
+	})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+)
+
+// The bitrate ladder steps a session's encoding down when the bandwidth
+// estimate says the link cannot carry it, and back up once it has been
+// clear for a while. Estimates come from pion's GCC implementation, fed by
+// the browser's transport-wide congestion control feedback.
+
+var bitrateLadderFile = "bitrate-ladder.json"
+
+// ladderRung is one step of the ladder. Widths follow the session's aspect
+// ratio.
+type ladderRung struct {
+	Height int `json:"height"`
+	FPS    int `json:"fps"`
+	// Kbps is the encoder's cap on this rung
+	Kbps int `json:"kbps"`
+}
+
+func (r ladderRung) String() string {
+	return fmt.Sprintf("%dp%d", r.Height, r.FPS)
+}
+
+func (r ladderRung) validate() error {
+	if r.Height < 144 || r.Height > 4320 || r.FPS < 1 || r.FPS > 240 {
+		return errors.New("height must be within 144-4320 and fps within 1-240")
+	}
+	if r.Kbps < 100 {
+		return errors.New("kbps must be at least 100")
+	}
+	return nil
+}
+
+// bitrateLadder is sorted from the highest rung down
+var bitrateLadder = []ladderRung{
+	{Height: 1080, FPS: 60, Kbps: 8000},
+	{Height: 1080, FPS: 30, Kbps: 5000},
+	{Height: 720, FPS: 60, Kbps: 4500},
+	{Height: 720, FPS: 30, Kbps: 3000},
+	{Height: 540, FPS: 30, Kbps: 1800},
+	{Height: 360, FPS: 30, Kbps: 800},
+}
+
+func loadBitrateLadder() {
+	data, err := os.ReadFile(bitrateLadderFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading bitrate ladder: %v", err)
+		}
+		return
+	}
+
+	var rungs []ladderRung
+	if err := json.Unmarshal(data, &rungs); err != nil {
+		log.Printf("Error parsing %s: %v", bitrateLadderFile, err)
+		return
+	}
+	for _, r := range rungs {
+		if err := r.validate(); err != nil {
+			log.Printf("Ignoring %s, invalid rung %s: %v", bitrateLadderFile, r, err)
+			return
+		}
+	}
+	sort.SliceStable(rungs, func(i, j int) bool { return rungs[i].Kbps > rungs[j].Kbps })
+	bitrateLadder = rungs
+	log.Printf("Loaded bitrate ladder with %d rungs", len(rungs))
+}
+
+const (
+	ladderInterval = time.Second
+	// Seconds the estimate must stay below the send rate to step down
+	ladderDownAfter = 2
+	// A step up waits for this long without congestion, doubled after
+	// every step up that had to be undone, up to ladderMaxUpgradeDelay
+	ladderUpgradeDelay    = 20 * time.Second
+	ladderMaxUpgradeDelay = 5 * time.Minute
+)
+
+// sessionLadder returns the rungs for a session encoding at height and
+// fps: the offer's own settings on top, then the ladder's rungs that fit
+// within them. The top rung gets the bitrate of the cheapest rung it fits
+// within, so a small viewport is not sent a desktop's bitrate; maxKbps,
+// when set, caps it.
+func sessionLadder(height, fps, maxKbps int) []ladderRung {
+	top := ladderRung{Height: height, FPS: fps}
+	for _, r := range bitrateLadder {
+		if r.Height >= height && r.FPS >= fps && (top.Kbps == 0 || r.Kbps < top.Kbps) {
+			top.Kbps = r.Kbps
+		}
+	}
+	if top.Kbps == 0 {
+		top.Kbps = defaultMaxKbps
+	}
+	if maxKbps > 0 {
+		top.Kbps = min(top.Kbps, maxKbps)
+	}
+	rungs := []ladderRung{top}
+	for _, r := range bitrateLadder {
+		if r.Height <= height && r.FPS <= fps && r.Kbps < top.Kbps {
+			rungs = append(rungs, r)
+		}
+	}
+	return rungs
+}
+
+// apply sets cfg to encode at rung r
+func (r ladderRung) apply(cfg *CaptureConfig) {
+	if r.Height >= cfg.Height {
+		cfg.OutputWidth, cfg.OutputHeight = 0, 0
+	} else {
+		cfg.OutputWidth = r.Height * cfg.Width / cfg.Height &^ 1
+		cfg.OutputHeight = r.Height &^ 1
+	}
+	cfg.FPS = r.FPS
+	cfg.MaxKbps = r.Kbps
+}
+
+// EncodingMessage reports a ladder step on the "input" DataChannel
+type EncodingMessage struct {
+	Type   string `json:"type"` // "encoding"
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	FPS    int    `json:"fps"`
+	Kbps   int    `json:"kbps"`
+	// EstimateKbps is the bandwidth estimate that caused the step
+	EstimateKbps int `json:"estimate_kbps"`
+}
+
+// followLadder steps the session's encoding along its ladder until ctx
+// ends. The link counts as congested while the estimate stays under what
+// the session sends, which is where GCC puts it once delay or loss grows.
+func (s *StreamSession) followLadder(ctx context.Context, estimator cc.BandwidthEstimator) {
+	cfg := s.encoder.config()
+	_, height := cfg.outputSize()
+	rungs := sessionLadder(height, cfg.FPS, cfg.MaxKbps)
+
+	ticker := time.NewTicker(ladderInterval)
+	defer ticker.Stop()
+	current := 0
+	congested := 0
+	clearSince := time.Now()
+	var upgradedAt time.Time
+	upgradeDelay := ladderUpgradeDelay
+	sent := s.Stats.bytesSent.Load()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		bytes := s.Stats.bytesSent.Load()
+		sendKbps := int(float64(bytes-sent) * 8 / 1000 / ladderInterval.Seconds())
+		sent = bytes
+		estimate := estimator.GetTargetBitrate() / 1000
+
+		if estimate*10 < sendKbps*9 {
+			congested++
+			clearSince = time.Now()
+		} else {
+			congested = 0
+		}
+
+		next := current
+		from := rungs[current]
+		ladder := rungs
+		viewport := int(s.viewport.Swap(0))
+		resized := viewport > 0 && viewport != rungs[0].Height
+		if resized {
+			// A new viewport gets a new ladder, entered at the top unless
+			// congestion had stepped down the old one
+			ladder = sessionLadder(viewport, s.FPS, s.maxKbps)
+			next = 0
+			for current > 0 && next < len(ladder)-1 && ladder[next].Kbps > from.Kbps {
+				next++
+			}
+			congested = 0
+		} else {
+			switch {
+			case congested >= ladderDownAfter && current < len(rungs)-1:
+				// Down to the first rung the estimate can carry
+				next++
+				for next < len(rungs)-1 && rungs[next].Kbps > estimate {
+					next++
+				}
+				if time.Since(upgradedAt) < ladderUpgradeDelay {
+					upgradeDelay = min(2*upgradeDelay, ladderMaxUpgradeDelay)
+				}
+				congested = 0
+			case current > 0 && time.Since(clearSince) >= upgradeDelay:
+				next--
+				upgradedAt = time.Now()
+				clearSince = upgradedAt
+			default:
+				continue
+			}
+		}
+
+		rung := ladder[next]
+		if err := s.updateEncoding(rung.apply); err != nil {
+			log.Printf("[Session %s] Error switching to %s: %v", s.ID, rung, err)
+			if resized {
+				s.viewport.CompareAndSwap(0, int32(viewport)) // Retried on the next tick
+			}
+			continue
+		}
+		rungs = ladder
+		cfg = s.encoder.config()
+		width, height := cfg.outputSize()
+		if resized {
+			log.Printf("[Session %s] Viewport changed, stepping from %s to %s (%dx%d, %d kbps)",
+				s.ID, from, rung, width, height, rung.Kbps)
+		} else {
+			log.Printf("[Session %s] Bandwidth estimate %d kbps, stepping from %s to %s (%dx%d, %d kbps)",
+				s.ID, estimate, from, rung, width, height, rung.Kbps)
+		}
+		current = next
+
+		s.mutex.RLock()
+		dc := s.inputChannel
+		s.mutex.RUnlock()
+		if dc != nil {
+			sendJSON(dc, EncodingMessage{
+				Type:         "encoding",
+				Width:        width,
+				Height:       height,
+				FPS:          rung.FPS,
+				Kbps:         rung.Kbps,
+				EstimateKbps: estimate,
+			})
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Browsers want HTTPS for much of what the web client does, and a host on
+// a LAN has no name Let's Encrypt would certify. "chimera-go cert lan"
+// makes the host a certificate authority of its own, and with it the
+// HTTPS certificate for the host's names and LAN addresses. Devices that
+// install the CA certificate, downloaded from GET /api/v1/ca.pem, trust
+// the host's HTTPS. As it starts, the server reissues the certificate if
+// the host's addresses changed or it nears expiry.
+
+var (
+	lanCAFile    = "lan-ca.pem"
+	lanCAKeyFile = "lan-ca-key.pem"
+)
+
+const (
+	lanCAValidity = 10 * 365 * 24 * time.Hour
+	// Apple's limit for certificates of private CAs
+	lanCertValidity = 825 * 24 * time.Hour
+	lanCertRenewal  = 30 * 24 * time.Hour
+)
+
+func runCertCommand(args []string) error {
+	if len(args) != 1 || args[0] != "lan" {
+		return errors.New("usage: chimera-go cert lan")
+	}
+	if cert, err := loadCertificate(tlsCertFile); err == nil && !issuedByLANCA(cert) {
+		return fmt.Errorf("%s is not from the LAN CA; remove it to replace it", tlsCertFile)
+	}
+
+	ca, caKey, err := loadLANCA()
+	if os.IsNotExist(err) {
+		ca, caKey, err = createLANCA()
+		if err == nil {
+			fmt.Printf("Created the LAN CA, %s\n", lanCAFile)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	names, ips := lanCertNames()
+	if err := issueLANCert(ca, caKey, names, ips); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote %s for %s and %s\n", tlsCertFile, strings.Join(names, ", "), joinIPs(ips))
+	fmt.Printf("Install %s on each device as a trusted root, or download it from %s/ca.pem\n", lanCAFile, apiPrefix)
+	fmt.Printf("on the host; keep %s private.\n", lanCAKeyFile)
+	return nil
+}
+
+// renewLANCert reissues the HTTPS certificate the LAN CA issued when it
+// lacks one of the host's addresses or is near expiry
+func renewLANCert() {
+	cert, err := loadCertificate(tlsCertFile)
+	if err != nil || !issuedByLANCA(cert) {
+		return
+	}
+	names, ips := lanCertNames()
+	var missing []string
+	for _, ip := range ips {
+		if cert.VerifyHostname(ip.String()) != nil {
+			missing = append(missing, ip.String())
+		}
+	}
+	expiring := time.Until(cert.NotAfter) < lanCertRenewal
+	if len(missing) == 0 && !expiring {
+		return
+	}
+
+	ca, caKey, err := loadLANCA()
+	if err != nil {
+		log.Printf("[HTTPS] Error loading the LAN CA: %v", err)
+		return
+	}
+	if err := issueLANCert(ca, caKey, names, ips); err != nil {
+		log.Printf("[HTTPS] Error reissuing %s: %v", tlsCertFile, err)
+		return
+	}
+	if expiring {
+		log.Printf("[HTTPS] Renewed %s", tlsCertFile)
+	} else {
+		log.Printf("[HTTPS] Reissued %s for new addresses %s", tlsCertFile, strings.Join(missing, ", "))
+	}
+}
+
+func loadCertificate(name string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s holds no certificate", name)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func issuedByLANCA(cert *x509.Certificate) bool {
+	ca, err := loadCertificate(lanCAFile)
+	return err == nil && cert.CheckSignatureFrom(ca) == nil
+}
+
+func loadLANCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	ca, err := loadCertificate(lanCAFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(lanCAKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, fmt.Errorf("%s holds no key", lanCAKeyFile)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, key, nil
+}
+
+func createLANCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "chimera-go LAN CA " + hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(lanCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		// It certifies this host only
+		MaxPathLenZero: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(lanCAKeyFile, "EC PRIVATE KEY", marshalECKey(key), 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(lanCAFile, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	return ca, key, nil
+}
+
+func issueLANCert(ca *x509.Certificate, caKey *ecdsa.PrivateKey, names []string, ips []net.IP) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: names[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(lanCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     names,
+		IPAddresses:  ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(tlsKeyFile, "EC PRIVATE KEY", marshalECKey(key), 0600); err != nil {
+		return err
+	}
+	return writePEM(tlsCertFile, "CERTIFICATE", der, 0644)
+}
+
+// lanCertNames returns the names and addresses the host is reached by:
+// its host name, with .local for mDNS, and its addresses but link-local
+// ones
+func lanCertNames() ([]string, []net.IP) {
+	var names []string
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		names = append(names, hostname)
+		if !strings.Contains(hostname, ".") {
+			names = append(names, hostname+".local")
+		}
+	}
+	names = append(names, "localhost")
+
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, ipNet.IP)
+	}
+	return names, ips
+}
+
+func joinIPs(ips []net.IP) string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 126))
+	return serial
+}
+
+func marshalECKey(key *ecdsa.PrivateKey) []byte {
+	der, _ := x509.MarshalECPrivateKey(key)
+	return der
+}
+
+func writePEM(name, blockType string, der []byte, perm os.FileMode) error {
+	return os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), perm)
+}
+
+// handleCACert serves the LAN CA's certificate for devices to install
+func handleCACert(w http.ResponseWriter, r *http.Request) {
+	data, err := os.ReadFile(lanCAFile)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "no_lan_ca", "This host has no LAN CA; run chimera-go cert lan")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Header().Set("Content-Disposition", `attachment; filename="chimera-lan-ca.crt"`)
+	w.Write(data)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Latency probe protocol, JSON text messages on the "ping" DataChannel.
+// Either side may probe; the receiver echoes the probe back as a pong with
+// its own timestamp filled in. Timestamps are Unix epoch milliseconds.
+//
+//	{"type":"ping","id":1,"client_ts":1700000000000.25}
+//	{"type":"pong","id":1,"client_ts":1700000000000.25,"server_ts":1700000000003.5}
+const (
+	latencyProbeInterval = 2 * time.Second
+	latencySampleWindow  = 150 // RTT samples kept per session (~5 minutes)
+	latencyProbeTimeout  = 10 * time.Second
+)
+
+type PingMessage struct {
+	Type     string  `json:"type"`
+	ID       uint64  `json:"id"`
+	ClientTS float64 `json:"client_ts,omitempty"`
+	ServerTS float64 `json:"server_ts,omitempty"`
+}
+
+// sampleRing is a fixed-size window of millisecond samples
+type sampleRing struct {
+	values []float64
+	next   int
+}
+
+func (r *sampleRing) add(v float64) {
+	if len(r.values) < latencySampleWindow {
+		r.values = append(r.values, v)
+	} else {
+		r.values[r.next] = v
+	}
+	r.next = (r.next + 1) % latencySampleWindow
+}
+
+func (r *sampleRing) last() (float64, bool) {
+	if len(r.values) == 0 {
+		return 0, false
+	}
+	return r.values[(r.next-1+latencySampleWindow)%latencySampleWindow], true
+}
+
+// LatencyTracker keeps windows of latency samples and the latest clock
+// offset estimate for one session
+type LatencyTracker struct {
+	mu          sync.Mutex
+	rtt         sampleRing
+	glass       sampleRing // Glass-to-glass, see e2elatency.go
+	clockOffset float64    // Client clock minus server clock, milliseconds
+	hasOffset   bool
+}
+
+func (t *LatencyTracker) add(rttMs, offsetMs float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rtt.add(rttMs)
+	t.clockOffset = offsetMs
+	t.hasOffset = true
+}
+
+func (t *LatencyTracker) addGlassToGlass(ms float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.glass.add(ms)
+}
+
+// samples returns a copy of the RTT window
+func (t *LatencyTracker) samples() []float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]float64(nil), t.rtt.values...)
+}
+
+// glassSamples returns a copy of the glass-to-glass window
+func (t *LatencyTracker) glassSamples() []float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]float64(nil), t.glass.values...)
+}
+
+// latest returns the most recent RTT and clock offset
+func (t *LatencyTracker) latest() (rttMs, offsetMs float64, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rttMs, ok = t.rtt.last()
+	return rttMs, t.clockOffset, ok && t.hasOffset
+}
+
+// toServerTime converts a client timestamp to the server clock using the
+// latest offset estimate
+func (t *LatencyTracker) toServerTime(clientMs float64) (float64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return clientMs - t.clockOffset, t.hasOffset
+}
+
+func nowMillis() float64 {
+	return float64(time.Now().UnixMicro()) / 1000
+}
+
+// percentile expects sorted input
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+// latencySummary aggregates percentiles of a latency metric across sessions
+func latencySummary(samples []float64) map[string]interface{} {
+	sort.Float64s(samples)
+	summary := map[string]interface{}{
+		"samples": len(samples),
+	}
+	if len(samples) > 0 {
+		summary["p50_ms"] = percentile(samples, 50)
+		summary["p95_ms"] = percentile(samples, 95)
+		summary["p99_ms"] = percentile(samples, 99)
+		summary["max_ms"] = samples[len(samples)-1]
+	}
+	return summary
+}
+
+func handlePingChannel(ctx context.Context, session *StreamSession, dc *webrtc.DataChannel) {
+	var (
+		pending   = make(map[uint64]time.Time)
+		pendingMu sync.Mutex
+	)
+
+	probeCtx, stopProbing := context.WithCancel(ctx)
+
+	dc.OnOpen(func() {
+		defer session.recoverPanic("ping channel")
+		session.goSafe("latency probes", func() {
+			ticker := time.NewTicker(latencyProbeInterval)
+			defer ticker.Stop()
+
+			var id uint64
+			for {
+				select {
+				case <-probeCtx.Done():
+					return
+				case <-ticker.C:
+				}
+
+				// Each probe's send time is kept by its ID for the pong
+				id++
+				now := time.Now()
+				pendingMu.Lock()
+				pending[id] = now
+				// Forget probes the client never answered
+				for pid, sent := range pending {
+					if now.Sub(sent) > latencyProbeTimeout {
+						delete(pending, pid)
+					}
+				}
+				pendingMu.Unlock()
+
+				if err := sendJSON(dc, PingMessage{Type: "ping", ID: id, ServerTS: float64(now.UnixMicro()) / 1000}); err != nil {
+					log.Printf("[Session %s] Error sending latency probe: %v", session.ID, err)
+					return
+				}
+			}
+		})
+	})
+
+	dc.OnClose(stopProbing)
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		defer session.recoverPanic("ping channel")
+		var m PingMessage
+		if err := json.Unmarshal(msg.Data, &m); err != nil {
+			return
+		}
+
+		switch m.Type {
+		case "ping":
+			// Client-initiated probe: echo with our receive time
+			m.Type = "pong"
+			m.ServerTS = nowMillis()
+			sendJSON(dc, m)
+
+		case "pong":
+			pendingMu.Lock()
+			sent, ok := pending[m.ID]
+			delete(pending, m.ID)
+			pendingMu.Unlock()
+			if !ok {
+				return
+			}
+
+			// Both times are our own: the server_ts the client echoes is
+			// not trusted, so it cannot skew the estimates
+			rtt := float64(time.Since(sent).Microseconds()) / 1000
+			sentMs := float64(sent.UnixMicro()) / 1000
+			// The client stamped its reply roughly half an RTT after we sent
+			offset := m.ClientTS - (sentMs + rtt/2)
+			session.Latency.add(rtt, offset)
+		}
+	})
+}
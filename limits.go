@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Offer limits cap what clients may request. The host's apply to everyone
+// and come from offer-limits.json; a paired device can be held to lower
+// ones with PUT /devices/{id}/limits, and a user with their account. They
+// also bound when and how long sessions run, see timelimits.go.
+
+var offerLimitsFile = "offer-limits.json"
+
+// offerLimits are the largest settings an offer may request. A zero field
+// sets no limit of its own.
+type offerLimits struct {
+	MaxWidth  int `json:"max_width,omitempty"`
+	MaxHeight int `json:"max_height,omitempty"`
+	MaxFPS    int `json:"max_fps,omitempty"`
+	MaxKbps   int `json:"max_kbps,omitempty"`
+
+	MaxSessionMinutes int          `json:"max_session_minutes,omitempty"`
+	AllowedHours      []timeWindow `json:"allowed_hours,omitempty"`
+
+	// narrowed are the allowed hours of the limits narrowed into these
+	narrowed [][]timeWindow
+}
+
+// hostLimits bound every offer; offer-limits.json overrides the fields it
+// sets
+var hostLimits = offerLimits{MaxWidth: 3840, MaxHeight: 2160, MaxFPS: 144}
+
+func (l offerLimits) validate() error {
+	if l.MaxWidth < 0 || l.MaxWidth > 7680 || l.MaxHeight < 0 || l.MaxHeight > 4320 {
+		return errors.New("max_width must be within 0-7680 and max_height within 0-4320")
+	}
+	if l.MaxFPS < 0 || l.MaxFPS > 240 {
+		return errors.New("max_fps must be within 0-240")
+	}
+	if l.MaxKbps != 0 && l.MaxKbps < 100 {
+		return errors.New("max_kbps must be at least 100")
+	}
+	if l.MaxSessionMinutes < 0 {
+		return errors.New("max_session_minutes must not be negative")
+	}
+	for i, w := range l.AllowedHours {
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("allowed_hours %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (l offerLimits) isZero() bool {
+	return l.MaxWidth == 0 && l.MaxHeight == 0 && l.MaxFPS == 0 && l.MaxKbps == 0 &&
+		l.MaxSessionMinutes == 0 && len(l.AllowedHours) == 0
+}
+
+// schedules returns the allowed hours of l and of the limits narrowed into
+// it, each of which must allow a session
+func (l offerLimits) schedules() [][]timeWindow {
+	if len(l.AllowedHours) == 0 {
+		return l.narrowed
+	}
+	return append(l.narrowed[:len(l.narrowed):len(l.narrowed)], l.AllowedHours)
+}
+
+// narrow returns the lower of l and o for every field o sets
+func (l offerLimits) narrow(o offerLimits) offerLimits {
+	lower := func(a, b int) int {
+		if b > 0 && (a == 0 || b < a) {
+			return b
+		}
+		return a
+	}
+	return offerLimits{
+		MaxWidth:  lower(l.MaxWidth, o.MaxWidth),
+		MaxHeight: lower(l.MaxHeight, o.MaxHeight),
+		MaxFPS:    lower(l.MaxFPS, o.MaxFPS),
+		MaxKbps:   lower(l.MaxKbps, o.MaxKbps),
+
+		MaxSessionMinutes: lower(l.MaxSessionMinutes, o.MaxSessionMinutes),
+		narrowed:          append(l.schedules(), o.schedules()...),
+	}
+}
+
+func loadOfferLimits() {
+	data, err := os.ReadFile(offerLimitsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading offer limits: %v", err)
+		}
+		return
+	}
+
+	var limits offerLimits
+	if err := json.Unmarshal(data, &limits); err != nil {
+		log.Printf("Error parsing %s: %v", offerLimitsFile, err)
+		return
+	}
+	if err := limits.validate(); err != nil {
+		log.Printf("Ignoring %s: %v", offerLimitsFile, err)
+		return
+	}
+	if limits.MaxWidth > 0 {
+		hostLimits.MaxWidth = limits.MaxWidth
+	}
+	if limits.MaxHeight > 0 {
+		hostLimits.MaxHeight = limits.MaxHeight
+	}
+	if limits.MaxFPS > 0 {
+		hostLimits.MaxFPS = limits.MaxFPS
+	}
+	hostLimits.MaxKbps = limits.MaxKbps
+	hostLimits.MaxSessionMinutes = limits.MaxSessionMinutes
+	hostLimits.AllowedHours = limits.AllowedHours
+	log.Printf("Loaded offer limits: %dx%d, %d fps, %d kbps, %d minutes, %d allowed hours (0 is unlimited)",
+		hostLimits.MaxWidth, hostLimits.MaxHeight, hostLimits.MaxFPS, hostLimits.MaxKbps,
+		hostLimits.MaxSessionMinutes, len(hostLimits.AllowedHours))
+}
+
+// limitsFor returns the limits of the client making r: the host's, lowered
+// by those of its paired device and of its signed-in user
+func limitsFor(r *http.Request) offerLimits {
+	limits := hostLimits
+	if u := currentUser(r); u != nil && u.Limits != nil {
+		limits = limits.narrow(*u.Limits)
+	}
+	token := r.Header.Get(deviceTokenHeader)
+	if token == "" || isHostRequest(r) {
+		return limits
+	}
+	hash := hashDeviceToken(token)
+
+	trustStoreLock.Lock()
+	defer trustStoreLock.Unlock()
+	for _, device := range trustedDevices {
+		if device.Kind == deviceKindBrowser && device.TokenHash == hash && device.Limits != nil {
+			return limits.narrow(*device.Limits)
+		}
+	}
+	return limits
+}
+
+// limitError is an offer that asks for more than its limits allow
+type limitError struct {
+	msg    string
+	limits offerLimits
+}
+
+func (e *limitError) Error() string { return e.msg }
+
+// checkLimits rejects offers over limits with a *limitError
+func checkLimits(req *OfferRequest, limits offerLimits) error {
+	over := func(msg string, args ...interface{}) error {
+		return &limitError{msg: fmt.Sprintf(msg, args...), limits: limits}
+	}
+	switch {
+	case limits.MaxWidth > 0 && req.Width > limits.MaxWidth,
+		limits.MaxHeight > 0 && req.Height > limits.MaxHeight:
+		return over("Resolution above the limit of %dx%d", limits.MaxWidth, limits.MaxHeight)
+	case limits.MaxFPS > 0 && req.FPS > limits.MaxFPS:
+		return over("FPS above the limit of %d", limits.MaxFPS)
+	case limits.MaxKbps > 0 && req.MaxKbps > limits.MaxKbps:
+		return over("Bitrate above the limit of %d kbps", limits.MaxKbps)
+	}
+	req.timeLimit = sessionTimeLimit{
+		maxDuration: time.Duration(limits.MaxSessionMinutes) * time.Minute,
+		schedules:   limits.schedules(),
+	}
+	if err := req.timeLimit.check(time.Now()); err != nil {
+		return over("%v", err)
+	}
+	// Offers that leave the bitrate to the host get the most they may use
+	if req.MaxKbps == 0 {
+		req.MaxKbps = limits.MaxKbps
+	}
+	return nil
+}
+
+// writeOfferError answers an offer validateOffer rejected
+func writeOfferError(w http.ResponseWriter, err error) {
+	var limitErr *limitError
+	if errors.As(err, &limitErr) {
+		writeErrorDetails(w, http.StatusForbidden, "over_limit", limitErr.msg, limitErr.limits)
+		return
+	}
+	writeError(w, http.StatusBadRequest, "invalid_offer", err.Error())
+}
+
+// handleSetDeviceLimits sets or, with an empty body, clears the limits of
+// a paired device. Host only.
+func handleSetDeviceLimits(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Devices can only be managed from the host")
+		return
+	}
+
+	var limits *offerLimits
+	if r.ContentLength != 0 {
+		limits = &offerLimits{}
+		if err := json.NewDecoder(r.Body).Decode(limits); err != nil {
+			writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+			return
+		}
+		if err := limits.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_limits", err.Error())
+			return
+		}
+		if limits.isZero() {
+			limits = nil
+		}
+	}
+
+	id := r.PathValue("id")
+	trustStoreLock.Lock()
+	var found *trustedDevice
+	for _, device := range trustedDevices {
+		if device.ID == id {
+			found = device
+		}
+	}
+	if found != nil {
+		found.Limits = limits
+		if err := saveTrustedDevices(); err != nil {
+			log.Printf("Error saving trusted devices: %v", err)
+		}
+	}
+	trustStoreLock.Unlock()
+	if found == nil {
+		writeError(w, http.StatusNotFound, "device_not_found", "Device not found")
+		return
+	}
+
+	auditRequest(r, "device_limits", id, map[string]interface{}{"limits": limits})
+	effective := hostLimits
+	if limits != nil {
+		effective = hostLimits.narrow(*limits)
+		log.Printf("Device %s limited to %dx%d, %d fps, %d kbps", id,
+			effective.MaxWidth, effective.MaxHeight, effective.MaxFPS, effective.MaxKbps)
+	} else {
+		log.Printf("Device %s limits cleared", id)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":        id,
+		"limits":    limits,
+		"effective": effective,
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// logging.json sends the server's log on to the host's own logging as well
+// as chimera-go.log: syslog, to the local daemon or a remote collector, or
+// the Windows Event Log, so monitoring picks errors up without reading the
+// file. Each line goes through as one message, its severity read from how
+// the line starts.
+
+var loggingFile = "logging.json"
+
+type loggingConfig struct {
+	// Syslog sends the log to syslog: the local daemon, or the collector
+	// at SyslogAddress, e.g. "udp://loghost:514" or "tcp://loghost:601"
+	Syslog        bool   `json:"syslog"`
+	SyslogAddress string `json:"syslog_address"`
+	// SyslogFacility is "daemon" (default), "user" or "local0"-"local7"
+	SyslogFacility string `json:"syslog_facility"`
+	// EventLog writes to the Windows Event Log, under the source that
+	// service install registers
+	EventLog bool `json:"event_log"`
+}
+
+type logSeverity int
+
+const (
+	severityInfo logSeverity = iota
+	severityWarning
+	severityError
+)
+
+// logSink receives each log line without the timestamp log puts first
+type logSink interface {
+	logLine(severity logSeverity, line string) error
+	close() error
+}
+
+// loadLogSinks opens the sinks logging.json asks for. Sinks that cannot be
+// opened are logged and left out.
+func loadLogSinks() []logSink {
+	data, err := os.ReadFile(loggingFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading logging config: %v", err)
+		}
+		return nil
+	}
+
+	var cfg loggingConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Printf("Error parsing %s: %v", loggingFile, err)
+		return nil
+	}
+
+	var sinks []logSink
+	if cfg.Syslog {
+		sink, err := newSyslogSink(cfg.SyslogAddress, cfg.SyslogFacility)
+		if err != nil {
+			log.Printf("Ignoring syslog in %s: %v", loggingFile, err)
+		} else {
+			sinks = append(sinks, sink)
+		}
+	}
+	if cfg.EventLog {
+		sink, err := newEventLogSink()
+		if err != nil {
+			log.Printf("Ignoring event_log in %s: %v", loggingFile, err)
+		} else {
+			sinks = append(sinks, sink)
+		}
+	}
+	return sinks
+}
+
+func closeLogSinks(sinks []logSink) {
+	for _, sink := range sinks {
+		sink.close()
+	}
+}
+
+// logSinkWriter is an io.Writer for log.SetOutput that hands each line to
+// the sinks. log writes a whole line per call.
+type logSinkWriter struct {
+	sinks []logSink
+}
+
+func (w logSinkWriter) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	// Drop log's "2006/01/02 15:04:05 "; the sinks stamp their own time
+	if len(line) > 20 && line[4] == '/' && line[7] == '/' && line[10] == ' ' && line[19] == ' ' {
+		line = line[20:]
+	}
+	severity := lineSeverity(line)
+	for _, sink := range w.sinks {
+		sink.logLine(severity, line) // Nowhere to report a failure to
+	}
+	return len(p), nil
+}
+
+var (
+	errorLinePrefixes   = []string{"Error", "Failed", "Panic"}
+	warningLinePrefixes = []string{"Warning", "Invalid", "Ignoring", "Skipping"}
+)
+
+// lineSeverity reads a line's severity from its first words, after any
+// "[Session ...]" style tag
+func lineSeverity(line string) logSeverity {
+	for strings.HasPrefix(line, "[") {
+		end := strings.Index(line, "] ")
+		if end < 0 {
+			break
+		}
+		line = line[end+2:]
+	}
+	for _, prefix := range errorLinePrefixes {
+		if strings.HasPrefix(line, prefix) {
+			return severityError
+		}
+	}
+	for _, prefix := range warningLinePrefixes {
+		if strings.HasPrefix(line, prefix) {
+			return severityWarning
+		}
+	}
+	return severityInfo
+}
+
+// teeLogToSinks adds the sinks to where log writes
+func teeLogToSinks(out io.Writer, sinks []logSink) {
+	if len(sinks) > 0 {
+		log.SetOutput(io.MultiWriter(out, logSinkWriter{sinks}))
+	}
+}
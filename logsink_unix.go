@@ -0,0 +1,68 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/url"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"":       syslog.LOG_DAEMON,
+	"daemon": syslog.LOG_DAEMON,
+	"user":   syslog.LOG_USER,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+// newSyslogSink connects to the local syslog daemon, or to the collector
+// at address
+func newSyslogSink(address, facility string) (logSink, error) {
+	priority, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown facility %q", facility)
+	}
+	var network, raddr string
+	if address != "" {
+		u, err := url.Parse(address)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return nil, fmt.Errorf("syslog_address %q is not a udp:// or tcp:// address", address)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	w, err := syslog.Dial(network, raddr, priority|syslog.LOG_INFO, "chimera-go")
+	if err != nil {
+		return nil, err
+	}
+	return syslogSink{w}, nil
+}
+
+func (s syslogSink) logLine(severity logSeverity, line string) error {
+	switch severity {
+	case severityError:
+		return s.w.Err(line)
+	case severityWarning:
+		return s.w.Warning(line)
+	}
+	return s.w.Info(line)
+}
+
+func (s syslogSink) close() error {
+	return s.w.Close()
+}
+
+func newEventLogSink() (logSink, error) {
+	return nil, errors.New("the Event Log is only on Windows")
+}
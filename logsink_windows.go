@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// Event IDs of the lines written to the Event Log, by severity
+const (
+	eventIDInfo    = 1
+	eventIDWarning = 2
+	eventIDError   = 3
+)
+
+func newSyslogSink(address, facility string) (logSink, error) {
+	return nil, errors.New("syslog is not on Windows; use event_log")
+}
+
+type eventLogSink struct {
+	l *eventlog.Log
+}
+
+// newEventLogSink writes to the Application log as the service's source,
+// which service install registers; without it, Event Viewer shows the
+// lines but says it has no description for them
+func newEventLogSink() (logSink, error) {
+	l, err := eventlog.Open(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return eventLogSink{l}, nil
+}
+
+func (s eventLogSink) logLine(severity logSeverity, line string) error {
+	switch severity {
+	case severityError:
+		return s.l.Error(eventIDError, line)
+	case severityWarning:
+		return s.l.Warning(eventIDWarning, line)
+	}
+	return s.l.Info(eventIDInfo, line)
+}
+
+func (s eventLogSink) close() error {
+	return s.l.Close()
+}
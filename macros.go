@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lightsyr/chimera-go/input"
+)
+
+// Macros are named sequences of input the host keeps in macros.json, for
+// players who cannot press a combination or hold a sequence themselves.
+// A client triggers one by name on the input channel, {"type": "macro",
+// "name": "..."}, and it runs through the same checks and mappings as the
+// client's own input. Sessions run macros only when their offer asked for
+// "macros": true or PUT /sessions/{id}/macros turned them on.
+
+var macrosFile = "macros.json"
+
+const (
+	maxMacroSteps    = 256
+	maxMacroWait     = 10 * time.Second
+	maxMacroDuration = 30 * time.Second
+)
+
+// Macro steps press or release a button or key, move an axis or wait
+const (
+	macroStepButton = "button"
+	macroStepAxis   = "axis"
+	macroStepKey    = "key"
+	macroStepWait   = "wait"
+)
+
+// Macro is a named sequence of steps, run in order
+type Macro struct {
+	Name  string      `json:"name"`
+	Steps []MacroStep `json:"steps"`
+}
+
+// MacroStep is one step: {"type": "button", "index": 0, "pressed": true},
+// {"type": "axis", "index": 1, "value": -32767}, {"type": "key", "vk": 65,
+// "pressed": true} or {"type": "wait", "ms": 50}
+type MacroStep struct {
+	Type    string `json:"type"`
+	Index   int    `json:"index,omitempty"`
+	Value   int    `json:"value,omitempty"`
+	VK      int    `json:"vk,omitempty"` // Windows virtual-key code
+	Pressed bool   `json:"pressed,omitempty"`
+	Ms      int    `json:"ms,omitempty"`
+}
+
+func (m *Macro) validate() error {
+	if !profileNamePattern.MatchString(m.Name) {
+		return errors.New("macro name must be 1-64 letters, digits, '_', '.' or '-'")
+	}
+	if len(m.Steps) == 0 || len(m.Steps) > maxMacroSteps {
+		return fmt.Errorf("a macro has 1-%d steps", maxMacroSteps)
+	}
+	var total time.Duration
+	for i, step := range m.Steps {
+		switch step.Type {
+		case macroStepButton:
+			if step.Index < 0 || step.Index >= input.NumButtons {
+				return fmt.Errorf("step %d: button index must be within 0-%d", i, input.NumButtons-1)
+			}
+		case macroStepAxis:
+			if step.Index < 0 || step.Index >= input.NumAxes {
+				return fmt.Errorf("step %d: axis index must be within 0-%d", i, input.NumAxes-1)
+			}
+			if step.Value < -32767 || step.Value > 32767 {
+				return fmt.Errorf("step %d: axis value must be within -32767-32767", i)
+			}
+		case macroStepKey:
+			if step.VK <= 0 || step.VK > 0xFE {
+				return fmt.Errorf("step %d: vk must be a virtual-key code, 1-254", i)
+			}
+		case macroStepWait:
+			wait := time.Duration(step.Ms) * time.Millisecond
+			if wait <= 0 || wait > maxMacroWait {
+				return fmt.Errorf("step %d: wait must be 1-%d ms", i, maxMacroWait.Milliseconds())
+			}
+			total += wait
+		default:
+			return fmt.Errorf("step %d: unknown type %q", i, step.Type)
+		}
+	}
+	if total > maxMacroDuration {
+		return fmt.Errorf("a macro waits at most %v in all", maxMacroDuration)
+	}
+	return nil
+}
+
+// message returns the binary input message of a step other than a wait
+func (step MacroStep) message() []byte {
+	switch step.Type {
+	case macroStepButton:
+		ev := input.GamepadEvent{Type: input.TypeButton, Index: uint8(step.Index)}
+		if step.Pressed {
+			ev.Value = 1
+		}
+		return ev.Encode()
+	case macroStepAxis:
+		return input.GamepadEvent{Type: input.TypeAxis, Index: uint8(step.Index), Value: int16(step.Value)}.Encode()
+	case macroStepKey:
+		return input.KeyEvent{Down: step.Pressed, VK: uint16(step.VK)}.Encode()
+	}
+	return nil
+}
+
+// release returns the step undoing a press, or false if step is none
+func (step MacroStep) release() (MacroStep, bool) {
+	switch {
+	case step.Type == macroStepButton && step.Pressed,
+		step.Type == macroStepKey && step.Pressed:
+		step.Pressed = false
+		return step, true
+	case step.Type == macroStepAxis && step.Value != 0:
+		step.Value = 0
+		return step, true
+	}
+	return step, false
+}
+
+// Macro store, persisted to macrosFile
+var (
+	macros     = make(map[string]*Macro)
+	macrosLock sync.RWMutex
+)
+
+func loadMacros() {
+	data, err := os.ReadFile(macrosFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading macros: %v", err)
+		}
+		return
+	}
+
+	var list []*Macro
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("Error parsing %s: %v", macrosFile, err)
+		return
+	}
+
+	macrosLock.Lock()
+	defer macrosLock.Unlock()
+	for _, m := range list {
+		if err := m.validate(); err != nil {
+			log.Printf("Skipping invalid macro %q: %v", m.Name, err)
+			continue
+		}
+		macros[m.Name] = m
+	}
+	log.Printf("Loaded %d macros", len(macros))
+}
+
+// saveMacros must be called with macrosLock held
+func saveMacros() error {
+	data, err := json.MarshalIndent(sortedMacros(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(macrosFile, data, 0644)
+}
+
+// sortedMacros must be called with macrosLock held
+func sortedMacros() []*Macro {
+	list := make([]*Macro, 0, len(macros))
+	for _, m := range macros {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func getMacro(name string) (*Macro, bool) {
+	macrosLock.RLock()
+	defer macrosLock.RUnlock()
+	m, ok := macros[name]
+	return m, ok
+}
+
+// MacroMessage reports on the input channel how a triggered macro went:
+// State is "running", "done", "stopped" or "error"
+type MacroMessage struct {
+	Type  string `json:"type"` // "macro"
+	Name  string `json:"name"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// handleMacroMessage runs the macro a client triggered, or with "stop":
+// true stops the one running
+func (s *StreamSession) handleMacroMessage(data []byte) {
+	var m struct {
+		Name string `json:"name"`
+		Stop bool   `json:"stop"`
+	}
+	json.Unmarshal(data, &m)
+
+	s.mutex.RLock()
+	dc := s.inputChannel
+	running := s.macroCancel
+	s.mutex.RUnlock()
+	reply := func(state, errMsg string) {
+		if dc != nil {
+			sendJSON(dc, MacroMessage{Type: "macro", Name: m.Name, State: state, Error: errMsg})
+		}
+	}
+
+	if m.Stop {
+		if running != nil {
+			running()
+		}
+		return
+	}
+	if !s.acceptsInput() {
+		s.Input.rejected.Add(1)
+		reply("error", "this peer has no control")
+		return
+	}
+	if !s.macros.Load() {
+		reply("error", "macros are off for this session")
+		return
+	}
+	macro, ok := getMacro(m.Name)
+	if !ok {
+		reply("error", "no such macro")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.mutex.Lock()
+	if s.macroCancel != nil {
+		s.mutex.Unlock()
+		cancel()
+		reply("error", "another macro is running")
+		return
+	}
+	s.macroCancel = cancel
+	s.mutex.Unlock()
+
+	reply("running", "")
+	s.goSafe("macro", func() {
+		defer cancel()
+		err := s.runMacro(ctx, macro)
+		s.mutex.Lock()
+		s.macroCancel = nil
+		s.mutex.Unlock()
+		switch {
+		case err != nil:
+			log.Printf("[Session %s] Error running macro %q: %v", s.ID, macro.Name, err)
+			reply("error", err.Error())
+		case ctx.Err() != nil:
+			reply("stopped", "")
+		default:
+			reply("done", "")
+		}
+	})
+}
+
+// runMacro sends the macro's steps into the session until they run out or
+// ctx ends, then releases what the macro left pressed
+func (s *StreamSession) runMacro(ctx context.Context, macro *Macro) error {
+	injector, err := s.inputInjector(s.ctx)
+	if err != nil {
+		return err
+	}
+
+	// Presses not yet released, by button, axis or key
+	held := make(map[string]MacroStep)
+	defer func() {
+		for _, step := range held {
+			if release, ok := step.release(); ok {
+				injectInput(s, injector, release.message())
+			}
+		}
+	}()
+
+	for _, step := range macro.Steps {
+		if step.Type == macroStepWait {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Duration(step.Ms) * time.Millisecond):
+			}
+			continue
+		}
+		// Control can be taken away while a macro runs
+		if ctx.Err() != nil || !s.acceptsInput() {
+			return nil
+		}
+
+		data := step.message()
+		accepted, err := injectInput(s, injector, data)
+		if err != nil {
+			return err
+		}
+		if !accepted {
+			s.Input.rejected.Add(1)
+			continue
+		}
+		s.Input.count(data[0])
+		s.markActive()
+
+		key := fmt.Sprintf("%s %d %d", step.Type, step.Index, step.VK)
+		if _, ok := step.release(); ok {
+			held[key] = step
+		} else {
+			delete(held, key)
+		}
+	}
+	return nil
+}
+
+// HTTP handlers for macros
+func handleListMacros(w http.ResponseWriter, r *http.Request) {
+	macrosLock.RLock()
+	list := sortedMacros()
+	macrosLock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"macros": list,
+	})
+}
+
+// handlePutMacro defines a macro. Admin only: a macro presses keys in
+// every session that runs it.
+func handlePutMacro(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		writeError(w, http.StatusForbidden, "admin_only", "Only admins can define macros")
+		return
+	}
+	var macro Macro
+	if err := json.NewDecoder(r.Body).Decode(&macro); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+	macro.Name = r.PathValue("name")
+	if err := macro.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_macro", err.Error())
+		return
+	}
+
+	macrosLock.Lock()
+	macros[macro.Name] = &macro
+	err := saveMacros()
+	macrosLock.Unlock()
+	if err != nil {
+		log.Printf("Error saving macros: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	log.Printf("Macro %q saved", macro.Name)
+	auditRequest(r, "macro_put", macro.Name, map[string]interface{}{"steps": len(macro.Steps)})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(macro)
+}
+
+func handleDeleteMacro(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		writeError(w, http.StatusForbidden, "admin_only", "Only admins can delete macros")
+		return
+	}
+	name := r.PathValue("name")
+
+	macrosLock.Lock()
+	_, exists := macros[name]
+	delete(macros, name)
+	err := saveMacros()
+	macrosLock.Unlock()
+
+	if !exists {
+		writeError(w, http.StatusNotFound, "macro_not_found", "Macro not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving macros: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	auditRequest(r, "macro_delete", name, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSetSessionMacros turns macros on or off for a session. Owner or
+// admin only.
+func handleSetSessionMacros(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	if !session.canManage(r) {
+		writeError(w, http.StatusForbidden, "not_owner", "Only the session owner can turn macros on or off")
+		return
+	}
+
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+
+	session.macros.Store(req.Enabled)
+	if !req.Enabled {
+		session.mutex.RLock()
+		cancel := session.macroCancel
+		session.mutex.RUnlock()
+		if cancel != nil {
+			cancel()
+		}
+	}
+	log.Printf("[Session %s] Macros enabled set to %v", session.ID, req.Enabled)
+	auditRequest(r, "session_macros", "", map[string]interface{}{"enabled": req.Enabled})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id": session.ID,
+		"enabled":    req.Enabled,
+	})
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -17,35 +18,222 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/lightsyr/chimera-go/input"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
 	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media"
 )
 
 var (
+	// httpAddr serves the web client and the API
+	httpAddr = ":8080"
+
 	pythonPath   = "python"
 	pythonScript = "gamepad-ws-server/src/server.py"
+	cmdPython    *exec.Cmd
 
-	// Metrics
-	framesProcessed int64
-	framesDropped   int64
-	activeStreams   int32
+	// Metrics; frame counters are per session, see hostStats
+	activeStreams int32
 )
 
 type OfferRequest struct {
-	SDP    string `json:"sdp"`
+	SDP string `json:"sdp"`
+	// Codec is "h264" (default), "vp8", "vp9" or "av1"
 	Codec  string `json:"codec"`
 	Width  int    `json:"width"`
 	Height int    `json:"height"`
-	FPS    int    `json:"fps"`
+	FPS    int    `json:"fps"` // 0 for the captured display's refresh rate
+
+	// Clipboard enables bidirectional clipboard sync for this session
+	Clipboard bool `json:"clipboard"`
+	// LatencyOverlay burns capture timestamps into the video for
+	// glass-to-glass measurement
+	LatencyOverlay bool `json:"latency_overlay"`
+	// GamepadSlot requests a specific virtual controller slot (0-3);
+	// the first free slot is assigned when omitted or taken
+	GamepadSlot *int `json:"gamepad_slot,omitempty"`
+	// MappingProfile names the input mapping profile, "default" when empty
+	MappingProfile string `json:"mapping_profile"`
+	// ControllerType selects the virtual controller model: "xbox360"
+	// (default) or "ds4", which also receives gyro/accelerometer data
+	ControllerType string `json:"controller_type"`
+	// Role is "control" (default) or "view" for a view-only peer
+	Role string `json:"role"`
+	// ShortcutPolicy decides what happens to host-reserved shortcuts such
+	// as Alt+Tab and the Windows key: "block" (default), "inject" or
+	// "translate" (delivered without their modifiers)
+	ShortcutPolicy string `json:"shortcut_policy"`
+	// App names a catalog app to launch when the session starts
+	App string `json:"app"`
+	// AppOnDisconnect overrides the app's on_disconnect policy
+	AppOnDisconnect string `json:"app_on_disconnect"`
+	// Capture names the capture source, captureSource when empty
+	Capture string `json:"capture"`
+	// ViewportWidth and ViewportHeight are the device pixels the client
+	// shows the video in. A larger picture is downscaled to fit them on
+	// the host; 0 leaves it at Width by Height.
+	ViewportWidth  int `json:"viewport_width"`
+	ViewportHeight int `json:"viewport_height"`
+	// AllMonitors captures the whole desktop across monitors as one wide
+	// picture, scaled to Width by Height
+	AllMonitors bool `json:"all_monitors"`
+	// Preset names the encoder preset: "balanced" (default) or
+	// "competitive", which uses intra refresh instead of keyframes
+	Preset string `json:"preset"`
+	// Slices splits each H.264 frame so decoding can start before it has
+	// fully arrived; Threads caps encoder threads. 0 leaves the encoder's
+	// default for either.
+	Slices  int `json:"slices"`
+	Threads int `json:"threads"`
+	// DropPolicy decides when encoded frames are discarded instead of
+	// sent: "none" (default) or "latency"
+	DropPolicy string `json:"drop_policy"`
+	// MaxKbps caps the session's bitrate; 0 leaves it to the host
+	MaxKbps int `json:"max_kbps"`
+	// E2EE encrypts every frame with the host's E2EE key (vp8 only)
+	E2EE bool `json:"e2ee"`
+	// Chroma is "420" (default) or "444" and BitDepth 8 (default) or 10.
+	// Past the defaults they need h264, vp9 or av1 and a client that
+	// offers the codec's matching profile.
+	Chroma   string `json:"chroma"`
+	BitDepth int    `json:"bit_depth"`
+	// ColorSpace ("bt709" or "bt601") and ColorRange ("limited" or
+	// "full") override the host's colors.json
+	ColorSpace string `json:"color_space"`
+	ColorRange string `json:"color_range"`
+	// AudioOnly streams the host's audio without any video; the video
+	// options are ignored
+	AudioOnly bool `json:"audio_only"`
+	// AudioBufferMs is how much audio the pipeline buffers against
+	// jitter, on the host and in the client; 0 leaves it to pipeline.json
+	// or the defaults. See audio.go.
+	AudioBufferMs int `json:"audio_buffer_ms"`
+	// Host names the cluster host to stream from; see cluster.go
+	Host string `json:"host"`
+	// LockOnEnd locks the host's desktop session once this session ends,
+	// or once the last session still streaming does
+	LockOnEnd bool `json:"lock_on_end"`
+	// Netsim simulates a lossy, jittery or narrow link for the session's
+	// video and audio, for testing; see netsim.go
+	Netsim *netsimSettings `json:"netsim,omitempty"`
+	// Publish pushes the session to the SFU of sfu.json as it starts, for
+	// its viewers to watch there; see sfu.go
+	Publish bool `json:"publish"`
+	// Macros lets the peer trigger the host's macros; see macros.go
+	Macros bool `json:"macros"`
+
+	requestID string      // Of the API request that made the offer
+	user      string      // Signed-in user who made it, if any
+	desktop   *Monitor    // Area AllMonitors captures
+	format    pixelFormat // From Chroma and BitDepth
+	colors    colorSettings
+	timeLimit sessionTimeLimit // From the limits of whoever made it
+}
+
+// OfferResponse is the SDP answer plus the metadata of the created session
+type OfferResponse struct {
+	webrtc.SessionDescription
+	SessionID   string `json:"session_id"`
+	GamepadSlot int    `json:"gamepad_slot"` // -1 when all slots are taken
+	Role        string `json:"role"`
+	// OwnerToken authorizes control changes for the session through the API
+	OwnerToken string `json:"owner_token"`
+	// E2EEKeyID names the key frames are encrypted with, if they are
+	E2EEKeyID *uint64 `json:"e2ee_kid,omitempty"`
+	// AudioBufferMs is the jitter buffer target the client should give
+	// the audio track, if the offer or the host set one
+	AudioBufferMs int `json:"audio_buffer_ms,omitempty"`
 }
 
 type StreamSession struct {
-	ID        string
-	PC        *webrtc.PeerConnection
-	FFmpegCmd *exec.Cmd
-	Cancel    context.CancelFunc
-	StartTime time.Time
-	mutex     sync.RWMutex
+	ID             string
+	PC             *webrtc.PeerConnection
+	Capture        CaptureSource // Set once the source has started
+	Cancel         context.CancelFunc
+	StartTime      time.Time
+	Width          int
+	Height         int
+	FPS            int
+	Clipboard      bool
+	LatencyOverlay bool
+	GamepadSlot    int // -1 when no virtual controller is assigned
+	ControllerType string
+	Stats          PipelineStats
+	Latency        LatencyTracker
+	Input          InputStats
+
+	ctx        context.Context // Ends with the session
+	parent     *StreamSession  // Host session of a co-op guest
+	videoTrack *webrtc.TrackLocalStaticSample
+	audioTrack *webrtc.TrackLocalStaticSample
+	source     string // Capture source name
+	maxKbps    int    // The offer's cap, 0 for none
+	shortcuts  *shortcutFilter
+	adaptive   adaptiveEncoder
+	encoder    encoderControl
+	bwe        cc.BandwidthEstimator
+	e2ee       *sframeEncryptor
+	colors     colorSettings
+	viewport   atomic.Int32
+	lastActive atomic.Int64
+	activity   chan struct{}
+	control    atomic.Bool // Input from the peer reaches the host
+	crashed    atomic.Bool // Ended by a panic in its goroutines
+	videoMuted atomic.Bool // The host blanked the picture
+	hidden     atomic.Bool // The peer reports its page hidden
+	macros     atomic.Bool // The peer may trigger macros
+	connected  atomic.Bool // The peer has connected at least once
+	ended      atomic.Bool // Its connection is over and it is unregistered
+	viewer     bool        // Joined with the view role; never gets control
+	ownerToken string
+	user       string // Account that started the session, if signed in
+	lockOnEnd  bool
+	netsim     *netsim // Simulated link, nil on co-op guests
+	ffmpegLog  *ffmpegLog
+	// bytesAtStart is what the pipeline had sent when the session
+	// joined it, for co-op guests; see usage.go
+	bytesAtStart int64
+	// deadline is when the session's time limit ends it, zero for never;
+	// see timelimits.go
+	deadline       time.Time
+	deadlineReason string
+
+	// renegotiation serializes the offers that follow the first
+	renegotiation sync.Mutex
+	// publishing serializes starting to publish to the SFU
+	publishing sync.Mutex
+	// endTimerLock guards endTimer, which ends the session if its peer
+	// does not connect or reconnect in time
+	endTimerLock sync.Mutex
+	endTimer     *time.Timer
+	// endConnection ends the session, as its connection state would
+	endConnection func()
+	// heartbeatLost is set while the peer's heartbeats are late
+	heartbeatLost atomic.Bool
+	// processLock guards processes, which FFmpeg restarts add to from
+	// under the capture's own lock
+	processLock sync.Mutex
+	processes   []trackedProcess
+
+	mutex sync.RWMutex
+	// Guarded by mutex
+	injector      input.Injector
+	inputChannel  *webrtc.DataChannel
+	rumbleChannel *webrtc.DataChannel
+	mapping       *MappingProfile
+	spectators    map[string]*Spectator
+	publisher     *sfuPublisher // Stream on the SFU, if published
+	monitors      map[int]bool  // Extra monitors streaming, by index
+	// inputRecording is the recording of the peer's input, if one runs,
+	// and inputReplay stops the replay into the session, if one runs
+	inputRecording *inputRecorder
+	inputReplay    context.CancelFunc
+	// macroCancel stops the macro running, if one is
+	macroCancel context.CancelFunc
+	// lastKeyframeRequest rate limits requestKeyframe
+	lastKeyframeRequest time.Time
+	App                 *AppProcess // Launched for the session, if any
 }
 
 var (
@@ -54,6 +242,18 @@ var (
 )
 
 func main() {
+	name, args := "serve", []string(nil)
+	if len(os.Args) > 1 {
+		name, args = os.Args[1], os.Args[2:]
+	}
+	if err := runCommand(name, args); err != nil {
+		fmt.Fprintf(os.Stderr, "chimera-go %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// serve runs the server until it is stopped
+func serve() {
 	// Setup logging
 	logFile, err := os.OpenFile("chimera-go.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
@@ -62,20 +262,72 @@ func main() {
 	defer logFile.Close()
 	multiWriter := io.MultiWriter(os.Stdout, logFile)
 	log.SetOutput(multiWriter)
-	log.Println("--- Server Started ---")
+	sinks := loadLogSinks()
+	defer closeLogSinks(sinks)
+	teeLogToSinks(multiWriter, sinks)
+	log.Printf("--- Server Started (%s) ---", version)
+	removeOldBinary()
+
+	loadMappingProfiles()
+	loadMacros()
+	loadTrustedDevices()
+	loadUsage()
+	loadApps()
+	loadBitrateLadder()
+	loadOfferLimits()
+	loadUsers()
+	loadOIDCConfig()
+	loadNetworkPolicy()
+	loadDTLSConfig()
+	loadAddressFamilies()
+	loadColors()
+	loadScaler()
+	loadWatermark()
+	loadIdlePause()
+	loadPrivacy()
+	loadCluster()
+	loadSFU()
+	loadCrashReporting()
+	loadResourceLimits()
+	loadPipeline()
+	loadSessionTimeouts()
+	applyICETimeouts()
+	if libraryDiscovery {
+		go scanLibraries()
+	}
 
 	// Start monitoring goroutines
 	go logMetrics()
-	go cleanupStaleSessions()
+	go sampleStats()
+	go sampleHostLoad()
+	go cleanupRooms()
+	if hostPrivacy.enabled() {
+		go enforcePrivacy()
+	}
+	if cluster != nil {
+		go cluster.run()
+	}
+	if version != "dev" {
+		go checkForUpdatesPeriodically()
+	}
+
+	if grpcEnabled {
+		startGRPC()
+	}
+	if adminSocketPath != "" {
+		startAdminSocket()
+	}
 
-	// Start Python server
-	cmdPython := exec.Command(pythonPath, pythonScript)
-	cmdPython.Stdout = multiWriter
-	cmdPython.Stderr = multiWriter
-	if err := cmdPython.Start(); err != nil {
-		log.Fatalf("[Go] Error starting server.py: %v", err)
+	// Start Python server where it owns the virtual input devices
+	if useGamepadServer {
+		cmdPython = exec.Command(pythonPath, pythonScript)
+		cmdPython.Stdout = multiWriter
+		cmdPython.Stderr = multiWriter
+		if err := cmdPython.Start(); err != nil {
+			log.Fatalf("[Go] Error starting server.py: %v", err)
+		}
+		log.Printf("[Go] server.py started with PID: %d", cmdPython.Process.Pid)
 	}
-	log.Printf("[Go] server.py started with PID: %d", cmdPython.Process.Pid)
 
 	// Graceful shutdown on Ctrl+C
 	sigs := make(chan os.Signal, 1)
@@ -83,96 +335,394 @@ func main() {
 	go func() {
 		<-sigs
 		log.Println("Shutdown signal received. Shutting down...")
-
-		// Cleanup all active sessions
-		cleanupAllSessions()
-
-		if cmdPython.Process != nil {
-			cmdPython.Process.Kill()
-		}
+		sdNotify("STOPPING=1")
+		stopServer()
 		os.Exit(0)
 	}()
 
 	// HTTP server setup
-	httpAddr := ":8080"
-	http.Handle("/", http.FileServer(http.Dir("./web")))
-	http.HandleFunc("/offer", handleOffer)
-	http.HandleFunc("/stats", handleStats)
-	http.HandleFunc("/sessions", handleSessions)
-
-	log.Printf("[Go] HTTP server running on http://localhost%s", httpAddr)
-	if err := http.ListenAndServe(httpAddr, nil); err != nil {
+	serveWebUI()
+	handleAPI("/offer", clusterRouted(trustedOnly(requirePermission(permStream, handleOffer))))
+	handleAPI("/stats", handleStats)
+	handleAPI("GET /stats/history", handleStatsHistory)
+	handleAPI("GET /usage", handleUsage)
+	handleAPI("GET /cluster", handleCluster)
+	handleAPI("GET /version", handleVersion)
+	handleAPI("GET /ca.pem", handleCACert)
+	handleAPI("GET /capture/sources", handleListCaptureSources)
+	handleAPI("GET /monitors", handleListMonitors)
+	handleAPI("/sessions", handleSessions)
+	handleAPI("DELETE /sessions/{id}", handleEndSession)
+	handleAPI("POST /sessions/{id}/latency", trustedOnly(handleLatencyReport))
+	handleAPI("POST /sessions/{id}/keyframe", trustedOnly(requirePermission(permStream, handleRequestKeyframe)))
+	handleAPI("PUT /sessions/{id}/mapping", handleSetSessionMapping)
+	handleAPI("PUT /sessions/{id}/macros", handleSetSessionMacros)
+	handleAPI("PUT /sessions/{id}/control", handleSetSessionControl)
+	handleAPI("POST /sessions/{id}/watch", trustedOnly(requirePermission(permWatch, handleWatch)))
+	handleAPI("POST /sessions/{id}/join", trustedOnly(requirePermission(permWatch, handleJoin)))
+	handleAPI("PUT /sessions/{id}/guests/{guest}/control", handleSetGuestControl)
+	handleAPI("POST /sessions/{id}/share", handleShareSession)
+	handleAPI("POST /sessions/{id}/monitors", trustedOnly(requirePermission(permStream, handleAddMonitor)))
+	handleAPI("POST /sessions/{id}/reconnect", trustedOnly(requirePermission(permStream, handleReconnect)))
+	handleAPI("PUT /sessions/{id}/video", handleSetVideoMuted)
+	handleAPI("PUT /sessions/{id}/overlay", handleSetStatsOverlay)
+	handleAPI("PUT /sessions/{id}/netsim", handleSetNetsim)
+	handleAPI("GET /sessions/{id}/ffmpeg-log", handleFFmpegLog)
+	handleAPI("POST /sessions/{id}/input-recording", handleStartInputRecording)
+	handleAPI("DELETE /sessions/{id}/input-recording", handleStopInputRecording)
+	handleAPI("POST /sessions/{id}/input-replay", handleStartInputReplay)
+	handleAPI("DELETE /sessions/{id}/input-replay", handleStopInputReplay)
+	handleAPI("GET /input-recordings", handleListInputRecordings)
+	handleAPI("POST /sessions/{id}/publish", handlePublish)
+	handleAPI("DELETE /sessions/{id}/publish", handleUnpublish)
+	handleAPI("GET /queue/{id}", handleQueueEvents)
+	handleAPI("POST /rooms", trustedOnly(requirePermission(permStream, handleCreateRoom)))
+	handleAPI("GET /rooms/{code}", handleGetRoom)
+	handleAPI("DELETE /rooms/{code}", handleCloseRoom)
+	handleAPI("POST /rooms/{code}/join", requirePermission(permWatch, handleJoinRoom))
+	handleAPI("POST /rooms/{code}/chat", handleRoomChat)
+	handleAPI("GET /rooms/{code}/events", handleRoomEvents)
+	handleAPI("PUT /rooms/{code}/members/{member}/control", handleSetMemberControl)
+	handleAPI("POST /rooms/{code}/share", handleShareRoom)
+	handleAPI("POST /share/{token}", handleRedeemShare)
+	handleAPI("POST /pair", handleRequestPairing)
+	handleAPI("GET /pair/{id}", handlePairingStatus)
+	handleAPI("POST /pair/join", handleJoinPairing)
+	handleAPI("GET /devices", handleListDevices)
+	handleAPI("POST /devices/approve", handleApprovePairing)
+	handleAPI("GET /devices/qr", handlePairingQR)
+	handleAPI("DELETE /devices/{id}", handleRevokeDevice)
+	handleAPI("PUT /devices/{id}/limits", handleSetDeviceLimits)
+	handleAPI("POST /auth/login", handleLogin)
+	handleAPI("POST /auth/logout", handleLogout)
+	handleAPI("GET /auth/me", handleCurrentUser)
+	handleAPI("GET /auth/providers", handleAuthProviders)
+	handleAPI("GET /auth/oidc/login", handleOIDCLogin)
+	handleAPI("GET /auth/oidc/callback", handleOIDCCallback)
+	handleAPI("GET /audit", handleAuditLog)
+	handleAPI("GET /e2ee", handleE2EEKey)
+	handleAPI("POST /e2ee", handleE2EEKey)
+	handleAPI("GET /users", handleListUsers)
+	handleAPI("PUT /users/{name}", handlePutUser)
+	handleAPI("DELETE /users/{name}", handleDeleteUser)
+	handleAPI("GET /apps", handleListApps)
+	handleAPI("POST /apps/scan", handleScanApps)
+	handleAPI("GET /apps/{name}/icon", handleAppIcon)
+	handleAPI("PUT /apps/{name}", handlePutApp)
+	handleAPI("DELETE /apps/{name}", handleDeleteApp)
+	handleAPI("GET /update", handleUpdateStatus)
+	handleAPI("POST /update", handleStartUpdate)
+	handleAPI("POST /admin/drain", handleDrain)
+	handleAPI("POST /admin/undrain", handleUndrain)
+	handleAPI("GET /mappings", handleListMappings)
+	handleAPI("PUT /mappings/{name}", handlePutMapping)
+	handleAPI("DELETE /mappings/{name}", handleDeleteMapping)
+	handleAPI("GET /macros", handleListMacros)
+	handleAPI("PUT /macros/{name}", handlePutMacro)
+	handleAPI("DELETE /macros/{name}", handleDeleteMacro)
+	http.HandleFunc(apiPrefix+"/", logRequests(handleAPINotFound))
+	startHTTPS(http.DefaultServeMux)
+
+	listener, err := listen("http", httpAddr)
+	if err != nil {
+		log.Fatalf("Error listening on %s: %v", httpAddr, err)
+	}
+	server := &http.Server{}
+	onHandover(func() { server.SetKeepAlivesEnabled(false) })
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("[systemd] Error notifying readiness: %v", err)
+	}
+	startWatchdog()
+	handleUpgradeSignal()
+
+	log.Printf("[Go] HTTP server running on http://%s", listener.Addr())
+	signalHandoverReady()
+	if err := server.Serve(listener); err != nil {
+		if handedOver.Load() {
+			select {} // Until exitAfterSessions
+		}
 		log.Printf("Fatal HTTP server error: %v", err)
 	}
 }
 
-// Fixed NALU scanner
-func scanNALUs(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if len(data) < 4 {
-		if atEOF && len(data) > 0 {
-			return len(data), data, nil
+func handleOffer(w http.ResponseWriter, r *http.Request) {
+	var req OfferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+
+	mapping, err := validateOffer(&req, limitsFor(r))
+	if err != nil {
+		writeOfferError(w, err)
+		return
+	}
+
+	user := currentUser(r)
+	if err := checkSessionQuota(user); err != nil {
+		writeQuotaError(w, user)
+		return
+	}
+	if user != nil {
+		req.user = user.Name
+	}
+
+	req.requestID = requestID(r)
+	log.Printf("[Request %s] Received offer with config: %dx%d @ %dfps", req.requestID, req.Width, req.Height, req.FPS)
+
+	// Offers wait in the queue while the host is full
+	resp, entry, err := admitOrEnqueue(req, mapping)
+	if isDraining(err) {
+		writeDraining(w, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	if entry != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"queue_id": entry.ID,
+			"position": entry.position(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error sending response: %v", err)
+	}
+}
+
+// validateOffer checks an offer's parameters, fills in defaults and returns
+// the mapping profile it names
+func validateOffer(req *OfferRequest, limits offerLimits) (*MappingProfile, error) {
+	if req.AudioOnly {
+		if req.E2EE || req.AllMonitors {
+			return nil, errors.New("Audio-only sessions have no video to encrypt or capture")
+		}
+	} else if req.Width <= 0 || req.Height <= 0 {
+		return nil, errors.New("Invalid resolution")
+	} else if req.FPS < 0 {
+		return nil, errors.New("Invalid FPS")
+	} else if req.ViewportWidth < 0 || req.ViewportHeight < 0 {
+		return nil, errors.New("Invalid viewport")
+	} else if req.FPS == 0 {
+		// Offers that leave the rate to the host get the display's, within
+		// the limits
+		req.FPS = displayFPS(req.AllMonitors)
+		if limits.MaxFPS > 0 {
+			req.FPS = min(req.FPS, limits.MaxFPS)
+		}
+	}
+	if req.MaxKbps < 0 || (req.MaxKbps > 0 && req.MaxKbps < 100) {
+		return nil, errors.New("Invalid max_kbps")
+	}
+	if req.Netsim != nil {
+		if err := req.Netsim.validate(); err != nil {
+			return nil, err
 		}
-		return 0, nil, nil
+	}
+	if req.AudioBufferMs < 0 || req.AudioBufferMs > maxAudioBufferMs {
+		return nil, errors.New("Invalid audio_buffer_ms")
+	} else if req.AudioBufferMs == 0 {
+		req.AudioBufferMs = hostPipeline.AudioBufferMs
+	}
+	if req.Publish && sfu == nil {
+		return nil, errors.New("Publishing to an SFU is not configured")
+	}
+	if err := checkLimits(req, limits); err != nil {
+		return nil, err
 	}
 
-	// Look for start codes: 0x00000001 or 0x000001
-	for i := 0; i <= len(data)-4; i++ {
-		// Check for 0x00000001
-		if data[i] == 0x00 && data[i+1] == 0x00 && data[i+2] == 0x00 && data[i+3] == 0x01 {
-			if i > 0 {
-				return i, data[:i], nil
-			}
-			// Found start code at beginning, look for next one
-			for j := i + 4; j <= len(data)-4; j++ {
-				if data[j] == 0x00 && data[j+1] == 0x00 &&
-					((data[j+2] == 0x00 && data[j+3] == 0x01) ||
-						(j <= len(data)-3 && data[j+2] == 0x01)) {
-					return j, data[i:j], nil
-				}
-			}
+	mapping, ok := getMappingProfile(req.MappingProfile)
+	if !ok {
+		return nil, errors.New("Unknown mapping profile")
+	}
+
+	if req.ControllerType == "" {
+		req.ControllerType = controllerXbox360
+	}
+	if req.ControllerType != controllerXbox360 && req.ControllerType != controllerDS4 {
+		return nil, errors.New("Invalid controller type")
+	}
+
+	if req.Role == "" {
+		req.Role = peerRoleControl
+	}
+	if req.Role != peerRoleControl && req.Role != peerRoleView {
+		return nil, errors.New("Invalid role")
+	}
+
+	if req.ShortcutPolicy == "" {
+		req.ShortcutPolicy = shortcutPolicyBlock
+	}
+	if !validShortcutPolicy(req.ShortcutPolicy) {
+		return nil, errors.New("Invalid shortcut policy")
+	}
+
+	if req.Host != "" && (cluster == nil || req.Host != cluster.config.HostID) {
+		return nil, errors.New("Unknown host")
+	}
+	if req.App != "" {
+		if _, ok := getApp(req.App); !ok {
+			return nil, errors.New("Unknown app")
 		}
+	}
+	if req.AppOnDisconnect != "" && !validAppOnDisconnect(req.AppOnDisconnect) {
+		return nil, errors.New("Invalid app_on_disconnect")
+	}
 
-		// Check for 0x000001 (if we haven't found 0x00000001)
-		if i <= len(data)-3 && data[i] == 0x00 && data[i+1] == 0x00 && data[i+2] == 0x01 {
-			if i > 0 {
-				return i, data[:i], nil
-			}
-			// Found start code at beginning, look for next one
-			for j := i + 3; j <= len(data)-3; j++ {
-				if data[j] == 0x00 && data[j+1] == 0x00 &&
-					(data[j+2] == 0x01 || (j <= len(data)-4 && data[j+2] == 0x00 && data[j+3] == 0x01)) {
-					return j, data[i:j], nil
-				}
-			}
+	if req.Capture == "" {
+		req.Capture = captureSource
+	}
+	if !captureSourceAvailable(req.Capture) {
+		return nil, errors.New("Unknown capture source")
+	}
+
+	if req.Codec == "" {
+		req.Codec = defaultVideoCodec
+	}
+	if _, ok := videoCodecs[req.Codec]; !ok {
+		return nil, errors.New("Unsupported codec")
+	}
+	if !captureSourceEncodes(req.Capture, req.Codec) {
+		return nil, errors.New("Capture source does not support codec")
+	}
+	if req.AllMonitors {
+		if !captureSourceTypes[req.Capture].caps.Desktop {
+			return nil, errors.New("Capture source cannot capture all monitors")
+		}
+		desktop, err := desktopArea()
+		if err != nil {
+			log.Printf("Error listing monitors: %v", err)
+			return nil, errors.New("Monitors unavailable")
+		}
+		req.desktop = desktop
+	}
+	if req.E2EE && req.Codec != "vp8" {
+		return nil, errors.New("E2EE needs the vp8 codec")
+	}
+	format, ok := parsePixelFormat(req.Chroma, req.BitDepth)
+	if !ok {
+		return nil, errors.New("Invalid chroma or bit depth")
+	}
+	if format != (pixelFormat{}) && !req.AudioOnly {
+		capability, ok := videoCodecs[req.Codec].capabilityFor(format)
+		if !ok || !captureSourceTypes[req.Capture].caps.PixelFormats {
+			return nil, errors.New("Codec or capture source does not support chroma or bit depth")
+		}
+		if !offersProfile(req.SDP, capability) {
+			return nil, errors.New("Client does not support chroma or bit depth")
 		}
 	}
+	req.format = format
 
-	if atEOF && len(data) > 0 {
-		return len(data), data, nil
+	if hostWatermark.enabled() && !req.AudioOnly && !captureSourceTypes[req.Capture].caps.Watermark {
+		return nil, errors.New("Capture source cannot draw the watermark")
 	}
 
-	return 0, nil, nil
-}
+	req.colors = hostColors
+	if !captureSourceTypes[req.Capture].caps.Colors {
+		if req.ColorSpace != "" || req.ColorRange != "" {
+			return nil, errors.New("Capture source cannot convert colors")
+		}
+		req.colors = inProcessColors
+	}
+	if req.ColorSpace != "" {
+		req.colors.Space = req.ColorSpace
+	}
+	if req.ColorRange != "" {
+		req.colors.Range = req.ColorRange
+	}
+	if err := req.colors.validate(); err != nil {
+		return nil, errors.New("Invalid color space or range")
+	}
 
-func handleOffer(w http.ResponseWriter, r *http.Request) {
-	var req OfferRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Error decoding JSON", http.StatusBadRequest)
-		return
+	if req.Preset == "" {
+		req.Preset = defaultEncoderPreset
+	}
+	if _, ok := encoderPresets[req.Preset]; !ok {
+		return nil, errors.New("Unknown encoder preset")
+	}
+	if req.Slices < 0 || req.Slices > maxEncoderSlices {
+		return nil, errors.New("Invalid slice count")
+	}
+	if req.Threads < 0 || req.Threads > maxEncoderThreads {
+		return nil, errors.New("Invalid thread count")
 	}
 
-	// Validate input parameters
-	if req.Width <= 0 || req.Width > 3840 || req.Height <= 0 || req.Height > 2160 {
-		http.Error(w, "Invalid resolution", http.StatusBadRequest)
-		return
+	if req.DropPolicy == "" {
+		req.DropPolicy = dropPolicyNone
 	}
-	if req.FPS <= 0 || req.FPS > 144 {
-		http.Error(w, "Invalid FPS", http.StatusBadRequest)
-		return
+	if !validDropPolicy(req.DropPolicy) {
+		return nil, errors.New("Invalid drop policy")
+	}
+	return mapping, nil
+}
+
+// sessionAPI is the WebRTC API for one session's peer connection: pion's
+// default codecs and interceptors plus FEC, bandwidth estimation and
+// network simulation, with the host's DTLS settings
+type sessionAPI struct {
+	*webrtc.API
+	fec    *ulpfec
+	netsim *netsim
+	// bwe is set when the peer connection is created
+	bwe cc.BandwidthEstimator
+}
+
+func newSessionAPI(initialKbps int, colors colorSettings) (*sessionAPI, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	if err := registerFECCodecs(m); err != nil {
+		return nil, err
+	}
+	if err := registerPixelFormatCodecs(m); err != nil {
+		return nil, err
+	}
+	if err := registerColorSpaceExtension(m); err != nil {
+		return nil, err
+	}
+
+	a := &sessionAPI{fec: &ulpfec{}, netsim: newNetsim()}
+	congestion, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		// Sending is paced by the encoder's rate control already
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(initialKbps*1000),
+			gcc.SendSideBWEMaxBitrate(2*initialKbps*1000),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return nil, err
 	}
+	congestion.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		a.bwe = estimator
+	})
 
-	log.Printf("Received offer with config: %dx%d @ %dfps", req.Width, req.Height, req.FPS)
+	i := &interceptor.Registry{}
+	i.Add(a.netsim.factory())
+	i.Add(a.fec.inner())
+	i.Add(congestion)
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, i); err != nil {
+		return nil, err
+	}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+	i.Add(a.fec.outer())
+	i.Add(colorSpaceFactory{colors})
+	a.API = webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(settingEngine))
+	return a, nil
+}
 
+// startSession creates a session for a validated offer and answers it
+func startSession(req OfferRequest, mapping *MappingProfile) (*OfferResponse, error) {
 	config := webrtc.Configuration{
 		ICEServers: []webrtc.ICEServer{
 			{URLs: []string{"stun:stun.l.google.com:19302"}},
@@ -180,11 +730,48 @@ func handleOffer(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	pc, err := webrtc.NewPeerConnection(config)
+	// The top rung encodes at the size the client shows the picture at
+	height := viewportHeight(req.Width, req.Height, req.ViewportWidth, req.ViewportHeight)
+	ladder := sessionLadder(height, req.FPS, req.MaxKbps)
+	api, err := newSessionAPI(ladder[0].Kbps, req.colors)
+	if err != nil {
+		log.Printf("Error creating WebRTC API: %v", err)
+		return nil, err
+	}
+	pc, err := api.NewPeerConnection(config)
 	if err != nil {
 		log.Printf("Error creating PeerConnection: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+
+	// Create video track; spectators share it with the session's peer.
+	// Audio-only sessions get an audio track instead.
+	var track, videoTrack, audioTrack *webrtc.TrackLocalStaticSample
+	if req.AudioOnly {
+		track, err = webrtc.NewTrackLocalStaticSample(audioCodec, "audio", "chimera-stream")
+		audioTrack = track
+	} else {
+		capability, _ := videoCodecs[req.Codec].capabilityFor(req.format)
+		track, err = webrtc.NewTrackLocalStaticSample(capability, "video", "chimera-stream")
+		videoTrack = track
+	}
+	if err != nil {
+		pc.Close()
+		log.Printf("Error creating track: %v", err)
+		return nil, err
+	}
+
+	var e2ee *sframeEncryptor
+	if req.E2EE {
+		key, err := getE2EEKey()
+		if err == nil {
+			e2ee, err = newSFrameEncryptor(key)
+		}
+		if err != nil {
+			pc.Close()
+			log.Printf("Error setting up E2EE: %v", err)
+			return nil, err
+		}
 	}
 
 	// Create session context - DON'T tie it to request context
@@ -192,75 +779,103 @@ func handleOffer(w http.ResponseWriter, r *http.Request) {
 
 	// Create session
 	sessionID := generateSessionID()
+	if req.requestID != "" {
+		log.Printf("[Session %s] Created by request %s", sessionID, req.requestID)
+	}
+
+	preferredSlot := -1
+	if req.GamepadSlot != nil {
+		preferredSlot = *req.GamepadSlot
+	}
+	gamepadSlot := acquireGamepadSlot(sessionID, preferredSlot)
+	if gamepadSlot < 0 {
+		log.Printf("[Session %s] No free gamepad slot, session will have no controller", sessionID)
+	}
+
 	session := &StreamSession{
-		ID:        sessionID,
-		PC:        pc,
-		Cancel:    sessionCancel,
-		StartTime: time.Now(),
+		ID:             sessionID,
+		PC:             pc,
+		Cancel:         sessionCancel,
+		StartTime:      time.Now(),
+		Width:          req.Width,
+		Height:         req.Height,
+		FPS:            req.FPS,
+		Clipboard:      req.Clipboard,
+		LatencyOverlay: req.LatencyOverlay,
+		GamepadSlot:    gamepadSlot,
+		ControllerType: req.ControllerType,
+		shortcuts:      newShortcutFilter(req.ShortcutPolicy),
+		viewer:         req.Role == peerRoleView,
+		e2ee:           e2ee,
+		ownerToken:     generateOwnerToken(),
+		user:           req.user,
+		mapping:        mapping,
+		ctx:            sessionCtx,
+		videoTrack:     videoTrack,
+		audioTrack:     audioTrack,
+		source:         req.Capture,
+		maxKbps:        req.MaxKbps,
+		activity:       make(chan struct{}, 1),
+		colors:         req.colors,
+		bwe:            api.bwe,
+		lockOnEnd:      req.LockOnEnd,
+		netsim:         api.netsim,
+		ffmpegLog:      newFFmpegLog(sessionID),
+	}
+	session.control.Store(req.Role == peerRoleControl)
+	session.macros.Store(req.Macros)
+	session.deadline, session.deadlineReason = req.timeLimit.deadline(session.StartTime)
+	api.fec.stats = &session.Stats
+	if req.Netsim != nil && req.Netsim.active() {
+		api.netsim.set(*req.Netsim)
+		log.Printf("[Session %s] Simulating %s", sessionID, req.Netsim)
 	}
 
 	registerSession(session)
+	setupDataChannels(sessionCtx, session)
 
-	// Setup connection state handler
+	// The session ends with its connection, see followConnectionState
+	endConnection := func() {
+		if !session.ended.CompareAndSwap(false, true) {
+			return
+		}
+		if session.connected.Load() {
+			atomic.AddInt32(&activeStreams, -1)
+		}
+		sessionCancel()
+		unregisterSession(sessionID)
+		if pc.ConnectionState() != webrtc.PeerConnectionStateClosed {
+			pc.Close()
+		}
+	}
+	session.followConnectionState(webrtc.PeerConnectionStateNew, endConnection)
 	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		defer session.recoverPanic("connection state handler")
 		log.Printf("[Session %s] WebRTC Connection State: %s", sessionID, state.String())
 
-		switch state {
-		case webrtc.PeerConnectionStateConnected:
+		if state == webrtc.PeerConnectionStateConnected && !session.connected.Swap(true) {
 			atomic.AddInt32(&activeStreams, 1)
-		case webrtc.PeerConnectionStateDisconnected,
-			webrtc.PeerConnectionStateFailed,
-			webrtc.PeerConnectionStateClosed:
-			atomic.AddInt32(&activeStreams, -1)
-			sessionCancel()
-			unregisterSession(sessionID)
-			if pc.ConnectionState() != webrtc.PeerConnectionStateClosed {
-				pc.Close()
-			}
 		}
+		session.followConnectionState(state, endConnection)
 	})
 
-	// Create video track
-	videoTrack, err := webrtc.NewTrackLocalStaticSample(
-		webrtc.RTPCodecCapability{
-			MimeType:    webrtc.MimeTypeH264,
-			ClockRate:   90000,
-			Channels:    0,
-			SDPFmtpLine: "level-id=1;profile-level-id=42e01e;packetization-mode=1",
-		},
-		"video",
-		"chimera-stream",
-	)
+	sender, err := pc.AddTrack(track)
 	if err != nil {
-		cleanup := func() {
-			sessionCancel()
-			unregisterSession(sessionID)
-			pc.Close()
-		}
-		cleanup()
-		log.Printf("Error creating video track: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-
-	if _, err = pc.AddTrack(videoTrack); err != nil {
 		sessionCancel()
 		unregisterSession(sessionID)
 		pc.Close()
 		log.Printf("Error adding track: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	// Set remote description
-	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: req.SDP}
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: hostFamilies.preferCandidates(req.SDP)}
 	if err := pc.SetRemoteDescription(offer); err != nil {
 		sessionCancel()
 		unregisterSession(sessionID)
 		pc.Close()
 		log.Printf("Error setting remote description: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	// Create and set answer
@@ -270,8 +885,7 @@ func handleOffer(w http.ResponseWriter, r *http.Request) {
 		unregisterSession(sessionID)
 		pc.Close()
 		log.Printf("Error creating answer: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	if err = pc.SetLocalDescription(answer); err != nil {
@@ -279,176 +893,204 @@ func handleOffer(w http.ResponseWriter, r *http.Request) {
 		unregisterSession(sessionID)
 		pc.Close()
 		log.Printf("Error setting local description: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
+	api.fec.setPayloadTypes(sender)
+	session.goSafe("rtcp reader", func() { session.readRTCP(sender) })
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(answer); err != nil {
-		log.Printf("Error sending response: %v", err)
+	if app, ok := getApp(req.App); ok {
+		session.launchApp(app, req.AppOnDisconnect)
+	}
+	if !session.deadline.IsZero() {
+		session.goSafe("time limit", func() { session.enforceTimeLimit(sessionCtx) })
+	}
+	if req.Publish {
+		session.goSafe("SFU publish", func() {
+			if err := session.publish(); err != nil {
+				log.Printf("[Session %s] Error publishing to the SFU: %v", sessionID, err)
+			}
+		})
 	}
 
-	// Start FFmpeg in separate goroutine with proper delay
-	go func() {
-		// Wait a bit for WebRTC connection to be established
-		time.Sleep(500 * time.Millisecond)
-		startFFmpeg(sessionCtx, videoTrack, req.Width, req.Height, req.FPS, sessionID)
-	}()
+	if req.AudioOnly {
+		session.goSafe("audio pipeline", func() { runAudioCapture(sessionCtx, session, audioTrack, req.AudioBufferMs) })
+	} else {
+		// Start FFmpeg in separate goroutine with proper delay
+		cfg := CaptureConfig{
+			Codec:          req.Codec,
+			Format:         req.format,
+			Colors:         req.colors,
+			Width:          req.Width,
+			Height:         req.Height,
+			LatencyOverlay: req.LatencyOverlay,
+			IntraRefresh:   encoderPresets[req.Preset].IntraRefresh,
+			Slices:         req.Slices,
+			Threads:        req.Threads,
+			Monitor:        req.desktop,
+		}
+		ladder[0].apply(&cfg)
+		session.goSafe("video pipeline", func() {
+			// Wait a bit for WebRTC connection to be established
+			time.Sleep(500 * time.Millisecond)
+			runCapture(sessionCtx, session, videoTrack, req.Capture, cfg, req.DropPolicy)
+		})
+	}
+
+	audit(auditEntry{
+		Action:    "session_start",
+		User:      req.user,
+		RequestID: req.requestID,
+		Session:   sessionID,
+		Details: map[string]interface{}{
+			"role":       req.Role,
+			"resolution": fmt.Sprintf("%dx%d@%d", req.Width, req.Height, req.FPS),
+			"app":        req.App,
+			"e2ee":       req.E2EE,
+			"audio_only": req.AudioOnly,
+		},
+	})
+
+	resp := &OfferResponse{
+		SessionDescription: answer,
+		SessionID:          sessionID,
+		GamepadSlot:        gamepadSlot,
+		Role:               req.Role,
+		OwnerToken:         session.ownerToken,
+	}
+	if e2ee != nil {
+		resp.E2EEKeyID = &e2ee.keyID
+	}
+	if req.AudioOnly {
+		resp.AudioBufferMs = req.AudioBufferMs
+	}
+	return resp, nil
 }
 
-func startFFmpeg(ctx context.Context, track *webrtc.TrackLocalStaticSample, width, height, fps int, sessionID string) {
-	log.Printf("[Session %s] Starting FFmpeg...", sessionID)
+// runCapture feeds the session's capture source into its video track
+func runCapture(ctx context.Context, session *StreamSession, track *webrtc.TrackLocalStaticSample, source string, cfg CaptureConfig, dropPolicy string) {
+	sessionID := session.ID
+	log.Printf("[Session %s] Starting %s capture...", sessionID, source)
 
 	// Check if context is already canceled
 	select {
 	case <-ctx.Done():
-		log.Printf("[Session %s] Context already canceled, not starting FFmpeg", sessionID)
+		log.Printf("[Session %s] Context already canceled, not starting capture", sessionID)
 		return
 	default:
 	}
 
-	// Optimized FFmpeg arguments
-	args := []string{
-		"-f", "gdigrab",
-		"-framerate", fmt.Sprintf("%d", fps),
-		"-video_size", fmt.Sprintf("%dx%d", width, height),
-		"-i", "desktop",
-		"-c:v", "libx264", // Use software encoder for compatibility
-		"-preset", "ultrafast",
-		"-tune", "zerolatency",
-		"-crf", "23",
-		"-maxrate", "8M",
-		"-bufsize", "16M",
-		"-g", fmt.Sprintf("%d", fps*2), // GOP size
-		"-keyint_min", fmt.Sprintf("%d", fps),
-		"-pix_fmt", "yuv420p",
-		"-f", "h264",
-		"-an", // No audio
-		"pipe:1",
-	}
-
-	// Create command with context
-	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Printf("[Session %s] Error creating stdout pipe: %v", sessionID, err)
-		return
+	if hostWatermark.enabled() {
+		watermark, err := session.watermark()
+		if err != nil {
+			log.Printf("[Session %s] Error writing watermark: %v", sessionID, err)
+			return
+		}
+		defer watermark.remove()
+		cfg.Watermark = watermark
 	}
 
-	stderr, err := cmd.StderrPipe()
+	capture, err := newCaptureSource(source, session, &session.Stats)
 	if err != nil {
-		log.Printf("[Session %s] Error creating stderr pipe: %v", sessionID, err)
+		log.Printf("[Session %s] Error creating capture source: %v", sessionID, err)
 		return
 	}
-
-	// Start FFmpeg
-	if err := cmd.Start(); err != nil {
-		log.Printf("[Session %s] Error starting FFmpeg: %v", sessionID, err)
+	if err := capture.Start(ctx, cfg); err != nil {
+		log.Printf("[Session %s] Error starting capture: %v", sessionID, err)
 		return
 	}
+	defer capture.Stop()
+
+	// Update session with the running source
+	updateSessionCapture(sessionID, capture)
+	session.encoder.start(capture, cfg)
+	session.Stats.gopFrames.Store(int32(cfg.gop()))
+	session.goSafe("adaptive encoding", func() { session.adaptEncoding(ctx) })
+	if session.bwe != nil {
+		session.goSafe("bitrate ladder", func() { session.followLadder(ctx, session.bwe) })
+	}
+	session.goSafe("stats overlay", func() { session.updateStatsOverlay(ctx) })
+	session.goSafe("idle pause", func() { session.pauseWhenIdle(ctx) })
+
+	// Samples go through a bounded queue so a slow WriteSample only holds
+	// the source up once it is full
+	samples := make(chan AccessUnit, cfg.buffers().sampleQueue)
+	defer close(samples)
+	session.goSafe("sample writer", func() { writeSamples(session, track, samples, cfg.FPS, dropPolicy) })
+
+	// Stopping the source ends a blocked ReadAccessUnit
+	session.goSafe("capture stopper", func() {
+		<-ctx.Done()
+		capture.Stop()
+	})
 
-	log.Printf("[Session %s] FFmpeg started successfully (PID: %d)", sessionID, cmd.Process.Pid)
-
-	// Update session with FFmpeg command
-	updateSessionFFmpeg(sessionID, cmd)
-
-	// FFmpeg logging goroutine
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
+	// A full queue means the track fell behind. Without a drop policy the
+	// source waits for it; with one, the frame is dropped and so is every
+	// frame up to the next keyframe, which is asked for, since they could
+	// not be decoded without it
+	dropping := false
+	for {
+		au, err := capture.ReadAccessUnit()
+		if err != nil {
 			select {
 			case <-ctx.Done():
-				return
+				log.Printf("[Session %s] Context canceled, capture stopped", sessionID)
 			default:
-				line := scanner.Text()
-				if len(line) > 0 && !bytes.Contains([]byte(line), []byte("frame=")) {
-					log.Printf("[Session %s] FFMPEG: %s", sessionID, line)
+				if err != io.EOF {
+					log.Printf("[Session %s] Capture error: %v", sessionID, err)
+				}
+				log.Printf("[Session %s] Capture source ended", sessionID)
+				var stalled *ffmpegStalledError
+				if errors.As(err, &stalled) {
+					session.fail(stalled.Error())
 				}
 			}
+			return
 		}
-	}()
-
-	// Video processing loop
-	const bufferSize = 1024 * 1024 // 1MB buffer
-	scanner := bufio.NewScanner(stdout)
-	buffer := make([]byte, bufferSize)
-	scanner.Buffer(buffer, bufferSize*4)
-	scanner.Split(scanNALUs)
+		au.Read = time.Now()
 
-	frameDuration := time.Second / time.Duration(fps)
-	lastFrameTime := time.Now()
-	frameCount := 0
-
-	for {
-		select {
-		case <-ctx.Done():
-			log.Printf("[Session %s] Context canceled, stopping FFmpeg", sessionID)
-			if cmd.Process != nil {
-				cmd.Process.Kill()
+		if dropping {
+			if !au.Keyframe {
+				session.Stats.samplesThrottled.Add(1)
+				continue
 			}
-			cmd.Wait()
-			return
-
+			dropping = false
+		}
+		if dropPolicy == dropPolicyNone {
+			select {
+			case samples <- au:
+			case <-ctx.Done():
+			}
+			session.Stats.queueDepth.Store(int32(len(samples)))
+			continue
+		}
+		select {
+		case samples <- au:
+			session.Stats.queueDepth.Store(int32(len(samples)))
 		default:
-			if scanner.Scan() {
-				nalu := scanner.Bytes()
-				if len(nalu) > 4 {
-					now := time.Now()
-
-					// Frame rate control
-					if now.Sub(lastFrameTime) >= frameDuration {
-						// Ensure NALU has start code
-						var naluWithStart []byte
-						if !bytes.HasPrefix(nalu, []byte{0x00, 0x00, 0x00, 0x01}) &&
-							!bytes.HasPrefix(nalu, []byte{0x00, 0x00, 0x01}) {
-							naluWithStart = append([]byte{0x00, 0x00, 0x00, 0x01}, nalu...)
-						} else {
-							naluWithStart = make([]byte, len(nalu))
-							copy(naluWithStart, nalu)
-						}
-
-						err := track.WriteSample(media.Sample{
-							Data:     naluWithStart,
-							Duration: frameDuration,
-						})
-
-						atomic.AddInt64(&framesProcessed, 1)
-						frameCount++
-
-						if err != nil {
-							atomic.AddInt64(&framesDropped, 1)
-							if frameCount%100 == 0 { // Log every 100th error
-								log.Printf("[Session %s] Error writing sample: %v", sessionID, err)
-							}
-						}
-
-						lastFrameTime = now
-
-						// Log progress every 5 seconds
-						if frameCount%300 == 0 {
-							log.Printf("[Session %s] Frames processed: %d", sessionID, frameCount)
-						}
-					}
-				}
-			} else {
-				if err := scanner.Err(); err != nil {
-					log.Printf("[Session %s] Scanner error: %v", sessionID, err)
-				}
-
-				// Check if FFmpeg process is still running
-				if cmd.ProcessState != nil && cmd.ProcessState.Exited() {
-					log.Printf("[Session %s] FFmpeg process exited", sessionID)
-				}
-				return
+			session.Stats.samplesDropped.Add(1)
+			dropping = true
+			if err := session.requestKeyframe(); err != nil && !errors.Is(err, errKeyframeTooSoon) {
+				log.Printf("[Session %s] Error requesting keyframe: %v", sessionID, err)
 			}
 		}
 	}
 }
 
 // Session management functions
+
+// generateSessionID returns a random ID, as session IDs are shared to
+// watch or join a session and must not be guessed
 func generateSessionID() string {
-	return fmt.Sprintf("session_%d", time.Now().UnixNano())
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "session_" + hex.EncodeToString(b)
+}
+
+func getSession(sessionID string) (*StreamSession, bool) {
+	sessionsLock.RLock()
+	defer sessionsLock.RUnlock()
+	session, exists := sessions[sessionID]
+	return session, exists
 }
 
 func registerSession(session *StreamSession) {
@@ -456,61 +1098,62 @@ func registerSession(session *StreamSession) {
 	defer sessionsLock.Unlock()
 	sessions[session.ID] = session
 	log.Printf("[Session %s] Session registered. Total: %d", session.ID, len(sessions))
+	clusterChanged()
 }
 
 func unregisterSession(sessionID string) {
 	sessionsLock.Lock()
 	defer sessionsLock.Unlock()
 	if session, exists := sessions[sessionID]; exists {
-		session.mutex.Lock()
-		if session.FFmpegCmd != nil && session.FFmpegCmd.Process != nil {
-			session.FFmpegCmd.Process.Kill()
-		}
-		session.mutex.Unlock()
-
-		delete(sessions, sessionID)
+		removeSession(session)
 		log.Printf("[Session %s] Session removed. Total: %d", sessionID, len(sessions))
+		clusterChanged()
+		go admitQueuedOffers()
+	}
+}
+
+// removeSession stops the session's capture, takes it out of sessions and
+// settles what it leaves behind: its logs and recordings, usage, stats,
+// gamepad slot and audit entry. sessionsLock must be held.
+func removeSession(session *StreamSession) {
+	session.mutex.Lock()
+	if session.Capture != nil {
+		session.Capture.Stop()
 	}
+	session.mutex.Unlock()
+
+	delete(sessions, session.ID)
+	if session.ffmpegLog != nil {
+		session.ffmpegLog.close()
+	}
+	session.stopInputRecording()
+	recordUsage(session)
+	session.Stats.retire()
+	releaseGamepadSlot(session.ID)
+	auditSessionEnd(session)
+	lockOnSessionEnd(session)
 }
 
-func updateSessionFFmpeg(sessionID string, cmd *exec.Cmd) {
+func updateSessionCapture(sessionID string, capture CaptureSource) {
 	sessionsLock.Lock()
 	defer sessionsLock.Unlock()
 	if session, exists := sessions[sessionID]; exists {
 		session.mutex.Lock()
-		session.FFmpegCmd = cmd
+		session.Capture = capture
 		session.mutex.Unlock()
 	}
 }
 
-func cleanupStaleSessions() {
-	ticker := time.NewTicker(2 * time.Minute)
-	defer ticker.Stop()
+// stopServer ends every session and the Python server before exiting
+func stopServer() {
+	cleanupAllSessions()
+	releasePrivacy()
+	if cluster != nil {
+		cluster.leave()
+	}
 
-	for range ticker.C {
-		sessionsLock.Lock()
-		now := time.Now()
-		for id, session := range sessions {
-			// Remove sessions inactive for more than 10 minutes
-			if now.Sub(session.StartTime) > 10*time.Minute {
-				state := session.PC.ConnectionState()
-				if state == webrtc.PeerConnectionStateDisconnected ||
-					state == webrtc.PeerConnectionStateFailed ||
-					state == webrtc.PeerConnectionStateClosed {
-
-					session.Cancel()
-					session.mutex.RLock()
-					if session.FFmpegCmd != nil && session.FFmpegCmd.Process != nil {
-						session.FFmpegCmd.Process.Kill()
-					}
-					session.mutex.RUnlock()
-
-					delete(sessions, id)
-					log.Printf("[Session %s] Stale session removed", id)
-				}
-			}
-		}
-		sessionsLock.Unlock()
+	if cmdPython != nil && cmdPython.Process != nil {
+		cmdPython.Process.Kill()
 	}
 }
 
@@ -518,18 +1161,12 @@ func cleanupAllSessions() {
 	sessionsLock.Lock()
 	defer sessionsLock.Unlock()
 
-	for id, session := range sessions {
+	for _, session := range sessions {
 		session.Cancel()
-		session.mutex.RLock()
-		if session.FFmpegCmd != nil && session.FFmpegCmd.Process != nil {
-			session.FFmpegCmd.Process.Kill()
-		}
-		session.mutex.RUnlock()
-
+		removeSession(session)
 		if session.PC != nil && session.PC.ConnectionState() != webrtc.PeerConnectionStateClosed {
 			session.PC.Close()
 		}
-		delete(sessions, id)
 	}
 	log.Printf("All sessions terminated. Total: %d", len(sessions))
 }
@@ -540,65 +1177,174 @@ func logMetrics() {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		processed := atomic.LoadInt64(&framesProcessed)
-		dropped := atomic.LoadInt64(&framesDropped)
+		host := hostStats()
 		active := atomic.LoadInt32(&activeStreams)
 
-		var dropRate float64
-		if processed > 0 {
-			dropRate = float64(dropped) / float64(processed) * 100
-		}
-
-		log.Printf("📊 Metrics: ActiveStreams=%d, FramesProcessed=%d, FramesDropped=%d, DropRate=%.2f%%",
-			active, processed, dropped, dropRate)
+		log.Printf("📊 Metrics: ActiveStreams=%d, FramesProcessed=%d, FramesDropped=%d, DropRate=%.2f%%, Bitrate=%.0fkbps, SessionPanics=%d",
+			active, host.processed, host.dropped, host.dropRate(), host.bitrateKbps, atomic.LoadInt64(&sessionPanics))
 	}
 }
 
 // HTTP handlers for monitoring
 func handleStats(w http.ResponseWriter, r *http.Request) {
-	processed := atomic.LoadInt64(&framesProcessed)
-	dropped := atomic.LoadInt64(&framesDropped)
+	host := hostStats()
 	active := atomic.LoadInt32(&activeStreams)
 
-	var dropRate float64
-	if processed > 0 {
-		dropRate = float64(dropped) / float64(processed) * 100
+	var rttSamples, glassSamples []float64
+	sessionsLock.RLock()
+	for _, session := range sessions {
+		rttSamples = append(rttSamples, session.Latency.samples()...)
+		glassSamples = append(glassSamples, session.Latency.glassSamples()...)
 	}
+	sessionsLock.RUnlock()
 
 	stats := map[string]interface{}{
 		"active_streams":    active,
-		"frames_processed":  processed,
-		"frames_dropped":    dropped,
-		"drop_rate_percent": dropRate,
-		"timestamp":         time.Now().Unix(),
+		"frames_processed":  host.processed,
+		"frames_dropped":    host.dropped,
+		"drop_rate_percent": host.dropRate(),
+		"send_fps":          host.sendFPS,
+		"bitrate_kbps":      host.bitrateKbps,
+		"queue_length":      queueLength(),
+		"draining":          drainError() != nil,
+		"overloaded":        overloaded() != nil,
+		"resources":         resourceStats(),
+		"session_panics":    atomic.LoadInt64(&sessionPanics),
+		"version":           version,
+		"latency": map[string]interface{}{
+			"rtt":            latencySummary(rttSamples),
+			"glass_to_glass": latencySummary(glassSamples),
+			"pipeline":       hostLatency.summary(),
+		},
+		"timestamp": time.Now().Unix(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(stats)
 }
 
+// handleSessions lists every session to admins and their own to owners
 func handleSessions(w http.ResponseWriter, r *http.Request) {
+	admin := isAdmin(r)
 	sessionsLock.RLock()
 	defer sessionsLock.RUnlock()
 
 	sessionInfo := make([]map[string]interface{}, 0, len(sessions))
 	for id, session := range sessions {
+		if !admin && !session.canManage(r) {
+			continue
+		}
 		session.mutex.RLock()
-		hasFFmpeg := session.FFmpegCmd != nil
+		hasFFmpeg := session.Capture != nil
 		session.mutex.RUnlock()
 
 		info := map[string]interface{}{
-			"id":         id,
-			"start_time": session.StartTime.Format(time.RFC3339),
-			"duration":   time.Since(session.StartTime).String(),
-			"state":      session.PC.ConnectionState().String(),
-			"has_ffmpeg": hasFFmpeg,
+			"id":              id,
+			"start_time":      session.StartTime.Format(time.RFC3339),
+			"duration":        time.Since(session.StartTime).String(),
+			"state":           session.PC.ConnectionState().String(),
+			"has_ffmpeg":      hasFFmpeg,
+			"gamepad_slot":    session.GamepadSlot,
+			"shortcut_policy": session.shortcuts.policy,
+			"control":         session.control.Load(),
+			"role":            session.peerRole(),
+			"spectators":      session.spectatorCount(),
+			"input":           session.Input.summary(),
+		}
+		if session.user != "" {
+			info["user"] = session.user
+		}
+		if session.audioTrack != nil {
+			info["audio_only"] = true
+		}
+		if session.videoMuted.Load() {
+			info["video_muted"] = true
+		}
+		if monitors := session.streamingMonitors(); len(monitors) > 0 {
+			info["monitors"] = monitors
+		}
+		stats := session.pipeline()
+		rates := stats.currentRates()
+		info["frames"] = map[string]interface{}{
+			"processed":    stats.samplesProcessed.Load(),
+			"dropped":      stats.samplesDropped.Load(),
+			"sent":         stats.samplesSent.Load(),
+			"bytes":        stats.bytesSent.Load(),
+			"send_fps":     rates.SendFPS,
+			"bitrate_kbps": rates.BitrateKbps,
+		}
+		if cfg := session.encoder.config(); cfg.FPS > 0 {
+			width, height := cfg.outputSize()
+			encoding := map[string]interface{}{
+				"width":    width,
+				"height":   height,
+				"fps":      cfg.FPS,
+				"max_kbps": cfg.maxKbps(),
+				"pix_fmt":  cfg.Format.pixFmt(),
+				"colors":   session.colors,
+			}
+			if cfg.Watermark != (watermarkOverlay{}) {
+				encoding["watermark"] = true
+			}
+			if cfg.Paused {
+				encoding["paused"] = true
+			}
+			if session.bwe != nil {
+				encoding["estimate_kbps"] = session.bwe.GetTargetBitrate() / 1000
+			}
+			info["encoding"] = encoding
+		}
+		if session.parent != nil {
+			info["coop_host"] = session.parent.ID
+		}
+		if session.GamepadSlot >= 0 {
+			info["controller_type"] = session.ControllerType
+		}
+		session.mutex.RLock()
+		if session.mapping != nil {
+			info["mapping_profile"] = session.mapping.Name
+		}
+		if session.App != nil {
+			info["app"] = session.App.info()
+		}
+		if session.inputRecording != nil {
+			info["input_recording"] = session.inputRecording.name
+		}
+		if session.inputReplay != nil {
+			info["input_replay"] = true
+		}
+		session.mutex.RUnlock()
+		if rtt, offset, ok := session.Latency.latest(); ok {
+			info["rtt_ms"] = rtt
+			info["clock_offset_ms"] = offset
+		}
+		if session.LatencyOverlay {
+			info["glass_to_glass"] = latencySummary(session.Latency.glassSamples())
+		}
+		info["pipeline_latency"] = stats.latency.summary()
+		if session.netsim != nil {
+			if netsim := session.netsim.info(); netsim != nil {
+				info["netsim"] = netsim
+			}
+		}
+		if !session.deadline.IsZero() {
+			info["ends_at"] = session.deadline
+			info["end_reason"] = session.deadlineReason
+		}
+		if session.ffmpegLog != nil {
+			info["ffmpeg_log"] = apiPrefix + "/sessions/" + id + "/ffmpeg-log"
+		}
+		if published := session.publisherInfo(); published != nil {
+			info["sfu"] = published
+		}
+		if total, byWhat := session.memoryUsage(); total > 0 {
+			info["memory"] = map[string]interface{}{"total_bytes": total, "by_process": byWhat}
 		}
 		sessionInfo = append(sessionInfo, info)
 	}
 
 	response := map[string]interface{}{
-		"total_sessions": len(sessions),
+		"total_sessions": len(sessionInfo),
 		"sessions":       sessionInfo,
 		"timestamp":      time.Now().Unix(),
 	}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"os"
+	"testing"
+)
+
+// TestMain runs the tests in a directory of their own, as handlers write
+// the audit log and other state to the working directory
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "chimera-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestGenerateSessionID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := generateSessionID()
+		if len(id) != len("session_")+32 {
+			t.Fatalf("session ID %q is not 16 random bytes", id)
+		}
+		if seen[id] {
+			t.Fatalf("session ID %q generated twice", id)
+		}
+		seen[id] = true
+	}
+}
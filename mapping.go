@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/lightsyr/chimera-go/input"
+)
+
+var mappingProfilesFile = "mapping-profiles.json"
+
+// MappingProfile remaps and shapes controller input before it reaches the
+// virtual controller. Maps are keyed by the client's index; a target of -1
+// disables the input.
+type MappingProfile struct {
+	Name            string      `json:"name"`
+	ButtonMap       map[int]int `json:"button_map,omitempty"`
+	AxisMap         map[int]int `json:"axis_map,omitempty"`
+	InvertAxes      []int       `json:"invert_axes,omitempty"`
+	StickDeadzone   float64     `json:"stick_deadzone"`   // 0-1, rescaled outside the deadzone
+	TriggerDeadzone float64     `json:"trigger_deadzone"` // 0-1
+	TriggerCurve    float64     `json:"trigger_curve"`    // Exponent, 1 = linear, >1 = finer low end
+}
+
+// defaultMappingProfile matches what the Python gamepad server used to apply
+var defaultMappingProfile = MappingProfile{
+	Name:          "default",
+	StickDeadzone: 0.08,
+	TriggerCurve:  1,
+}
+
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+func (p *MappingProfile) validate() error {
+	if !profileNamePattern.MatchString(p.Name) {
+		return errors.New("profile name must be 1-64 letters, digits, '_', '.' or '-'")
+	}
+	for from, to := range p.ButtonMap {
+		if from < 0 || from >= input.NumButtons || to < -1 || to >= input.NumButtons {
+			return errors.New("button_map indices must be within 0-13 (target -1 disables)")
+		}
+	}
+	for from, to := range p.AxisMap {
+		if from < 0 || from >= input.NumAxes || to < -1 || to >= input.NumAxes {
+			return errors.New("axis_map indices must be within 0-5 (target -1 disables)")
+		}
+		// Sticks and triggers have different value ranges
+		if to >= 0 && input.IsTriggerAxis(from) != input.IsTriggerAxis(to) {
+			return errors.New("axis_map cannot map sticks to triggers or vice versa")
+		}
+	}
+	for _, axis := range p.InvertAxes {
+		if axis < 0 || axis >= input.NumAxes || input.IsTriggerAxis(axis) {
+			return errors.New("invert_axes only accepts stick axes 0-3")
+		}
+	}
+	if p.StickDeadzone < 0 || p.StickDeadzone >= 1 || p.TriggerDeadzone < 0 || p.TriggerDeadzone >= 1 {
+		return errors.New("deadzones must be within [0, 1)")
+	}
+	if p.TriggerCurve == 0 {
+		p.TriggerCurve = 1
+	}
+	if p.TriggerCurve < 0.1 || p.TriggerCurve > 10 {
+		return errors.New("trigger_curve must be within [0.1, 10]")
+	}
+	return nil
+}
+
+// apply maps one input event; ok is false when the input is disabled
+func (p *MappingProfile) apply(ev input.GamepadEvent) (out input.GamepadEvent, ok bool) {
+	out = ev
+	switch ev.Type {
+	case input.TypeButton:
+		if to, mapped := p.ButtonMap[int(ev.Index)]; mapped {
+			if to < 0 {
+				return out, false
+			}
+			out.Index = uint8(to)
+		}
+
+	case input.TypeAxis:
+		if to, mapped := p.AxisMap[int(ev.Index)]; mapped {
+			if to < 0 {
+				return out, false
+			}
+			out.Index = uint8(to)
+		}
+
+		v := float64(ev.Value) / 32767
+		if input.IsTriggerAxis(int(out.Index)) {
+			v = math.Max(0, math.Min(1, v))
+			v = applyDeadzone(v, p.TriggerDeadzone)
+			v = math.Pow(v, p.TriggerCurve)
+		} else {
+			v = math.Max(-1, math.Min(1, v))
+			for _, axis := range p.InvertAxes {
+				if axis == int(out.Index) {
+					v = -v
+				}
+			}
+			v = applyDeadzone(v, p.StickDeadzone)
+		}
+		out.Value = int16(math.Round(v * 32767))
+	}
+	return out, true
+}
+
+// applyDeadzone zeroes |v| below dz and rescales the rest to the full range
+func applyDeadzone(v, dz float64) float64 {
+	if dz <= 0 {
+		return v
+	}
+	if math.Abs(v) < dz {
+		return 0
+	}
+	return math.Copysign((math.Abs(v)-dz)/(1-dz), v)
+}
+
+// Profile store, persisted to mappingProfilesFile
+var (
+	mappingProfiles     = map[string]*MappingProfile{"default": &defaultMappingProfile}
+	mappingProfilesLock sync.RWMutex
+)
+
+func loadMappingProfiles() {
+	data, err := os.ReadFile(mappingProfilesFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading mapping profiles: %v", err)
+		}
+		return
+	}
+
+	var profiles []*MappingProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		log.Printf("Error parsing %s: %v", mappingProfilesFile, err)
+		return
+	}
+
+	mappingProfilesLock.Lock()
+	defer mappingProfilesLock.Unlock()
+	for _, p := range profiles {
+		if err := p.validate(); err != nil {
+			log.Printf("Skipping invalid mapping profile %q: %v", p.Name, err)
+			continue
+		}
+		mappingProfiles[p.Name] = p
+	}
+	log.Printf("Loaded %d mapping profiles", len(mappingProfiles))
+}
+
+// saveMappingProfiles must be called with mappingProfilesLock held
+func saveMappingProfiles() error {
+	data, err := json.MarshalIndent(sortedMappingProfiles(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(mappingProfilesFile, data, 0644)
+}
+
+// sortedMappingProfiles must be called with mappingProfilesLock held
+func sortedMappingProfiles() []*MappingProfile {
+	list := make([]*MappingProfile, 0, len(mappingProfiles))
+	for _, p := range mappingProfiles {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func getMappingProfile(name string) (*MappingProfile, bool) {
+	if name == "" {
+		name = "default"
+	}
+	mappingProfilesLock.RLock()
+	defer mappingProfilesLock.RUnlock()
+	p, ok := mappingProfiles[name]
+	return p, ok
+}
+
+// HTTP handlers for mapping profiles
+func handleListMappings(w http.ResponseWriter, r *http.Request) {
+	mappingProfilesLock.RLock()
+	list := sortedMappingProfiles()
+	mappingProfilesLock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"profiles": list,
+	})
+}
+
+func handlePutMapping(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		writeError(w, http.StatusForbidden, "admin_only", "Only admins can change mapping profiles")
+		return
+	}
+	var profile MappingProfile
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+	profile.Name = r.PathValue("name")
+	if profile.Name == "default" {
+		writeError(w, http.StatusForbidden, "read_only", "The default profile is read-only")
+		return
+	}
+	if err := profile.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_mapping", err.Error())
+		return
+	}
+
+	mappingProfilesLock.Lock()
+	mappingProfiles[profile.Name] = &profile
+	err := saveMappingProfiles()
+	mappingProfilesLock.Unlock()
+	if err != nil {
+		log.Printf("Error saving mapping profiles: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	// Sessions hold a pointer to the profile they were started with
+	sessionsLock.RLock()
+	for _, session := range sessions {
+		session.mutex.Lock()
+		if session.mapping != nil && session.mapping.Name == profile.Name {
+			session.mapping = &profile
+		}
+		session.mutex.Unlock()
+	}
+	sessionsLock.RUnlock()
+
+	log.Printf("Mapping profile %q saved", profile.Name)
+	auditRequest(r, "mapping_put", profile.Name, nil)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+func handleDeleteMapping(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		writeError(w, http.StatusForbidden, "admin_only", "Only admins can delete mapping profiles")
+		return
+	}
+	name := r.PathValue("name")
+	if name == "default" {
+		writeError(w, http.StatusForbidden, "read_only", "The default profile is read-only")
+		return
+	}
+
+	mappingProfilesLock.Lock()
+	_, exists := mappingProfiles[name]
+	delete(mappingProfiles, name)
+	err := saveMappingProfiles()
+	mappingProfilesLock.Unlock()
+
+	if !exists {
+		writeError(w, http.StatusNotFound, "mapping_not_found", "Mapping profile not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving mapping profiles: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	auditRequest(r, "mapping_delete", name, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSetSessionMapping switches a running session to another profile.
+// Owner or admin only.
+func handleSetSessionMapping(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	if !session.canManage(r) {
+		writeError(w, http.StatusForbidden, "not_owner", "Only the session owner can change the mapping")
+		return
+	}
+
+	var req struct {
+		Profile string `json:"profile"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+
+	profile, ok := getMappingProfile(req.Profile)
+	if !ok {
+		writeError(w, http.StatusNotFound, "mapping_not_found", "Mapping profile not found")
+		return
+	}
+
+	session.mutex.Lock()
+	session.mapping = profile
+	session.mutex.Unlock()
+
+	log.Printf("[Session %s] Mapping profile set to %q", session.ID, profile.Name)
+	auditRequest(r, "session_mapping", profile.Name, nil)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id": session.ID,
+		"profile":    profile.Name,
+	})
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Further monitors stream as extra video tracks of the session's peer
+// connection, so a dual-screen desk takes one session rather than two. To
+// add one the client renegotiates: it adds a receive-only video
+// transceiver and posts the new offer with the monitor's index to
+// POST /sessions/{id}/monitors. The answer sends a track with the stream
+// ID "monitor-<index>", encoded like the session's own video but outside
+// its bitrate ladder.
+//
+// Monitors are read from monitors.json when it exists,
+//
+//	[{"name": "HDMI-1", "x": 1920, "y": 0, "width": 1920, "height": 1080, "refresh_hz": 144}]
+//
+// and otherwise asked of xrandr on Linux and of Windows Forms on Windows,
+// with the refresh rate of the current display mode. Only xrandr tells
+// whether a monitor does variable refresh, from its vrr_capable property.
+
+var monitorsFile = "monitors.json"
+
+// Monitor is one screen, positioned on the desktop
+type Monitor struct {
+	Index   int    `json:"index"`
+	Name    string `json:"name"`
+	X       int    `json:"x"`
+	Y       int    `json:"y"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Primary bool   `json:"primary"`
+	// RefreshHz is the rate of the current display mode, 0 when unknown
+	RefreshHz float64 `json:"refresh_hz,omitempty"`
+	VRR       bool    `json:"vrr,omitempty"`
+}
+
+var errMonitorStreaming = errors.New("monitor is already streaming")
+
+func listMonitors() ([]Monitor, error) {
+	data, err := os.ReadFile(monitorsFile)
+	if err == nil {
+		var monitors []Monitor
+		if err := json.Unmarshal(data, &monitors); err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", monitorsFile, err)
+		}
+		for i := range monitors {
+			monitors[i].Index = i
+		}
+		return monitors, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	switch runtime.GOOS {
+	case "windows":
+		out, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", windowsScreensScript).Output()
+		if err != nil {
+			return nil, err
+		}
+		return parseWindowsScreens(string(out)), nil
+	case "linux":
+		out, err := exec.Command("xrandr", "--listmonitors").Output()
+		if err != nil {
+			return nil, err
+		}
+		monitors := parseXrandrMonitors(string(out))
+		// Without the modes the monitors are still usable
+		if out, err := exec.Command("xrandr", "--query", "--prop").Output(); err == nil {
+			applyXrandrModes(monitors, string(out))
+		}
+		return monitors, nil
+	}
+	return nil, fmt.Errorf("listing monitors is not supported on %s", runtime.GOOS)
+}
+
+// xrandrMonitor matches a line of xrandr --listmonitors:
+//
+//	1: +HDMI-1 1920/527x1080/296+2560+0  HDMI-1
+var xrandrMonitor = regexp.MustCompile(`^\s*\d+:\s+\+?(\*?)(\S+)\s+(\d+)/\d+x(\d+)/\d+([+-]\d+)([+-]\d+)`)
+
+func parseXrandrMonitors(out string) []Monitor {
+	var monitors []Monitor
+	for _, line := range strings.Split(out, "\n") {
+		m := xrandrMonitor.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		monitor := Monitor{Index: len(monitors), Name: m[2], Primary: m[1] == "*"}
+		monitor.Width, _ = strconv.Atoi(m[3])
+		monitor.Height, _ = strconv.Atoi(m[4])
+		monitor.X, _ = strconv.Atoi(m[5])
+		monitor.Y, _ = strconv.Atoi(m[6])
+		monitors = append(monitors, monitor)
+	}
+	return monitors
+}
+
+var (
+	// xrandrOutput and xrandrMode match the lines of xrandr --query --prop
+	// that name a connected output and list a mode's rates, the current
+	// one starred:
+	//
+	//	DP-1 connected primary 2560x1440+0+0 (normal left inverted right) 597mm x 336mm
+	//	   2560x1440    143.91*+  59.95
+	xrandrOutput = regexp.MustCompile(`^(\S+) connected`)
+	xrandrMode   = regexp.MustCompile(`^\s+\d+x\d+\S*\s+(.*)`)
+	xrandrVRR    = regexp.MustCompile(`^\s+vrr_capable:\s*1\b`)
+)
+
+// applyXrandrModes fills in the refresh rate and VRR support of monitors
+// named after their outputs, as xrandr names them unless told otherwise
+func applyXrandrModes(monitors []Monitor, out string) {
+	byName := make(map[string]*Monitor)
+	for i := range monitors {
+		byName[monitors[i].Name] = &monitors[i]
+	}
+	var current *Monitor
+	for _, line := range strings.Split(out, "\n") {
+		if m := xrandrOutput.FindStringSubmatch(line); m != nil {
+			current = byName[m[1]]
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		if xrandrVRR.MatchString(line) {
+			current.VRR = true
+			continue
+		}
+		m := xrandrMode.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		for _, rate := range strings.Fields(m[1]) {
+			if strings.Contains(rate, "*") {
+				current.RefreshHz, _ = strconv.ParseFloat(strings.Trim(rate, "*+"), 64)
+			}
+		}
+	}
+}
+
+// windowsScreensScript prints "name x y width height primary hz" for each
+// screen; Windows Forms has no refresh rate, so it comes from
+// EnumDisplaySettings
+const windowsScreensScript = `Add-Type -AssemblyName System.Windows.Forms
+Add-Type @'
+using System.Runtime.InteropServices;
+public static class DisplayMode {
+	[StructLayout(LayoutKind.Sequential, CharSet = CharSet.Unicode)]
+	struct DEVMODE {
+		[MarshalAs(UnmanagedType.ByValTStr, SizeConst = 32)] public string dmDeviceName;
+		public short dmSpecVersion, dmDriverVersion, dmSize, dmDriverExtra;
+		public int dmFields, dmPositionX, dmPositionY, dmDisplayOrientation, dmDisplayFixedOutput;
+		public short dmColor, dmDuplex, dmYResolution, dmTTOption, dmCollate;
+		[MarshalAs(UnmanagedType.ByValTStr, SizeConst = 32)] public string dmFormName;
+		public short dmLogPixels;
+		public int dmBitsPerPel, dmPelsWidth, dmPelsHeight, dmDisplayFlags, dmDisplayFrequency;
+		public int dmICMMethod, dmICMIntent, dmMediaType, dmDitherType, dmReserved1, dmReserved2, dmPanningWidth, dmPanningHeight;
+	}
+	[DllImport("user32.dll", CharSet = CharSet.Unicode)]
+	static extern bool EnumDisplaySettings(string device, int mode, ref DEVMODE dm);
+	public static int Frequency(string device) {
+		var dm = new DEVMODE();
+		dm.dmSize = (short)Marshal.SizeOf(dm);
+		return EnumDisplaySettings(device, -1, ref dm) ? dm.dmDisplayFrequency : 0;
+	}
+}
+'@
+[System.Windows.Forms.Screen]::AllScreens | ForEach-Object {
+	'{0} {1} {2} {3} {4} {5} {6}' -f $_.DeviceName, $_.Bounds.X, $_.Bounds.Y,
+		$_.Bounds.Width, $_.Bounds.Height, $_.Primary, [DisplayMode]::Frequency($_.DeviceName)
+}`
+
+// parseWindowsScreens reads "name x y width height primary hz" lines, in
+// the order of Desktop Duplication's outputs
+func parseWindowsScreens(out string) []Monitor {
+	var monitors []Monitor
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 7 {
+			continue
+		}
+		monitor := Monitor{Index: len(monitors), Name: fields[0], Primary: fields[5] == "True"}
+		monitor.X, _ = strconv.Atoi(fields[1])
+		monitor.Y, _ = strconv.Atoi(fields[2])
+		monitor.Width, _ = strconv.Atoi(fields[3])
+		monitor.Height, _ = strconv.Atoi(fields[4])
+		// 0 and 1 stand for the hardware's default rate
+		if hz, _ := strconv.Atoi(fields[6]); hz > 1 {
+			monitor.RefreshHz = float64(hz)
+		}
+		monitors = append(monitors, monitor)
+	}
+	return monitors
+}
+
+// defaultDisplayFPS is assumed when no refresh rate can be found
+const defaultDisplayFPS = 60
+
+// displayFPS is the refresh rate of what a session captures: the primary
+// monitor, or with allMonitors the slowest one, which the others' extra
+// frames would be wasted on
+func displayFPS(allMonitors bool) int {
+	monitors, err := listMonitors()
+	if err != nil {
+		log.Printf("Error listing monitors: %v", err)
+		return defaultDisplayFPS
+	}
+	hz := 0.0
+	for _, m := range monitors {
+		if m.RefreshHz <= 0 {
+			continue
+		}
+		switch {
+		case allMonitors:
+			if hz == 0 || m.RefreshHz < hz {
+				hz = m.RefreshHz
+			}
+		case m.Primary:
+			hz = m.RefreshHz
+		case hz == 0:
+			hz = m.RefreshHz // Until the primary turns up
+		}
+	}
+	if hz == 0 {
+		return defaultDisplayFPS
+	}
+	// 59.94 and 143.91 Hz modes are 60 and 144 in practice
+	return int(math.Round(hz))
+}
+
+// desktopArea returns the rectangle spanning every monitor
+func desktopArea() (*Monitor, error) {
+	monitors, err := listMonitors()
+	if err != nil {
+		return nil, err
+	}
+	if len(monitors) == 0 {
+		return nil, errors.New("no monitors found")
+	}
+	left, top := monitors[0].X, monitors[0].Y
+	right, bottom := left+monitors[0].Width, top+monitors[0].Height
+	for _, m := range monitors[1:] {
+		left, top = min(left, m.X), min(top, m.Y)
+		right, bottom = max(right, m.X+m.Width), max(bottom, m.Y+m.Height)
+	}
+	return &Monitor{Index: -1, Name: "desktop", X: left, Y: top, Width: right - left, Height: bottom - top}, nil
+}
+
+func handleListMonitors(w http.ResponseWriter, r *http.Request) {
+	monitors, err := listMonitors()
+	if err != nil {
+		log.Printf("Error listing monitors: %v", err)
+		writeErrorDetails(w, http.StatusInternalServerError, "monitors_unavailable", "Error listing monitors", err.Error())
+		return
+	}
+	if monitors == nil {
+		monitors = []Monitor{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"monitors": monitors})
+}
+
+// handleAddMonitor answers a renegotiation offer with a track of another
+// monitor. Only the session owner and admins may add one.
+func handleAddMonitor(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	if !session.canManage(r) {
+		writeError(w, http.StatusForbidden, "not_owner", "Only the session owner can add monitors")
+		return
+	}
+	if session.parent != nil {
+		writeError(w, http.StatusConflict, "coop_guest", "Co-op guests watch the host's screen")
+		return
+	}
+	if session.videoTrack == nil {
+		writeError(w, http.StatusConflict, "audio_only", "Audio-only sessions stream no monitors")
+		return
+	}
+
+	var req struct {
+		Monitor int    `json:"monitor"`
+		SDP     string `json:"sdp"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+	if req.SDP == "" {
+		writeError(w, http.StatusBadRequest, "invalid_offer", "Missing SDP")
+		return
+	}
+
+	monitors, err := listMonitors()
+	if err != nil {
+		log.Printf("[Session %s] Error listing monitors: %v", session.ID, err)
+		writeErrorDetails(w, http.StatusInternalServerError, "monitors_unavailable", "Error listing monitors", err.Error())
+		return
+	}
+	if req.Monitor < 0 || req.Monitor >= len(monitors) {
+		writeError(w, http.StatusNotFound, "monitor_not_found", "Monitor not found")
+		return
+	}
+	monitor := monitors[req.Monitor]
+
+	answer, err := session.addMonitor(monitor, req.SDP)
+	switch {
+	case errors.Is(err, errMonitorStreaming):
+		writeError(w, http.StatusConflict, "monitor_streaming", "The monitor is already streaming")
+		return
+	case errors.Is(err, errCaptureNotStarted):
+		writeError(w, http.StatusConflict, "capture_not_started", "Capture has not started")
+		return
+	case err != nil:
+		log.Printf("[Session %s] Error adding monitor %d: %v", session.ID, monitor.Index, err)
+		writeErrorDetails(w, http.StatusBadRequest, "renegotiation_failed", "Error answering the offer", err.Error())
+		return
+	}
+	auditRequest(r, "monitor_add", monitor.Name, map[string]interface{}{"monitor": monitor.Index})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":      answer.Type,
+		"sdp":       answer.SDP,
+		"monitor":   monitor.Index,
+		"stream_id": monitorStreamID(monitor),
+	})
+}
+
+// streamingMonitors returns the indexes of the session's extra monitors
+func (s *StreamSession) streamingMonitors() []int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	indexes := make([]int, 0, len(s.monitors))
+	for index := range s.monitors {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+func monitorStreamID(m Monitor) string {
+	return fmt.Sprintf("monitor-%d", m.Index)
+}
+
+// addMonitor answers offer, which must add a video transceiver, with a
+// track capturing m, and starts the capture
+func (s *StreamSession) addMonitor(m Monitor, offer string) (*webrtc.SessionDescription, error) {
+	base := s.encoder.config()
+	if base.Codec == "" {
+		return nil, errCaptureNotStarted
+	}
+
+	s.renegotiation.Lock()
+	defer s.renegotiation.Unlock()
+	s.mutex.Lock()
+	streaming := s.monitors[m.Index]
+	s.mutex.Unlock()
+	if streaming {
+		return nil, errMonitorStreaming
+	}
+
+	// The offer must bring a video transceiver for the track, or the
+	// connection would be left halfway through the renegotiation
+	desc := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return nil, err
+	}
+	offered, transceivers := 0, 0
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media == "video" {
+			offered++
+		}
+	}
+	for _, t := range s.PC.GetTransceivers() {
+		if t.Kind() == webrtc.RTPCodecTypeVideo {
+			transceivers++
+		}
+	}
+	if offered <= transceivers {
+		return nil, errors.New("offer adds no video transceiver")
+	}
+
+	id := monitorStreamID(m)
+	track, err := webrtc.NewTrackLocalStaticSample(s.videoTrack.Codec(), id, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.PC.SetRemoteDescription(desc); err != nil {
+		return nil, err
+	}
+	sender, err := s.PC.AddTrack(track)
+	if err != nil {
+		return nil, err
+	}
+	answer, err := s.PC.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.PC.SetLocalDescription(answer); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	if s.monitors == nil {
+		s.monitors = make(map[int]bool)
+	}
+	s.monitors[m.Index] = true
+	s.mutex.Unlock()
+
+	// The capture matches the monitor, the encoding the session's video
+	cfg := base
+	cfg.Monitor = &m
+	cfg.Width, cfg.Height = m.Width&^1, m.Height&^1
+	cfg.OutputWidth, cfg.OutputHeight = base.outputSize()
+	log.Printf("[Session %s] Streaming monitor %d (%s, %dx%d)", s.ID, m.Index, m.Name, m.Width, m.Height)
+	s.goSafe("monitor rtcp reader", func() {
+		for {
+			if _, _, err := sender.ReadRTCP(); err != nil {
+				return
+			}
+		}
+	})
+	s.goSafe("monitor capture", func() { s.runMonitorCapture(track, cfg) })
+	return s.PC.LocalDescription(), nil
+}
+
+// runMonitorCapture feeds one extra monitor into its track until the
+// session ends
+func (s *StreamSession) runMonitorCapture(track *webrtc.TrackLocalStaticSample, cfg CaptureConfig) {
+	defer func() {
+		s.mutex.Lock()
+		delete(s.monitors, cfg.Monitor.Index)
+		s.mutex.Unlock()
+	}()
+
+	// Counted apart from the session's video, which the ladder follows
+	var stats PipelineStats
+	capture, err := newCaptureSource(s.source, s, &stats)
+	if err != nil {
+		log.Printf("[Session %s] Error creating monitor %d capture: %v", s.ID, cfg.Monitor.Index, err)
+		return
+	}
+	if err := capture.Start(s.ctx, cfg); err != nil {
+		log.Printf("[Session %s] Error starting monitor %d capture: %v", s.ID, cfg.Monitor.Index, err)
+		return
+	}
+	defer capture.Stop()
+	s.goSafe("monitor capture stopper", func() {
+		<-s.ctx.Done()
+		capture.Stop()
+	})
+
+	clock := sampleClock{
+		rate:     float64(track.Codec().ClockRate),
+		interval: time.Second / time.Duration(cfg.FPS),
+	}
+	muted, resuming := false, false
+	for {
+		au, err := capture.ReadAccessUnit()
+		if err != nil {
+			if err != io.EOF && s.ctx.Err() == nil {
+				log.Printf("[Session %s] Monitor %d capture error: %v", s.ID, cfg.Monitor.Index, err)
+			}
+			return
+		}
+		if s.videoMuted.Load() {
+			muted = true
+			continue
+		}
+		if muted && !au.Keyframe {
+			if !resuming {
+				resuming = true
+				capture.RequestKeyframe()
+			}
+			continue
+		}
+		muted, resuming = false, false
+		if s.e2ee != nil {
+			au.Data = s.e2ee.encrypt(au.Data, vp8ClearBytes(au.Data))
+		}
+		if err := writeAccessUnit(track, au, clock.duration(au.PTS)); err != nil {
+			stats.samplesDropped.Add(1)
+		}
+	}
+}
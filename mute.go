@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Muting the video blanks the picture without touching the connection:
+// the capture keeps running but its frames are not sent, so the peer's
+// player holds the last one and the transport stays up on RTCP. Unmuting
+// asks for a keyframe, which the picture resumes on.
+
+// VideoMessage tells the peers of a session whether its video is muted;
+// sent on the "input" DataChannel when it opens muted and on every change
+type VideoMessage struct {
+	Type  string `json:"type"` // "video"
+	Muted bool   `json:"muted"`
+}
+
+// setVideoMuted mutes or unmutes the video of a host session, which its
+// co-op guests and spectators share
+func (s *StreamSession) setVideoMuted(muted bool) {
+	if s.videoMuted.Swap(muted) == muted {
+		return
+	}
+	if !muted {
+		// Not rate limited like requestKeyframe: the picture waits on it
+		s.mutex.RLock()
+		capture := s.Capture
+		s.mutex.RUnlock()
+		if capture != nil {
+			if err := capture.RequestKeyframe(); err != nil {
+				log.Printf("[Session %s] Error requesting keyframe: %v", s.ID, err)
+			}
+		}
+	}
+
+	sessionsLock.RLock()
+	defer sessionsLock.RUnlock()
+	for _, peer := range sessions {
+		if peer != s && peer.parent != s {
+			continue
+		}
+		peer.mutex.RLock()
+		dc := peer.inputChannel
+		peer.mutex.RUnlock()
+		if dc != nil {
+			sendJSON(dc, VideoMessage{Type: "video", Muted: muted})
+		}
+	}
+}
+
+// pictureMuted reports whether the picture the session's peer sees is
+// muted
+func (s *StreamSession) pictureMuted() bool {
+	if s.parent != nil {
+		return s.parent.videoMuted.Load()
+	}
+	return s.videoMuted.Load()
+}
+
+// handleSetVideoMuted blanks or restores a session's picture. Host only:
+// it is for whoever sits at the host to hide the screen for a moment.
+func handleSetVideoMuted(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Video can only be muted from the host")
+		return
+	}
+	session, ok := getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	if session.parent != nil {
+		writeError(w, http.StatusConflict, "coop_guest", "Co-op guests watch the host's screen")
+		return
+	}
+	if session.videoTrack == nil {
+		writeError(w, http.StatusConflict, "audio_only", "Audio-only sessions have no video")
+		return
+	}
+
+	var req struct {
+		Muted bool `json:"muted"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+
+	session.setVideoMuted(req.Muted)
+	log.Printf("[Session %s] Video muted set to %v", session.ID, req.Muted)
+	auditRequest(r, "video_mute", "", map[string]interface{}{"muted": req.Muted})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id": session.ID,
+		"muted":      req.Muted,
+	})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The network policy limits which addresses may use signaling, for hosts
+// reachable from the internet. It comes from network-policy.json:
+//
+//	{
+//	  "allow": ["192.168.0.0/16", "203.0.113.7/32"],
+//	  "deny": ["192.168.66.0/24"],
+//	  "geoip_database": "dbip-country-lite.csv",
+//	  "allow_countries": ["BR", "PT"],
+//	  "deny_countries": []
+//	}
+//
+// A denied network always loses; with an allow list, addresses outside it
+// are refused. Country rules need a GeoIP database in the
+// start_ip,end_ip,country CSV format of DB-IP's free country database, and
+// do not apply to private addresses. The host itself is always allowed.
+
+var networkPolicyFile = "network-policy.json"
+
+type networkPolicyConfig struct {
+	Allow          []string `json:"allow"`
+	Deny           []string `json:"deny"`
+	GeoIPDatabase  string   `json:"geoip_database"`
+	AllowCountries []string `json:"allow_countries"`
+	DenyCountries  []string `json:"deny_countries"`
+}
+
+type networkPolicy struct {
+	allow, deny    []*net.IPNet
+	geoip          geoIPDatabase
+	allowCountries map[string]bool
+	denyCountries  map[string]bool
+}
+
+// policy is nil while no policy is configured
+var policy *networkPolicy
+
+func loadNetworkPolicy() {
+	data, err := os.ReadFile(networkPolicyFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading network policy: %v", err)
+		}
+		return
+	}
+
+	// Serving without the policy would expose what it was meant to
+	// protect, so a broken one stops the server
+	p, err := parseNetworkPolicy(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	policy = p
+	log.Printf("Network policy: %d allowed and %d denied networks, %d allowed and %d denied countries (%d GeoIP ranges)",
+		len(p.allow), len(p.deny), len(p.allowCountries), len(p.denyCountries), len(p.geoip))
+}
+
+// parseNetworkPolicy parses and compiles network-policy.json
+func parseNetworkPolicy(data []byte) (*networkPolicy, error) {
+	var cfg networkPolicyConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", networkPolicyFile, err)
+	}
+	p, err := cfg.compile()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %v", networkPolicyFile, err)
+	}
+	return p, nil
+}
+
+func (cfg networkPolicyConfig) compile() (*networkPolicy, error) {
+	p := &networkPolicy{
+		allowCountries: make(map[string]bool),
+		denyCountries:  make(map[string]bool),
+	}
+	for _, list := range []struct {
+		cidrs []string
+		nets  *[]*net.IPNet
+	}{{cfg.Allow, &p.allow}, {cfg.Deny, &p.deny}} {
+		for _, cidr := range list.cidrs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			*list.nets = append(*list.nets, ipNet)
+		}
+	}
+	for _, c := range cfg.AllowCountries {
+		p.allowCountries[strings.ToUpper(c)] = true
+	}
+	for _, c := range cfg.DenyCountries {
+		p.denyCountries[strings.ToUpper(c)] = true
+	}
+
+	if len(p.allowCountries)+len(p.denyCountries) > 0 {
+		if cfg.GeoIPDatabase == "" {
+			return nil, errors.New("country rules need geoip_database")
+		}
+		db, err := loadGeoIPDatabase(cfg.GeoIPDatabase)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %v", cfg.GeoIPDatabase, err)
+		}
+		p.geoip = db
+	}
+	return p, nil
+}
+
+// check returns why ip is refused, or nil
+func (p *networkPolicy) check(ip net.IP) error {
+	if ip.IsLoopback() {
+		return nil
+	}
+	for _, n := range p.deny {
+		if n.Contains(ip) {
+			return fmt.Errorf("network %s is denied", n)
+		}
+	}
+	if len(p.allow) > 0 {
+		allowed := false
+		for _, n := range p.allow {
+			allowed = allowed || n.Contains(ip)
+		}
+		if !allowed {
+			return errors.New("address is not in an allowed network")
+		}
+	}
+
+	if p.geoip == nil || ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+		return nil
+	}
+	country := p.geoip.country(ip)
+	if p.denyCountries[country] {
+		return fmt.Errorf("country %s is denied", country)
+	}
+	if len(p.allowCountries) > 0 && !p.allowCountries[country] {
+		if country == "" {
+			return errors.New("country unknown")
+		}
+		return fmt.Errorf("country %s is not allowed", country)
+	}
+	return nil
+}
+
+// policyChecked wraps the API handlers, signaling first among them, so
+// refused addresses get no further than the policy
+func policyChecked(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if policy != nil && !isAdminSocketRequest(r) {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			ip := net.ParseIP(host)
+			var err error
+			if ip == nil {
+				err = errors.New("unknown address")
+			} else {
+				err = policy.check(ip)
+			}
+			if err != nil {
+				log.Printf("[Request %s] Refused %s: %v", requestID(r), host, err)
+				writeError(w, http.StatusForbidden, "network_denied", "Connections from this network are not allowed")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// geoIPRange maps the addresses from start to end to a country
+type geoIPRange struct {
+	start, end net.IP // 16-byte form
+	country    string
+}
+
+// geoIPDatabase is sorted by start; ranges do not overlap
+type geoIPDatabase []geoIPRange
+
+func loadGeoIPDatabase(path string) (geoIPDatabase, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	var db geoIPDatabase
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("line %d: want start_ip,end_ip,country", line)
+		}
+		start, end := net.ParseIP(record[0]).To16(), net.ParseIP(record[1]).To16()
+		if start == nil || end == nil || bytes.Compare(start, end) > 0 {
+			if line == 1 {
+				continue // A header
+			}
+			return nil, fmt.Errorf("line %d: invalid range", line)
+		}
+		db = append(db, geoIPRange{start, end, strings.ToUpper(record[2])})
+	}
+	sort.Slice(db, func(i, j int) bool { return bytes.Compare(db[i].start, db[j].start) < 0 })
+	return db, nil
+}
+
+// country returns the country of ip, "" when the database has none
+func (db geoIPDatabase) country(ip net.IP) string {
+	ip = ip.To16()
+	// The last range starting at or before ip
+	i := sort.Search(len(db), func(i int) bool { return bytes.Compare(db[i].start, ip) > 0 }) - 1
+	if i < 0 || bytes.Compare(ip, db[i].end) > 0 {
+		return ""
+	}
+	return db[i].country
+}
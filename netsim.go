@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+)
+
+// Network simulation makes a session's own link worse on purpose, so the
+// bitrate ladder and FEC can be watched at work on a LAN. It drops a share
+// of the outgoing packets, delays each by up to the jitter, which can
+// reorder them, and sends no faster than a bandwidth cap, queueing up to
+// netsimQueueLimit behind it and dropping what is past that, as a router
+// would. It runs under every other interceptor, so FEC and NACK
+// retransmissions cross the same link and TWCC feedback sees the loss.
+//
+// An offer turns it on with "netsim": {"loss_percent": 5, "jitter_ms": 30,
+// "kbps": 3000} and PUT /sessions/{id}/netsim changes or, with every field
+// 0, ends it. Spectators and co-op guests have links of their own.
+
+// netsimQueueLimit is how long a packet may wait behind the bandwidth cap
+const netsimQueueLimit = 200 * time.Millisecond
+
+const (
+	maxNetsimJitterMs = 1000
+	minNetsimKbps     = 100
+)
+
+type netsimSettings struct {
+	LossPercent float64 `json:"loss_percent"`
+	JitterMs    int     `json:"jitter_ms"`
+	Kbps        int     `json:"kbps"`
+}
+
+func (s netsimSettings) active() bool {
+	return s.LossPercent > 0 || s.JitterMs > 0 || s.Kbps > 0
+}
+
+func (s netsimSettings) String() string {
+	return fmt.Sprintf("%.1f%% loss, %d ms jitter, %d kbps", s.LossPercent, s.JitterMs, s.Kbps)
+}
+
+func (s netsimSettings) validate() error {
+	if s.LossPercent < 0 || s.LossPercent > 100 {
+		return errors.New("Invalid netsim loss percent")
+	}
+	if s.JitterMs < 0 || s.JitterMs > maxNetsimJitterMs {
+		return errors.New("Invalid netsim jitter")
+	}
+	if s.Kbps < 0 || (s.Kbps > 0 && s.Kbps < minNetsimKbps) {
+		return errors.New("Invalid netsim bandwidth")
+	}
+	return nil
+}
+
+// netsim is the simulated link, shared by the session's audio and video
+type netsim struct {
+	interceptor.NoOp
+	// settings is nil while simulation is off
+	settings atomic.Pointer[netsimSettings]
+	dropped  atomic.Int64
+
+	mu   sync.Mutex
+	rand *rand.Rand
+	// linkFree is when the link has sent what is queued on it
+	linkFree time.Time
+}
+
+func newNetsim() *netsim {
+	return &netsim{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (n *netsim) set(s netsimSettings) {
+	if !s.active() {
+		n.settings.Store(nil)
+		return
+	}
+	n.settings.Store(&s)
+}
+
+func (n *netsim) info() map[string]interface{} {
+	s := n.settings.Load()
+	if s == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"loss_percent": s.LossPercent,
+		"jitter_ms":    s.JitterMs,
+		"kbps":         s.Kbps,
+		"dropped":      n.dropped.Load(),
+	}
+}
+
+// factory is registered first, below the other interceptors
+func (n *netsim) factory() interceptor.Factory { return netsimFactory{n} }
+
+type netsimFactory struct{ n *netsim }
+
+func (f netsimFactory) NewInterceptor(string) (interceptor.Interceptor, error) { return f.n, nil }
+
+func (n *netsim) BindLocalStream(_ *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		s := n.settings.Load()
+		if s == nil {
+			return writer.Write(header, payload, attributes)
+		}
+		size := header.MarshalSize() + len(payload)
+		now := time.Now()
+		at, ok := n.schedule(s, size, now)
+		if !ok {
+			n.dropped.Add(1)
+			return size, nil
+		}
+		if !at.After(now) {
+			return writer.Write(header, payload, attributes)
+		}
+
+		// The caller reuses the header and payload once this returns
+		delayed, body := header.Clone(), append([]byte(nil), payload...)
+		time.AfterFunc(at.Sub(now), func() {
+			writer.Write(&delayed, body, interceptor.Attributes{})
+		})
+		return size, nil
+	})
+}
+
+// schedule decides when a packet of size bytes leaves the link, or that it
+// is lost
+func (n *netsim) schedule(s *netsimSettings, size int, now time.Time) (time.Time, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if s.LossPercent > 0 && n.rand.Float64()*100 < s.LossPercent {
+		return time.Time{}, false
+	}
+	at := now
+	if s.Kbps > 0 {
+		if n.linkFree.Before(now) {
+			n.linkFree = now
+		}
+		if n.linkFree.Sub(now) > netsimQueueLimit {
+			return time.Time{}, false
+		}
+		n.linkFree = n.linkFree.Add(time.Duration(size*8) * time.Millisecond / time.Duration(s.Kbps))
+		at = n.linkFree
+	}
+	if s.JitterMs > 0 {
+		at = at.Add(time.Duration(n.rand.Int63n(int64(s.JitterMs)*int64(time.Millisecond) + 1)))
+	}
+	return at, true
+}
+
+func handleSetNetsim(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	if !session.canManage(r) {
+		writeError(w, http.StatusForbidden, "not_owner", "Only the session owner can simulate its network")
+		return
+	}
+	if session.netsim == nil {
+		writeError(w, http.StatusConflict, "netsim_unsupported", "Session has no link of its own to simulate")
+		return
+	}
+
+	var req netsimSettings
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_netsim", err.Error())
+		return
+	}
+
+	session.netsim.set(req)
+	if req.active() {
+		log.Printf("[Session %s] Simulating %s", session.ID, req)
+	} else {
+		log.Printf("[Session %s] Network simulation off", session.ID)
+	}
+	auditRequest(r, "netsim", "", map[string]interface{}{
+		"loss_percent": req.LossPercent,
+		"jitter_ms":    req.JitterMs,
+		"kbps":         req.Kbps,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id": session.ID,
+		"netsim":     session.netsim.info(),
+	})
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenID Connect sign-in with the authorization code flow and PKCE. The
+// provider's ID token is verified against its published keys, then the
+// user is signed in with a user token like local users are.
+
+var oidcConfigFile = "oidc.json"
+
+// oidcConfig is read from oidc.json; sign-in through a provider is off
+// without it
+type oidcConfig struct {
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// RedirectURL is this host's /api/v1/auth/oidc/callback as registered
+	// with the provider
+	RedirectURL string `json:"redirect_url"`
+	// DefaultPermissions are given to provider users without an account;
+	// with none they cannot sign in
+	DefaultPermissions []string `json:"default_permissions,omitempty"`
+}
+
+const (
+	oidcLoginTTL = 10 * time.Minute
+	// How long discovery and keys are reused before fetching them again
+	oidcCacheTTL = time.Hour
+)
+
+// oidcLogin is a sign-in waiting for the provider's redirect, by state
+type oidcLogin struct {
+	nonce     string
+	verifier  string // PKCE code verifier
+	createdAt time.Time
+}
+
+// oidcProvider is what discovery and the key set say about the issuer
+type oidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	keys      map[string]crypto.PublicKey // By key ID
+	fetchedAt time.Time
+}
+
+var oidc = struct {
+	sync.Mutex
+	config   *oidcConfig
+	provider *oidcProvider
+	logins   map[string]*oidcLogin
+}{logins: make(map[string]*oidcLogin)}
+
+var oidcHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+func loadOIDCConfig() {
+	data, err := os.ReadFile(oidcConfigFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading OIDC config: %v", err)
+		}
+		return
+	}
+
+	var cfg oidcConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Printf("Error parsing %s: %v", oidcConfigFile, err)
+		return
+	}
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		log.Printf("Ignoring %s: issuer, client_id and redirect_url are required", oidcConfigFile)
+		return
+	}
+	for _, p := range cfg.DefaultPermissions {
+		if !validPermission(p) {
+			log.Printf("Ignoring %s: unknown permission %q", oidcConfigFile, p)
+			return
+		}
+	}
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+
+	oidc.Lock()
+	oidc.config = &cfg
+	oidc.Unlock()
+	log.Printf("OIDC sign-in through %s", cfg.Issuer)
+}
+
+func oidcEnabled() bool {
+	oidc.Lock()
+	defer oidc.Unlock()
+	return oidc.config != nil
+}
+
+func oidcDefaultPermissions() []string {
+	oidc.Lock()
+	defer oidc.Unlock()
+	if oidc.config == nil {
+		return nil
+	}
+	return oidc.config.DefaultPermissions
+}
+
+func getJSON(u string, v interface{}) error {
+	resp, err := oidcHTTPClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discoverOIDC returns the provider, fetching discovery and keys when
+// they are missing or stale, or when refresh is set
+func discoverOIDC(cfg *oidcConfig, refresh bool) (*oidcProvider, error) {
+	oidc.Lock()
+	p := oidc.provider
+	oidc.Unlock()
+	if p != nil && !refresh && time.Since(p.fetchedAt) < oidcCacheTTL {
+		return p, nil
+	}
+
+	p = &oidcProvider{}
+	if err := getJSON(cfg.Issuer+"/.well-known/openid-configuration", p); err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(p.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if key, err := k.publicKey(); err == nil {
+			p.keys[k.KeyID] = key
+		}
+	}
+	p.fetchedAt = time.Now()
+
+	oidc.Lock()
+	oidc.provider = p
+	oidc.Unlock()
+	return p, nil
+}
+
+// jsonWebKey is an RSA or P-256 key of the provider's key set
+type jsonWebKey struct {
+	KeyID string `json:"kid"`
+	Type  string `json:"kty"`
+	Use   string `json:"use"`
+	N     string `json:"n"`
+	E     string `json:"e"`
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	if k.Use != "" && k.Use != "sig" {
+		return nil, errors.New("not a signing key")
+	}
+	number := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("bad key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch {
+	case k.Type == "RSA":
+		n, err := number(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := number(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("bad key exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case k.Type == "EC" && k.Curve == "P-256":
+		x, err := number(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := number(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !key.Curve.IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Type)
+}
+
+// idTokenClaims are the claims of the provider's ID token used here
+type idTokenClaims struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      json.RawMessage `json:"aud"` // A string or a list
+	Expires       int64           `json:"exp"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified bool            `json:"email_verified"`
+}
+
+func (c idTokenClaims) hasAudience(clientID string) bool {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return one == clientID
+	}
+	var many []string
+	json.Unmarshal(c.Audience, &many)
+	for _, a := range many {
+		if a == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyIDToken checks the ID token's RS256 or ES256 signature and claims
+func verifyIDToken(cfg *oidcConfig, token, nonce string) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return nil, errors.New("malformed ID token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+
+	p, err := discoverOIDC(cfg, false)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := p.keys[header.Kid]
+	if !ok {
+		// The provider may have rotated its keys
+		if p, err = discoverOIDC(cfg, true); err != nil {
+			return nil, err
+		}
+		if key, ok = p.keys[header.Kid]; !ok {
+			return nil, fmt.Errorf("unknown key %q", header.Kid)
+		}
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errors.New("bad ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("bad ID token signature")
+		}
+	default:
+		return nil, errors.New("unsupported key")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed ID token payload")
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("malformed ID token payload")
+	}
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != cfg.Issuer:
+		return nil, errors.New("ID token from another issuer")
+	case !claims.hasAudience(cfg.ClientID):
+		return nil, errors.New("ID token for another client")
+	case time.Now().Unix() >= claims.Expires:
+		return nil, errors.New("ID token expired")
+	case claims.Nonce != nonce:
+		return nil, errors.New("ID token nonce mismatch")
+	case claims.Subject == "":
+		return nil, errors.New("ID token without subject")
+	}
+	return &claims, nil
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// handleOIDCLogin sends the browser to the provider
+func handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	oidc.Lock()
+	cfg := oidc.config
+	oidc.Unlock()
+	if cfg == nil {
+		writeError(w, http.StatusNotFound, "oidc_disabled", "OIDC sign-in is not configured")
+		return
+	}
+	p, err := discoverOIDC(cfg, false)
+	if err != nil {
+		log.Printf("[OIDC] Discovery failed: %v", err)
+		writeError(w, http.StatusBadGateway, "oidc_unavailable", "Identity provider unavailable")
+		return
+	}
+
+	state := randomString(16)
+	login := &oidcLogin{nonce: randomString(16), verifier: randomString(32), createdAt: time.Now()}
+	oidc.Lock()
+	for id, l := range oidc.logins {
+		if time.Since(l.createdAt) > oidcLoginTTL {
+			delete(oidc.logins, id)
+		}
+	}
+	oidc.logins[state] = login
+	oidc.Unlock()
+
+	challenge := sha256.Sum256([]byte(login.verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {cfg.ClientID},
+		"redirect_uri":          {cfg.RedirectURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {state},
+		"nonce":                 {login.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, p.AuthorizationEndpoint+sep+query.Encode(), http.StatusFound)
+}
+
+// handleOIDCCallback finishes the sign-in the provider redirected back
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	oidc.Lock()
+	cfg := oidc.config
+	state := r.URL.Query().Get("state")
+	login := oidc.logins[state]
+	delete(oidc.logins, state)
+	oidc.Unlock()
+	if cfg == nil {
+		writeError(w, http.StatusNotFound, "oidc_disabled", "OIDC sign-in is not configured")
+		return
+	}
+	if login == nil || time.Since(login.createdAt) > oidcLoginTTL {
+		writeError(w, http.StatusBadRequest, "oidc_failed", "Sign-in expired, try again")
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		log.Printf("[OIDC] Provider refused sign-in: %s", e)
+		auditRequest(r, "login_failed", "", map[string]interface{}{"provider": providerOIDC, "error": e})
+		writeErrorDetails(w, http.StatusUnauthorized, "oidc_failed", "Sign-in refused by the identity provider", e)
+		return
+	}
+
+	claims, err := exchangeOIDCCode(cfg, r.URL.Query().Get("code"), login)
+	if err != nil {
+		log.Printf("[OIDC] Sign-in failed: %v", err)
+		auditRequest(r, "login_failed", "", map[string]interface{}{"provider": providerOIDC, "error": err.Error()})
+		writeError(w, http.StatusUnauthorized, "oidc_failed", "Sign-in failed")
+		return
+	}
+
+	name := oidcAccountName(claims)
+	if name == "" {
+		log.Printf("[OIDC] %s (%s) has no account", claims.Subject, claims.Email)
+		auditRequest(r, "login_failed", claims.Subject, map[string]interface{}{"provider": providerOIDC, "error": "no account"})
+		writeError(w, http.StatusForbidden, "no_account", "No account for this user")
+		return
+	}
+	issueUserToken(w, r, name, providerOIDC)
+	http.Redirect(w, r, webPrefix, http.StatusFound)
+}
+
+// exchangeOIDCCode trades the authorization code for a verified ID token
+func exchangeOIDCCode(cfg *oidcConfig, code string, login *oidcLogin) (*idTokenClaims, error) {
+	p, err := discoverOIDC(cfg, false)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {cfg.RedirectURL},
+		"code_verifier": {login.verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	return verifyIDToken(cfg, tokens.IDToken, login.nonce)
+}
+
+// oidcAccountName maps a provider user to an account: by subject, then by
+// verified email. Others get a name of their own, which local names cannot
+// take, if the provider's users have default permissions.
+func oidcAccountName(claims *idTokenClaims) string {
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	for _, u := range users {
+		if u.OIDCSubject != "" && u.OIDCSubject == claims.Subject {
+			return u.Name
+		}
+	}
+	if claims.EmailVerified && claims.Email != "" {
+		for _, u := range users {
+			if u.Email != "" && strings.EqualFold(u.Email, claims.Email) {
+				return u.Name
+			}
+		}
+	}
+	if len(oidcDefaultPermissions()) == 0 {
+		return ""
+	}
+	if claims.EmailVerified && claims.Email != "" {
+		return "oidc:" + claims.Email
+	}
+	return "oidc:" + hex.EncodeToString([]byte(claims.Subject))
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Device pairing. A new browser client asks to pair and shows the PIN it is
+// given; the host enters that PIN to approve it and the client receives a
+// device token it sends from then on, and ends up in the trust store.
+const (
+	pairingRequestTTL = 5 * time.Minute
+	deviceTokenHeader = "X-Device-Token"
+
+	deviceKindBrowser = "browser"
+)
+
+var (
+	trustedDevicesFile = "trusted-devices.json"
+
+	// When set, starting, joining or watching a session needs a paired
+	// device token. Requests from the host itself are always allowed.
+	requireTrustedDevices = false
+)
+
+// trustedDevice is a paired client. It authenticates with a token, of which
+// only the hash is stored.
+type trustedDevice struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Kind      string    `json:"kind"`
+	TokenHash string    `json:"token_hash,omitempty"`
+	PairedAt  time.Time `json:"paired_at"`
+	LastSeen  time.Time `json:"last_seen,omitempty"`
+	// Limits lower the host's offer limits for this device
+	Limits *offerLimits `json:"limits,omitempty"`
+}
+
+// pairingRequest is a browser waiting for the host to enter its PIN. The
+// request ID is the client's secret for collecting the token.
+type pairingRequest struct {
+	ID        string
+	Name      string
+	PIN       string
+	CreatedAt time.Time
+	token     string // Set on approval, handed out once
+	deviceID  string
+}
+
+var (
+	trustedDevices  []*trustedDevice
+	pairingRequests = make(map[string]*pairingRequest)
+	trustStoreLock  sync.Mutex
+)
+
+func loadTrustedDevices() {
+	data, err := os.ReadFile(trustedDevicesFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading trusted devices: %v", err)
+		}
+		return
+	}
+
+	trustStoreLock.Lock()
+	defer trustStoreLock.Unlock()
+	if err := json.Unmarshal(data, &trustedDevices); err != nil {
+		log.Printf("Error parsing %s: %v", trustedDevicesFile, err)
+		return
+	}
+	log.Printf("Loaded %d trusted devices", len(trustedDevices))
+}
+
+// saveTrustedDevices must be called with trustStoreLock held
+func saveTrustedDevices() error {
+	data, err := json.MarshalIndent(trustedDevices, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(trustedDevicesFile, data, 0600)
+}
+
+// addTrustedDevice stores a newly paired device
+func addTrustedDevice(device *trustedDevice) {
+	trustStoreLock.Lock()
+	defer trustStoreLock.Unlock()
+
+	device.ID = fmt.Sprintf("device_%d", time.Now().UnixNano())
+	device.PairedAt = time.Now()
+	trustedDevices = append(trustedDevices, device)
+	if err := saveTrustedDevices(); err != nil {
+		log.Printf("Error saving trusted devices: %v", err)
+	}
+	log.Printf("Device %s (%s, %s) paired", device.ID, device.Name, device.Kind)
+}
+
+// removeTrustedDevices drops the devices match selects and reports how many
+func removeTrustedDevices(match func(*trustedDevice) bool) int {
+	trustStoreLock.Lock()
+	defer trustStoreLock.Unlock()
+
+	kept := trustedDevices[:0]
+	for _, device := range trustedDevices {
+		if !match(device) {
+			kept = append(kept, device)
+		}
+	}
+	removed := len(trustedDevices) - len(kept)
+	trustedDevices = kept
+	if removed > 0 {
+		if err := saveTrustedDevices(); err != nil {
+			log.Printf("Error saving trusted devices: %v", err)
+		}
+	}
+	return removed
+}
+
+func hashDeviceToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// deviceForToken returns the browser device a token belongs to, or nil
+func deviceForToken(token string) *trustedDevice {
+	if token == "" {
+		return nil
+	}
+	hash := hashDeviceToken(token)
+
+	trustStoreLock.Lock()
+	defer trustStoreLock.Unlock()
+	for _, device := range trustedDevices {
+		if device.Kind == deviceKindBrowser && device.TokenHash == hash {
+			device.LastSeen = time.Now()
+			return device
+		}
+	}
+	return nil
+}
+
+// isHostRequest reports whether the request comes from the host machine,
+// which alone may approve and revoke devices
+func isHostRequest(r *http.Request) bool {
+	if isAdminSocketRequest(r) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// trustedOnly wraps handlers that need a paired device while
+// requireTrustedDevices is set
+func trustedOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requireTrustedDevices && !isHostRequest(r) && deviceForToken(r.Header.Get(deviceTokenHeader)) == nil {
+			writeError(w, http.StatusUnauthorized, "device_not_paired", "Device not paired")
+			return
+		}
+		next(w, r)
+	}
+}
+
+var pairingPINPattern = regexp.MustCompile(`^[0-9]{4}$`)
+
+func generatePairingPIN() string {
+	n, _ := rand.Int(rand.Reader, big.NewInt(10000))
+	return fmt.Sprintf("%04d", n.Int64())
+}
+
+// expirePairingRequestsLocked must be called with trustStoreLock held
+func expirePairingRequestsLocked() {
+	for id, req := range pairingRequests {
+		if time.Since(req.CreatedAt) > pairingRequestTTL {
+			delete(pairingRequests, id)
+		}
+	}
+}
+
+// handleRequestPairing starts pairing a browser and returns the PIN it shows
+func handleRequestPairing(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" {
+		name = "Browser"
+	}
+	if len(name) > 64 {
+		writeError(w, http.StatusBadRequest, "name_too_long", "Name too long")
+		return
+	}
+
+	trustStoreLock.Lock()
+	expirePairingRequestsLocked()
+	if len(pairingRequests) >= 16 {
+		trustStoreLock.Unlock()
+		writeError(w, http.StatusServiceUnavailable, "pairing_limit", "Too many pending pairing requests")
+		return
+	}
+	// PINs identify the request to the host, so they must be unique
+	pin := generatePairingPIN()
+	for pinInUse(pin) {
+		pin = generatePairingPIN()
+	}
+	req := &pairingRequest{
+		ID:        generateOwnerToken(),
+		Name:      name,
+		PIN:       pin,
+		CreatedAt: time.Now(),
+	}
+	pairingRequests[req.ID] = req
+	trustStoreLock.Unlock()
+
+	log.Printf("Pairing requested by %s, PIN %s", name, pin)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"request_id": req.ID,
+		"pin":        pin,
+		"expires_in": int(pairingRequestTTL.Seconds()),
+	})
+}
+
+// pinInUse must be called with trustStoreLock held
+func pinInUse(pin string) bool {
+	for _, req := range pairingRequests {
+		if req.PIN == pin {
+			return true
+		}
+	}
+	return false
+}
+
+// handlePairingStatus is polled by the pairing browser. Once approved it
+// returns the device token, exactly once.
+func handlePairingStatus(w http.ResponseWriter, r *http.Request) {
+	trustStoreLock.Lock()
+	expirePairingRequestsLocked()
+	req, ok := pairingRequests[r.PathValue("id")]
+	response := map[string]interface{}{"status": "pending"}
+	if ok && req.token != "" {
+		response = map[string]interface{}{
+			"status":    "approved",
+			"device_id": req.deviceID,
+			"token":     req.token,
+		}
+		delete(pairingRequests, req.ID)
+	}
+	trustStoreLock.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "pairing_not_found", "Pairing request not found or expired")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleApprovePairing is the host entering a PIN; the browser request
+// showing that PIN is approved
+func handleApprovePairing(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Devices can only be approved from the host")
+		return
+	}
+
+	var body struct {
+		PIN string `json:"pin"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+	if !pairingPINPattern.MatchString(body.PIN) {
+		writeError(w, http.StatusBadRequest, "invalid_pin", "PIN must be 4 digits")
+		return
+	}
+
+	trustStoreLock.Lock()
+	expirePairingRequestsLocked()
+	var req *pairingRequest
+	for _, pending := range pairingRequests {
+		if pending.PIN == body.PIN && pending.token == "" {
+			req = pending
+		}
+	}
+	trustStoreLock.Unlock()
+
+	if req == nil {
+		writeError(w, http.StatusNotFound, "pairing_not_found", "No pairing request shows this PIN")
+		return
+	}
+
+	token := generateOwnerToken()
+	device := &trustedDevice{
+		Name:      req.Name,
+		Kind:      deviceKindBrowser,
+		TokenHash: hashDeviceToken(token),
+	}
+	addTrustedDevice(device)
+
+	trustStoreLock.Lock()
+	req.token = token
+	req.deviceID = device.ID
+	trustStoreLock.Unlock()
+	auditRequest(r, "device_approve", device.ID, map[string]interface{}{"name": device.Name, "kind": device.Kind})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_id": device.ID,
+		"name":      device.Name,
+		"kind":      device.Kind,
+	})
+}
+
+// handleListDevices lists trusted devices and pending pairings for the host
+func handleListDevices(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Devices can only be listed from the host")
+		return
+	}
+
+	trustStoreLock.Lock()
+	expirePairingRequestsLocked()
+	devices := make([]map[string]interface{}, 0, len(trustedDevices))
+	for _, device := range trustedDevices {
+		info := map[string]interface{}{
+			"id":        device.ID,
+			"name":      device.Name,
+			"kind":      device.Kind,
+			"paired_at": device.PairedAt.Format(time.RFC3339),
+		}
+		if !device.LastSeen.IsZero() {
+			info["last_seen"] = device.LastSeen.Format(time.RFC3339)
+		}
+		if device.Limits != nil {
+			info["limits"] = device.Limits
+		}
+		devices = append(devices, info)
+	}
+	pending := make([]map[string]interface{}, 0, len(pairingRequests))
+	for _, req := range pairingRequests {
+		if req.token == "" {
+			pending = append(pending, map[string]interface{}{
+				"name": req.Name,
+				"kind": deviceKindBrowser,
+			})
+		}
+	}
+	trustStoreLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"require_pairing": requireTrustedDevices,
+		"devices":         devices,
+		"pending":         pending,
+	})
+}
+
+// handleRevokeDevice removes a device from the trust store
+func handleRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Devices can only be revoked from the host")
+		return
+	}
+
+	id := r.PathValue("id")
+	if removeTrustedDevices(func(d *trustedDevice) bool { return d.ID == id }) == 0 {
+		writeError(w, http.StatusNotFound, "device_not_found", "Device not found")
+		return
+	}
+	log.Printf("Device %s revoked", id)
+	auditRequest(r, "device_revoke", id, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
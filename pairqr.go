@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"image/png"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Pairing by QR code, instead of typing the host's address and a PIN: the
+// host shows a code from GET /devices/qr holding the web client's URL with
+// a one-time join token in ?pair=. The phone that scans it opens the
+// client, which trades the token for a device token at POST /pair/join.
+// Tokens expire like pairing requests.
+
+// joinTokens are the unredeemed tokens and when they expire; guarded by
+// trustStoreLock
+var joinTokens = make(map[string]time.Time)
+
+const (
+	maxJoinTokens  = 16
+	qrModulePixels = 8
+)
+
+// handlePairingQR mints a join token and returns its code, as SVG or,
+// with ?format=png, PNG. ?url= sets the address the phone opens, by
+// default this request's host, or the host's LAN address when the request
+// comes from the host itself.
+func handlePairingQR(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Pairing codes can only be made on the host")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "svg" && format != "png" {
+		writeError(w, http.StatusBadRequest, "invalid_format", "Format must be svg or png")
+		return
+	}
+	base := r.URL.Query().Get("url")
+	if base == "" {
+		base = pairingBaseURL(r)
+	}
+	parsed, err := url.Parse(base)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		writeError(w, http.StatusBadRequest, "invalid_url", "URL must be an http or https address")
+		return
+	}
+
+	trustStoreLock.Lock()
+	expireJoinTokensLocked()
+	if len(joinTokens) >= maxJoinTokens {
+		trustStoreLock.Unlock()
+		writeError(w, http.StatusServiceUnavailable, "pairing_limit", "Too many unused pairing codes")
+		return
+	}
+	token := generateOwnerToken()
+	joinTokens[token] = time.Now().Add(pairingRequestTTL)
+	trustStoreLock.Unlock()
+
+	link := strings.TrimSuffix(base, "/") + webPrefix + "?pair=" + token
+	code, err := encodeQR(link)
+	if err != nil {
+		trustStoreLock.Lock()
+		delete(joinTokens, token)
+		trustStoreLock.Unlock()
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_url", "URL too long for a QR code", err.Error())
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Pairing-URL", link)
+	if format == "png" {
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, code.image(qrModulePixels))
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Write([]byte(code.svg()))
+}
+
+// pairingBaseURL is the address a phone on the LAN reaches the host at
+func pairingBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, ""
+	}
+	if ip := net.ParseIP(host); (ip == nil || !ip.IsLoopback()) && host != "localhost" {
+		return scheme + "://" + r.Host
+	}
+
+	// A private IPv4 address, as most LANs have, or else any other
+	var lan net.IP
+	_, ips := lanCertNames()
+	for _, ip := range ips {
+		if ip.IsLoopback() {
+			continue
+		}
+		if lan == nil || ip.To4() != nil && ip.IsPrivate() && !(lan.To4() != nil && lan.IsPrivate()) {
+			lan = ip
+		}
+	}
+	if lan != nil {
+		host = lan.String()
+	}
+	if port == "" {
+		return scheme + "://" + host
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// expireJoinTokensLocked must be called with trustStoreLock held
+func expireJoinTokensLocked() {
+	for token, expires := range joinTokens {
+		if time.Now().After(expires) {
+			delete(joinTokens, token)
+		}
+	}
+}
+
+// handleJoinPairing pairs the browser that scanned a code
+func handleJoinPairing(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token string `json:"token"`
+		Name  string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" {
+		name = "Browser"
+	}
+	if len(name) > 64 {
+		writeError(w, http.StatusBadRequest, "name_too_long", "Name too long")
+		return
+	}
+
+	trustStoreLock.Lock()
+	expireJoinTokensLocked()
+	_, ok := joinTokens[body.Token]
+	delete(joinTokens, body.Token)
+	trustStoreLock.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "pairing_not_found", "Pairing code not found, used or expired")
+		return
+	}
+
+	token := generateOwnerToken()
+	device := &trustedDevice{
+		Name:      name,
+		Kind:      deviceKindBrowser,
+		TokenHash: hashDeviceToken(token),
+	}
+	addTrustedDevice(device)
+	auditRequest(r, "device_approve", device.ID, map[string]interface{}{"name": device.Name, "kind": device.Kind, "via": "qr"})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_id": device.ID,
+		"token":     token,
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/lightsyr/chimera-go/input"
+	"github.com/pion/webrtc/v3"
+)
+
+// Peer roles requested at signaling. View-only peers receive the stream but
+// none of their input reaches the host.
+const (
+	peerRoleControl = "control"
+	peerRoleView    = "view"
+)
+
+// ControlMessage tells the client whether its input is accepted; sent on
+// the "input" DataChannel when it opens and whenever the owner changes it
+type ControlMessage struct {
+	Type    string `json:"type"` // "control"
+	Control bool   `json:"control"`
+}
+
+func generateOwnerToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// isOwner checks the request's bearer token against the session owner token
+func (s *StreamSession) isOwner(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.ownerToken)) == 1
+}
+
+// setControl grants or revokes input control. On revoke everything the
+// peer holds on the host is released so nothing stays stuck down. Viewers
+// cannot be granted control.
+func (s *StreamSession) setControl(control bool) error {
+	if control && s.viewer {
+		return errViewerInput
+	}
+	if s.control.Swap(control) == control {
+		return nil
+	}
+
+	if !control {
+		s.mutex.RLock()
+		injector := s.injector
+		s.mutex.RUnlock()
+		if injector != nil {
+			for _, ev := range s.shortcuts.releaseAll() {
+				injector.Key(ev)
+			}
+			injector.Mouse(input.MouseEvent{})
+			if s.GamepadSlot >= 0 {
+				injector.Reset()
+			}
+		}
+	}
+
+	s.mutex.RLock()
+	dc := s.inputChannel
+	s.mutex.RUnlock()
+	if dc != nil {
+		sendJSON(dc, ControlMessage{Type: "control", Control: control})
+	}
+	return nil
+}
+
+// handleSetSessionControl lets the session owner or an admin grant or
+// revoke control
+func handleSetSessionControl(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	if !session.canManage(r) {
+		writeError(w, http.StatusForbidden, "not_owner", "Only the session owner can change control")
+		return
+	}
+
+	var req struct {
+		Control bool `json:"control"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+
+	if err := session.setControl(req.Control); err != nil {
+		writeError(w, http.StatusForbidden, "viewer", err.Error())
+		return
+	}
+	log.Printf("[Session %s] Input control set to %v", session.ID, req.Control)
+	auditRequest(r, "control", "", map[string]interface{}{"control": req.Control})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id": session.ID,
+		"control":    req.Control,
+	})
+}
+
+// endSession closes the session's peer connection, which ends it with its
+// guests and spectators
+func endSession(session *StreamSession) {
+	session.Cancel()
+	session.PC.Close()
+	// The peer may never have connected, so its state handler may not run
+	unregisterSession(session.ID)
+}
+
+// handleEndSession ends a session for its owner or an admin
+func handleEndSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	if !session.canManage(r) {
+		writeError(w, http.StatusForbidden, "not_owner", "Only the session owner can end the session")
+		return
+	}
+
+	role := session.apiRole(r)
+	log.Printf("[Session %s] Ended through the API (%s)", session.ID, role)
+	auditRequest(r, "session_kill", "", map[string]interface{}{"role": role})
+	endSession(session)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// trackInputChannel remembers the channel control changes, video muting and
+// the app's state are announced on
+func (s *StreamSession) trackInputChannel(dc *webrtc.DataChannel) {
+	s.mutex.Lock()
+	s.inputChannel = dc
+	app := s.App
+	s.mutex.Unlock()
+
+	sendJSON(dc, ControlMessage{Type: "control", Control: s.control.Load()})
+	if s.pictureMuted() {
+		sendJSON(dc, VideoMessage{Type: "video", Muted: true})
+	}
+	if app != nil {
+		sendJSON(dc, app.message())
+	}
+	if !s.deadline.IsZero() {
+		sendJSON(dc, s.timeLimitMessage())
+	}
+}
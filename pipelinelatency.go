@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Access units are stamped as they move through the pipeline, so a session
+// that feels laggy can be pinned on a stage:
+//
+//	capture  grabbing the frame until it is encoded
+//	source   encoded until runCapture reads it from the source
+//	queue    read and queued until the sample writer takes it
+//	write    encrypting, packetizing and sending it with WriteSample
+//
+// FFmpeg captures and encodes out of sight, so only in-process sources
+// report the first two. The network's share is half the ping channel's
+// RTT. Each stage keeps a histogram per session, in GET /sessions, and one
+// for the host, in GET /stats.
+
+// latencyBoundsMs are the upper bounds of the histogram buckets; a last
+// bucket counts what is slower
+var latencyBoundsMs = [...]float64{1, 2, 5, 10, 20, 50, 100, 200, 500}
+
+type latencyHistogram struct {
+	counts    [len(latencyBoundsMs) + 1]atomic.Int64
+	sumMicros atomic.Int64
+	maxMicros atomic.Int64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	if d < 0 {
+		return // Clocks of different sources
+	}
+	ms := float64(d) / float64(time.Millisecond)
+	bucket := len(latencyBoundsMs)
+	for i, bound := range latencyBoundsMs {
+		if ms <= bound {
+			bucket = i
+			break
+		}
+	}
+	h.counts[bucket].Add(1)
+	micros := d.Microseconds()
+	h.sumMicros.Add(micros)
+	for {
+		old := h.maxMicros.Load()
+		if micros <= old || h.maxMicros.CompareAndSwap(old, micros) {
+			break
+		}
+	}
+}
+
+// summary returns the histogram's bucket counts with its mean, maximum
+// and percentiles, which are the upper bounds of their buckets
+func (h *latencyHistogram) summary() map[string]interface{} {
+	counts := make([]int64, len(h.counts))
+	var total int64
+	for i := range h.counts {
+		counts[i] = h.counts[i].Load()
+		total += counts[i]
+	}
+	summary := map[string]interface{}{
+		"count":  total,
+		"counts": counts,
+	}
+	if total == 0 {
+		return summary
+	}
+
+	maxMs := float64(h.maxMicros.Load()) / 1000
+	quantile := func(p float64) float64 {
+		var seen int64
+		for i, n := range counts[:len(latencyBoundsMs)] {
+			seen += n
+			if float64(seen) >= p/100*float64(total) {
+				return min(latencyBoundsMs[i], maxMs)
+			}
+		}
+		return maxMs
+	}
+	summary["mean_ms"] = float64(h.sumMicros.Load()) / 1000 / float64(total)
+	summary["max_ms"] = maxMs
+	summary["p50_ms"] = quantile(50)
+	summary["p95_ms"] = quantile(95)
+	summary["p99_ms"] = quantile(99)
+	return summary
+}
+
+// pipelineLatency holds one histogram per stage
+type pipelineLatency struct {
+	capture, source, queue, write latencyHistogram
+}
+
+// hostLatency counts the frames of every session, ended ones included
+var hostLatency pipelineLatency
+
+// observe records the stages of an access unit the sample writer took at
+// dequeued and finished writing at written
+func (p *pipelineLatency) observe(au AccessUnit, dequeued, written time.Time) {
+	if !au.Grabbed.IsZero() {
+		p.capture.observe(au.Encoded.Sub(au.Grabbed))
+		p.source.observe(au.Read.Sub(au.Encoded))
+	}
+	p.queue.observe(dequeued.Sub(au.Read))
+	p.write.observe(written.Sub(dequeued))
+}
+
+func (p *pipelineLatency) summary() map[string]interface{} {
+	return map[string]interface{}{
+		"bounds_ms": latencyBoundsMs,
+		"capture":   p.capture.summary(),
+		"source":    p.source.summary(),
+		"queue":     p.queue.summary(),
+		"write":     p.write.summary(),
+	}
+}
+
+// observeLatency records an access unit's stages for the session and the
+// host
+func (s *PipelineStats) observeLatency(au AccessUnit, dequeued, written time.Time) {
+	s.latency.observe(au, dequeued, written)
+	hostLatency.observe(au, dequeued, written)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Privacy mode keeps a streamed host private to whoever is sitting at it:
+// its monitors go black and its own keyboard and mouse stop working, while
+// the captured picture and the remote player's input carry on. It is on
+// with privacy.json,
+//
+//	{"blank_display": true, "lock_input": true}
+//
+// and engages while any session is connected. Ctrl+Alt+End on a local
+// keyboard takes control back, and the host stays unlocked until every
+// session has ended.
+//
+// Linux blanks with an xrandr gamma ramp, which scanout applies after
+// capture, and grabs the keyboards and mice under /dev/input. Windows
+// covers the desktop with a window excluded from capture (Windows 10 2004
+// or later) and drops input that was not injected.
+
+var privacyFile = "privacy.json"
+
+const privacyCheckInterval = time.Second
+
+// privacySettings are privacy.json
+type privacySettings struct {
+	BlankDisplay bool `json:"blank_display"`
+	LockInput    bool `json:"lock_input"`
+}
+
+var hostPrivacy privacySettings
+
+func (p privacySettings) enabled() bool {
+	return p.BlankDisplay || p.LockInput
+}
+
+func loadPrivacy() {
+	data, err := os.ReadFile(privacyFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading privacy settings: %v", err)
+		}
+		return
+	}
+
+	var settings privacySettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		log.Printf("Error parsing %s: %v", privacyFile, err)
+		return
+	}
+	hostPrivacy = settings
+	log.Printf("Privacy mode: blank display %v, lock input %v", settings.BlankDisplay, settings.LockInput)
+}
+
+var (
+	privacyLock sync.Mutex
+	// privacyUndo lifts what is engaged, nil while privacy mode is off
+	privacyUndo []func()
+	// privacyReclaimed is set by the hotkey until no session is connected
+	privacyReclaimed bool
+)
+
+// enforcePrivacy engages privacy mode while a session is connected
+func enforcePrivacy() {
+	ticker := time.NewTicker(privacyCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		setPrivacy(anySessionConnected())
+	}
+}
+
+func anySessionConnected() bool {
+	sessionsLock.RLock()
+	defer sessionsLock.RUnlock()
+	for _, session := range sessions {
+		if session.PC != nil && session.PC.ConnectionState() == webrtc.PeerConnectionStateConnected {
+			return true
+		}
+	}
+	return false
+}
+
+func setPrivacy(active bool) {
+	privacyLock.Lock()
+	defer privacyLock.Unlock()
+
+	if !active {
+		privacyReclaimed = false
+	}
+	engage := active && !privacyReclaimed
+	if engage == (privacyUndo != nil) {
+		return
+	}
+	if !engage {
+		liftPrivacy()
+		log.Printf("Privacy mode lifted")
+		return
+	}
+
+	privacyUndo = []func(){}
+	if hostPrivacy.BlankDisplay {
+		if restore, err := blankDisplays(); err != nil {
+			log.Printf("Error blanking the display: %v", err)
+		} else {
+			privacyUndo = append(privacyUndo, restore)
+		}
+	}
+	if hostPrivacy.LockInput {
+		if unlock, err := lockLocalInput(reclaimPrivacy); err != nil {
+			log.Printf("Error locking local input: %v", err)
+		} else {
+			privacyUndo = append(privacyUndo, unlock)
+		}
+	}
+	log.Printf("Privacy mode engaged, Ctrl+Alt+End at the host reclaims it")
+}
+
+// liftPrivacy undoes privacy mode; privacyLock must be held
+func liftPrivacy() {
+	for _, undo := range privacyUndo {
+		undo()
+	}
+	privacyUndo = nil
+}
+
+// reclaimPrivacy lifts privacy mode for someone at the host. It is called
+// from the input lock, so it lifts it on another goroutine.
+func reclaimPrivacy() {
+	go func() {
+		privacyLock.Lock()
+		defer privacyLock.Unlock()
+		if privacyUndo == nil {
+			return
+		}
+		privacyReclaimed = true
+		liftPrivacy()
+		log.Printf("Privacy mode reclaimed at the host")
+	}()
+}
+
+// releasePrivacy gives the host back its display and input on shutdown
+func releasePrivacy() {
+	privacyLock.Lock()
+	defer privacyLock.Unlock()
+	liftPrivacy()
+}
+
+// hotkey spots a key pressed while one key of each modifier group is
+// held, from the local key events the input lock swallows
+type hotkey struct {
+	mu        sync.Mutex
+	held      map[uint32]bool
+	key       uint32
+	modifiers [][]uint32
+}
+
+func newHotkey(key uint32, modifiers ...[]uint32) *hotkey {
+	return &hotkey{held: make(map[uint32]bool), key: key, modifiers: modifiers}
+}
+
+// press records a key going down or up and reports whether it completes
+// the hotkey
+func (h *hotkey) press(code uint32, down bool) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	wasHeld := h.held[code]
+	h.held[code] = down
+	if !down || wasHeld || code != h.key {
+		return false
+	}
+	for _, group := range h.modifiers {
+		held := false
+		for _, modifier := range group {
+			held = held || h.held[modifier]
+		}
+		if !held {
+			return false
+		}
+	}
+	return true
+}
+
+// A session offered with lock_on_end locks the host's desktop session when
+// it ends, so a remote rig is not left signed in. With other sessions
+// still streaming the lock waits for the last of them to end.
+
+// workstationLockPending is guarded by sessionsLock
+var workstationLockPending bool
+
+// lockOnSessionEnd locks the host if the session that just ended asked to
+// and it was the last, or it was the last after one that asked.
+// sessionsLock must be held.
+func lockOnSessionEnd(session *StreamSession) {
+	if session.lockOnEnd && session.connected.Load() {
+		workstationLockPending = true
+		if len(sessions) > 0 {
+			log.Printf("[Session %s] Locking the host once the other %d sessions end", session.ID, len(sessions))
+		}
+	}
+	if !workstationLockPending || len(sessions) > 0 {
+		return
+	}
+	workstationLockPending = false
+	if err := lockWorkstation(); err != nil {
+		log.Printf("[Session %s] Error locking the host: %v", session.ID, err)
+		return
+	}
+	log.Printf("[Session %s] Host locked", session.ID)
+	auditSession(session, "host_lock", nil)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// evdev ioctls and codes (linux/input.h, linux/input-event-codes.h)
+const (
+	eviocGrab    = 0x40044590
+	eviocGName   = 0x80004506 // | len<<16
+	eviocGBitKey = 0x80004521 // EVIOCGBIT(EV_KEY), | len<<16
+
+	keyMax = 0x2ff
+
+	evKey    = 0x01
+	btnLeft  = 0x110
+	btnTouch = 0x14a
+)
+
+// struct input_event
+type evdevEvent struct {
+	Time  syscall.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+// reclaimHotkey is Ctrl+Alt+End, either Ctrl and either Alt
+var reclaimHotkey = newHotkey(107, []uint32{29, 97}, []uint32{56, 100})
+
+func blankDisplays() (func(), error) {
+	out, err := exec.Command("xrandr", "--query").Output()
+	if err != nil {
+		return nil, err
+	}
+	var outputs []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if m := xrandrOutput.FindStringSubmatch(line); m != nil {
+			outputs = append(outputs, m[1])
+		}
+	}
+	if len(outputs) == 0 {
+		return nil, errors.New("xrandr lists no connected output")
+	}
+	if err := setBrightness(outputs, "0"); err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := setBrightness(outputs, "1"); err != nil {
+			log.Printf("Error restoring the display: %v", err)
+		}
+	}, nil
+}
+
+func setBrightness(outputs []string, brightness string) error {
+	var args []string
+	for _, output := range outputs {
+		args = append(args, "--output", output, "--brightness", brightness)
+	}
+	if out, err := exec.Command("xrandr", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// lockLocalInput grabs every keyboard, mouse and touchscreen but the
+// virtual devices, so only their reader sees the events. Devices plugged
+// in later are not grabbed.
+func lockLocalInput(reclaim func()) (func(), error) {
+	paths, err := filepath.Glob("/dev/input/event*")
+	if err != nil {
+		return nil, err
+	}
+	var grabbed []*os.File
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		if !isLocalInput(f) || evdevIoctl(f, eviocGrab, 1) != nil {
+			f.Close()
+			continue
+		}
+		grabbed = append(grabbed, f)
+	}
+	if len(grabbed) == 0 {
+		return nil, errors.New("no keyboard or mouse could be grabbed")
+	}
+
+	for _, f := range grabbed {
+		go watchReclaimHotkey(f, reclaim)
+	}
+	return func() {
+		// Closing a device releases its grab and ends its reader
+		for _, f := range grabbed {
+			f.Close()
+		}
+	}, nil
+}
+
+// isLocalInput reports whether the device is a physical keyboard, mouse or
+// touchscreen
+func isLocalInput(f *os.File) bool {
+	name := make([]byte, 256)
+	if evdevIoctl(f, eviocGName|uintptr(len(name))<<16, uintptr(unsafe.Pointer(&name[0]))) != nil {
+		return false
+	}
+	if strings.HasPrefix(string(name), "Chimera ") {
+		return false
+	}
+
+	keys := make([]byte, keyMax/8+1)
+	if evdevIoctl(f, eviocGBitKey|uintptr(len(keys))<<16, uintptr(unsafe.Pointer(&keys[0]))) != nil {
+		return false
+	}
+	has := func(code int) bool { return keys[code/8]&(1<<(code%8)) != 0 }
+	// A, the left button or touch, which gamepads and power buttons lack
+	return has(30) || has(btnLeft) || has(btnTouch)
+}
+
+// evdevIoctl runs an ioctl on the device without taking it out of the
+// poller, so closing it still ends a blocked read
+func evdevIoctl(f *os.File, req, arg uintptr) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// watchReclaimHotkey reads the grabbed device's events until it is closed
+func watchReclaimHotkey(f *os.File, reclaim func()) {
+	var ev evdevEvent
+	for binary.Read(f, binary.NativeEndian, &ev) == nil {
+		// Value 2 is autorepeat
+		if ev.Type == evKey && ev.Value != 2 && reclaimHotkey.press(uint32(ev.Code), ev.Value == 1) {
+			reclaim()
+		}
+	}
+}
+
+// lockWorkstation locks the desktop session the server runs in, through
+// logind or else the screensaver
+func lockWorkstation() error {
+	err := exec.Command("loginctl", "lock-session").Run()
+	if err == nil {
+		return nil
+	}
+	if out, fallbackErr := exec.Command("xdg-screensaver", "lock").CombinedOutput(); fallbackErr != nil {
+		return fmt.Errorf("loginctl: %v, xdg-screensaver: %v: %s", err, fallbackErr, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func blankDisplays() (func(), error) {
+	return nil, fmt.Errorf("blanking the display is not supported on %s", runtime.GOOS)
+}
+
+func lockLocalInput(reclaim func()) (func(), error) {
+	return nil, fmt.Errorf("locking local input is not supported on %s", runtime.GOOS)
+}
+
+func lockWorkstation() error {
+	return fmt.Errorf("locking the host is not supported on %s", runtime.GOOS)
+}
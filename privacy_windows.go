@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	wsPopup               = 0x80000000
+	wsVisible             = 0x10000000
+	wsExTopmost           = 0x00000008
+	wsExTransparent       = 0x00000020
+	wsExToolWindow        = 0x00000080
+	wsExLayered           = 0x00080000
+	wsExNoActivate        = 0x08000000
+	lwaAlpha              = 0x2
+	wdaExcludeFromCapture = 0x11
+	blackBrush            = 4
+
+	smXVirtualScreen  = 76
+	smYVirtualScreen  = 77
+	smCXVirtualScreen = 78
+	smCYVirtualScreen = 79
+
+	whKeyboardLL   = 13
+	whMouseLL      = 14
+	hcAction       = 0
+	llkhfInjected  = 0x10
+	llmhfInjected  = 0x01
+	wmQuit         = 0x0012
+	wmKeyDown      = 0x0100
+	wmSysKeyDown   = 0x0104
+	errClassExists = 1410
+)
+
+var (
+	user32                         = syscall.NewLazyDLL("user32.dll")
+	gdi32                          = syscall.NewLazyDLL("gdi32.dll")
+	procRegisterClassExW           = user32.NewProc("RegisterClassExW")
+	procCreateWindowExW            = user32.NewProc("CreateWindowExW")
+	procDestroyWindow              = user32.NewProc("DestroyWindow")
+	procDefWindowProcW             = user32.NewProc("DefWindowProcW")
+	procSetLayeredWindowAttributes = user32.NewProc("SetLayeredWindowAttributes")
+	procSetWindowDisplayAffinity   = user32.NewProc("SetWindowDisplayAffinity")
+	procGetSystemMetrics           = user32.NewProc("GetSystemMetrics")
+	procSetWindowsHookExW          = user32.NewProc("SetWindowsHookExW")
+	procUnhookWindowsHookEx        = user32.NewProc("UnhookWindowsHookEx")
+	procCallNextHookEx             = user32.NewProc("CallNextHookEx")
+	procGetMessageW                = user32.NewProc("GetMessageW")
+	procDispatchMessageW           = user32.NewProc("DispatchMessageW")
+	procPostThreadMessageW         = user32.NewProc("PostThreadMessageW")
+	procLockWorkStation            = user32.NewProc("LockWorkStation")
+	procGetStockObject             = gdi32.NewProc("GetStockObject")
+)
+
+// reclaimHotkey is Ctrl+Alt+End; low-level hooks tell left from right
+var reclaimHotkey = newHotkey(0x23, []uint32{0xA2, 0xA3}, []uint32{0xA4, 0xA5})
+
+// Hook callbacks are never freed, so there is one of each
+var (
+	keyboardHookProc = syscall.NewCallback(keyboardHook)
+	mouseHookProc    = syscall.NewCallback(mouseHook)
+	// hookReclaim is the reclaim of the running input lock
+	hookReclaim func()
+)
+
+type wndClassEx struct {
+	size       uint32
+	style      uint32
+	wndProc    uintptr
+	clsExtra   int32
+	wndExtra   int32
+	instance   windows.Handle
+	icon       windows.Handle
+	cursor     windows.Handle
+	background windows.Handle
+	menuName   *uint16
+	className  *uint16
+	iconSm     windows.Handle
+}
+
+type winMsg struct {
+	hwnd    uintptr
+	message uint32
+	wParam  uintptr
+	lParam  uintptr
+	time    uint32
+	pt      struct{ x, y int32 }
+	private uint32
+}
+
+type kbdLLHookStruct struct {
+	vkCode, scanCode, flags, time uint32
+	extraInfo                     uintptr
+}
+
+type msLLHookStruct struct {
+	pt                     struct{ x, y int32 }
+	mouseData, flags, time uint32
+	extraInfo              uintptr
+}
+
+// runMessageLoop runs setup on a thread of its own and serves its windows
+// and hooks, which Windows ties to the thread that made them, until the
+// returned stop is called; then the thread runs setup's cleanup
+func runMessageLoop(setup func() (cleanup func(), err error)) (func(), error) {
+	started := make(chan error, 1)
+	var threadID uint32
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		cleanup, err := setup()
+		if err != nil {
+			started <- err
+			return
+		}
+		threadID = windows.GetCurrentThreadId()
+		started <- nil
+
+		var msg winMsg
+		for {
+			if r, _, _ := procGetMessageW.Call(uintptr(unsafe.Pointer(&msg)), 0, 0, 0); int32(r) <= 0 {
+				break
+			}
+			procDispatchMessageW.Call(uintptr(unsafe.Pointer(&msg)))
+		}
+		cleanup()
+	}()
+	if err := <-started; err != nil {
+		return nil, err
+	}
+	return func() { procPostThreadMessageW.Call(uintptr(threadID), wmQuit, 0, 0) }, nil
+}
+
+// blankDisplays covers the whole desktop with a black click-through
+// window that capture leaves out
+func blankDisplays() (func(), error) {
+	return runMessageLoop(func() (func(), error) {
+		var instance windows.Handle
+		if err := windows.GetModuleHandleEx(0, nil, &instance); err != nil {
+			return nil, err
+		}
+		className, _ := windows.UTF16PtrFromString("ChimeraPrivacy")
+		brush, _, _ := procGetStockObject.Call(blackBrush)
+		class := wndClassEx{
+			wndProc:    procDefWindowProcW.Addr(),
+			instance:   instance,
+			background: windows.Handle(brush),
+			className:  className,
+		}
+		class.size = uint32(unsafe.Sizeof(class))
+		if r, _, err := procRegisterClassExW.Call(uintptr(unsafe.Pointer(&class))); r == 0 && err != syscall.Errno(errClassExists) {
+			return nil, fmt.Errorf("RegisterClassExW: %v", err)
+		}
+
+		x, _, _ := procGetSystemMetrics.Call(smXVirtualScreen)
+		y, _, _ := procGetSystemMetrics.Call(smYVirtualScreen)
+		width, _, _ := procGetSystemMetrics.Call(smCXVirtualScreen)
+		height, _, _ := procGetSystemMetrics.Call(smCYVirtualScreen)
+		hwnd, _, err := procCreateWindowExW.Call(
+			wsExTopmost|wsExTransparent|wsExToolWindow|wsExLayered|wsExNoActivate,
+			uintptr(unsafe.Pointer(className)), 0, wsPopup|wsVisible,
+			uintptr(int32(x)), uintptr(int32(y)), width, height, 0, 0, uintptr(instance), 0)
+		if hwnd == 0 {
+			return nil, fmt.Errorf("CreateWindowExW: %v", err)
+		}
+		procSetLayeredWindowAttributes.Call(hwnd, 0, 255, lwaAlpha)
+		// Without the exclusion the stream would be black too
+		if r, _, err := procSetWindowDisplayAffinity.Call(hwnd, wdaExcludeFromCapture); r == 0 {
+			procDestroyWindow.Call(hwnd)
+			return nil, fmt.Errorf("SetWindowDisplayAffinity: %v", err)
+		}
+		return func() { procDestroyWindow.Call(hwnd) }, nil
+	})
+}
+
+// lockLocalInput drops keyboard and mouse input but what is injected, as
+// remote input is
+func lockLocalInput(reclaim func()) (func(), error) {
+	return runMessageLoop(func() (func(), error) {
+		var instance windows.Handle
+		if err := windows.GetModuleHandleEx(0, nil, &instance); err != nil {
+			return nil, err
+		}
+		hookReclaim = reclaim
+		keyboard, _, err := procSetWindowsHookExW.Call(whKeyboardLL, keyboardHookProc, uintptr(instance), 0)
+		if keyboard == 0 {
+			return nil, fmt.Errorf("SetWindowsHookExW: %v", err)
+		}
+		mouse, _, err := procSetWindowsHookExW.Call(whMouseLL, mouseHookProc, uintptr(instance), 0)
+		if mouse == 0 {
+			procUnhookWindowsHookEx.Call(keyboard)
+			return nil, fmt.Errorf("SetWindowsHookExW: %v", err)
+		}
+		return func() {
+			procUnhookWindowsHookEx.Call(keyboard)
+			procUnhookWindowsHookEx.Call(mouse)
+		}, nil
+	})
+}
+
+func keyboardHook(code, wParam, lParam uintptr) uintptr {
+	if int32(code) == hcAction {
+		ev := *(**kbdLLHookStruct)(unsafe.Pointer(&lParam))
+		if ev.flags&llkhfInjected == 0 {
+			down := wParam == wmKeyDown || wParam == wmSysKeyDown
+			if reclaimHotkey.press(ev.vkCode, down) {
+				hookReclaim()
+			}
+			return 1
+		}
+	}
+	r, _, _ := procCallNextHookEx.Call(0, code, wParam, lParam)
+	return r
+}
+
+func mouseHook(code, wParam, lParam uintptr) uintptr {
+	if int32(code) == hcAction {
+		ev := *(**msLLHookStruct)(unsafe.Pointer(&lParam))
+		if ev.flags&llmhfInjected == 0 {
+			return 1
+		}
+	}
+	r, _, _ := procCallNextHookEx.Call(0, code, wParam, lParam)
+	return r
+}
+
+func lockWorkstation() error {
+	if r, _, err := procLockWorkStation.Call(); r == 0 {
+		return fmt.Errorf("LockWorkStation: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// chimera-go probe reports what the host has for streaming: FFmpeg and its
+// encoders, the capture sources, the monitors and input injection. Each
+// line that would keep sessions from working is marked, and the command
+// fails when there is one, so provisioning scripts can check a host before
+// serving from it.
+
+const probeTimeout = 10 * time.Second
+
+func runProbeCommand(args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: chimera-go probe")
+	}
+
+	problems := 0
+	report := func(what, detail string, err error) {
+		if err != nil {
+			problems++
+			detail = "PROBLEM: " + err.Error()
+		}
+		fmt.Printf("%-10s %s\n", what, detail)
+	}
+
+	fmt.Printf("chimera-go %s on %s/%s\n\n", version, runtime.GOOS, runtime.GOARCH)
+
+	ffmpeg := ffmpegVersion()
+	if ffmpeg == "" {
+		report("FFmpeg", "", errors.New("not found on PATH; only in-process capture sources can encode"))
+	} else {
+		report("FFmpeg", ffmpeg, nil)
+		encoders, err := ffmpegEncoders()
+		if err != nil {
+			report("Encoders", "", err)
+		}
+		var names []string
+		for name := range videoCodecs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			encoder := videoCodecs[name].ffmpegEncoder(CaptureConfig{Codec: name, Width: 1280, Height: 720, FPS: 30})
+			switch {
+			case err != nil:
+			case encoders[encoder]:
+				report("Encoder", fmt.Sprintf("%s with %s", name, encoder), nil)
+			case name == defaultVideoCodec:
+				report("Encoder", "", fmt.Errorf("%s needs %s, which this FFmpeg lacks", name, encoder))
+			default:
+				// Offers can do without the codecs past the default
+				report("Encoder", fmt.Sprintf("%s unavailable, FFmpeg lacks %s", name, encoder), nil)
+			}
+		}
+	}
+
+	var sources []string
+	for name := range captureSourceTypes {
+		if captureSourceAvailable(name) {
+			sources = append(sources, name)
+		}
+	}
+	sort.Strings(sources)
+	for i, name := range sources {
+		if name == captureSource {
+			sources[i] += " (default)"
+		}
+	}
+	report("Capture", strings.Join(sources, ", "), nil)
+
+	monitors, err := listMonitors()
+	switch {
+	case err != nil:
+		report("Monitors", "", fmt.Errorf("listing them: %v", err))
+	case len(monitors) == 0:
+		report("Monitors", "", errors.New("none found"))
+	}
+	for _, m := range monitors {
+		detail := fmt.Sprintf("%d %s %dx%d at %d,%d", m.Index, m.Name, m.Width, m.Height, m.X, m.Y)
+		if m.RefreshHz > 0 {
+			detail += fmt.Sprintf(", %.0f Hz", m.RefreshHz)
+		}
+		if m.VRR {
+			detail += ", VRR"
+		}
+		if m.Primary {
+			detail += ", primary"
+		}
+		report("Monitor", detail, nil)
+	}
+
+	injector, err := probeInjector()
+	report("Input", injector, err)
+
+	fmt.Println()
+	if problems > 0 {
+		return fmt.Errorf("%d problems found", problems)
+	}
+	fmt.Println("Ready to stream")
+	return nil
+}
+
+// ffmpegEncoders lists the encoders FFmpeg was built with
+func ffmpegEncoders() (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing FFmpeg's encoders: %v", err)
+	}
+	// " V....D libx264              libx264 H.264 / AVC ..."
+	encoders := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && len(fields[0]) == 6 {
+			encoders[fields[1]] = true
+		}
+	}
+	return encoders, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// The reference matrices are Kazuhiko Arase's encoder's, forced to the mask
+// ours picks: it does not score masks by the standard's rules
+var qrReferences = []struct {
+	text    string
+	version int
+	matrix  []string
+}{
+	{
+		// One block
+		text:    "HELLO WORLD",
+		version: 1,
+		matrix: []string{
+			"#######.##..#.#######",
+			"#.....#....#..#.....#",
+			"#.###.#..#.#..#.###.#",
+			"#.###.#.#..#..#.###.#",
+			"#.###.#.###.#.#.###.#",
+			"#.....#.#..#..#.....#",
+			"#######.#.#.#.#######",
+			"........#..##........",
+			"#...#.######.#####..#",
+			"...#....#.###....####",
+			"..######..##.##.#..#.",
+			"#####...##...#.......",
+			"#####.#.#.#.#.##..##.",
+			"........#.#.####.#.##",
+			"#######.###.#.#.##.#.",
+			"#.....#..#.###.##..##",
+			"#.###.#.##.#.##...##.",
+			"#.###.#..#..#...##.##",
+			"#.###.#..###...###...",
+			"#.....#....#.#.......",
+			"#######.#########.#.#",
+		},
+	},
+	{
+		// Two blocks
+		text:    "https://192.168.1.20:8443/pair#code=483920&host=living-room-pc",
+		version: 4,
+		matrix: []string{
+			"#######....#..#.##.#..###.#######",
+			"#.....#..#.##..###....#...#.....#",
+			"#.###.#.#.#.#..#..##.##.#.#.###.#",
+			"#.###.#.#.#####.##.#..#.#.#.###.#",
+			"#.###.#.#..##...########..#.###.#",
+			"#.....#.####.#.##.#.#.#.#.#.....#",
+			"#######.#.#.#.#.#.#.#.#.#.#######",
+			"........#......##.#..#..#........",
+			"#.#####....#.#...####..#..#####..",
+			"#.####..###.#...#..#.####.##.##.#",
+			".##.###.##...#.###......#...#.##.",
+			"##.###...##...##.....###.##.#####",
+			"#.#..###.#.#...#.##...###...##.##",
+			"#..##..###.###....###.##.###.####",
+			"#..#.##....######....#..####..##.",
+			".#.##......#...##.####.#.######..",
+			"#.##..##.#.#.##..##.#...#..##...#",
+			".#...#..#####...##.#.#.#####.##.#",
+			"#########.#.##.#.....##.#.###.##.",
+			"..##...#..#...##...#.#.###.######",
+			"..#...#..#....##.#..#...#...##...",
+			"###..#.###....#.#..##.######.##.#",
+			"#..#.##.#..#..###...#.#.#..#.###.",
+			"#...#..#.#.#..#.#.#..#..##....#.#",
+			"#..#..#.#.#..#..#####...######.##",
+			"........#.##.##.#..#..###...#.#.#",
+			"#######..#..#.#####..####.#.#.##.",
+			"#.....#.#.###...#.#####.#...#####",
+			"#.###.#.#.##.....#.#..#.######...",
+			"#.###.#.##.####.#.####.##...##.##",
+			"#.###.#.##...#.####..#...###.##..",
+			"#.....#..#####..#...####....#.#..",
+			"#######.#..#.#...###....#.##.#.#.",
+		},
+	},
+	{
+		// Blocks of two sizes, and the version information
+		text:    "https://chimera.example.net:8443/pair?code=918273&fingerprint=5f3a9c2e7b1d4086a2e9c7f1b3d5e8a0c4f6b2d9e1a7c3f5b8d0e2a4c6f8b1d3&name=office",
+		version: 8,
+		matrix: []string{
+			"#######...#..#..#.##.#.#.....###...##...#.#######",
+			"#.....#......#...##.###.##.#....####..###.#.....#",
+			"#.###.#.###.#.#...#.#..##.#.##.##.##...##.#.###.#",
+			"#.###.#.##.####..###....#.##..#..##.##.#..#.###.#",
+			"#.###.#.#..#.#....#..######..##.#..###....#.###.#",
+			"#.....#.#.#..##....#.##...#....#.####.#...#.....#",
+			"#######.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#######",
+			"........#.##.###..#...#...####..#....#.##........",
+			"#.#####..####..###.##.#####....#..#######.#####..",
+			"##.#...##.#..##..##..#.##...####.........##.###..",
+			"#...####..###.#..#....#.####.#..####.##....#.#.##",
+			".#####..##..###..#.#...#....###.###....#...###.#.",
+			"##.#.########.###....##.##.#...#.#..##..#.....#.#",
+			"##.#...#.#..##.....##.##...#.##....###.#..##.#.#.",
+			"#######.#.#.######..###.###......##.#.###..#.####",
+			"..#......##..#..#..##.#....#..#.#....#.....##...#",
+			".#.########.#....##.##.###..##.#...##...###..##..",
+			".##.#...#####.#.#.##..#..#.####.##.##..#..##...#.",
+			"##.##.##..#.#...##....#.#.#.#..#..#.######.###..#",
+			"........#.####.###..#..#.######.#.....##...##..##",
+			"##...###.#.#...#..###.#.#.#..###...###.####...###",
+			"...###.#.#.##.##.##.....###...#....###...####.##.",
+			"...###########.####...#######..#..###.#.#####.#.#",
+			"#...#...#####....###..#...#.###.#.......#...#...#",
+			"..#.#.#.#..#.#.#.######.#.##..##...######.#.###.#",
+			"###.#...#.####.###.#..#...###.#.#..##..##...#....",
+			"....#####.#.#.#.####..#####..#....#...#.#########",
+			"######.#.###...###..##.##...#.####.............#.",
+			"#...#.#..##.####.###..#.#.#....#...##.##.#######.",
+			"####.#.##.########...#.#......##.#...........#...",
+			"#####.##....#.###..#.........#.##.#.####..###..##",
+			"###.##..##.#...#.#...###.##..##.#.#.....##...#...",
+			".....##...#.##....####....##.###...#######..#.#..",
+			"....##..#..###.###...#####....#.#.......##.#.....",
+			"#.....##.##.##......##.#.#.#..##.###..###.#.##.##",
+			".##..#...##...##.....####.#.##.#####.##.........#",
+			".###.###..#.#.##.#..##.#...#.....#..##.#..###.#.#",
+			"#.#..#.#.#.#..#.##.#.#..##.#.####...##.#.##....#.",
+			".#...#######...#...#..##.........####.#...##.#..#",
+			".###...#.....#....#..#..######.###...#..##.#....#",
+			"###...######.####.#.#######..###.####.###########",
+			"........#######....#..#...#...#......#..#...##.#.",
+			"#######....#.#..####.##.#.#..#....###.#.#.#.#...#",
+			"#.....#.#.#..####....##...###.#.##.#....#...##...",
+			"#.###.#.##.###..###..######....#.#.####.#####.#.#",
+			"#.###.#.#...###....##.##...#####...###.##.###...#",
+			"#.###.#.#..##.#.##..#...##..#....####.#..#.#.#...",
+			"#.....#...#.##.#..###...#..#.#..#.#..#.#..#.....#",
+			"#######.##.#..#.##..#..###..#..#..###.####...####",
+		},
+	},
+}
+
+func qrRows(q *qrCode) []string {
+	rows := make([]string, q.size)
+	for y, row := range q.modules {
+		var b strings.Builder
+		for _, dark := range row {
+			if dark {
+				b.WriteByte('#')
+			} else {
+				b.WriteByte('.')
+			}
+		}
+		rows[y] = b.String()
+	}
+	return rows
+}
+
+func TestEncodeQR(t *testing.T) {
+	for _, test := range qrReferences {
+		q, err := encodeQR(test.text)
+		if err != nil {
+			t.Fatalf("encodeQR(%q): %v", test.text, err)
+		}
+		if want := 17 + 4*test.version; q.size != want {
+			t.Errorf("encodeQR(%q) is %d modules wide, want %d (version %d)", test.text, q.size, want, test.version)
+			continue
+		}
+		for y, row := range qrRows(q) {
+			if row != test.matrix[y] {
+				t.Errorf("encodeQR(%q) row %d:\n got %s\nwant %s", test.text, y, row, test.matrix[y])
+			}
+		}
+	}
+}
+
+func TestEncodeQRVersions(t *testing.T) {
+	tests := []struct {
+		length, version int
+	}{
+		{0, 1},
+		{14, 1}, // 16 data codewords, less the mode and count
+		{15, 2},
+		{180, 9},
+		{181, 10}, // From which the count takes 16 bits
+		{213, 10},
+	}
+	for _, test := range tests {
+		q, err := encodeQR(strings.Repeat("a", test.length))
+		if err != nil {
+			t.Errorf("encodeQR of %d bytes: %v", test.length, err)
+			continue
+		}
+		if want := 17 + 4*test.version; q.size != want {
+			t.Errorf("encodeQR of %d bytes is %d modules wide, want %d (version %d)", test.length, q.size, want, test.version)
+		}
+	}
+
+	if _, err := encodeQR(strings.Repeat("a", 214)); err == nil {
+		t.Error("encodeQR of 214 bytes succeeded, want an error")
+	}
+}
+
+func TestReedSolomonRemainder(t *testing.T) {
+	// The data of "HELLO WORLD" in alphanumeric mode at 1-M, from the
+	// standard's worked example
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := reedSolomonRemainder(data, reedSolomonDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("reedSolomonRemainder = %v, want %v", got, want)
+	}
+}
+
+// readQRBits reads n bits, most significant first, bit i from the module
+// at(i) returns
+func readQRBits(q *qrCode, n int, at func(i int) (x, y int)) string {
+	var b strings.Builder
+	for i := n - 1; i >= 0; i-- {
+		x, y := at(i)
+		if q.modules[y][x] {
+			b.WriteByte('1')
+		} else {
+			b.WriteByte('0')
+		}
+	}
+	return b.String()
+}
+
+func TestQRFormatBits(t *testing.T) {
+	// Level M's, by mask
+	want := []string{
+		"101010000010010",
+		"101000100100101",
+		"101111001111100",
+		"101101101001011",
+		"100010111111001",
+		"100000011001110",
+		"100111110010111",
+		"100101010100000",
+	}
+	q, _ := encodeQR("")
+	for mask, bits := range want {
+		q.drawFormatBits(mask)
+		// The copy along the bottom left and top right
+		got := readQRBits(q, 15, func(i int) (int, int) {
+			if i < 8 {
+				return q.size - 1 - i, 8
+			}
+			return 8, q.size - 15 + i
+		})
+		if got != bits {
+			t.Errorf("format bits of mask %d = %s, want %s", mask, got, bits)
+		}
+	}
+}
+
+func TestQRVersionBits(t *testing.T) {
+	want := map[int]string{
+		7:  "000111110010010100",
+		8:  "001000010110111100",
+		9:  "001001101010011001",
+		10: "001010010011010011",
+	}
+	for version, bits := range want {
+		q := newQRCode(version, 8, nil)
+		// The copy above the bottom left finder
+		got := readQRBits(q, 18, func(i int) (int, int) {
+			return i / 3, q.size - 11 + i%3
+		})
+		if got != bits {
+			t.Errorf("version %d bits = %s, want %s", version, got, bits)
+		}
+	}
+}
+
+func TestQRSVG(t *testing.T) {
+	q, _ := encodeQR("HELLO WORLD")
+	svg := q.svg()
+	if want := `viewBox="0 0 29 29"`; !strings.Contains(svg, want) {
+		t.Errorf("svg() has no %s", want)
+	}
+	// The top left module of the top left finder, inside the quiet zone
+	if want := fmt.Sprintf("M%d %dh1v1h-1z", qrQuietZone, qrQuietZone); !strings.Contains(svg, want) {
+		t.Errorf("svg() has no %s", want)
+	}
+}
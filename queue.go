@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Host sessions (own capture pipeline) running at once; co-op guests and
+// spectators do not count. Further offers wait in the queue.
+var maxSessions = 4
+
+// Queued offers must start listening for events within this time
+const queueAttachTimeout = 30 * time.Second
+
+// queueEntry is an offer waiting for a free session. The client keeps its
+// peer connection open and receives the answer once admitted.
+type queueEntry struct {
+	ID       string
+	req      OfferRequest
+	mapping  *MappingProfile
+	attached bool
+	events   chan sseEvent
+}
+
+// sseEvent is one Server-Sent Event; queued offers get "position",
+// "admitted" or "error"
+type sseEvent struct {
+	name string
+	data interface{}
+}
+
+func writeSSE(w http.ResponseWriter, flusher http.Flusher, ev sseEvent) {
+	data, _ := json.Marshal(ev.data)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.name, data)
+	flusher.Flush()
+}
+
+var (
+	waitQueue     []*queueEntry
+	waitQueueLock sync.Mutex
+	// startingSessions are admitted and starting outside waitQueueLock;
+	// they hold their place until registered
+	startingSessions int
+)
+
+func hostSessionCount() int {
+	sessionsLock.RLock()
+	defer sessionsLock.RUnlock()
+
+	count := 0
+	for _, session := range sessions {
+		if session.parent == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// hasRoomLocked must be called with waitQueueLock held
+func hasRoomLocked() bool {
+	return hostSessionCount()+startingSessions < maxSessions
+}
+
+// startAdmitted starts a session admitted under waitQueueLock, which the
+// caller counted in startingSessions and has released: capture and the
+// peer connection can take a while to start, and the queue must not wait
+func startAdmitted(req OfferRequest, mapping *MappingProfile) (*OfferResponse, error) {
+	resp, err := startSession(req, mapping)
+
+	waitQueueLock.Lock()
+	startingSessions--
+	waiting := len(waitQueue) > 0
+	waitQueueLock.Unlock()
+	// Its place may have been needed meanwhile, or be free again
+	if waiting {
+		go admitQueuedOffers()
+	}
+	return resp, err
+}
+
+// admitOrEnqueue starts the session when the host has room and nobody is
+// waiting; otherwise the offer is queued and entry is returned
+func admitOrEnqueue(req OfferRequest, mapping *MappingProfile) (*OfferResponse, *queueEntry, error) {
+	waitQueueLock.Lock()
+	if err := admissionError(); err != nil {
+		waitQueueLock.Unlock()
+		return nil, nil, err
+	}
+	if len(waitQueue) == 0 && hasRoomLocked() {
+		startingSessions++
+		waitQueueLock.Unlock()
+		resp, err := startAdmitted(req, mapping)
+		return resp, nil, err
+	}
+	defer waitQueueLock.Unlock()
+
+	entry := &queueEntry{
+		ID:      fmt.Sprintf("queue_%d", time.Now().UnixNano()),
+		req:     req,
+		mapping: mapping,
+		events:  make(chan sseEvent, 8),
+	}
+	waitQueue = append(waitQueue, entry)
+	log.Printf("Host full, offer queued as %s (position %d)", entry.ID, len(waitQueue))
+
+	time.AfterFunc(queueAttachTimeout, func() {
+		waitQueueLock.Lock()
+		defer waitQueueLock.Unlock()
+		if !entry.attached && removeQueueEntryLocked(entry.ID) {
+			log.Printf("Queued offer %s expired before the client listened", entry.ID)
+			broadcastQueuePositionsLocked()
+		}
+	})
+	return nil, entry, nil
+}
+
+var errHostFull = errors.New("host is full")
+
+// startIfRoom starts the session only when the host has room and nobody is
+// waiting, for callers that cannot wait in the queue
+func startIfRoom(req OfferRequest, mapping *MappingProfile) (*OfferResponse, error) {
+	waitQueueLock.Lock()
+	if err := admissionError(); err != nil {
+		waitQueueLock.Unlock()
+		return nil, err
+	}
+	if len(waitQueue) > 0 || !hasRoomLocked() {
+		waitQueueLock.Unlock()
+		return nil, errHostFull
+	}
+	startingSessions++
+	waitQueueLock.Unlock()
+	return startAdmitted(req, mapping)
+}
+
+// position is 1-based; 0 when no longer queued
+func (e *queueEntry) position() int {
+	for i, other := range waitQueue {
+		if other == e {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// send never blocks; a full buffer only loses position updates
+func (e *queueEntry) send(ev sseEvent) {
+	select {
+	case e.events <- ev:
+	default:
+	}
+}
+
+// removeQueueEntryLocked must be called with waitQueueLock held
+func removeQueueEntryLocked(id string) bool {
+	for i, entry := range waitQueue {
+		if entry.ID == id {
+			waitQueue = append(waitQueue[:i], waitQueue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// broadcastQueuePositionsLocked must be called with waitQueueLock held
+func broadcastQueuePositionsLocked() {
+	for i, entry := range waitQueue {
+		entry.send(sseEvent{"position", map[string]interface{}{
+			"position":     i + 1,
+			"queue_length": len(waitQueue),
+		}})
+	}
+}
+
+// admitQueuedOffers starts sessions for waiting clients, in order, while the
+// host has room. Entries whose client is not listening yet are skipped.
+func admitQueuedOffers() {
+	for {
+		waitQueueLock.Lock()
+		var next *queueEntry
+		if hasRoomLocked() && overloaded() == nil {
+			for _, entry := range waitQueue {
+				if entry.attached {
+					next = entry
+					break
+				}
+			}
+		}
+		if next == nil {
+			broadcastQueuePositionsLocked()
+			waitQueueLock.Unlock()
+			return
+		}
+		removeQueueEntryLocked(next.ID)
+		startingSessions++
+		waitQueueLock.Unlock()
+
+		resp, err := startAdmitted(next.req, next.mapping)
+		if err != nil {
+			next.send(sseEvent{"error", map[string]string{"error": "failed to start session"}})
+			continue
+		}
+		log.Printf("[Session %s] Admitted queued offer %s", resp.SessionID, next.ID)
+		next.send(sseEvent{"admitted", resp})
+	}
+}
+
+func queueLength() int {
+	waitQueueLock.Lock()
+	defer waitQueueLock.Unlock()
+	return len(waitQueue)
+}
+
+// handleQueueEvents streams a queued offer's position as Server-Sent Events
+// and finally the answer once admitted. Closing the stream leaves the queue.
+func handleQueueEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Streaming unsupported")
+		return
+	}
+
+	id := r.PathValue("id")
+	waitQueueLock.Lock()
+	var entry *queueEntry
+	for _, e := range waitQueue {
+		if e.ID == id && !e.attached {
+			entry = e
+		}
+	}
+	if entry != nil {
+		entry.attached = true
+		broadcastQueuePositionsLocked()
+	}
+	waitQueueLock.Unlock()
+
+	if entry == nil {
+		writeError(w, http.StatusNotFound, "queue_entry_not_found", "Queue entry not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	// A session may have freed up while the client was connecting
+	go admitQueuedOffers()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			waitQueueLock.Lock()
+			if removeQueueEntryLocked(entry.ID) {
+				log.Printf("Queued offer %s left the queue", entry.ID)
+				broadcastQueuePositionsLocked()
+			}
+			waitQueueLock.Unlock()
+			return
+
+		case ev := <-entry.events:
+			writeSSE(w, flusher, ev)
+			if ev.name != "position" {
+				return
+			}
+		}
+	}
+}
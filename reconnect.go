@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// A client whose network changed, Wi-Fi to mobile or a new address after a
+// blip, gets its session back by restarting ICE: it sends an offer made
+// with ICE restart to POST /sessions/{id}/reconnect, authorized by the
+// owner token the first offer returned, and the game plays on where it
+// was. The reconnect window is the disconnect grace of
+// session-timeouts.json: past it the session has ended.
+//
+// ICE itself gives up on the connection as the window closes, so a
+// Failed state never ends a session a reconnect could still save.
+
+const (
+	iceDisconnectedTimeout = 5 * time.Second // pion's default
+	iceKeepaliveInterval   = 2 * time.Second // pion's default
+)
+
+// applyICETimeouts has connections fail once the disconnect grace is over
+func applyICETimeouts() {
+	settingEngine.SetICETimeouts(iceDisconnectedTimeout, iceDisconnectedTimeout+disconnectGrace, iceKeepaliveInterval)
+}
+
+// ReconnectRequest is an offer that restarts ICE
+type ReconnectRequest struct {
+	SDP string `json:"sdp"`
+}
+
+// handleReconnect answers an ICE restart offer for the session's owner
+func handleReconnect(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found; the reconnect window may have passed")
+		return
+	}
+	if !session.canManage(r) {
+		writeError(w, http.StatusForbidden, "not_owner", "Only the session owner can reconnect")
+		return
+	}
+
+	var req ReconnectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+	if req.SDP == "" {
+		writeError(w, http.StatusBadRequest, "invalid_offer", "Missing SDP")
+		return
+	}
+
+	answer, err := session.restartICE(req.SDP)
+	if err != nil {
+		log.Printf("[Session %s] Error reconnecting: %v", session.ID, err)
+		writeErrorDetails(w, http.StatusBadRequest, "renegotiation_failed", "Error answering the offer", err.Error())
+		return
+	}
+	log.Printf("[Session %s] Reconnecting, was %s", session.ID, session.PC.ConnectionState())
+	auditRequest(r, "session_reconnect", "", nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type": answer.Type,
+		"sdp":  answer.SDP,
+	})
+}
+
+// restartICE answers offer, which should restart ICE, on the session's
+// connection
+func (s *StreamSession) restartICE(offer string) (*webrtc.SessionDescription, error) {
+	s.renegotiation.Lock()
+	defer s.renegotiation.Unlock()
+
+	if err := s.PC.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: hostFamilies.preferCandidates(offer)}); err != nil {
+		return nil, err
+	}
+	answer, err := s.PC.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.PC.SetLocalDescription(answer); err != nil {
+		return nil, err
+	}
+	return s.PC.LocalDescription(), nil
+}
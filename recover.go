@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// A panic in a session's goroutines or DataChannel callbacks ends that
+// session only; the other streams keep running
+var sessionPanics int64
+
+// sessionErrorFlushTimeout is how long a failing session waits for its
+// error message to be sent
+const sessionErrorFlushTimeout = time.Second
+
+// SessionErrorMessage tells the client on the "input" DataChannel that its
+// session is ending because of a server fault: a panic, or a capture that
+// never started
+type SessionErrorMessage struct {
+	Type  string `json:"type"` // "error"
+	Error string `json:"error"`
+}
+
+// recoverPanic must be deferred directly by the session's goroutines and
+// callbacks
+func (s *StreamSession) recoverPanic(where string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	atomic.AddInt64(&sessionPanics, 1)
+	stack := debug.Stack()
+	log.Printf("[Session %s] Panic in %s: %v\n%s", s.ID, where, r, stack)
+	if crashReports != nil {
+		crashReports.reportSessionPanic(s, where, r, stack)
+	}
+	s.crash()
+}
+
+// goSafe runs fn in a goroutine that takes down only this session if fn
+// panics
+func (s *StreamSession) goSafe(where string, fn func()) {
+	go func() {
+		defer s.recoverPanic(where)
+		fn()
+	}()
+}
+
+// crash ends the session after a panic. The panicking code may have held
+// the session mutex, so it is only tried.
+func (s *StreamSession) crash() {
+	if !s.crashed.CompareAndSwap(false, true) {
+		return
+	}
+
+	if s.mutex.TryRLock() {
+		dc := s.inputChannel
+		s.mutex.RUnlock()
+		if dc != nil {
+			sendJSON(dc, SessionErrorMessage{Type: "error", Error: "session ended by an internal error"})
+		}
+	}
+
+	s.Cancel()
+	// Closing from inside a pion callback can deadlock
+	go s.PC.Close()
+}
+
+// fail ends the session on a fault other than a panic and tells the client
+// why
+func (s *StreamSession) fail(reason string) {
+	auditSession(s, "session_error", map[string]interface{}{"error": reason})
+	s.endWithError(reason)
+}
+
+// endWithError ends the session, telling the client why
+func (s *StreamSession) endWithError(reason string) {
+	log.Printf("[Session %s] Ending session: %s", s.ID, reason)
+	s.mutex.RLock()
+	dc := s.inputChannel
+	s.mutex.RUnlock()
+	if dc != nil && sendJSON(dc, SessionErrorMessage{Type: "error", Error: reason}) == nil {
+		// Closing the connection would drop the message still queued
+		deadline := time.Now().Add(sessionErrorFlushTimeout)
+		for dc.BufferedAmount() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	endSession(s)
+}
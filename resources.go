@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// resources.json keeps the streamer from starving the game it streams: it
+// caps the Go runtime's memory and threads, and stops admitting sessions
+// while the host's CPU or memory is over a threshold. Sessions account the
+// memory of the FFmpeg processes they run, which is most of what a session
+// costs; the server's own memory is reported in /stats.
+
+var resourcesFile = "resources.json"
+
+const (
+	resourceSampleInterval = 5 * time.Second
+	// Seconds clients refused for load are told to wait
+	overloadRetryAfter = 30
+)
+
+type resourceLimits struct {
+	// MemoryLimitMB is the Go runtime's soft memory limit, as GOMEMLIMIT;
+	// 0 leaves GOMEMLIMIT's
+	MemoryLimitMB int `json:"memory_limit_mb"`
+	// MaxProcs caps the threads running Go code at once, as GOMAXPROCS;
+	// 0 leaves GOMAXPROCS's
+	MaxProcs int `json:"max_procs"`
+	// MaxCPUPercent and MaxMemoryPercent refuse new sessions while the
+	// host's use is over them; 0 for no threshold
+	MaxCPUPercent    float64 `json:"max_cpu_percent"`
+	MaxMemoryPercent float64 `json:"max_memory_percent"`
+}
+
+var hostResourceLimits resourceLimits
+
+func parseResourceLimits(data []byte) (resourceLimits, error) {
+	var l resourceLimits
+	if err := json.Unmarshal(data, &l); err != nil {
+		return l, err
+	}
+	switch {
+	case l.MemoryLimitMB < 0 || l.MaxProcs < 0:
+		return l, errors.New("memory_limit_mb and max_procs cannot be negative")
+	case l.MaxCPUPercent < 0 || l.MaxCPUPercent > 100 || l.MaxMemoryPercent < 0 || l.MaxMemoryPercent > 100:
+		return l, errors.New("max_cpu_percent and max_memory_percent must be between 0 and 100")
+	}
+	return l, nil
+}
+
+func loadResourceLimits() {
+	data, err := os.ReadFile(resourcesFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading resource limits: %v", err)
+		}
+		return
+	}
+	limits, err := parseResourceLimits(data)
+	if err != nil {
+		log.Printf("Ignoring %s: %v", resourcesFile, err)
+		return
+	}
+	hostResourceLimits = limits
+
+	if limits.MemoryLimitMB > 0 {
+		debug.SetMemoryLimit(int64(limits.MemoryLimitMB) << 20)
+		log.Printf("Go memory limit %d MB", limits.MemoryLimitMB)
+	}
+	if limits.MaxProcs > 0 {
+		runtime.GOMAXPROCS(limits.MaxProcs)
+		log.Printf("GOMAXPROCS %d", limits.MaxProcs)
+	}
+}
+
+// hostLoad is the host's CPU and memory use at the last sample, -1 when
+// unknown
+var hostLoad = struct {
+	sync.Mutex
+	cpuPercent, memoryPercent float64
+}{cpuPercent: -1, memoryPercent: -1}
+
+// sampleHostLoad measures the host's CPU and memory use every
+// resourceSampleInterval, and admits the offers queued while the host was
+// overloaded once it is not
+func sampleHostLoad() {
+	busyBefore, totalBefore, cpuErr := cpuTimes()
+	for range time.Tick(resourceSampleInterval) {
+		cpu := -1.0
+		busy, total, err := cpuTimes()
+		if err == nil && cpuErr == nil && total > totalBefore {
+			cpu = float64(busy-busyBefore) / float64(total-totalBefore) * 100
+		}
+		busyBefore, totalBefore, cpuErr = busy, total, err
+
+		memory := -1.0
+		if total, available, err := hostMemory(); err == nil && total > 0 {
+			memory = float64(total-available) / float64(total) * 100
+		}
+
+		wasOverloaded := overloaded() != nil
+		hostLoad.Lock()
+		hostLoad.cpuPercent, hostLoad.memoryPercent = cpu, memory
+		hostLoad.Unlock()
+		if err := overloaded(); err != nil && !wasOverloaded {
+			log.Printf("Warning: not admitting sessions: %v", err)
+		} else if err == nil && wasOverloaded {
+			log.Printf("Host load is back under its limits, admitting sessions")
+			go admitQueuedOffers()
+		}
+	}
+}
+
+// overloadError refuses a session while a resource is over its threshold
+type overloadError struct {
+	Resource string  `json:"resource"` // "cpu" or "memory"
+	Percent  float64 `json:"percent"`
+	Limit    float64 `json:"limit"`
+}
+
+func (e *overloadError) Error() string {
+	return fmt.Sprintf("Host %s use is %.0f%%, over its %.0f%% limit", e.Resource, e.Percent, e.Limit)
+}
+
+// overloaded returns why the host is too loaded to admit a session, or nil
+func overloaded() error {
+	hostLoad.Lock()
+	cpu, memory := hostLoad.cpuPercent, hostLoad.memoryPercent
+	hostLoad.Unlock()
+
+	limits := hostResourceLimits
+	switch {
+	case limits.MaxCPUPercent > 0 && cpu > limits.MaxCPUPercent:
+		return &overloadError{"cpu", cpu, limits.MaxCPUPercent}
+	case limits.MaxMemoryPercent > 0 && memory > limits.MaxMemoryPercent:
+		return &overloadError{"memory", memory, limits.MaxMemoryPercent}
+	}
+	return nil
+}
+
+func writeOverloaded(w http.ResponseWriter, err *overloadError) {
+	w.Header().Set("Retry-After", strconv.Itoa(overloadRetryAfter))
+	writeErrorDetails(w, http.StatusServiceUnavailable, "host_overloaded", err.Error(), err)
+}
+
+// resourceStats is the host's load and the server's own memory for /stats
+func resourceStats() map[string]interface{} {
+	hostLoad.Lock()
+	cpu, memory := hostLoad.cpuPercent, hostLoad.memoryPercent
+	hostLoad.Unlock()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := map[string]interface{}{
+		"go_memory_mb": mem.Sys >> 20,
+		"gomaxprocs":   runtime.GOMAXPROCS(0),
+	}
+	if cpu >= 0 {
+		stats["host_cpu_percent"] = cpu
+	}
+	if memory >= 0 {
+		stats["host_memory_percent"] = memory
+	}
+	return stats
+}
+
+// trackedProcess is a process a session started, accounted to it
+type trackedProcess struct {
+	process *os.Process
+	what    string
+}
+
+// trackProcess accounts a process to the session until it exits
+func (s *StreamSession) trackProcess(p *os.Process, what string) {
+	s.processLock.Lock()
+	defer s.processLock.Unlock()
+	s.processes = append(s.processes, trackedProcess{p, what})
+}
+
+// memoryUsage returns the resident memory of the session's processes, in
+// all and by what they do; processes that have exited are dropped
+func (s *StreamSession) memoryUsage() (total uint64, byWhat map[string]uint64) {
+	s.processLock.Lock()
+	defer s.processLock.Unlock()
+
+	byWhat = make(map[string]uint64)
+	running := s.processes[:0]
+	for _, p := range s.processes {
+		rss, err := processMemory(p.process)
+		if err != nil {
+			continue
+		}
+		running = append(running, p)
+		total += rss
+		byWhat[p.what] += rss
+	}
+	clear(s.processes[len(running):])
+	s.processes = running
+	return total, byWhat
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// hostMemory returns the host's memory and how much of it is available,
+// from /proc/meminfo
+func hostMemory() (total, available uint64, err error) {
+	values, err := procKilobytes("/proc/meminfo", "MemTotal:", "MemAvailable:")
+	if err != nil {
+		return 0, 0, err
+	}
+	return values[0], values[1], nil
+}
+
+// processMemory returns a running process's resident memory, from
+// /proc/<pid>/status; exited processes have none
+func processMemory(p *os.Process) (uint64, error) {
+	values, err := procKilobytes(fmt.Sprintf("/proc/%d/status", p.Pid), "VmRSS:")
+	if err != nil {
+		return 0, err
+	}
+	return values[0], nil
+}
+
+// procKilobytes reads the "Name:  1234 kB" lines of a /proc file, in bytes
+func procKilobytes(path string, names ...string) ([]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make([]uint64, len(names))
+	found := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		for i, name := range names {
+			if fields[0] == name {
+				kb, err := strconv.ParseUint(fields[1], 10, 64)
+				if err != nil {
+					return nil, err
+				}
+				values[i] = kb << 10
+				found++
+			}
+		}
+	}
+	if found < len(names) {
+		return nil, errors.New("unexpected " + path)
+	}
+	return values, nil
+}
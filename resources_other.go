@@ -0,0 +1,17 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func hostMemory() (total, available uint64, err error) {
+	return 0, 0, fmt.Errorf("host memory is not supported on %s", runtime.GOOS)
+}
+
+func processMemory(p *os.Process) (uint64, error) {
+	return 0, fmt.Errorf("process memory is not supported on %s", runtime.GOOS)
+}
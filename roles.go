@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Roles decide what a client may do with a session:
+//
+//   - admin: the host itself or a user with the admin permission; sees and
+//     manages every session
+//   - owner: holds the session's owner token or is the user who started it;
+//     manages that session
+//   - controller: a peer whose input reaches the host while it has control
+//   - viewer: a peer that joined with the "view" role; its input never
+//     reaches the host, whatever the owner grants
+//
+// The first two are roles of API clients, the other two of peers.
+const (
+	roleAdmin      = "admin"
+	roleOwner      = "owner"
+	roleController = "controller"
+	roleViewer     = "viewer"
+)
+
+var errViewerInput = errors.New("Viewers cannot send input")
+
+// isAdmin reports whether r comes from an admin
+func isAdmin(r *http.Request) bool {
+	if isHostRequest(r) {
+		return true
+	}
+	u := currentUser(r)
+	return u != nil && u.can(permAdmin)
+}
+
+// apiRole returns the role r has on the session: roleAdmin, roleOwner or
+// "" for none
+func (s *StreamSession) apiRole(r *http.Request) string {
+	if isAdmin(r) {
+		return roleAdmin
+	}
+	if s.isOwner(r) {
+		return roleOwner
+	}
+	if s.user != "" {
+		if u := currentUser(r); u != nil && strings.EqualFold(u.Name, s.user) {
+			return roleOwner
+		}
+	}
+	return ""
+}
+
+// canManage reports whether r may change or end the session
+func (s *StreamSession) canManage(r *http.Request) bool {
+	return s.apiRole(r) != ""
+}
+
+// peerRole returns the role of the session's peer
+func (s *StreamSession) peerRole() string {
+	if s.viewer {
+		return roleViewer
+	}
+	return roleController
+}
+
+// acceptsInput reports whether input from the session's peer may reach the
+// host. DataChannel handlers check it on every message.
+func (s *StreamSession) acceptsInput() bool {
+	return !s.viewer && s.control.Load()
+}
@@ -0,0 +1,683 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Rooms put one host session and its peers behind a short join code. The
+// owner starts the session by joining; everyone else joins as a co-op player
+// or spectator. Members only see member IDs, never raw session IDs.
+const (
+	roomCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" // No 0/O or 1/I
+	roomCodeLength   = 6
+	maxRooms         = 16
+	roomIdleTimeout  = 30 * time.Minute
+	maxChatHistory   = 50
+	maxChatLength    = 500
+	maxMemberName    = 32
+)
+
+type Room struct {
+	Code      string
+	CreatedAt time.Time
+	// GuestControl lets players other than the owner send input as soon as
+	// they join; otherwise the owner grants it per member
+	GuestControl bool
+
+	ownerToken string
+
+	mutex sync.Mutex
+	// Guarded by mutex
+	session    *StreamSession // Host session, nil until the owner joins
+	members    map[string]*RoomMember
+	chat       []ChatMessage
+	listeners  map[chan sseEvent]struct{}
+	lastActive time.Time
+	closed     bool
+}
+
+type RoomMember struct {
+	ID       string
+	Name     string
+	Role     string
+	Owner    bool
+	JoinedAt time.Time
+
+	token       string
+	session     *StreamSession // The host session or the member's co-op guest session
+	spectatorID string         // View-only members
+}
+
+type ChatMessage struct {
+	From     string `json:"from"`
+	MemberID string `json:"member_id,omitempty"`
+	Text     string `json:"text"`
+	Time     int64  `json:"time"` // Unix milliseconds
+}
+
+type CreateRoomRequest struct {
+	GuestControl bool `json:"guest_control"`
+}
+
+// RoomJoinRequest is an offer plus the member's display name. The owner's
+// first join starts the session and needs the full offer parameters; later
+// joins only use the controller fields.
+type RoomJoinRequest struct {
+	OfferRequest
+	Name string `json:"name"`
+}
+
+type RoomJoinResponse struct {
+	webrtc.SessionDescription
+	MemberID string `json:"member_id"`
+	// MemberToken authenticates chat and room events for this member
+	MemberToken string `json:"member_token"`
+	Role        string `json:"role"`
+	GamepadSlot int    `json:"gamepad_slot"`
+	Control     bool   `json:"control"`
+}
+
+var (
+	rooms     = make(map[string]*Room)
+	roomsLock sync.RWMutex
+)
+
+func generateRoomCode() string {
+	b := make([]byte, roomCodeLength)
+	rand.Read(b)
+	for i := range b {
+		b[i] = roomCodeAlphabet[int(b[i])%len(roomCodeAlphabet)]
+	}
+	return string(b)
+}
+
+func getRoom(code string) (*Room, bool) {
+	roomsLock.RLock()
+	defer roomsLock.RUnlock()
+	room, ok := rooms[strings.ToUpper(code)]
+	return room, ok
+}
+
+// requestToken returns the bearer token, or the "token" query parameter for
+// EventSource clients, which cannot set headers
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+func (room *Room) isOwner(r *http.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(requestToken(r)), []byte(room.ownerToken)) == 1
+}
+
+// memberLocked returns the member the request authenticates as, if any.
+// Must be called with room.mutex held.
+func (room *Room) memberLocked(r *http.Request) *RoomMember {
+	token := []byte(requestToken(r))
+	for _, member := range room.members {
+		if subtle.ConstantTimeCompare(token, []byte(member.token)) == 1 {
+			return member
+		}
+	}
+	return nil
+}
+
+// liveSessionLocked returns the running host session or nil
+func (room *Room) liveSessionLocked() *StreamSession {
+	if room.session == nil || room.session.ctx.Err() != nil {
+		return nil
+	}
+	return room.session
+}
+
+// broadcastLocked sends an event to every listener without blocking
+func (room *Room) broadcastLocked(name string, data interface{}) {
+	for ch := range room.listeners {
+		select {
+		case ch <- sseEvent{name, data}:
+		default:
+		}
+	}
+}
+
+func (m *RoomMember) info() map[string]interface{} {
+	info := map[string]interface{}{
+		"id":        m.ID,
+		"name":      m.Name,
+		"role":      m.Role,
+		"owner":     m.Owner,
+		"joined_at": m.JoinedAt.Format(time.RFC3339),
+	}
+	if m.session != nil {
+		info["control"] = m.session.control.Load()
+		info["gamepad_slot"] = m.session.GamepadSlot
+	}
+	return info
+}
+
+// live reports whether the member's peer is still connected to host
+func (m *RoomMember) live(host *StreamSession) bool {
+	if m.session != nil {
+		return m.session.ctx.Err() == nil
+	}
+	return host != nil && host.hasSpectator(m.spectatorID)
+}
+
+func handleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	var req CreateRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+
+	roomsLock.Lock()
+	if len(rooms) >= maxRooms {
+		roomsLock.Unlock()
+		writeErrorDetails(w, http.StatusServiceUnavailable, "room_limit", "Room limit reached", map[string]int{"limit": maxRooms})
+		return
+	}
+	code := generateRoomCode()
+	for rooms[code] != nil {
+		code = generateRoomCode()
+	}
+	room := &Room{
+		Code:         code,
+		CreatedAt:    time.Now(),
+		GuestControl: req.GuestControl,
+		ownerToken:   generateOwnerToken(),
+		members:      make(map[string]*RoomMember),
+		listeners:    make(map[chan sseEvent]struct{}),
+		lastActive:   time.Now(),
+	}
+	rooms[code] = room
+	roomsLock.Unlock()
+
+	log.Printf("[Room %s] Created", code)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":          code,
+		"owner_token":   room.ownerToken,
+		"guest_control": room.GuestControl,
+	})
+}
+
+func handleGetRoom(w http.ResponseWriter, r *http.Request) {
+	room, ok := getRoom(r.PathValue("code"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "room_not_found", "Room not found")
+		return
+	}
+
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	if !room.isOwner(r) && room.memberLocked(r) == nil {
+		writeError(w, http.StatusForbidden, "not_room_member", "Not a room member")
+		return
+	}
+
+	members := make([]map[string]interface{}, 0, len(room.members))
+	for _, member := range room.members {
+		members = append(members, member.info())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":          room.Code,
+		"created_at":    room.CreatedAt.Format(time.RFC3339),
+		"running":       room.liveSessionLocked() != nil,
+		"guest_control": room.GuestControl,
+		"members":       members,
+		"chat_messages": len(room.chat),
+	})
+}
+
+// handleJoinRoom answers a member's offer. The owner's join starts the room
+// session; other members join it as co-op players ("control") or
+// spectators ("view").
+func handleJoinRoom(w http.ResponseWriter, r *http.Request) {
+	room, ok := getRoom(r.PathValue("code"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "room_not_found", "Room not found")
+		return
+	}
+
+	var req RoomJoinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+
+	req.requestID = requestID(r)
+	owner := room.isOwner(r)
+	room.join(w, req, roomGrant{
+		owner:   owner,
+		start:   owner,
+		control: owner || room.GuestControl,
+		limits:  limitsFor(r),
+		user:    currentUser(r),
+	})
+}
+
+// roomGrant is what a joining peer is allowed to do in a room
+type roomGrant struct {
+	owner    bool   // Room owner: default name "Host", counts as owner member
+	start    bool   // May start the room session when it is not running
+	control  bool   // Co-op input reaches the host from the start
+	viewOnly bool   // Joins as a spectator whatever role it asks for
+	via      string // How the grant was obtained, for the log
+	// Bound the offer when the peer starts the session
+	limits offerLimits
+	user   *userAccount // Signed-in user, whose quota a start counts against
+}
+
+// join answers a member's offer according to grant and writes the response
+func (room *Room) join(w http.ResponseWriter, req RoomJoinRequest, grant roomGrant) {
+	if req.Role == "" {
+		req.Role = peerRoleControl
+	}
+	if req.Role != peerRoleControl && req.Role != peerRoleView {
+		writeError(w, http.StatusBadRequest, "invalid_role", "Invalid role")
+		return
+	}
+	if grant.viewOnly {
+		req.Role = peerRoleView
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "Player"
+		if grant.owner {
+			name = "Host"
+		}
+	}
+	if utf8.RuneCountInString(name) > maxMemberName {
+		writeError(w, http.StatusBadRequest, "name_too_long", "Name too long")
+		return
+	}
+
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	if room.closed {
+		writeError(w, http.StatusNotFound, "room_not_found", "Room not found")
+		return
+	}
+
+	member := &RoomMember{
+		ID:       fmt.Sprintf("member_%d", time.Now().UnixNano()),
+		Name:     name,
+		Role:     req.Role,
+		Owner:    grant.owner,
+		JoinedAt: time.Now(),
+		token:    generateOwnerToken(),
+	}
+	resp := RoomJoinResponse{
+		MemberID:    member.ID,
+		MemberToken: member.token,
+		Role:        req.Role,
+		GamepadSlot: -1,
+	}
+
+	host := room.liveSessionLocked()
+	switch {
+	case host == nil && grant.start:
+		mapping, err := validateOffer(&req.OfferRequest, grant.limits)
+		if err != nil {
+			writeOfferError(w, err)
+			return
+		}
+		if err := checkSessionQuota(grant.user); err != nil {
+			writeQuotaError(w, grant.user)
+			return
+		}
+		if grant.user != nil {
+			req.user = grant.user.Name
+		}
+		offer, err := startIfRoom(req.OfferRequest, mapping)
+		if errors.Is(err, errHostFull) {
+			writeErrorDetails(w, http.StatusServiceUnavailable, "host_full", "Host is full", map[string]int{"max_sessions": maxSessions})
+			return
+		}
+		if isDraining(err) {
+			writeDraining(w, err)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+			return
+		}
+		session, ok := getSession(offer.SessionID)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+			return
+		}
+		room.session = session
+		member.session = session
+		resp.SessionDescription = offer.SessionDescription
+		resp.GamepadSlot = offer.GamepadSlot
+		resp.Control = session.control.Load()
+		log.Printf("[Room %s] Session %s started", room.Code, session.ID)
+		room.broadcastLocked("session_started", nil)
+
+	case host == nil:
+		writeError(w, http.StatusConflict, "session_not_started", "Room session has not started")
+		return
+
+	case req.Role == peerRoleView:
+		watch, err := watchSession(host, req.SDP)
+		if errors.Is(err, errSpectatorLimit) {
+			writeErrorDetails(w, http.StatusServiceUnavailable, "spectator_limit", "Spectator limit reached", map[string]int{"limit": maxSpectatorsPerSession})
+			return
+		}
+		if errors.Is(err, errWatchThroughSFU) {
+			writeWatchThroughSFU(w)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+			return
+		}
+		member.spectatorID = watch.SpectatorID
+		resp.SessionDescription = watch.SessionDescription
+
+	default:
+		join := JoinRequest{
+			SDP:            req.SDP,
+			GamepadSlot:    req.GamepadSlot,
+			ControllerType: req.ControllerType,
+			MappingProfile: req.MappingProfile,
+		}
+		mapping, err := validateJoin(&join)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		offer, err := joinSession(host, join, mapping, grant.control)
+		if errors.Is(err, errNoFreeSlot) {
+			writeError(w, http.StatusServiceUnavailable, "no_free_slot", "No free controller slot")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+			return
+		}
+		guest, ok := getSession(offer.SessionID)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+			return
+		}
+		member.session = guest
+		resp.SessionDescription = offer.SessionDescription
+		resp.GamepadSlot = offer.GamepadSlot
+		resp.Control = guest.control.Load()
+	}
+
+	room.members[member.ID] = member
+	room.lastActive = time.Now()
+	room.broadcastLocked("member_joined", member.info())
+	if grant.via != "" {
+		log.Printf("[Room %s] %s joined as %s (%s) via %s", room.Code, member.ID, member.Name, member.Role, grant.via)
+	} else {
+		log.Printf("[Room %s] %s joined as %s (%s)", room.Code, member.ID, member.Name, member.Role)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleSetMemberControl lets the room owner grant or revoke a member's input
+func handleSetMemberControl(w http.ResponseWriter, r *http.Request) {
+	room, ok := getRoom(r.PathValue("code"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "room_not_found", "Room not found")
+		return
+	}
+	if !room.isOwner(r) {
+		writeError(w, http.StatusForbidden, "not_owner", "Only the room owner can change control")
+		return
+	}
+
+	var req struct {
+		Control bool `json:"control"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	member, ok := room.members[r.PathValue("member")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "member_not_found", "Member not found")
+		return
+	}
+	if member.session == nil {
+		writeError(w, http.StatusBadRequest, "invalid_role", "Spectators cannot send input")
+		return
+	}
+
+	if err := member.session.setControl(req.Control); err != nil {
+		writeError(w, http.StatusForbidden, "viewer", err.Error())
+		return
+	}
+	room.broadcastLocked("control", map[string]interface{}{
+		"member_id": member.ID,
+		"control":   req.Control,
+	})
+	log.Printf("[Room %s] Input control of %s set to %v", room.Code, member.ID, req.Control)
+	auditRequest(r, "control", member.ID, map[string]interface{}{
+		"room":    room.Code,
+		"session": member.session.ID,
+		"control": req.Control,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(member.info())
+}
+
+// handleRoomChat posts a chat message to every member
+func handleRoomChat(w http.ResponseWriter, r *http.Request) {
+	room, ok := getRoom(r.PathValue("code"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "room_not_found", "Room not found")
+		return
+	}
+
+	var req struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+	text := strings.TrimSpace(req.Text)
+	if text == "" {
+		writeError(w, http.StatusBadRequest, "empty_message", "Empty message")
+		return
+	}
+	if utf8.RuneCountInString(text) > maxChatLength {
+		writeErrorDetails(w, http.StatusBadRequest, "message_too_long", "Message too long", map[string]int{"max_length": maxChatLength})
+		return
+	}
+
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+
+	msg := ChatMessage{Text: text, Time: time.Now().UnixMilli()}
+	if member := room.memberLocked(r); member != nil {
+		msg.From = member.Name
+		msg.MemberID = member.ID
+	} else if room.isOwner(r) {
+		msg.From = "Host"
+	} else {
+		writeError(w, http.StatusForbidden, "not_room_member", "Not a room member")
+		return
+	}
+
+	room.chat = append(room.chat, msg)
+	if len(room.chat) > maxChatHistory {
+		room.chat = room.chat[len(room.chat)-maxChatHistory:]
+	}
+	room.lastActive = time.Now()
+	room.broadcastLocked("chat", msg)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+// handleRoomEvents streams chat, membership and control changes as
+// Server-Sent Events, starting with the chat history
+func handleRoomEvents(w http.ResponseWriter, r *http.Request) {
+	room, ok := getRoom(r.PathValue("code"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "room_not_found", "Room not found")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Streaming unsupported")
+		return
+	}
+
+	events := make(chan sseEvent, 32)
+	room.mutex.Lock()
+	if room.closed || (!room.isOwner(r) && room.memberLocked(r) == nil) {
+		room.mutex.Unlock()
+		writeError(w, http.StatusForbidden, "not_room_member", "Not a room member")
+		return
+	}
+	room.listeners[events] = struct{}{}
+	history := append([]ChatMessage(nil), room.chat...)
+	room.mutex.Unlock()
+
+	defer func() {
+		room.mutex.Lock()
+		delete(room.listeners, events)
+		room.mutex.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, msg := range history {
+		writeSSE(w, flusher, sseEvent{"chat", msg})
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			writeSSE(w, flusher, ev)
+		}
+	}
+}
+
+// handleCloseRoom ends the room and its session; for its owner and admins
+func handleCloseRoom(w http.ResponseWriter, r *http.Request) {
+	room, ok := getRoom(r.PathValue("code"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "room_not_found", "Room not found")
+		return
+	}
+	if !room.isOwner(r) && !isAdmin(r) {
+		writeError(w, http.StatusForbidden, "not_owner", "Only the room owner can close the room")
+		return
+	}
+
+	room.close("closed by owner")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// close ends the room session, with every guest and spectator, and
+// disconnects all listeners
+func (room *Room) close(reason string) {
+	room.mutex.Lock()
+	if room.closed {
+		room.mutex.Unlock()
+		return
+	}
+	room.closed = true
+	session := room.session
+	room.broadcastLocked("closed", map[string]string{"reason": reason})
+	for events := range room.listeners {
+		close(events)
+	}
+	room.listeners = nil
+	room.mutex.Unlock()
+
+	if session != nil {
+		session.Cancel()
+		session.PC.Close()
+	}
+
+	roomsLock.Lock()
+	delete(rooms, room.Code)
+	roomsLock.Unlock()
+	log.Printf("[Room %s] Closed: %s", room.Code, reason)
+}
+
+// prune drops members whose peer has left and notices the end of the room
+// session. It reports whether the room has been idle for too long.
+func (room *Room) prune() bool {
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+
+	if room.session != nil && room.session.ctx.Err() != nil {
+		log.Printf("[Room %s] Session %s ended", room.Code, room.session.ID)
+		var reason interface{}
+		if room.session.crashed.Load() {
+			reason = map[string]string{"reason": "internal error"}
+		}
+		room.session = nil
+		room.lastActive = time.Now()
+		room.broadcastLocked("session_ended", reason)
+	}
+	for id, member := range room.members {
+		if !member.live(room.session) {
+			delete(room.members, id)
+			room.lastActive = time.Now()
+			room.broadcastLocked("member_left", map[string]string{"id": id})
+			log.Printf("[Room %s] %s left", room.Code, id)
+		}
+	}
+
+	return room.session == nil && len(room.members) == 0 && len(room.listeners) == 0 &&
+		time.Since(room.lastActive) > roomIdleTimeout
+}
+
+func cleanupRooms() {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		roomsLock.RLock()
+		list := make([]*Room, 0, len(rooms))
+		for _, room := range rooms {
+			list = append(list, room)
+		}
+		roomsLock.RUnlock()
+
+		for _, room := range list {
+			if room.prune() {
+				room.close("idle")
+			}
+		}
+	}
+}
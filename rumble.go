@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// sendRumble forwards the gamepad's motor magnitudes, 0 to 1, to the
+// client if it opened the rumble channel
+func (s *StreamSession) sendRumble(strong, weak float64) {
+	s.mutex.RLock()
+	dc := s.rumbleChannel
+	s.mutex.RUnlock()
+	if dc == nil {
+		return
+	}
+
+	sendJSON(dc, RumbleMessage{
+		Type:   "rumble",
+		Strong: strong,
+		Weak:   weak,
+	})
+}
+
+// Rumble messages sent to the client on the "rumble" DataChannel.
+// Magnitudes are normalized to 0-1 to match the Gamepad API.
+type RumbleMessage struct {
+	Type   string  `json:"type"`
+	Strong float64 `json:"strong"`
+	Weak   float64 `json:"weak"`
+}
+
+func handleRumbleChannel(ctx context.Context, session *StreamSession, dc *webrtc.DataChannel) {
+	dc.OnOpen(func() {
+		defer session.recoverPanic("rumble channel")
+		if _, err := session.inputInjector(ctx); err != nil {
+			log.Printf("[Session %s] Error creating input injector for rumble: %v", session.ID, err)
+			dc.Close()
+			return
+		}
+
+		session.mutex.Lock()
+		session.rumbleChannel = dc
+		session.mutex.Unlock()
+		log.Printf("[Session %s] Rumble forwarding enabled", session.ID)
+	})
+
+	dc.OnClose(func() {
+		defer session.recoverPanic("rumble channel")
+		session.mutex.Lock()
+		if session.rumbleChannel == dc {
+			session.rumbleChannel = nil
+		}
+		session.mutex.Unlock()
+	})
+}
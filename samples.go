@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// Sources pace themselves at the session's frame rate, so the sample
+// writer sends every access unit it is given, timed by its PTS. Frames are
+// only discarded when the session's drop policy says so.
+const (
+	dropPolicyNone = "none"
+	// dropPolicyLatency trades smoothness for delay: once the queue backs
+	// up, frames are discarded until the next keyframe, which is
+	// requested, since the frames after a dropped one cannot be decoded
+	dropPolicyLatency = "latency"
+)
+
+// dropBacklog is the queue depth at which dropPolicyLatency skips ahead
+const dropBacklog = 4
+
+func validDropPolicy(policy string) bool {
+	return policy == dropPolicyNone || policy == dropPolicyLatency
+}
+
+// writeSamples drains the sample queue into the video track
+func writeSamples(session *StreamSession, track *webrtc.TrackLocalStaticSample, samples <-chan AccessUnit, fps int, dropPolicy string) {
+	clock := sampleClock{
+		rate:     float64(track.Codec().ClockRate),
+		interval: time.Second / time.Duration(fps),
+	}
+	skipping := false
+	frameCount := 0
+
+	for au := range samples {
+		dequeued := time.Now()
+		session.Stats.queueDepth.Store(int32(len(samples)))
+
+		// Muted frames are not sent; the picture resumes on a keyframe
+		if session.videoMuted.Load() {
+			skipping = true
+			continue
+		}
+
+		if dropPolicy == dropPolicyLatency && !skipping && len(samples) >= dropBacklog {
+			skipping = true
+			err := session.requestKeyframe()
+			if err != nil && !errors.Is(err, errKeyframeTooSoon) {
+				log.Printf("[Session %s] Error requesting keyframe: %v", session.ID, err)
+			}
+		}
+		if skipping {
+			if !au.Keyframe {
+				session.Stats.samplesThrottled.Add(1)
+				continue
+			}
+			skipping = false
+		}
+
+		if session.e2ee != nil {
+			au.Data = session.e2ee.encrypt(au.Data, vp8ClearBytes(au.Data))
+		}
+		err := writeAccessUnit(track, au, clock.duration(au.PTS))
+
+		session.Stats.samplesProcessed.Add(1)
+		frameCount++
+
+		if err != nil {
+			session.Stats.samplesDropped.Add(1)
+			if frameCount%100 == 0 { // Log every 100th error
+				log.Printf("[Session %s] Error writing sample: %v", session.ID, err)
+			}
+		} else {
+			session.Stats.samplesSent.Add(1)
+			session.Stats.bytesSent.Add(int64(len(au.Data)))
+			session.Stats.observeLatency(au, dequeued, time.Now())
+		}
+
+		// Log progress every 5 seconds
+		if frameCount%300 == 0 {
+			log.Printf("[Session %s] Frames processed: %d", session.ID, frameCount)
+		}
+	}
+}
+
+// sampleClock turns PTS into sample durations. pion stamps each sample
+// where the previous one's duration left its RTP clock, so a duration is
+// a guess at the next frame's PTS from the average interval, corrected by
+// what the previous guess missed.
+type sampleClock struct {
+	rate     float64 // RTP ticks per second
+	interval time.Duration
+
+	started  bool
+	firstPTS time.Duration
+	lastPTS  time.Duration
+	ticks    int64 // Where the next sample will be stamped
+}
+
+func (c *sampleClock) duration(pts time.Duration) time.Duration {
+	if !c.started {
+		c.started = true
+		c.firstPTS = pts
+	} else if delta := pts - c.lastPTS; delta > 0 && delta <= 4*c.interval {
+		// Longer gaps are dropped frames, not a new frame rate
+		c.interval += (delta - c.interval) / 8
+	}
+	c.lastPTS = pts
+
+	next := int64((pts-c.firstPTS+c.interval).Seconds()*c.rate + 0.5)
+	// Frames must not share a timestamp
+	ticks := max(next-c.ticks, int64(c.rate)/1000)
+	c.ticks += ticks
+	// pion truncates durations to ticks; half a tick more lands on ticks
+	return time.Duration((float64(ticks) + 0.5) / c.rate * float64(time.Second))
+}
+
+// writeAccessUnit sends one frame. pion packetizes AV1 an OBU at a time,
+// so its OBUs go separately with the frame's duration on the last.
+func writeAccessUnit(track *webrtc.TrackLocalStaticSample, au AccessUnit, duration time.Duration) error {
+	if track.Codec().MimeType != webrtc.MimeTypeAV1 {
+		return track.WriteSample(media.Sample{Data: au.Data, Duration: duration})
+	}
+	obus := av1Samples(au.Data)
+	for i, obu := range obus {
+		sample := media.Sample{Data: obu}
+		if i == len(obus)-1 {
+			sample.Duration = duration
+		}
+		if err := track.WriteSample(sample); err != nil {
+			return err
+		}
+	}
+	return nil
+}
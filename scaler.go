@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+)
+
+// A client showing the video smaller than the host captures it says so
+// with viewport_width and viewport_height, and the picture is downscaled
+// to fit before encoding instead of after decoding. A phone showing a
+// 1080p desktop in a 390 point wide window saves most of the bitrate.
+//
+// FFmpeg sources resize with the swscale algorithm scaler.json names,
+//
+//	{"algorithm": "lanczos"}
+//
+// and the in-process sources pick the nearest pixel.
+
+var scalerFile = "scaler.json"
+
+// minViewportHeight keeps tiny viewports from getting a picture too
+// small to read once the client zooms in
+const minViewportHeight = 144
+
+var scalerAlgorithms = []string{
+	"fast_bilinear", "bilinear", "bicubic", "neighbor", "area",
+	"bicublin", "gauss", "sinc", "lanczos", "spline",
+}
+
+var scaler = "bicubic"
+
+func loadScaler() {
+	data, err := os.ReadFile(scalerFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading scaler: %v", err)
+		}
+		return
+	}
+
+	var cfg struct {
+		Algorithm string `json:"algorithm"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Printf("Error parsing %s: %v", scalerFile, err)
+		return
+	}
+	if !slices.Contains(scalerAlgorithms, cfg.Algorithm) {
+		log.Printf("Ignoring %s, unknown algorithm %q", scalerFile, cfg.Algorithm)
+		return
+	}
+	scaler = cfg.Algorithm
+	log.Printf("Scaler: %s", scaler)
+}
+
+// scaleFilter resizes the picture to width by height
+func scaleFilter(width, height int) string {
+	return fmt.Sprintf("scale=%d:%d:flags=%s", width, height, scaler)
+}
+
+// viewportHeight returns the height a width by height picture is encoded
+// at for a viewport of vw by vh, which keeps the aspect ratio and only
+// ever scales down. A zero viewport side does not constrain it.
+func viewportHeight(width, height, vw, vh int) int {
+	scaled := height
+	if vw > 0 && vw < width {
+		scaled = min(scaled, height*vw/width)
+	}
+	if vh > 0 {
+		scaled = min(scaled, vh)
+	}
+	return max(scaled, min(height, minViewportHeight))
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lightsyr/chimera-go/chimeraclient"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+// chimera-go selftest streams from a running server into a WebRTC client
+// in this process, as a browser would, and checks that what arrives could
+// be decoded: the stream starts on a keyframe, no frame is missing a
+// packet, keyframes recur and one comes when asked for. It prints a line
+// per check and exits non-zero when one fails, for scripts and CI runs on
+// a real machine; -source testsrc needs no display.
+
+const (
+	selftestConnectTimeout  = 15 * time.Second
+	selftestKeyframeTimeout = 5 * time.Second
+	// Packets a frame may wait for its missing ones
+	selftestMaxLate = 256
+	// A stream is healthy from this share of the requested frame rate;
+	// desktop sources send fewer frames while the screen is still
+	selftestMinFPSShare = 0.5
+)
+
+// selftestFrame is a frame put together from the track's packets
+type selftestFrame struct {
+	at       time.Time
+	size     int
+	keyframe bool
+}
+
+type selftestCheck struct {
+	name   string
+	err    error
+	detail string
+}
+
+func runSelftestCommand(args []string) error {
+	flags := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	url := flags.String("url", "http://127.0.0.1:8080", "server to test")
+	source := flags.String("source", "", "capture source, the server's default when empty")
+	codec := flags.String("codec", defaultVideoCodec, "video codec")
+	width := flags.Int("width", 1280, "video width")
+	height := flags.Int("height", 720, "video height")
+	fps := flags.Int("fps", 30, "frame rate")
+	seconds := flags.Int("seconds", 10, "seconds to stream for")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return errors.New("usage: chimera-go selftest [-url url] [-source name] [-codec name] [-width n] [-height n] [-fps n] [-seconds n]")
+	}
+	// pion has no AV1 depacketizer to put its frames together with
+	if *codec != "h264" && *codec != "vp8" && *codec != "vp9" {
+		return fmt.Errorf("selftest checks h264, vp8 and vp9, not %q", *codec)
+	}
+	if *seconds < 4 || *fps < 1 {
+		return errors.New("seconds must be at least 4 and fps at least 1")
+	}
+
+	var checks []selftestCheck
+	check := func(name string, err error, detail string) {
+		checks = append(checks, selftestCheck{name, err, detail})
+		status := "PASS"
+		if err != nil {
+			status, detail = "FAIL", err.Error()
+		}
+		fmt.Printf("%-5s %-17s %s\n", status, name, detail)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selftestConnectTimeout+time.Duration(*seconds)*time.Second)
+	defer cancel()
+
+	frames := make(chan selftestFrame, 1024)
+	tracks := make(chan *webrtc.TrackRemote, 1)
+	var lostPackets atomic.Int64
+	connectStart := time.Now()
+	session, err := chimeraclient.New(*url).Connect(ctx, chimeraclient.Options{
+		Width:   *width,
+		Height:  *height,
+		FPS:     *fps,
+		Codec:   *codec,
+		Capture: *source,
+		OnTrack: func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+			select {
+			case tracks <- track:
+				go readSelftestFrames(track, frames, &lostPackets)
+			default:
+			}
+		},
+	})
+	if err != nil {
+		check("connect", err, "")
+		return errors.New("could not connect")
+	}
+	defer session.Close()
+	check("connect", nil, fmt.Sprintf("session %s", session.ID))
+
+	var track *webrtc.TrackRemote
+	select {
+	case track = <-tracks:
+	case <-ctx.Done():
+		check("track", errors.New("no video track"), "")
+		return errors.New("no video track")
+	}
+	mime := track.Codec().MimeType
+	if !strings.EqualFold(mime, "video/"+*codec) {
+		check("codec", fmt.Errorf("negotiated %s", mime), "")
+	} else {
+		check("codec", nil, mime)
+	}
+
+	// The first keyframe, which is the first picture a decoder can show,
+	// then half the run untouched to see keyframes recur, then a keyframe
+	// request and the rest of the run
+	var first selftestFrame
+	skipped := 0
+	deadline := time.After(selftestConnectTimeout)
+	for !first.keyframe {
+		select {
+		case first = <-frames:
+			if !first.keyframe {
+				skipped++
+				if skipped == 1 {
+					deadline = time.After(selftestKeyframeTimeout)
+				}
+			}
+		case <-deadline:
+			err := errors.New("no frame arrived")
+			if skipped > 0 {
+				err = fmt.Errorf("no keyframe among the first %d frames", skipped)
+			}
+			check("first picture", err, "")
+			return err
+		}
+	}
+	check("first picture", nil, fmt.Sprintf("keyframe after %v, %d frames before it, %d bytes",
+		first.at.Sub(connectStart).Round(time.Millisecond), skipped, first.size))
+
+	count, keyframes := 1, 0
+	half := time.After(time.Duration(*seconds) * time.Second / 2)
+	end := time.After(time.Duration(*seconds) * time.Second)
+	var requested, answered time.Time
+	for done := false; !done; {
+		select {
+		case f, ok := <-frames:
+			if !ok {
+				done = true
+				break
+			}
+			count++
+			if !f.keyframe {
+				break
+			}
+			if requested.IsZero() {
+				keyframes++
+			} else if answered.IsZero() {
+				answered = f.at
+			}
+		case <-half:
+			requested = time.Now()
+			if err := session.RequestKeyframe(ctx); err != nil {
+				check("keyframe request", err, "")
+			}
+		case <-end:
+			done = true
+		}
+	}
+	elapsed := time.Since(first.at).Seconds()
+
+	rate := float64(count) / elapsed
+	lost := lostPackets.Load()
+	switch {
+	case lost > 0:
+		check("frames", fmt.Errorf("%d frames, %d packets lost", count, lost), "")
+	case rate < selftestMinFPSShare*float64(*fps):
+		check("frames", fmt.Errorf("%d frames, %.1f fps of %d", count, rate, *fps), "")
+	default:
+		check("frames", nil, fmt.Sprintf("%d frames, %.1f fps, no packet lost", count, rate))
+	}
+
+	if keyframes == 0 {
+		check("keyframes", errors.New("none after the first"), "")
+	} else {
+		check("keyframes", nil, fmt.Sprintf("%d more in %ds", keyframes, *seconds/2))
+	}
+	switch {
+	case answered.IsZero():
+		check("keyframe request", errors.New("no keyframe came"), "")
+	case answered.Sub(requested) > selftestKeyframeTimeout:
+		check("keyframe request", fmt.Errorf("keyframe came after %v", answered.Sub(requested).Round(time.Millisecond)), "")
+	default:
+		check("keyframe request", nil, fmt.Sprintf("keyframe after %v", answered.Sub(requested).Round(time.Millisecond)))
+	}
+
+	failed := 0
+	for _, c := range checks {
+		if c.err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	fmt.Println("\nAll checks passed")
+	return nil
+}
+
+// readSelftestFrames puts the track's packets together into frames until
+// the track ends. Frames missing a packet are dropped and counted as lost.
+func readSelftestFrames(track *webrtc.TrackRemote, frames chan<- selftestFrame, lost *atomic.Int64) {
+	defer close(frames)
+	mime := track.Codec().MimeType
+	depacketizer := trackDepacketizer(mime)
+	if depacketizer == nil {
+		return
+	}
+
+	builder := samplebuilder.New(selftestMaxLate, depacketizer, track.Codec().ClockRate)
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		builder.Push(packet)
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			lost.Add(int64(sample.PrevDroppedPackets))
+			keyframe := receivedKeyframe(mime, sample.Data)
+			select {
+			case frames <- selftestFrame{at: time.Now(), size: len(sample.Data), keyframe: keyframe}:
+			default:
+			}
+		}
+	}
+}
+
+// trackDepacketizer puts frames of a received track's codec back together,
+// nil for AV1, which pion has no depacketizer for
+func trackDepacketizer(mime string) rtp.Depacketizer {
+	switch strings.ToLower(mime) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return &codecs.H264Packet{}
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return &codecs.VP8Packet{}
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return &codecs.VP9Packet{}
+	}
+	return nil
+}
+
+// receivedKeyframe reports whether a received frame is a keyframe a
+// decoder can start on
+func receivedKeyframe(mime string, frame []byte) bool {
+	switch strings.ToLower(mime) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		// Decoding starts from an IDR slice with the SPS and PPS ahead of it
+		var sps, pps bool
+		for _, nalu := range strings.Split(string(frame), "\x00\x00\x01") {
+			if nalu == "" {
+				continue
+			}
+			switch nalu[0] & 0x1f {
+			case 7:
+				sps = true
+			case 8:
+				pps = true
+			case 5:
+				return sps && pps
+			}
+		}
+		return false
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return len(frame) > 0 && ivfKeyframe("VP80", frame)
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return len(frame) > 0 && ivfKeyframe("VP90", frame)
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// On Linux the service is the example systemd units, installed for the
+// binary where it is: ExecStart runs it and WorkingDirectory, which holds
+// web/ and the host's files, is its directory. The socket unit holds the
+// ports across restarts.
+
+//go:embed systemd/chimera-go.service systemd/chimera-go.socket
+var systemdUnits embed.FS
+
+const systemdUnitDir = "/etc/systemd/system"
+
+var systemdUnitNames = []string{"chimera-go.socket", "chimera-go.service"}
+
+func runServiceCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: chimera-go service install|uninstall")
+	}
+	switch args[0] {
+	case "install":
+		return installService()
+	case "uninstall":
+		return uninstallService()
+	}
+	return fmt.Errorf("unknown service command %q", args[0])
+}
+
+func installService() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	for _, name := range systemdUnitNames {
+		if _, err := os.Stat(filepath.Join(systemdUnitDir, name)); err == nil {
+			return fmt.Errorf("%s is already installed", name)
+		}
+	}
+
+	for _, name := range systemdUnitNames {
+		unit, err := systemdUnits.ReadFile("systemd/" + name)
+		if err != nil {
+			return err
+		}
+		lines := strings.Split(string(unit), "\n")
+		for i, line := range lines {
+			switch {
+			case strings.HasPrefix(line, "ExecStart="):
+				lines[i] = "ExecStart=" + exe
+			case strings.HasPrefix(line, "WorkingDirectory="):
+				lines[i] = "WorkingDirectory=" + filepath.Dir(exe)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(systemdUnitDir, name), []byte(strings.Join(lines, "\n")), 0o644); err != nil {
+			return err
+		}
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	if err := systemctl(append([]string{"enable", "--now"}, systemdUnitNames...)...); err != nil {
+		return err
+	}
+	fmt.Printf("Service chimera-go installed and started, serving from %s\n", filepath.Dir(exe))
+	return nil
+}
+
+func uninstallService() error {
+	if _, err := os.Stat(filepath.Join(systemdUnitDir, "chimera-go.service")); err != nil {
+		return errors.New("service chimera-go is not installed")
+	}
+	if err := systemctl(append([]string{"disable", "--now"}, systemdUnitNames...)...); err != nil {
+		return err
+	}
+	for _, name := range systemdUnitNames {
+		if err := os.Remove(filepath.Join(systemdUnitDir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	fmt.Println("Service chimera-go uninstalled")
+	return nil
+}
+
+func systemctl(args ...string) error {
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
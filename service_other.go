@@ -0,0 +1,9 @@
+//go:build !windows && !linux
+
+package main
+
+import "errors"
+
+func runServiceCommand(args []string) error {
+	return errors.New("service mode is only available on Windows and Linux")
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// Windows service mode. Services run in session 0, which has no desktop to
+// capture or inject input into, so the service only supervises: it starts
+// chimera-go as SYSTEM in the active console session, restarts it when it
+// exits and moves it when the console changes session (logon after boot,
+// fast user switching).
+const (
+	serviceName         = "chimera-go"
+	serviceDisplayName  = "Chimera game streaming"
+	serviceRestartDelay = 5 * time.Second
+)
+
+// No session is attached to the console
+const noConsoleSession = 0xFFFFFFFF
+
+func runServiceCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: chimera-go service install|uninstall|run")
+	}
+	switch args[0] {
+	case "install":
+		return installService()
+	case "uninstall":
+		return uninstallService()
+	case "run":
+		return runService()
+	}
+	return fmt.Errorf("unknown service command %q", args[0])
+}
+
+func installService() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s is already installed", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: "Streams this computer's desktop and games to browsers.",
+		StartType:   mgr.StartAutomatic,
+	}, "service", "run")
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// The supervisor itself rarely fails; restart it if it does
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: serviceRestartDelay},
+		{Type: mgr.ServiceRestart, Delay: time.Minute},
+	}, uint32((24 * time.Hour).Seconds()))
+	if err != nil {
+		return err
+	}
+
+	// The source logging.json's event_log writes as
+	err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil && !strings.Contains(err.Error(), "registry key already exists") {
+		return err
+	}
+
+	if err := s.Start(); err != nil {
+		return err
+	}
+	fmt.Printf("Service %s installed and started\n", serviceName)
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+
+	if status, err := s.Control(svc.Stop); err == nil {
+		for deadline := time.Now().Add(10 * time.Second); status.State != svc.Stopped && time.Now().Before(deadline); {
+			time.Sleep(300 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				break
+			}
+		}
+	}
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	eventlog.Remove(serviceName) // Not there if it was installed before event_log
+	fmt.Printf("Service %s uninstalled\n", serviceName)
+	return nil
+}
+
+// runService is the entry point the service manager starts
+func runService() error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	if !isService {
+		return errors.New("run is started by the service manager; use install")
+	}
+
+	// Services start in System32; the server keeps its files next to the
+	// executable
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(filepath.Dir(exe)); err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile("chimera-go-service.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	log.SetOutput(logFile)
+	os.Setenv(serviceChildEnv, "1")
+
+	return svc.Run(serviceName, &serviceSupervisor{exe: exe})
+}
+
+type serviceSupervisor struct {
+	exe string
+}
+
+// serviceChild is the server running in a user session. Closing its job
+// ends the server and everything it started, such as server.py.
+type serviceChild struct {
+	process windows.Handle
+	job     windows.Handle
+	session uint32
+	exited  chan uint32
+	moving  bool // Ended to follow the console to another session
+}
+
+func (sv *serviceSupervisor) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.AcceptSessionChange}
+	log.Printf("[Service] Running")
+
+	var child *serviceChild
+	var exited chan uint32
+	restart := time.NewTimer(0)
+	defer restart.Stop()
+
+	for {
+		select {
+		case <-restart.C:
+			session := windows.WTSGetActiveConsoleSessionId()
+			if session == noConsoleSession {
+				restart.Reset(serviceRestartDelay)
+				continue
+			}
+			c, err := startInSession(sv.exe, session)
+			if err != nil {
+				log.Printf("[Service] Error starting server in session %d: %v", session, err)
+				restart.Reset(serviceRestartDelay)
+				continue
+			}
+			child, exited = c, c.exited
+			log.Printf("[Service] Server started in session %d", session)
+
+		case code := <-exited:
+			child.close()
+			if child.moving {
+				restart.Reset(0)
+			} else {
+				log.Printf("[Service] Server exited with code %d; restarting in %v", code, serviceRestartDelay)
+				restart.Reset(serviceRestartDelay)
+			}
+			child, exited = nil, nil
+
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				if child != nil {
+					windows.TerminateJobObject(child.job, 0)
+					<-exited
+					child.close()
+				}
+				log.Printf("[Service] Stopped")
+				return false, 0
+			case svc.SessionChange:
+				if req.EventType != windows.WTS_CONSOLE_CONNECT && req.EventType != windows.WTS_SESSION_LOGON {
+					continue
+				}
+				if child != nil && child.session != windows.WTSGetActiveConsoleSessionId() {
+					log.Printf("[Service] Console changed session; moving the server")
+					child.moving = true
+					windows.TerminateJobObject(child.job, 0)
+				}
+			}
+		}
+	}
+}
+
+// startInSession runs exe as SYSTEM on the interactive desktop of session,
+// with a hidden console its console children share instead of opening
+// windows of their own
+func startInSession(exe string, session uint32) (*serviceChild, error) {
+	var self windows.Token
+	if err := windows.OpenProcessToken(windows.CurrentProcess(), windows.TOKEN_ALL_ACCESS, &self); err != nil {
+		return nil, err
+	}
+	defer self.Close()
+
+	var token windows.Token
+	if err := windows.DuplicateTokenEx(self, windows.MAXIMUM_ALLOWED, nil,
+		windows.SecurityImpersonation, windows.TokenPrimary, &token); err != nil {
+		return nil, err
+	}
+	defer token.Close()
+	if err := windows.SetTokenInformation(token, windows.TokenSessionId,
+		(*byte)(unsafe.Pointer(&session)), uint32(unsafe.Sizeof(session))); err != nil {
+		return nil, err
+	}
+
+	job, err := newKillOnCloseJob()
+	if err != nil {
+		return nil, err
+	}
+
+	si := &windows.StartupInfo{
+		Desktop:    windows.StringToUTF16Ptr(`winsta0\default`),
+		Flags:      windows.STARTF_USESHOWWINDOW,
+		ShowWindow: windows.SW_HIDE,
+	}
+	si.Cb = uint32(unsafe.Sizeof(*si))
+	var pi windows.ProcessInformation
+	err = windows.CreateProcessAsUser(token, nil,
+		windows.StringToUTF16Ptr(windows.EscapeArg(exe)), nil, nil, false,
+		windows.CREATE_SUSPENDED|windows.CREATE_NEW_CONSOLE, nil,
+		windows.StringToUTF16Ptr(filepath.Dir(exe)), si, &pi)
+	if err != nil {
+		windows.CloseHandle(job)
+		return nil, err
+	}
+	defer windows.CloseHandle(pi.Thread)
+
+	// Join the job before the server runs so nothing it starts escapes
+	if err := windows.AssignProcessToJobObject(job, pi.Process); err != nil {
+		windows.TerminateProcess(pi.Process, 1)
+		windows.CloseHandle(pi.Process)
+		windows.CloseHandle(job)
+		return nil, err
+	}
+	windows.ResumeThread(pi.Thread)
+
+	child := &serviceChild{
+		process: pi.Process,
+		job:     job,
+		session: session,
+		exited:  make(chan uint32, 1),
+	}
+	go func() {
+		windows.WaitForSingleObject(child.process, windows.INFINITE)
+		var code uint32
+		windows.GetExitCodeProcess(child.process, &code)
+		child.exited <- code
+	}()
+	return child, nil
+}
+
+func (c *serviceChild) close() {
+	windows.CloseHandle(c.job)
+	windows.CloseHandle(c.process)
+}
+
+// newKillOnCloseJob creates a job whose processes end when it is closed
+func newKillOnCloseJob() (windows.Handle, error) {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{}
+	info.BasicLimitInformation.LimitFlags = windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE
+	if _, err := windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info))); err != nil {
+		windows.CloseHandle(job)
+		return 0, err
+	}
+	return job, nil
+}
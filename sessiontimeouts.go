@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Sessions end as their peer connection does: at once when it fails or
+// closes, and after a grace period when it disconnects, which a network
+// blip recovers from on its own and a changed network through a reconnect,
+// see reconnect.go. A peer that never connects at all, a client that sent
+// its offer and went away, ends its session after the connect timeout.
+// session-timeouts.json sets both, and how late a heartbeat may be, see
+// heartbeat.go:
+//
+//	{"disconnect_grace_seconds": 10, "connect_timeout_seconds": 30, "heartbeat_timeout_ms": 2000}
+
+var sessionTimeoutsFile = "session-timeouts.json"
+
+var (
+	disconnectGrace = 10 * time.Second
+	connectTimeout  = 30 * time.Second
+)
+
+func loadSessionTimeouts() {
+	data, err := os.ReadFile(sessionTimeoutsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading session timeouts: %v", err)
+		}
+		return
+	}
+
+	var cfg struct {
+		DisconnectGraceSeconds int `json:"disconnect_grace_seconds"`
+		ConnectTimeoutSeconds  int `json:"connect_timeout_seconds"`
+		HeartbeatTimeoutMs     int `json:"heartbeat_timeout_ms"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Printf("Error parsing %s: %v", sessionTimeoutsFile, err)
+		return
+	}
+	if cfg.DisconnectGraceSeconds < 0 || cfg.ConnectTimeoutSeconds < 0 || cfg.HeartbeatTimeoutMs < 0 {
+		log.Printf("Ignoring %s, timeouts must not be negative", sessionTimeoutsFile)
+		return
+	}
+	if cfg.DisconnectGraceSeconds > 0 {
+		disconnectGrace = time.Duration(cfg.DisconnectGraceSeconds) * time.Second
+	}
+	if cfg.ConnectTimeoutSeconds > 0 {
+		connectTimeout = time.Duration(cfg.ConnectTimeoutSeconds) * time.Second
+	}
+	if cfg.HeartbeatTimeoutMs > 0 {
+		heartbeatTimeout = time.Duration(cfg.HeartbeatTimeoutMs) * time.Millisecond
+	}
+	log.Printf("Sessions end %v after a disconnect, or %v after the offer if never connected", disconnectGrace, connectTimeout)
+}
+
+// followConnectionState calls end when the session's peer connection is
+// over. Called with PeerConnectionStateNew as the session starts, it starts
+// the connect timeout and keeps end for the heartbeat. end may be called
+// more than once.
+func (s *StreamSession) followConnectionState(state webrtc.PeerConnectionState, end func()) {
+	switch state {
+	case webrtc.PeerConnectionStateNew:
+		s.endConnection = end
+		s.endAfter(connectTimeout, "never connected", end)
+	case webrtc.PeerConnectionStateConnected:
+		s.stopEndTimer()
+	case webrtc.PeerConnectionStateDisconnected:
+		s.endAfter(disconnectGrace, "did not reconnect", end)
+	case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+		s.stopEndTimer()
+		end()
+	}
+}
+
+// endAfter ends the session in d unless the timer is stopped or replaced
+// first
+func (s *StreamSession) endAfter(d time.Duration, why string, end func()) {
+	s.endTimerLock.Lock()
+	defer s.endTimerLock.Unlock()
+	if s.endTimer != nil {
+		s.endTimer.Stop()
+	}
+	s.endTimer = time.AfterFunc(d, func() {
+		defer s.recoverPanic("connection timeout")
+		log.Printf("[Session %s] Peer %s within %v, ending session", s.ID, why, d)
+		end()
+	})
+}
+
+func (s *StreamSession) stopEndTimer() {
+	s.endTimerLock.Lock()
+	defer s.endTimerLock.Unlock()
+	if s.endTimer != nil {
+		s.endTimer.Stop()
+		s.endTimer = nil
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// With sfu.json the host publishes sessions to an external SFU over WHIP,
+// which LiveKit's ingress and Janus's WHIP server both accept, and the SFU
+// fans the stream out to its viewers. The host still captures, encodes and
+// injects the player's input through the session's own peer; viewers watch
+// through the SFU rather than as spectators of the host. The SFU is sent
+// the one encoding the session streams, so it has no simulcast layers to
+// pick between unless it transcodes.
+
+var sfuFile = "sfu.json"
+
+const sfuTimeout = 10 * time.Second
+
+type sfuConfig struct {
+	// WHIPURL is the SFU's WHIP endpoint
+	WHIPURL string `json:"whip_url"`
+	// Token is sent as the bearer token, e.g. a LiveKit ingress stream key
+	Token string `json:"token"`
+	// ViewerURL is where viewers watch, given to those who try to spectate
+	ViewerURL string `json:"viewer_url"`
+	// DirectViewers keeps accepting spectators on the host as well
+	DirectViewers bool `json:"direct_viewers"`
+}
+
+// sfu is nil unless sfu.json configures publishing
+var sfu *sfuConfig
+
+func loadSFU() {
+	data, err := os.ReadFile(sfuFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading SFU config: %v", err)
+		}
+		return
+	}
+
+	var cfg sfuConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Printf("Error parsing %s: %v", sfuFile, err)
+		return
+	}
+	endpoint, err := url.Parse(cfg.WHIPURL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		log.Printf("Ignoring %s: whip_url must be an http or https URL", sfuFile)
+		return
+	}
+	sfu = &cfg
+	log.Printf("SFU: publishing sessions to %s", endpoint.Redacted())
+}
+
+// sfuPublisher is a session's peer connection to the SFU
+type sfuPublisher struct {
+	pc       *webrtc.PeerConnection
+	resource string // WHIP resource of the stream, deleted to end it
+	started  time.Time
+}
+
+var (
+	errSFUDisabled   = errors.New("publishing to an SFU is not configured")
+	errSFUPublishing = errors.New("session is already published")
+	errSFUGuest      = errors.New("co-op guests are published with their host")
+)
+
+// publish sends the session's track to the SFU until the session ends or
+// unpublish is called
+func (s *StreamSession) publish() error {
+	if sfu == nil {
+		return errSFUDisabled
+	}
+	if s.parent != nil {
+		return errSFUGuest
+	}
+	s.publishing.Lock()
+	defer s.publishing.Unlock()
+
+	s.mutex.RLock()
+	published := s.publisher != nil
+	s.mutex.RUnlock()
+	if published {
+		return errSFUPublishing
+	}
+
+	pc, err := newPeerConnection(webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{URLs: []string{"stun:stun.l.google.com:19302"}},
+			{URLs: []string{"stun:stun1.l.google.com:19302"}},
+		},
+	}, s.colors)
+	if err != nil {
+		return err
+	}
+	transceiver, err := pc.AddTransceiverFromTrack(s.track(), webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionSendonly,
+	})
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	// WHIP has no trickle here: the offer goes out with every candidate
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		pc.Close()
+		return err
+	}
+	select {
+	case <-gathered:
+	case <-time.After(sfuTimeout):
+		pc.Close()
+		return errors.New("timed out gathering ICE candidates")
+	}
+
+	answer, resource, err := whipOffer(pc.LocalDescription().SDP)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		pc.Close()
+		whipDelete(resource)
+		return err
+	}
+
+	publisher := &sfuPublisher{pc: pc, resource: resource, started: time.Now()}
+	s.mutex.Lock()
+	s.publisher = publisher
+	s.mutex.Unlock()
+	log.Printf("[Session %s] Publishing to the SFU", s.ID)
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		defer s.recoverPanic("SFU connection state handler")
+		log.Printf("[Session %s] SFU connection state: %s", s.ID, state.String())
+		if state == webrtc.PeerConnectionStateFailed {
+			go s.unpublish(publisher)
+		}
+	})
+	// The SFU asks for a keyframe whenever a viewer joins
+	s.goSafe("SFU RTCP reader", func() {
+		for {
+			packets, _, err := transceiver.Sender().ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, packet := range packets {
+				switch packet.(type) {
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					s.requestKeyframe()
+				}
+			}
+		}
+	})
+	s.goSafe("SFU publisher", func() {
+		<-s.ctx.Done()
+		s.unpublish(publisher)
+	})
+	return nil
+}
+
+// unpublish ends the session's stream on the SFU, if it is still publisher
+func (s *StreamSession) unpublish(publisher *sfuPublisher) bool {
+	s.mutex.Lock()
+	if s.publisher == nil || (publisher != nil && s.publisher != publisher) {
+		s.mutex.Unlock()
+		return false
+	}
+	publisher = s.publisher
+	s.publisher = nil
+	s.mutex.Unlock()
+
+	publisher.pc.Close()
+	whipDelete(publisher.resource)
+	log.Printf("[Session %s] Stopped publishing to the SFU", s.ID)
+	return true
+}
+
+func (s *StreamSession) publisherInfo() map[string]interface{} {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.publisher == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"state":   s.publisher.pc.ConnectionState().String(),
+		"started": s.publisher.started.Unix(),
+	}
+}
+
+// whipOffer posts an SDP offer to the WHIP endpoint and returns the answer
+// and the URL of the resource it created
+func whipOffer(sdp string) (answer, resource string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sfuTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sfu.WHIPURL, bytes.NewBufferString(sdp))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	if sfu.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+sfu.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", "", fmt.Errorf("WHIP endpoint answered %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return "", "", fmt.Errorf("WHIP endpoint gave no resource: %v", err)
+	}
+	return string(body), location.String(), nil
+}
+
+// whipDelete ends a WHIP resource; the SFU times it out anyway if this fails
+func whipDelete(resource string) {
+	ctx, cancel := context.WithTimeout(context.Background(), sfuTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, resource, nil)
+	if err != nil {
+		return
+	}
+	if sfu.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+sfu.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Error ending WHIP resource %s: %v", resource, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// watchThroughSFU reports whether viewers are sent to the SFU instead of
+// spectating the host
+func watchThroughSFU() bool {
+	return sfu != nil && !sfu.DirectViewers
+}
+
+func writeWatchThroughSFU(w http.ResponseWriter) {
+	var details interface{}
+	if sfu.ViewerURL != "" {
+		details = map[string]string{"viewer_url": sfu.ViewerURL}
+	}
+	writeErrorDetails(w, http.StatusConflict, "watch_through_sfu", "Viewers watch through the SFU", details)
+}
+
+func handlePublish(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	if !session.canManage(r) {
+		writeError(w, http.StatusForbidden, "not_owner", "Only the session owner can publish it")
+		return
+	}
+
+	err := session.publish()
+	switch {
+	case errors.Is(err, errSFUDisabled):
+		writeError(w, http.StatusNotFound, "sfu_disabled", "Publishing to an SFU is not configured")
+		return
+	case errors.Is(err, errSFUPublishing), errors.Is(err, errSFUGuest):
+		writeError(w, http.StatusConflict, "already_published", err.Error())
+		return
+	case err != nil:
+		log.Printf("[Session %s] Error publishing to the SFU: %v", session.ID, err)
+		writeErrorDetails(w, http.StatusBadGateway, "sfu_unreachable", "Error publishing to the SFU", err.Error())
+		return
+	}
+	auditRequest(r, "sfu_publish", session.ID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id": session.ID,
+		"sfu":        session.publisherInfo(),
+		"viewer_url": sfu.ViewerURL,
+	})
+}
+
+func handleUnpublish(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	if !session.canManage(r) {
+		writeError(w, http.StatusForbidden, "not_owner", "Only the session owner can unpublish it")
+		return
+	}
+	if !session.unpublish(nil) {
+		writeError(w, http.StatusConflict, "not_published", "Session is not published")
+		return
+	}
+	auditRequest(r, "sfu_unpublish", session.ID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id": session.ID,
+		"sfu":        nil,
+	})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Share links let an owner hand out access to a session or room without
+// handing out the owner token. The link carries signed, expiring claims;
+// nothing is stored server-side, so links stay valid until they expire or
+// the server restarts with a new key.
+const (
+	defaultShareTTL = time.Hour
+	maxShareTTL     = 24 * time.Hour
+)
+
+// Signs share links; generated per process
+var shareLinkKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// shareTokenHeader carries a share link to endpoints addressed by session
+// ID, such as joining as a co-op player
+const shareTokenHeader = "X-Share-Token"
+
+var (
+	errInvalidShareToken = errors.New("invalid share link")
+	errShareExpired      = errors.New("share link expired")
+)
+
+// shareClaims is the signed payload of a share link. Exactly one of Session
+// and Room is set.
+type shareClaims struct {
+	Session string `json:"s,omitempty"`
+	Room    string `json:"r,omitempty"`
+	Role    string `json:"p"`            // peerRoleView or peerRoleControl
+	Start   bool   `json:"st,omitempty"` // May start the room session
+	Expires int64  `json:"exp"`          // Unix seconds
+}
+
+// ShareRequest asks for a share link; TTLSeconds defaults to an hour
+type ShareRequest struct {
+	Role       string `json:"role"`
+	Start      bool   `json:"start"`
+	TTLSeconds int    `json:"ttl_seconds"`
+}
+
+func (req *ShareRequest) validate() error {
+	if req.Role == "" {
+		req.Role = peerRoleView
+	}
+	if req.Role != peerRoleControl && req.Role != peerRoleView {
+		return errors.New("Invalid role")
+	}
+	if req.Start && req.Role != peerRoleControl {
+		return errors.New("Starting the session requires the control role")
+	}
+	if req.TTLSeconds < 0 || time.Duration(req.TTLSeconds)*time.Second > maxShareTTL {
+		return errors.New("Invalid ttl_seconds")
+	}
+	return nil
+}
+
+func (req *ShareRequest) ttl() time.Duration {
+	if req.TTLSeconds == 0 {
+		return defaultShareTTL
+	}
+	return time.Duration(req.TTLSeconds) * time.Second
+}
+
+func signShareToken(claims shareClaims) string {
+	payload, _ := json.Marshal(claims)
+	mac := hmac.New(sha256.New, shareLinkKey)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifyShareToken(token string) (*shareClaims, error) {
+	encPayload, encSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errInvalidShareToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return nil, errInvalidShareToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encSig)
+	if err != nil {
+		return nil, errInvalidShareToken
+	}
+	mac := hmac.New(sha256.New, shareLinkKey)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errInvalidShareToken
+	}
+
+	var claims shareClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidShareToken
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return nil, errShareExpired
+	}
+	return &claims, nil
+}
+
+// sessionShare returns the claims of the share link r carries for
+// session, or nil if it carries none valid for it
+func sessionShare(r *http.Request, session *StreamSession) *shareClaims {
+	token := r.Header.Get(shareTokenHeader)
+	if token == "" {
+		return nil
+	}
+	claims, err := verifyShareToken(token)
+	if err != nil || claims.Session != session.ID {
+		return nil
+	}
+	return claims
+}
+
+// writeShareLink signs claims and responds with the link to the web client
+func writeShareLink(w http.ResponseWriter, r *http.Request, claims shareClaims) {
+	token := signShareToken(claims)
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      token,
+		"url":        fmt.Sprintf("%s://%s%s?share=%s", scheme, r.Host, webPrefix, token),
+		"role":       claims.Role,
+		"start":      claims.Start,
+		"expires_at": time.Unix(claims.Expires, 0).Format(time.RFC3339),
+	})
+}
+
+// handleShareSession creates a link to watch or co-op join a session
+func handleShareSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSession(r.PathValue("id"))
+	if !ok || session.parent != nil {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	if !session.canManage(r) {
+		writeError(w, http.StatusForbidden, "not_owner", "Only the session owner can share it")
+		return
+	}
+
+	var req ShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if req.Start {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Sessions are already started; share a room instead")
+		return
+	}
+
+	log.Printf("[Session %s] Share link created (%s, %s)", session.ID, req.Role, req.ttl())
+	auditRequest(r, "share_create", session.ID, map[string]interface{}{"role": req.Role, "ttl": req.ttl().String()})
+	writeShareLink(w, r, shareClaims{
+		Session: session.ID,
+		Role:    req.Role,
+		Expires: time.Now().Add(req.ttl()).Unix(),
+	})
+}
+
+// handleShareRoom creates a link to join a room, optionally allowed to
+// start its session
+func handleShareRoom(w http.ResponseWriter, r *http.Request) {
+	room, ok := getRoom(r.PathValue("code"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "room_not_found", "Room not found")
+		return
+	}
+	if !room.isOwner(r) {
+		writeError(w, http.StatusForbidden, "not_owner", "Only the room owner can share it")
+		return
+	}
+
+	var req ShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	log.Printf("[Room %s] Share link created (%s, start=%v, %s)", room.Code, req.Role, req.Start, req.ttl())
+	auditRequest(r, "share_create", room.Code, map[string]interface{}{"role": req.Role, "start": req.Start, "ttl": req.ttl().String()})
+	writeShareLink(w, r, shareClaims{
+		Room:    room.Code,
+		Role:    req.Role,
+		Start:   req.Start,
+		Expires: time.Now().Add(req.ttl()).Unix(),
+	})
+}
+
+// handleRedeemShare answers an offer sent with a share link. The link's
+// role caps what the peer gets: view links always make a spectator.
+func handleRedeemShare(w http.ResponseWriter, r *http.Request) {
+	claims, err := verifyShareToken(r.PathValue("token"))
+	if err != nil {
+		writeError(w, http.StatusForbidden, "invalid_share_link", err.Error())
+		return
+	}
+
+	var req RoomJoinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+	req.requestID = requestID(r)
+
+	if claims.Room != "" {
+		room, ok := getRoom(claims.Room)
+		if !ok {
+			writeError(w, http.StatusNotFound, "room_not_found", "Room not found")
+			return
+		}
+		room.join(w, req, roomGrant{
+			start:    claims.Start,
+			control:  claims.Role == peerRoleControl,
+			viewOnly: claims.Role == peerRoleView,
+			via:      "share link",
+			limits:   limitsFor(r),
+			user:     currentUser(r),
+		})
+		return
+	}
+
+	host, ok := getSession(claims.Session)
+	if !ok || host.ctx.Err() != nil {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+
+	if claims.Role == peerRoleView || req.Role == peerRoleView {
+		resp, err := watchSession(host, req.SDP)
+		if errors.Is(err, errSpectatorLimit) {
+			writeErrorDetails(w, http.StatusServiceUnavailable, "spectator_limit", "Spectator limit reached", map[string]int{"limit": maxSpectatorsPerSession})
+			return
+		}
+		if errors.Is(err, errWatchThroughSFU) {
+			writeWatchThroughSFU(w)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	join := JoinRequest{
+		SDP:            req.SDP,
+		GamepadSlot:    req.GamepadSlot,
+		ControllerType: req.ControllerType,
+		MappingProfile: req.MappingProfile,
+	}
+	mapping, err := validateJoin(&join)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	// A control link is the owner's grant of control, made in advance
+	resp, err := joinSession(host, join, mapping, true)
+	if errors.Is(err, errNoFreeSlot) {
+		writeError(w, http.StatusServiceUnavailable, "no_free_slot", "No free controller slot")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	log.Printf("[Session %s] Co-op player %s joined via share link", host.ID, resp.SessionID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
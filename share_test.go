@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareTokenRoundTrip(t *testing.T) {
+	want := shareClaims{
+		Room:    "ABC123",
+		Role:    peerRoleControl,
+		Start:   true,
+		Expires: time.Now().Add(time.Hour).Unix(),
+	}
+	claims, err := verifyShareToken(signShareToken(want))
+	if err != nil {
+		t.Fatalf("verifyShareToken: %v", err)
+	}
+	if *claims != want {
+		t.Errorf("verifyShareToken = %+v, want %+v", *claims, want)
+	}
+}
+
+func TestVerifyShareToken(t *testing.T) {
+	valid := signShareToken(shareClaims{
+		Session: "s1",
+		Role:    peerRoleView,
+		Expires: time.Now().Add(time.Hour).Unix(),
+	})
+	payload, sig, _ := strings.Cut(valid, ".")
+
+	// Claims granting more, under the valid signature
+	forged, _ := base64.RawURLEncoding.DecodeString(payload)
+	forged = []byte(strings.Replace(string(forged), `"p":"view"`, `"p":"control"`, 1))
+	forgedPayload := base64.RawURLEncoding.EncodeToString(forged)
+
+	// Signed with another key, as by an earlier run of the server
+	key := shareLinkKey
+	shareLinkKey = []byte("another key")
+	otherKey := signShareToken(shareClaims{Session: "s1", Role: peerRoleView, Expires: time.Now().Add(time.Hour).Unix()})
+	shareLinkKey = key
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid", valid, nil},
+		{"no signature", payload, errInvalidShareToken},
+		{"empty", "", errInvalidShareToken},
+		{"payload not base64", "!!." + sig, errInvalidShareToken},
+		{"signature not base64", payload + ".!!", errInvalidShareToken},
+		{"forged claims", forgedPayload + "." + sig, errInvalidShareToken},
+		{"truncated signature", payload + "." + sig[:len(sig)-4], errInvalidShareToken},
+		{"other key", otherKey, errInvalidShareToken},
+		{"expired", signShareToken(shareClaims{Session: "s1", Role: peerRoleView, Expires: time.Now().Add(-time.Second).Unix()}), errShareExpired},
+		{"expiring now", signShareToken(shareClaims{Session: "s1", Role: peerRoleView, Expires: time.Now().Unix()}), errShareExpired},
+	}
+	for _, test := range tests {
+		_, err := verifyShareToken(test.token)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: verifyShareToken error = %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestShareRequestValidate(t *testing.T) {
+	tests := []struct {
+		req  ShareRequest
+		ok   bool
+		role string
+		ttl  time.Duration
+	}{
+		{ShareRequest{}, true, peerRoleView, defaultShareTTL},
+		{ShareRequest{Role: peerRoleControl, TTLSeconds: 60}, true, peerRoleControl, time.Minute},
+		{ShareRequest{Role: peerRoleControl, Start: true}, true, peerRoleControl, defaultShareTTL},
+		{ShareRequest{TTLSeconds: int(maxShareTTL / time.Second)}, true, peerRoleView, maxShareTTL},
+		{ShareRequest{Role: "admin"}, false, "", 0},
+		{ShareRequest{Start: true}, false, "", 0},
+		{ShareRequest{TTLSeconds: -1}, false, "", 0},
+		{ShareRequest{TTLSeconds: int(maxShareTTL/time.Second) + 1}, false, "", 0},
+	}
+	for _, test := range tests {
+		req := test.req
+		err := req.validate()
+		if (err == nil) != test.ok {
+			t.Errorf("%+v: validate error = %v, want ok %v", test.req, err, test.ok)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		if req.Role != test.role || req.ttl() != test.ttl {
+			t.Errorf("%+v: role %q, ttl %v; want %q, %v", test.req, req.Role, req.ttl(), test.role, test.ttl)
+		}
+	}
+}
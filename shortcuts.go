@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/lightsyr/chimera-go/input"
+)
+
+// Shortcut policies for host-reserved key combinations
+const (
+	shortcutPolicyInject    = "inject"    // Deliver as-is
+	shortcutPolicyBlock     = "block"     // Drop the key completing the shortcut
+	shortcutPolicyTranslate = "translate" // Deliver the key without its modifiers
+)
+
+func validShortcutPolicy(policy string) bool {
+	switch policy {
+	case shortcutPolicyInject, shortcutPolicyBlock, shortcutPolicyTranslate:
+		return true
+	}
+	return false
+}
+
+// Modifier groups; generic and left/right virtual-key codes count the same
+const (
+	modShift = 1 << iota
+	modCtrl
+	modAlt
+)
+
+var modifierKeys = map[uint16]uint8{
+	0x10: modShift, 0xA0: modShift, 0xA1: modShift,
+	0x11: modCtrl, 0xA2: modCtrl, 0xA3: modCtrl,
+	0x12: modAlt, 0xA4: modAlt, 0xA5: modAlt,
+}
+
+// Windows keys are reserved on their own: alone they open the Start menu
+// and every Win+key combination is a shell shortcut
+func isWinKey(vk uint16) bool {
+	return vk == 0x5B || vk == 0x5C
+}
+
+// Combinations that switch away from or close the foreground app
+var reservedShortcuts = []struct {
+	mods uint8
+	key  uint16
+}{
+	{modAlt, 0x09},           // Alt+Tab
+	{modAlt, 0x1B},           // Alt+Esc
+	{modAlt, 0x73},           // Alt+F4
+	{modAlt, 0x20},           // Alt+Space, window menu
+	{modCtrl, 0x1B},          // Ctrl+Esc and Ctrl+Shift+Esc
+	{modCtrl | modAlt, 0x2E}, // Ctrl+Alt+Del
+	{modCtrl | modAlt, 0x23}, // Ctrl+Alt+End, Ctrl+Alt+Del over RDP
+}
+
+// shortcutFilter applies a session's shortcut policy to its key events.
+// It tracks which keys the host has seen pressed so releases stay balanced.
+type shortcutFilter struct {
+	policy string
+
+	mu       sync.Mutex
+	pressed  map[uint16]bool     // Held on the client
+	injected map[uint16]bool     // Held on the host
+	stripped map[uint16][]uint16 // Modifiers released to translate a key
+}
+
+func newShortcutFilter(policy string) *shortcutFilter {
+	return &shortcutFilter{
+		policy:   policy,
+		pressed:  make(map[uint16]bool),
+		injected: make(map[uint16]bool),
+		stripped: make(map[uint16][]uint16),
+	}
+}
+
+// releaseAll returns key-up events for every key held on the host
+func (f *shortcutFilter) releaseAll() []input.KeyEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := make([]input.KeyEvent, 0, len(f.injected))
+	for vk := range f.injected {
+		out = append(out, input.KeyEvent{Down: false, VK: vk})
+	}
+	clear(f.injected)
+	clear(f.stripped)
+	return out
+}
+
+// filter returns the key events to inject for one client key event
+func (f *shortcutFilter) filter(ev input.KeyEvent) []input.KeyEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !ev.Down {
+		delete(f.pressed, ev.VK)
+		if !f.injected[ev.VK] {
+			// Blocked, or a modifier already released for translation
+			return nil
+		}
+		delete(f.injected, ev.VK)
+		out := []input.KeyEvent{ev}
+
+		// Restore modifiers still held after a translated key
+		for _, mod := range f.stripped[ev.VK] {
+			if f.pressed[mod] && !f.injected[mod] {
+				f.injected[mod] = true
+				out = append(out, input.KeyEvent{Down: true, VK: mod})
+			}
+		}
+		delete(f.stripped, ev.VK)
+		return out
+	}
+
+	f.pressed[ev.VK] = true
+	if f.policy == shortcutPolicyInject {
+		f.injected[ev.VK] = true
+		return []input.KeyEvent{ev}
+	}
+	if isWinKey(ev.VK) {
+		return nil
+	}
+
+	var held uint8
+	for vk := range f.injected {
+		held |= modifierKeys[vk]
+	}
+	for _, s := range reservedShortcuts {
+		if ev.VK != s.key || held&s.mods != s.mods {
+			continue
+		}
+		if f.policy == shortcutPolicyBlock {
+			return nil
+		}
+
+		var out []input.KeyEvent
+		for vk := range f.injected {
+			if modifierKeys[vk]&s.mods != 0 {
+				delete(f.injected, vk)
+				f.stripped[ev.VK] = append(f.stripped[ev.VK], vk)
+				out = append(out, input.KeyEvent{Down: false, VK: vk})
+			}
+		}
+		f.injected[ev.VK] = true
+		return append(out, ev)
+	}
+
+	f.injected[ev.VK] = true
+	return []input.KeyEvent{ev}
+}
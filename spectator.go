@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Spectators a single session accepts on top of its own peer
+const maxSpectatorsPerSession = 8
+
+// Spectator is a watch-only peer of an existing session. It is sent the
+// session's tracks and opens no DataChannels, so it has no input path.
+type Spectator struct {
+	ID        string
+	PC        *webrtc.PeerConnection
+	StartTime time.Time
+}
+
+type WatchRequest struct {
+	SDP string `json:"sdp"`
+}
+
+type WatchResponse struct {
+	webrtc.SessionDescription
+	SessionID   string `json:"session_id"`
+	SpectatorID string `json:"spectator_id"`
+}
+
+// handleWatch adds a spectator to a running session. The session's tracks
+// are shared, so spectators cost no extra capture or encode. Watching takes
+// the owner, an admin or a share link for the session in X-Share-Token.
+func handleWatch(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	if !session.canManage(r) && sessionShare(r, session) == nil {
+		writeError(w, http.StatusForbidden, "not_owner", "Watching takes the session owner or a share link")
+		return
+	}
+
+	var req WatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+
+	resp, err := watchSession(session, req.SDP)
+	if errors.Is(err, errSpectatorLimit) {
+		writeErrorDetails(w, http.StatusServiceUnavailable, "spectator_limit", "Spectator limit reached", map[string]int{"limit": maxSpectatorsPerSession})
+		return
+	}
+	if errors.Is(err, errWatchThroughSFU) {
+		writeWatchThroughSFU(w)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+var (
+	errSpectatorLimit  = errors.New("spectator limit reached")
+	errWatchThroughSFU = errors.New("viewers watch through the SFU")
+)
+
+// watchSession adds a spectator peer to session and answers its offer
+func watchSession(session *StreamSession, sdp string) (*WatchResponse, error) {
+	if watchThroughSFU() {
+		return nil, errWatchThroughSFU
+	}
+	pc, err := newPeerConnection(webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{URLs: []string{"stun:stun.l.google.com:19302"}},
+			{URLs: []string{"stun:stun1.l.google.com:19302"}},
+		},
+	}, session.colors)
+	if err != nil {
+		log.Printf("[Session %s] Error creating spectator PeerConnection: %v", session.ID, err)
+		return nil, err
+	}
+
+	spectator := &Spectator{
+		ID:        fmt.Sprintf("spectator_%d", time.Now().UnixNano()),
+		PC:        pc,
+		StartTime: time.Now(),
+	}
+	if !session.addSpectator(spectator) {
+		pc.Close()
+		return nil, errSpectatorLimit
+	}
+
+	fail := func(msg string, err error) (*WatchResponse, error) {
+		session.removeSpectator(spectator.ID)
+		log.Printf("[Session %s] %s: %v", session.ID, msg, err)
+		return nil, err
+	}
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		defer session.recoverPanic("spectator connection state handler")
+		log.Printf("[Session %s] Spectator %s connection state: %s", session.ID, spectator.ID, state.String())
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			session.goSafe("spectator keyframe", session.viewerKeyframe)
+		case webrtc.PeerConnectionStateDisconnected,
+			webrtc.PeerConnectionStateFailed,
+			webrtc.PeerConnectionStateClosed:
+			session.removeSpectator(spectator.ID)
+		}
+	})
+
+	if _, err := pc.AddTrack(session.track()); err != nil {
+		return fail("Error adding track for spectator", err)
+	}
+
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: hostFamilies.preferCandidates(sdp)}
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return fail("Error setting spectator remote description", err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return fail("Error creating spectator answer", err)
+	}
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return fail("Error setting spectator local description", err)
+	}
+
+	log.Printf("[Session %s] Spectator %s joined", session.ID, spectator.ID)
+	return &WatchResponse{
+		SessionDescription: answer,
+		SessionID:          session.ID,
+		SpectatorID:        spectator.ID,
+	}, nil
+}
+
+func (s *StreamSession) addSpectator(spectator *Spectator) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ctx.Err() != nil || len(s.spectators) >= maxSpectatorsPerSession {
+		return false
+	}
+	if s.spectators == nil {
+		s.spectators = make(map[string]*Spectator)
+
+		// Spectators leave with the session
+		go func() {
+			<-s.ctx.Done()
+			s.mutex.Lock()
+			spectators := s.spectators
+			s.spectators = nil
+			s.mutex.Unlock()
+			for _, sp := range spectators {
+				sp.PC.Close()
+			}
+		}()
+	}
+	s.spectators[spectator.ID] = spectator
+	return true
+}
+
+func (s *StreamSession) removeSpectator(id string) {
+	s.mutex.Lock()
+	spectator, ok := s.spectators[id]
+	delete(s.spectators, id)
+	s.mutex.Unlock()
+
+	if ok {
+		log.Printf("[Session %s] Spectator %s left", s.ID, id)
+		spectator.PC.Close()
+	}
+}
+
+func (s *StreamSession) spectatorCount() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.spectators)
+}
+
+func (s *StreamSession) hasSpectator(id string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ok := s.spectators[id]
+	return ok
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWatchRequiresOwnerOrShareLink(t *testing.T) {
+	addTestSession(t, "host1", "owner-token")
+	addTestSession(t, "host2", "other-token")
+	link := func(session, role string, expires time.Time) string {
+		return signShareToken(shareClaims{Session: session, Role: role, Expires: expires.Unix()})
+	}
+	later := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		status int
+	}{
+		{"no credentials", nil, http.StatusForbidden},
+		{"another session's owner token", map[string]string{"Authorization": "Bearer other-token"}, http.StatusForbidden},
+		{"another session's link", map[string]string{shareTokenHeader: link("host2", peerRoleView, later)}, http.StatusForbidden},
+		{"expired link", map[string]string{shareTokenHeader: link("host1", peerRoleView, time.Now().Add(-time.Minute))}, http.StatusForbidden},
+		{"forged link", map[string]string{shareTokenHeader: link("host1", peerRoleView, later) + "x"}, http.StatusForbidden},
+		// Past the check, the empty body is refused
+		{"owner token", map[string]string{"Authorization": "Bearer owner-token"}, http.StatusBadRequest},
+		{"view link", map[string]string{shareTokenHeader: link("host1", peerRoleView, later)}, http.StatusBadRequest},
+		{"control link", map[string]string{shareTokenHeader: link("host1", peerRoleControl, later)}, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		w := apiRequest(handleWatch, "POST", "/sessions/{id}/watch", "/sessions/host1/watch", "", test.header)
+		if w.Code != test.status {
+			t.Errorf("%s: status %d, want %d: %s", test.name, w.Code, test.status, w.Body)
+		}
+	}
+
+	w := apiRequest(handleWatch, "POST", "/sessions/{id}/watch", "/sessions/nosuch/watch", "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown session: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
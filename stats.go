@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const statsPushInterval = time.Second
+
+// PipelineStats holds live counters for one session's capture/encode pipeline
+type PipelineStats struct {
+	// Reported by FFmpeg through -progress
+	encodedFrames  atomic.Int64
+	encoderDropped atomic.Int64
+	encoderDuped   atomic.Int64
+
+	// Maintained by the sample pipeline
+	samplesProcessed atomic.Int64 // Written to the track, successfully or not
+	samplesSent      atomic.Int64
+	samplesDropped   atomic.Int64 // Queue overflow and WriteSample errors
+	samplesThrottled atomic.Int64 // Discarded by the drop policy
+	bytesSent        atomic.Int64
+	queueDepth       atomic.Int32
+
+	// Maintained by adaptive encoding
+	packetLoss atomic.Int32 // Per mille, smoothed from receiver reports
+	fecPercent atomic.Int32 // Parity packets per 100 media packets
+	fecSent    atomic.Int64
+	gopFrames  atomic.Int32
+
+	// current holds the rates over the last second, set by sampleStats
+	current atomic.Pointer[StatsMessage]
+	history statsHistory
+
+	// latency times the stages of every access unit sent
+	latency pipelineLatency
+}
+
+// progressBase is what a session's earlier FFmpeg processes counted; the
+// -progress counters of a restarted one continue from it
+type progressBase struct {
+	encoded, dropped, duped int64
+}
+
+func (s *PipelineStats) progressBase() progressBase {
+	return progressBase{
+		encoded: s.encodedFrames.Load(),
+		dropped: s.encoderDropped.Load(),
+		duped:   s.encoderDuped.Load(),
+	}
+}
+
+// parseProgressLine consumes one key=value line of FFmpeg's -progress output.
+// Returns false if the line is regular log output.
+func (s *PipelineStats) parseProgressLine(line string, base progressBase) bool {
+	key, value, ok := strings.Cut(line, "=")
+	if !ok || key == "" || strings.ContainsAny(key, " \t[") {
+		return false
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	switch key {
+	case "frame":
+		if err == nil {
+			s.encodedFrames.Store(base.encoded + n)
+		}
+	case "drop_frames":
+		if err == nil {
+			s.encoderDropped.Store(base.dropped + n)
+		}
+	case "dup_frames":
+		if err == nil {
+			s.encoderDuped.Store(base.duped + n)
+		}
+	}
+	return true
+}
+
+type statsSnapshot struct {
+	at       time.Time
+	encoded  int64
+	captured int64
+	sent     int64
+	bytes    int64
+	dropped  int64
+}
+
+func (s *PipelineStats) snapshot() statsSnapshot {
+	encoded := s.encodedFrames.Load()
+	return statsSnapshot{
+		at:      time.Now(),
+		encoded: encoded,
+		// Every captured frame is either encoded once, dropped by FFmpeg's
+		// vsync, or encoded again as a duplicate
+		captured: encoded + s.encoderDropped.Load() - s.encoderDuped.Load(),
+		sent:     s.samplesSent.Load(),
+		bytes:    s.bytesSent.Load(),
+		dropped:  s.samplesDropped.Load(),
+	}
+}
+
+// StatsMessage is pushed to the client on the "stats" DataChannel
+type StatsMessage struct {
+	Type              string  `json:"type"`
+	Timestamp         int64   `json:"timestamp"`
+	CaptureFPS        float64 `json:"capture_fps"`
+	EncodeFPS         float64 `json:"encode_fps"`
+	SendFPS           float64 `json:"send_fps"`
+	BitrateKbps       float64 `json:"bitrate_kbps"`
+	QueueDepth        int32   `json:"queue_depth"`
+	SamplesDropped    int64   `json:"samples_dropped"`
+	SamplesThrottled  int64   `json:"samples_throttled"`
+	EncoderDropped    int64   `json:"encoder_dropped"`
+	EncoderDuplicated int64   `json:"encoder_duplicated"`
+	PacketLoss        float64 `json:"packet_loss"` // Fraction, before FEC and retransmission
+	FECPercent        int32   `json:"fec_percent"`
+	FECPacketsSent    int64   `json:"fec_packets_sent"`
+	GOPFrames         int32   `json:"gop_frames"`
+}
+
+func (s *PipelineStats) message(prev, cur statsSnapshot) StatsMessage {
+	elapsed := cur.at.Sub(prev.at).Seconds()
+	rate := func(from, to int64) float64 {
+		if elapsed <= 0 || to < from {
+			return 0
+		}
+		return float64(to-from) / elapsed
+	}
+
+	return StatsMessage{
+		Type:              "stats",
+		Timestamp:         cur.at.UnixMilli(),
+		CaptureFPS:        rate(prev.captured, cur.captured),
+		EncodeFPS:         rate(prev.encoded, cur.encoded),
+		SendFPS:           rate(prev.sent, cur.sent),
+		BitrateKbps:       rate(prev.bytes, cur.bytes) * 8 / 1000,
+		QueueDepth:        s.queueDepth.Load(),
+		SamplesDropped:    s.samplesDropped.Load(),
+		SamplesThrottled:  s.samplesThrottled.Load(),
+		EncoderDropped:    s.encoderDropped.Load(),
+		EncoderDuplicated: s.encoderDuped.Load(),
+		PacketLoss:        float64(s.packetLoss.Load()) / 1000,
+		FECPercent:        s.fecPercent.Load(),
+		FECPacketsSent:    s.fecSent.Load(),
+		GOPFrames:         s.gopFrames.Load(),
+	}
+}
+
+// currentRates returns the session's rates over the last second
+func (s *PipelineStats) currentRates() StatsMessage {
+	if msg := s.current.Load(); msg != nil {
+		return *msg
+	}
+	return StatsMessage{Type: "stats"}
+}
+
+// Totals of sessions that have ended, so host totals outlive them
+var (
+	endedFramesProcessed atomic.Int64
+	endedFramesDropped   atomic.Int64
+)
+
+// retireStats adds an ending session's counters to the host totals
+func (s *PipelineStats) retire() {
+	endedFramesProcessed.Add(s.samplesProcessed.Load())
+	endedFramesDropped.Add(s.samplesDropped.Load())
+}
+
+// hostFrameStats sums the frame counters and current rates of every
+// session, ended ones included in the counters
+type hostFrameStats struct {
+	processed, dropped int64
+	sendFPS            float64
+	bitrateKbps        float64
+}
+
+func hostStats() hostFrameStats {
+	h := hostFrameStats{
+		processed: endedFramesProcessed.Load(),
+		dropped:   endedFramesDropped.Load(),
+	}
+	sessionsLock.RLock()
+	defer sessionsLock.RUnlock()
+	for _, session := range sessions {
+		h.processed += session.Stats.samplesProcessed.Load()
+		h.dropped += session.Stats.samplesDropped.Load()
+		rates := session.Stats.currentRates()
+		h.sendFPS += rates.SendFPS
+		h.bitrateKbps += rates.BitrateKbps
+	}
+	return h
+}
+
+func (h hostFrameStats) dropRate() float64 {
+	if h.processed == 0 {
+		return 0
+	}
+	return float64(h.dropped) / float64(h.processed) * 100
+}
+
+// sampleStats updates every session's current rates and the stats
+// history once a second
+func sampleStats() {
+	ticker := time.NewTicker(statsPushInterval)
+	defer ticker.Stop()
+
+	prev := make(map[*StreamSession]statsSnapshot)
+	for range ticker.C {
+		sessionsLock.RLock()
+		live := make([]*StreamSession, 0, len(sessions))
+		for _, session := range sessions {
+			live = append(live, session)
+		}
+		sessionsLock.RUnlock()
+
+		now := time.Now()
+		next := make(map[*StreamSession]statsSnapshot, len(live))
+		points := make([]statsPoint, 0, len(live))
+		for _, session := range live {
+			cur := session.Stats.snapshot()
+			if p, ok := prev[session]; ok {
+				msg := session.Stats.message(p, cur)
+				session.Stats.current.Store(&msg)
+				points = append(points, session.Stats.record(msg, p.dropped))
+			}
+			next[session] = cur
+		}
+		prev = next
+		recordHostStats(now, points)
+	}
+}
+
+// handleStatsChannel pushes pipeline stats to the client once per second
+func handleStatsChannel(ctx context.Context, session *StreamSession, dc *webrtc.DataChannel) {
+	pushCtx, stopPushing := context.WithCancel(ctx)
+
+	dc.OnOpen(func() {
+		defer session.recoverPanic("stats channel")
+		session.goSafe("stats push", func() {
+			ticker := time.NewTicker(statsPushInterval)
+			defer ticker.Stop()
+
+			stats := session.pipeline()
+			prev := stats.snapshot()
+			for {
+				select {
+				case <-pushCtx.Done():
+					return
+				case <-ticker.C:
+				}
+
+				cur := stats.snapshot()
+				if err := sendJSON(dc, stats.message(prev, cur)); err != nil {
+					log.Printf("[Session %s] Error pushing stats: %v", session.ID, err)
+					return
+				}
+				prev = cur
+			}
+		})
+	})
+
+	dc.OnClose(stopPushing)
+}
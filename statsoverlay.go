@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The stats overlay draws the session's frame rate, bitrate and encoding
+// into the corner of its picture, so a screenshot of a quality complaint
+// carries the numbers behind it. FFmpeg's drawtext reads them from a text
+// file the session rewrites every second; turning the overlay on or off
+// restarts the encoder, like any other change to its config.
+
+const statsOverlayInterval = time.Second
+
+// statsOverlayPath is the text file drawn over a session's picture
+func statsOverlayPath(sessionID string) string {
+	return filepath.Join(os.TempDir(), "chimera-stats-"+sessionID+".txt")
+}
+
+// filterPath quotes path for a filter option: quoted for the filtergraph,
+// with the option separator escaped as in a Windows drive letter
+func filterPath(path string) string {
+	return "'" + strings.ReplaceAll(filepath.ToSlash(path), ":", `\:`) + "'"
+}
+
+// statsOverlayFilter draws the text file at path in the bottom-left
+// corner, sized for a picture height pixels tall
+func statsOverlayFilter(path string, height int) string {
+	return fmt.Sprintf("drawtext=textfile=%s:reload=1:expansion=none:font=monospace:fontsize=%d"+
+		":fontcolor=white:box=1:boxcolor=black@0.6:boxborderw=4:x=8:y=h-th-8",
+		filterPath(path), max(12, height/40))
+}
+
+// statsOverlayText is what the overlay shows for the session encoding cfg
+func (s *StreamSession) statsOverlayText(cfg CaptureConfig) string {
+	encoder := cfg.Codec
+	if codec, ok := videoCodecs[cfg.Codec]; ok && codec.ffmpegEncoder(cfg) != "" {
+		encoder = codec.ffmpegEncoder(cfg)
+	}
+	width, height := cfg.outputSize()
+	rates := s.Stats.currentRates()
+	return fmt.Sprintf("%s\n%s %dx%d %s\n%.1f/%d fps  %.0f/%d kbps\n",
+		s.ID, encoder, width, height, cfg.Format.pixFmt(),
+		rates.SendFPS, cfg.FPS, rates.BitrateKbps, cfg.maxKbps())
+}
+
+// writeStatsOverlay replaces the overlay's text file in one step, so
+// drawtext never reads half of it
+func (s *StreamSession) writeStatsOverlay(cfg CaptureConfig) error {
+	tmp := cfg.StatsOverlay + ".tmp"
+	if err := os.WriteFile(tmp, []byte(s.statsOverlayText(cfg)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cfg.StatsOverlay)
+}
+
+// updateStatsOverlay keeps the overlay's text current while the session's
+// encoding has it on, until ctx ends
+func (s *StreamSession) updateStatsOverlay(ctx context.Context) {
+	path := statsOverlayPath(s.ID)
+	defer os.Remove(path)
+
+	ticker := time.NewTicker(statsOverlayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if cfg := s.encoder.config(); cfg.StatsOverlay != "" {
+			if err := s.writeStatsOverlay(cfg); err != nil {
+				log.Printf("[Session %s] Error writing stats overlay: %v", s.ID, err)
+			}
+		}
+	}
+}
+
+// setStatsOverlay turns the session's stats overlay on or off
+func (s *StreamSession) setStatsOverlay(on bool) error {
+	return s.updateEncoding(func(cfg *CaptureConfig) {
+		cfg.StatsOverlay = ""
+		if on {
+			cfg.StatsOverlay = statsOverlayPath(s.ID)
+			// drawtext fails to start without the file
+			if err := s.writeStatsOverlay(*cfg); err != nil {
+				log.Printf("[Session %s] Error writing stats overlay: %v", s.ID, err)
+			}
+		}
+	})
+}
+
+// handleSetStatsOverlay turns a session's stats overlay on or off for its
+// owner or an admin
+func handleSetStatsOverlay(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session_not_found", "Session not found")
+		return
+	}
+	if !session.canManage(r) {
+		writeError(w, http.StatusForbidden, "not_owner", "Only the session owner can change the overlay")
+		return
+	}
+	if session.parent != nil {
+		writeError(w, http.StatusConflict, "coop_guest", "Co-op guests watch the host's screen")
+		return
+	}
+	if session.videoTrack == nil {
+		writeError(w, http.StatusConflict, "audio_only", "Audio-only sessions have no video")
+		return
+	}
+	if !captureSourceTypes[session.source].caps.StatsOverlay {
+		writeError(w, http.StatusConflict, "overlay_unsupported", "Capture source cannot draw the overlay")
+		return
+	}
+
+	var req struct {
+		Stats bool `json:"stats"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+		return
+	}
+
+	if err := session.setStatsOverlay(req.Stats); err != nil {
+		if errors.Is(err, errCaptureNotStarted) {
+			writeError(w, http.StatusConflict, "capture_not_started", "Capture has not started")
+			return
+		}
+		log.Printf("[Session %s] Error setting stats overlay: %v", session.ID, err)
+		writeErrorDetails(w, http.StatusInternalServerError, "overlay_failed", "Error setting the overlay", err.Error())
+		return
+	}
+	log.Printf("[Session %s] Stats overlay set to %v", session.ID, req.Stats)
+	auditRequest(r, "stats_overlay", "", map[string]interface{}{"stats": req.Stats})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id": session.ID,
+		"stats":      req.Stats,
+	})
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Library discovery fills the app catalog with the games installed through
+// launchers on the host. Discovered apps carry their Source; a rescan
+// replaces them and never touches apps added by hand.
+var libraryDiscovery = true
+
+// A libraryScanner returns the apps one launcher has installed
+type libraryScanner struct {
+	source string
+	scan   func() ([]*App, error)
+}
+
+var errNoLibraries = errors.New("No launcher library found on the host")
+
+var libraryScanners = []libraryScanner{
+	{source: "steam", scan: scanSteamLibrary},
+}
+
+// scanLibraries runs every scanner and merges the result into the catalog
+func scanLibraries() (map[string]int, error) {
+	found := make(map[string][]*App)
+	for _, scanner := range libraryScanners {
+		list, err := scanner.scan()
+		if err != nil {
+			log.Printf("Error scanning %s library: %v", scanner.source, err)
+			continue
+		}
+		found[scanner.source] = list
+	}
+
+	appsLock.Lock()
+	defer appsLock.Unlock()
+
+	counts := make(map[string]int)
+	for source, list := range found {
+		// Apps the launcher no longer has installed go away
+		for name, a := range apps {
+			if a.Source == source {
+				delete(apps, name)
+			}
+		}
+		for _, a := range list {
+			if existing, ok := apps[a.Name]; ok && existing.Source != source {
+				continue
+			}
+			apps[a.Name] = a
+			counts[source]++
+		}
+		log.Printf("Found %d %s apps", counts[source], source)
+	}
+	if len(found) == 0 {
+		return counts, errNoLibraries
+	}
+	return counts, saveApps()
+}
+
+// Steam apps that are runtimes and tools rather than games
+var steamToolApps = map[string]bool{
+	"228980":  true, // Steamworks Common Redistributables
+	"1070560": true, // Steam Linux Runtime
+	"1391110": true, // Steam Linux Runtime - Soldier
+	"1628350": true, // Steam Linux Runtime - Sniper
+}
+
+// StateFlags bit set once an app is fully installed
+const steamStateFullyInstalled = 4
+
+func scanSteamLibrary() ([]*App, error) {
+	root := findSteamRoot()
+	if root == "" {
+		return nil, errors.New("Steam is not installed")
+	}
+	command := steamCommand(root)
+
+	var list []*App
+	seen := make(map[string]bool)
+	for _, library := range steamLibraryFolders(root) {
+		manifests, _ := filepath.Glob(filepath.Join(library, "steamapps", "appmanifest_*.acf"))
+		for _, manifest := range manifests {
+			app, err := readSteamManifest(manifest)
+			if err != nil {
+				log.Printf("Skipping %s: %v", manifest, err)
+				continue
+			}
+			if app == nil || seen[app.appID] {
+				continue
+			}
+			seen[app.appID] = true
+
+			list = append(list, &App{
+				Name:         steamAppName(app.name, app.appID),
+				Command:      command,
+				Args:         []string{"steam://rungameid/" + app.appID},
+				URI:          "steam://rungameid/" + app.appID,
+				Icon:         steamIcon(root, app.appID),
+				Source:       "steam",
+				OnDisconnect: appOnDisconnectKeep, // The command only hands the URI to Steam
+			})
+		}
+	}
+	return list, nil
+}
+
+// findSteamRoot looks for the Steam installation in its usual places
+func findSteamRoot() string {
+	var candidates []string
+	switch runtime.GOOS {
+	case "windows":
+		for _, env := range []string{"ProgramFiles(x86)", "ProgramFiles"} {
+			if dir := os.Getenv(env); dir != "" {
+				candidates = append(candidates, filepath.Join(dir, "Steam"))
+			}
+		}
+	case "darwin":
+		if home, err := os.UserHomeDir(); err == nil {
+			candidates = append(candidates, filepath.Join(home, "Library", "Application Support", "Steam"))
+		}
+	default:
+		if home, err := os.UserHomeDir(); err == nil {
+			candidates = append(candidates,
+				filepath.Join(home, ".steam", "steam"),
+				filepath.Join(home, ".local", "share", "Steam"),
+				filepath.Join(home, ".var", "app", "com.valvesoftware.Steam", ".local", "share", "Steam"),
+			)
+		}
+	}
+
+	for _, dir := range candidates {
+		if _, err := os.Stat(filepath.Join(dir, "steamapps")); err == nil {
+			return dir
+		}
+	}
+	return ""
+}
+
+// steamCommand is what opens steam:// URIs on the host
+func steamCommand(root string) string {
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(root, "steam.exe")
+	case "darwin":
+		return "open"
+	default:
+		return "steam"
+	}
+}
+
+// steamLibraryFolders lists the root and every library it knows about
+func steamLibraryFolders(root string) []string {
+	folders := []string{root}
+
+	f, err := os.Open(filepath.Join(root, "steamapps", "libraryfolders.vdf"))
+	if err != nil {
+		return folders
+	}
+	defer f.Close()
+
+	doc, err := parseVDF(f)
+	if err != nil {
+		log.Printf("Error parsing Steam library folders: %v", err)
+		return folders
+	}
+	for _, entry := range vdfSection(doc, "libraryfolders") {
+		// Newer files hold a section per library, older ones just the path
+		var path string
+		switch v := entry.(type) {
+		case string:
+			path = v
+		case map[string]interface{}:
+			path, _ = vdfValue(v, "path").(string)
+		}
+		if path != "" && filepath.Clean(path) != filepath.Clean(root) {
+			if _, err := os.Stat(filepath.Join(path, "steamapps")); err == nil {
+				folders = append(folders, path)
+			}
+		}
+	}
+	return folders
+}
+
+type steamManifest struct {
+	appID string
+	name  string
+}
+
+// readSteamManifest returns nil for apps that are not installed games
+func readSteamManifest(path string) (*steamManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	doc, err := parseVDF(f)
+	if err != nil {
+		return nil, err
+	}
+	state := vdfSection(doc, "AppState")
+	appID, _ := vdfValue(state, "appid").(string)
+	name, _ := vdfValue(state, "name").(string)
+	flags, _ := vdfValue(state, "StateFlags").(string)
+	if appID == "" {
+		return nil, errors.New("no appid")
+	}
+
+	stateFlags, _ := strconv.Atoi(flags)
+	if stateFlags&steamStateFullyInstalled == 0 || steamToolApps[appID] || strings.HasPrefix(name, "Proton") {
+		return nil, nil
+	}
+	return &steamManifest{appID: appID, name: name}, nil
+}
+
+// steamAppName makes a catalog name out of a game title
+func steamAppName(title, appID string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r == '/':
+			return '-'
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(title))
+
+	if runes := []rune(name); len(runes) > 64 {
+		name = strings.TrimSpace(string(runes[:64]))
+	}
+	if name == "" {
+		name = "Steam app " + appID
+	}
+	return name
+}
+
+// steamIcon finds the library artwork Steam cached for the app. Newer
+// clients keep it in a directory per app.
+func steamIcon(root, appID string) string {
+	cache := filepath.Join(root, "appcache", "librarycache")
+	for _, name := range []string{
+		filepath.Join(appID, "library_600x900.jpg"),
+		appID + "_library_600x900.jpg",
+		filepath.Join(appID, "header.jpg"),
+		appID + "_header.jpg",
+		appID + "_icon.jpg",
+	} {
+		path := filepath.Join(cache, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// parseVDF reads Valve's text KeyValues format into nested maps of strings
+func parseVDF(r io.Reader) (map[string]interface{}, error) {
+	tokens, err := vdfTokens(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	doc, rest, err := vdfParseSection(tokens, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("unexpected '}'")
+	}
+	return doc, nil
+}
+
+func vdfParseSection(tokens []string, nested bool) (map[string]interface{}, []string, error) {
+	section := make(map[string]interface{})
+	for len(tokens) > 0 {
+		key := tokens[0]
+		tokens = tokens[1:]
+		if key == "}" {
+			if !nested {
+				return nil, nil, errors.New("unexpected '}'")
+			}
+			return section, tokens, nil
+		}
+		if len(tokens) == 0 {
+			return nil, nil, fmt.Errorf("no value for %q", key)
+		}
+
+		if tokens[0] == "{" {
+			child, rest, err := vdfParseSection(tokens[1:], true)
+			if err != nil {
+				return nil, nil, err
+			}
+			section[key] = child
+			tokens = rest
+		} else {
+			section[key] = tokens[0]
+			tokens = tokens[1:]
+		}
+	}
+	if nested {
+		return nil, nil, errors.New("missing '}'")
+	}
+	return section, nil, nil
+}
+
+// vdfTokens splits the input into quoted or bare strings and braces,
+// dropping // comments
+func vdfTokens(r *bufio.Reader) ([]string, error) {
+	var tokens []string
+	for {
+		c, _, err := r.ReadRune()
+		if err == io.EOF {
+			return tokens, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case unicode.IsSpace(c):
+		case c == '{' || c == '}':
+			tokens = append(tokens, string(c))
+		case c == '/' && peekRune(r) == '/':
+			r.ReadString('\n')
+		case c == '"':
+			var sb strings.Builder
+			for {
+				c, _, err := r.ReadRune()
+				if err != nil {
+					return nil, errors.New("unterminated string")
+				}
+				if c == '"' {
+					break
+				}
+				if c == '\\' {
+					next, _, err := r.ReadRune()
+					if err != nil {
+						return nil, errors.New("unterminated string")
+					}
+					switch next {
+					case 'n':
+						c = '\n'
+					case 't':
+						c = '\t'
+					default:
+						c = next
+					}
+				}
+				sb.WriteRune(c)
+			}
+			tokens = append(tokens, sb.String())
+		default:
+			var sb strings.Builder
+			sb.WriteRune(c)
+			for {
+				next := peekRune(r)
+				if next == 0 || unicode.IsSpace(next) || next == '"' || next == '{' || next == '}' {
+					break
+				}
+				r.ReadRune()
+				sb.WriteRune(next)
+			}
+			tokens = append(tokens, sb.String())
+		}
+	}
+}
+
+func peekRune(r *bufio.Reader) rune {
+	c, _, err := r.ReadRune()
+	if err != nil {
+		return 0
+	}
+	r.UnreadRune()
+	return c
+}
+
+// Keys are case-insensitive in practice: Steam writes both "StateFlags"
+// and "stateflags" depending on version
+func vdfValue(section map[string]interface{}, key string) interface{} {
+	if v, ok := section[key]; ok {
+		return v
+	}
+	for k, v := range section {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return nil
+}
+
+func vdfSection(section map[string]interface{}, key string) map[string]interface{} {
+	child, _ := vdfValue(section, key).(map[string]interface{})
+	return child
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// systemd integration: readiness and watchdog notifications for
+// Type=notify units, and listening sockets handed over by socket
+// activation. Everything is a no-op when not started by systemd.
+
+// sdNotify sends a state such as "READY=1" to the service manager
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ names a socket in the abstract namespace
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// startWatchdog pings the service manager at half the WatchdogSec=
+// interval. The pings stop if the session table deadlocks, so systemd
+// restarts a server that no longer accepts sessions.
+func startWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+	log.Printf("[systemd] Watchdog enabled, pinging every %v", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			// The new process pings once it is the main PID
+			if handedOver.Load() {
+				return
+			}
+			sessionsLock.RLock()
+			count := len(sessions)
+			sessionsLock.RUnlock()
+
+			state := fmt.Sprintf("WATCHDOG=1\nSTATUS=%d active sessions", count)
+			if err := sdNotify(state); err != nil {
+				log.Printf("[systemd] Error pinging watchdog: %v", err)
+			}
+		}
+	}()
+}
+
+// Sockets passed by systemd, or by the process handing over to this one
+type activatedListener struct {
+	name string // FileDescriptorName=, "unknown" if unset
+	ln   net.Listener
+	pc   net.PacketConn // Instead of ln for datagram sockets
+}
+
+func (a activatedListener) addr() net.Addr {
+	if a.pc != nil {
+		return a.pc.LocalAddr()
+	}
+	return a.ln.Addr()
+}
+
+var (
+	activatedListeners     []activatedListener
+	activatedListenersOnce sync.Once
+	// "systemd" or "Handover", for the logs
+	activatedBy = "systemd"
+)
+
+// The first passed descriptor, per sd_listen_fds(3)
+const listenFDsStart = 3
+
+func loadActivatedListeners() {
+	if os.Getenv(handoverReadyEnv) != "" {
+		activatedBy = "Handover"
+	} else if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// Children such as server.py must not see these
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := 0; i < count; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		a := activatedListener{name: name}
+		a.ln, err = net.FileListener(f)
+		if err != nil {
+			a.pc, err = net.FilePacketConn(f)
+		}
+		f.Close()
+		if err != nil {
+			log.Printf("[%s] Ignoring passed socket %q: %v", activatedBy, name, err)
+			continue
+		}
+		activatedListeners = append(activatedListeners, a)
+	}
+	log.Printf("[%s] Received %d sockets", activatedBy, len(activatedListeners))
+}
+
+// listen returns a socket systemd or a handover passed for name, or binds
+// addr. A passed socket is matched by FileDescriptorName=, then by the port
+// of addr; the main HTTP server also takes any unnamed socket left over,
+// so a plain .socket unit on another port works too.
+func listen(name, addr string) (net.Listener, error) {
+	a := takeActivatedListener(name, addr, false)
+	if a == nil && name == "http" {
+		a = takeActivated(func(a activatedListener) bool { return a.ln != nil && a.name == "unknown" })
+	}
+	if a != nil {
+		log.Printf("[%s] Using passed socket %s for %s", activatedBy, a.ln.Addr(), name)
+		keepForHandover(name, a.ln)
+		return a.ln, nil
+	}
+	ln, err := net.Listen(hostFamilies.network("tcp", addr), addr)
+	if err == nil {
+		keepForHandover(name, ln)
+	}
+	return ln, err
+}
+
+// listenPacket is listen for UDP sockets
+func listenPacket(name, addr string) (net.PacketConn, error) {
+	if a := takeActivatedListener(name, addr, true); a != nil {
+		log.Printf("[%s] Using passed socket %s for %s", activatedBy, a.pc.LocalAddr(), name)
+		keepForHandover(name, a.pc)
+		return a.pc, nil
+	}
+	pc, err := net.ListenPacket(hostFamilies.network("udp", addr), addr)
+	if err == nil {
+		keepForHandover(name, pc)
+	}
+	return pc, err
+}
+
+// listenUnix is listen for Unix domain sockets, which are matched by name
+// only. A socket file no process answers on, left by one that crashed, is
+// replaced.
+func listenUnix(name, path string) (net.Listener, error) {
+	activatedListenersOnce.Do(loadActivatedListeners)
+	if a := takeActivated(func(a activatedListener) bool { return a.ln != nil && a.name == name }); a != nil {
+		log.Printf("[%s] Using passed socket %s for %s", activatedBy, a.ln.Addr(), name)
+		keepForHandover(name, a.ln)
+		return a.ln, nil
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s is in use by another process", path)
+	}
+	os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// The process taking the socket over in a handover goes on using the
+	// file
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	keepForHandover(name, ln)
+	return ln, nil
+}
+
+// takeActivatedListener matches a passed socket of the kind by name, then
+// by the port of addr
+func takeActivatedListener(name, addr string, datagram bool) *activatedListener {
+	activatedListenersOnce.Do(loadActivatedListeners)
+
+	a := takeActivated(func(a activatedListener) bool { return (a.pc != nil) == datagram && a.name == name })
+	if _, port, _ := net.SplitHostPort(addr); a == nil && port != "" {
+		a = takeActivated(func(a activatedListener) bool {
+			_, p, _ := net.SplitHostPort(a.addr().String())
+			return (a.pc != nil) == datagram && p == port
+		})
+	}
+	return a
+}
+
+func takeActivated(match func(activatedListener) bool) *activatedListener {
+	for i, a := range activatedListeners {
+		if match(a) {
+			activatedListeners = append(activatedListeners[:i], activatedListeners[i+1:]...)
+			return &a
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Offer limits can also bound when and how long sessions run, for parental
+// controls or a host shared by turns: max_session_minutes ends a session
+// that long after it starts, and allowed_hours are the host's local times
+// sessions may run in. Offers outside them are refused; a session running
+// into the end of its window ends with it. The host, a user and a paired
+// device can each set them, and a session keeps to all that apply. Its
+// peer is warned on the input channel before the end:
+//
+//	"max_session_minutes": 120,
+//	"allowed_hours": [{"days": ["mon", "tue", "wed", "thu", "fri"], "start": "16:00", "end": "21:00"},
+//	                  {"days": ["sat", "sun"], "start": "09:00", "end": "22:00"}]
+
+// How long before a session's end its peer is warned
+var timeLimitWarnings = []time.Duration{10 * time.Minute, 5 * time.Minute, time.Minute}
+
+// timeWindow is a span of local time on each of Days, or every day. An
+// End not after Start runs past midnight, into the next day.
+type timeWindow struct {
+	Days  []string `json:"days,omitempty"` // "mon" to "sun"
+	Start string   `json:"start"`          // "15:30"
+	End   string   `json:"end"`            // "22:00", "24:00" for midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseClock returns the minutes past midnight of "HH:MM"
+func parseClock(s string) (int, error) {
+	hours, minutes, ok := strings.Cut(s, ":")
+	h, err1 := strconv.Atoi(hours)
+	m, err2 := strconv.Atoi(minutes)
+	if !ok || err1 != nil || err2 != nil || len(minutes) != 2 || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("time %q is not HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+func (w timeWindow) validate() error {
+	for _, day := range w.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("unknown day %q, use mon to sun", day)
+		}
+	}
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return err
+	}
+	if start == 24*60 {
+		return errors.New("a window starts before 24:00")
+	}
+	_, err = parseClock(w.End)
+	return err
+}
+
+func (w timeWindow) on(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// end returns the end of the window's span that t falls in, or false if
+// t is outside the window
+func (w timeWindow) end(t time.Time) (time.Time, bool) {
+	start, _ := parseClock(w.Start)
+	end, _ := parseClock(w.End)
+	if end <= start {
+		end += 24 * 60
+	}
+	// Spans start today or, past midnight, yesterday
+	for back := 0; back <= 1; back++ {
+		day := time.Date(t.Year(), t.Month(), t.Day()-back, 0, 0, 0, 0, t.Location())
+		if !w.on(day.Weekday()) {
+			continue
+		}
+		from := time.Date(day.Year(), day.Month(), day.Day(), 0, start, 0, 0, t.Location())
+		to := time.Date(day.Year(), day.Month(), day.Day(), 0, end, 0, 0, t.Location())
+		if !t.Before(from) && t.Before(to) {
+			return to, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// scheduleEnd returns when the time windows stop allowing sessions, from
+// t on: the end of the span t falls in, or of those running on from it.
+// ok is false if they do not allow t.
+func scheduleEnd(windows []timeWindow, t time.Time) (end time.Time, ok bool) {
+	end = t
+	// A week of back-to-back spans is as good as no end
+	for limit := t.Add(8 * 24 * time.Hour); end.Before(limit); {
+		next := end
+		for _, w := range windows {
+			if e, in := w.end(end); in && e.After(next) {
+				next = e
+			}
+		}
+		if !next.After(end) {
+			break
+		}
+		end, ok = next, true
+	}
+	return end, ok
+}
+
+// sessionTimeLimit is when a session must end, by its offer's limits
+type sessionTimeLimit struct {
+	maxDuration time.Duration
+	schedules   [][]timeWindow // Each must allow the session
+}
+
+// check refuses sessions outside their allowed hours
+func (l sessionTimeLimit) check(now time.Time) error {
+	for _, windows := range l.schedules {
+		if _, ok := scheduleEnd(windows, now); !ok {
+			return errors.New("Sessions are not allowed at this time")
+		}
+	}
+	return nil
+}
+
+// deadline returns when a session starting at start must end and why,
+// "max_duration" or "schedule", or the zero time if it may run on
+func (l sessionTimeLimit) deadline(start time.Time) (time.Time, string) {
+	var deadline time.Time
+	reason := ""
+	if l.maxDuration > 0 {
+		deadline, reason = start.Add(l.maxDuration), "max_duration"
+	}
+	for _, windows := range l.schedules {
+		end, ok := scheduleEnd(windows, start)
+		if !ok {
+			end = start
+		}
+		if end.Sub(start) >= 7*24*time.Hour {
+			continue
+		}
+		if deadline.IsZero() || end.Before(deadline) {
+			deadline, reason = end, "schedule"
+		}
+	}
+	return deadline, reason
+}
+
+// TimeLimitMessage warns the peer that the session ends soon; sent on the
+// input channel as it opens and at each of timeLimitWarnings
+type TimeLimitMessage struct {
+	Type             string    `json:"type"` // "time_limit"
+	EndsAt           time.Time `json:"ends_at"`
+	RemainingSeconds int       `json:"remaining_seconds"`
+	Reason           string    `json:"reason"` // "max_duration" or "schedule"
+}
+
+func (s *StreamSession) timeLimitMessage() TimeLimitMessage {
+	return TimeLimitMessage{
+		Type:             "time_limit",
+		EndsAt:           s.deadline,
+		RemainingSeconds: int(time.Until(s.deadline).Round(time.Second).Seconds()),
+		Reason:           s.deadlineReason,
+	}
+}
+
+// enforceTimeLimit warns the peer as the session's deadline nears and
+// ends the session at it
+func (s *StreamSession) enforceTimeLimit(ctx context.Context) {
+	log.Printf("[Session %s] Time limit (%s): ends at %s", s.ID, s.deadlineReason, s.deadline.Format("2006-01-02 15:04"))
+	for _, warning := range timeLimitWarnings {
+		at := s.deadline.Add(-warning)
+		if time.Until(at) <= 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(at)):
+		}
+		s.mutex.RLock()
+		dc := s.inputChannel
+		s.mutex.RUnlock()
+		if dc != nil {
+			sendJSON(dc, s.timeLimitMessage())
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Until(s.deadline)):
+	}
+	auditSession(s, "session_time_limit", map[string]interface{}{"reason": s.deadlineReason})
+	s.endWithError("session time limit reached")
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Key releases are signed with, set at release time like the version with
+// -ldflags "-X main.updatePublicKey=<base64 ed25519 key>". Development
+// builds and builds without a key never update themselves.
+var updatePublicKey = ""
+
+var (
+	updateManifestURL   = "https://github.com/lightsyr/chimera-go/releases/latest/download/release.json"
+	updateCheckInterval = 24 * time.Hour
+	// How long an update waits for sessions to end before ending them
+	updateDrainTimeout = 30 * time.Minute
+)
+
+// Largest binary an update downloads
+const maxUpdateSize = 256 << 20
+
+// Exit status asking a supervisor (systemd, the Windows service) to start
+// the updated binary
+const updateRestartExitCode = 75
+
+// releaseManifest describes the latest release; release.json is published
+// next to the binaries
+type releaseManifest struct {
+	Version string                  `json:"version"`
+	Notes   string                  `json:"notes,omitempty"`
+	Assets  map[string]releaseAsset `json:"assets"` // By GOOS-GOARCH
+}
+
+type releaseAsset struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+	// Signature is the base64 ed25519 signature of releaseMessage, which
+	// binds the hash to the version and platform so an old or foreign
+	// binary cannot be passed off as this one
+	Signature string `json:"signature"`
+}
+
+func releaseMessage(version, platform, sha string) []byte {
+	return []byte(fmt.Sprintf("chimera-go %s %s %s", version, platform, sha))
+}
+
+func updatePlatform() string {
+	return runtime.GOOS + "-" + runtime.GOARCH
+}
+
+// Update progress, for GET /update
+var (
+	updateState = struct {
+		sync.Mutex
+		latest  *releaseManifest
+		checked time.Time
+		// "idle", "downloading", "installing", "handing_over", "handed_over",
+		// "draining", "restarting" or "failed"
+		status string
+		err    string
+	}{status: "idle"}
+
+	// Set while an update waits for sessions to end; no new ones start
+	updateDraining atomic.Bool
+)
+
+var errDraining = errors.New("Server is restarting for an update")
+
+func fetchReleaseManifest() (*releaseManifest, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(updateManifestURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("release check returned %s", resp.Status)
+	}
+
+	var m releaseManifest
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&m); err != nil {
+		return nil, fmt.Errorf("bad release manifest: %v", err)
+	}
+	return &m, nil
+}
+
+// checkForUpdate fetches the manifest and remembers it
+func checkForUpdate() (*releaseManifest, error) {
+	m, err := fetchReleaseManifest()
+	if err != nil {
+		return nil, err
+	}
+	updateState.Lock()
+	updateState.latest = m
+	updateState.checked = time.Now()
+	updateState.Unlock()
+	return m, nil
+}
+
+// checkForUpdatesPeriodically only reports releases; installing one is
+// left to the host
+func checkForUpdatesPeriodically() {
+	for {
+		if m, err := checkForUpdate(); err != nil {
+			log.Printf("[Update] Release check failed: %v", err)
+		} else if newerVersion(m.Version, version) {
+			log.Printf("[Update] chimera-go %s is available (running %s)", m.Version, version)
+		}
+		time.Sleep(updateCheckInterval)
+	}
+}
+
+// newerVersion compares vMAJOR.MINOR.PATCH versions. Anything else, such
+// as a "dev" build, is never older.
+func newerVersion(latest, current string) bool {
+	l, ok1 := parseVersion(latest)
+	c, ok2 := parseVersion(current)
+	if !ok1 || !ok2 {
+		return false
+	}
+	for i := range l {
+		if l[i] != c[i] {
+			return l[i] > c[i]
+		}
+	}
+	return false
+}
+
+func parseVersion(v string) ([3]int, bool) {
+	var out [3]int
+	parts := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	if len(parts) != 3 {
+		return out, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return out, false
+		}
+		out[i] = n
+	}
+	return out, true
+}
+
+// downloadRelease fetches this platform's binary and checks its hash and
+// signature
+func downloadRelease(m *releaseManifest) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(updatePublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("this build has no release signing key; update manually")
+	}
+	asset, ok := m.Assets[updatePlatform()]
+	if !ok {
+		return nil, fmt.Errorf("release %s has no binary for %s", m.Version, updatePlatform())
+	}
+	sig, err := base64.StdEncoding.DecodeString(asset.Signature)
+	if err != nil {
+		return nil, errors.New("bad release signature")
+	}
+	if !ed25519.Verify(key, releaseMessage(m.Version, updatePlatform(), asset.SHA256), sig) {
+		return nil, errors.New("release signature does not match")
+	}
+
+	client := &http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Get(asset.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download returned %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxUpdateSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxUpdateSize {
+		return nil, errors.New("release binary is too large")
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != strings.ToLower(asset.SHA256) {
+		return nil, errors.New("downloaded binary does not match the signed hash")
+	}
+	return data, nil
+}
+
+// installBinary swaps the running executable for data, keeping the old one
+// as .old until the next start. Renaming works on a running binary on
+// Windows too.
+func installBinary(data []byte) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", err
+	}
+
+	newPath, oldPath := exe+".new", exe+".old"
+	if err := os.WriteFile(newPath, data, 0755); err != nil {
+		return "", err
+	}
+	os.Remove(oldPath)
+	if err := os.Rename(exe, oldPath); err != nil {
+		os.Remove(newPath)
+		return "", err
+	}
+	if err := os.Rename(newPath, exe); err != nil {
+		os.Rename(oldPath, exe)
+		return "", err
+	}
+	return exe, nil
+}
+
+// removeOldBinary deletes what the last update replaced
+func removeOldBinary() {
+	if exe, err := os.Executable(); err == nil {
+		os.Remove(exe + ".old")
+	}
+}
+
+func setUpdateStatus(status string, err error) {
+	updateState.Lock()
+	updateState.status = status
+	updateState.err = ""
+	if err != nil {
+		updateState.err = err.Error()
+	}
+	updateState.Unlock()
+}
+
+// runUpdate downloads and verifies the release before touching anything,
+// then hands over to it when it can, leaving the running sessions here.
+// Otherwise it stops admitting sessions, waits for the running ones to end
+// (or ends them when force is set or the drain times out), swaps the
+// binary and restarts.
+func runUpdate(m *releaseManifest, force bool) {
+	setUpdateStatus("downloading", nil)
+	log.Printf("[Update] Downloading %s", m.Version)
+	data, err := downloadRelease(m)
+	if err != nil {
+		log.Printf("[Update] Failed: %v", err)
+		setUpdateStatus("failed", err)
+		return
+	}
+
+	var exe string
+	if !force && canHandover() == nil {
+		setUpdateStatus("installing", nil)
+		if exe, err = installBinary(data); err != nil {
+			log.Printf("[Update] Error installing %s: %v", m.Version, err)
+			setUpdateStatus("failed", err)
+			return
+		}
+		setUpdateStatus("handing_over", nil)
+		if err = handover(exe); err == nil {
+			log.Printf("[Update] %s serves new sessions", m.Version)
+			setUpdateStatus("handed_over", nil)
+			return
+		}
+		log.Printf("[Update] Error handing over, draining instead: %v", err)
+	}
+
+	setUpdateStatus("draining", nil)
+	updateDraining.Store(true)
+	failQueuedOffers(errDraining.Error())
+	deadline := time.Now().Add(updateDrainTimeout)
+	for !force && time.Now().Before(deadline) {
+		sessionsLock.RLock()
+		active := len(sessions)
+		sessionsLock.RUnlock()
+		if active == 0 {
+			break
+		}
+		log.Printf("[Update] Waiting for %d sessions to end", active)
+		time.Sleep(10 * time.Second)
+	}
+
+	if exe == "" {
+		setUpdateStatus("installing", nil)
+		if exe, err = installBinary(data); err != nil {
+			log.Printf("[Update] Error installing %s: %v", m.Version, err)
+			setUpdateStatus("failed", err)
+			updateDraining.Store(false)
+			return
+		}
+	}
+
+	setUpdateStatus("restarting", nil)
+	log.Printf("[Update] Installed %s; restarting", m.Version)
+	stopServer()
+	if supervised() {
+		os.Exit(updateRestartExitCode)
+	}
+	if err := execSelf(exe); err != nil {
+		log.Printf("[Update] Error restarting, start the server again: %v", err)
+		os.Exit(1)
+	}
+}
+
+// Set by the Windows service in the environment of the server it runs
+const serviceChildEnv = "CHIMERA_SERVICE"
+
+// supervised reports whether systemd or the Windows service restarts the
+// server; they also hold the listening sockets across the restart
+func supervised() bool {
+	return os.Getenv("INVOCATION_ID") != "" || os.Getenv(serviceChildEnv) != ""
+}
+
+// failQueuedOffers tells every waiting client the host will not admit it
+func failQueuedOffers(reason string) {
+	waitQueueLock.Lock()
+	defer waitQueueLock.Unlock()
+	for _, entry := range waitQueue {
+		entry.send(sseEvent{"error", map[string]string{"error": reason}})
+	}
+	waitQueue = nil
+}
+
+// HTTP handlers, host only: GET /update reports the running and latest
+// versions, POST /update installs the latest release
+func handleUpdateStatus(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Updates can only be managed from the host")
+		return
+	}
+
+	if r.URL.Query().Has("check") {
+		if _, err := checkForUpdate(); err != nil {
+			log.Printf("[Update] Release check failed: %v", err)
+			writeError(w, http.StatusBadGateway, "release_check_failed", "Release check failed")
+			return
+		}
+	}
+
+	updateState.Lock()
+	info := map[string]interface{}{
+		"version":   version,
+		"status":    updateState.status,
+		"available": false,
+	}
+	if updateState.err != "" {
+		info["error"] = updateState.err
+	}
+	if m := updateState.latest; m != nil {
+		info["latest"] = m.Version
+		info["notes"] = m.Notes
+		info["available"] = newerVersion(m.Version, version)
+		info["checked_at"] = updateState.checked.Format(time.RFC3339)
+	}
+	updateState.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// UpdateRequest starts an update. Force ends running sessions instead of
+// waiting for them.
+type UpdateRequest struct {
+	Force bool `json:"force"`
+}
+
+func handleStartUpdate(w http.ResponseWriter, r *http.Request) {
+	if !isHostRequest(r) {
+		writeError(w, http.StatusForbidden, "host_only", "Updates can only be managed from the host")
+		return
+	}
+
+	var req UpdateRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorDetails(w, http.StatusBadRequest, "invalid_json", "Error decoding JSON", err.Error())
+			return
+		}
+	}
+
+	m, err := checkForUpdate()
+	if err != nil {
+		log.Printf("[Update] Release check failed: %v", err)
+		writeError(w, http.StatusBadGateway, "release_check_failed", "Release check failed")
+		return
+	}
+	if !newerVersion(m.Version, version) {
+		writeError(w, http.StatusConflict, "up_to_date", fmt.Sprintf("Already up to date (%s)", version))
+		return
+	}
+
+	updateState.Lock()
+	busy := updateState.status != "idle" && updateState.status != "failed"
+	if !busy {
+		updateState.status = "downloading"
+	}
+	updateState.Unlock()
+	if busy {
+		writeError(w, http.StatusConflict, "update_in_progress", "An update is already in progress")
+		return
+	}
+
+	auditRequest(r, "update", m.Version, map[string]interface{}{"force": req.Force})
+	go runUpdate(m, req.Force)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version": m.Version,
+		"status":  "downloading",
+	})
+}
+
+// runUpdateCommand handles "chimera-go update [check]" for a server that
+// is not running; a running one picks the new binary up on restart
+func runUpdateCommand(args []string) error {
+	if len(args) > 1 || (len(args) == 1 && args[0] != "check") {
+		return errors.New("usage: chimera-go update [check]")
+	}
+
+	m, err := fetchReleaseManifest()
+	if err != nil {
+		return err
+	}
+	if !newerVersion(m.Version, version) {
+		fmt.Printf("chimera-go %s is up to date (latest %s)\n", version, m.Version)
+		return nil
+	}
+	fmt.Printf("chimera-go %s is available (running %s)\n", m.Version, version)
+	if len(args) == 1 {
+		return nil
+	}
+
+	data, err := downloadRelease(m)
+	if err != nil {
+		return err
+	}
+	exe, err := installBinary(data)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Installed %s to %s; restart the server to use it\n", m.Version, exe)
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// execSelf replaces the process with the updated binary
+func execSelf(exe string) error {
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
+
+// handleUpgradeSignal hands over to the binary on disk on SIGUSR2, for
+// upgrades that replace it in place, such as a package manager's
+func handleUpgradeSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+	go func() {
+		for range sigs {
+			exe, err := os.Executable()
+			if err == nil {
+				log.Printf("[Handover] Upgrade signal received, starting %s", exe)
+				err = handover(exe)
+			}
+			if err != nil {
+				log.Printf("[Handover] Error: %v", err)
+			}
+		}
+	}()
+}
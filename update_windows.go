@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// execSelf starts the updated binary and exits, as Windows cannot replace
+// a running process
+func execSelf(exe string) error {
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
+
+// handleUpgradeSignal does nothing: Windows has no upgrade signal, and
+// the service restarts the server instead of handing over
+func handleUpgradeSignal() {}
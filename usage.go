@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Usage is accounted per user and month, for hosts that are shared or
+// rented out to bill or hold users to quotas: the sessions each user ran,
+// how long they ran and the bytes of video and audio sent to them. A
+// session counts once it has connected, in the month it started, and is
+// added to usage.json when it ends; GET /usage adds the sessions still
+// running. Co-op guests count for the user of the session they joined, and
+// sessions of no signed-in user under the user "".
+
+var usageFile = "usage.json"
+
+// usageTotals is what one user streamed in one month
+type usageTotals struct {
+	Sessions         int   `json:"sessions"`
+	StreamingSeconds int64 `json:"streaming_seconds"`
+	BytesSent        int64 `json:"bytes_sent"`
+}
+
+func (t *usageTotals) add(o usageTotals) {
+	t.Sessions += o.Sessions
+	t.StreamingSeconds += o.StreamingSeconds
+	t.BytesSent += o.BytesSent
+}
+
+// usage is by user, then by month as "2006-01" in the host's time zone;
+// guarded by usageLock
+var (
+	usage     = make(map[string]map[string]*usageTotals)
+	usageLock sync.Mutex
+)
+
+var usageMonthPattern = regexp.MustCompile(`^\d{4}-(0[1-9]|1[0-2])$`)
+
+func loadUsage() {
+	data, err := os.ReadFile(usageFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading usage: %v", err)
+		}
+		return
+	}
+
+	loaded := make(map[string]map[string]*usageTotals)
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		log.Printf("Error parsing %s: %v", usageFile, err)
+		return
+	}
+	usageLock.Lock()
+	usage = loaded
+	usageLock.Unlock()
+	log.Printf("Loaded the usage of %d users", len(loaded))
+}
+
+// saveUsage must be called with usageLock held
+func saveUsage() error {
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(usageFile, data, 0600)
+}
+
+// sessionUsage returns what the session has streamed so far, and the user
+// and month it counts for; ok is false for sessions that never connected
+func sessionUsage(s *StreamSession) (user, month string, totals usageTotals, ok bool) {
+	if !s.connected.Load() {
+		return "", "", usageTotals{}, false
+	}
+	user = s.user
+	if s.parent != nil {
+		user = s.parent.user
+	}
+	return user, s.StartTime.Format("2006-01"), usageTotals{
+		Sessions:         1,
+		StreamingSeconds: int64(time.Since(s.StartTime).Seconds()),
+		// Co-op guests are sent the host's stream from the time they join
+		BytesSent: s.pipeline().bytesSent.Load() - s.bytesAtStart,
+	}, true
+}
+
+// recordUsage adds an ended session to its user's usage
+func recordUsage(s *StreamSession) {
+	user, month, totals, ok := sessionUsage(s)
+	if !ok {
+		return
+	}
+
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	months := usage[user]
+	if months == nil {
+		months = make(map[string]*usageTotals)
+		usage[user] = months
+	}
+	if months[month] == nil {
+		months[month] = &usageTotals{}
+	}
+	months[month].add(totals)
+	if err := saveUsage(); err != nil {
+		log.Printf("Error saving usage: %v", err)
+	}
+}
+
+// handleUsage returns the usage of every user, for admins, or of the
+// signed-in user. ?user= and ?month= (2006-01) narrow it down.
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	user, filterUser := query.Get("user"), query.Has("user")
+	if !isAdmin(r) {
+		u := currentUser(r)
+		if u == nil {
+			writeError(w, http.StatusUnauthorized, "login_required", "Sign in first")
+			return
+		}
+		if filterUser && user != u.Name {
+			writeError(w, http.StatusForbidden, "admin_only", "Only admins can see the usage of other users")
+			return
+		}
+		user, filterUser = u.Name, true
+	}
+	month := query.Get("month")
+	if month != "" && !usageMonthPattern.MatchString(month) {
+		writeError(w, http.StatusBadRequest, "invalid_month", "month must be YYYY-MM")
+		return
+	}
+
+	// Copied, with the sessions still running added
+	totals := make(map[string]map[string]*usageTotals)
+	add := func(name, m string, t usageTotals) {
+		if (filterUser && name != user) || (month != "" && m != month) {
+			return
+		}
+		if totals[name] == nil {
+			totals[name] = make(map[string]*usageTotals)
+		}
+		if totals[name][m] == nil {
+			totals[name][m] = &usageTotals{}
+		}
+		totals[name][m].add(t)
+	}
+	// Sessions are recorded as they are unregistered, with sessionsLock
+	// held: holding it too, each is counted once
+	active := make(map[string]int)
+	sessionsLock.RLock()
+	usageLock.Lock()
+	for name, months := range usage {
+		for m, t := range months {
+			add(name, m, *t)
+		}
+	}
+	usageLock.Unlock()
+	for _, session := range sessions {
+		if name, m, t, ok := sessionUsage(session); ok {
+			add(name, m, t)
+			active[name]++
+		}
+	}
+	sessionsLock.RUnlock()
+
+	names := make([]string, 0, len(totals))
+	for name := range totals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		var all usageTotals
+		months := make(map[string]interface{}, len(totals[name]))
+		for m, t := range totals[name] {
+			all.add(*t)
+			months[m] = usageInfo(*t)
+		}
+		info := usageInfo(all)
+		info["user"] = name
+		info["active_sessions"] = active[name]
+		info["months"] = months
+		list = append(list, info)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users": list,
+	})
+}
+
+func usageInfo(t usageTotals) map[string]interface{} {
+	return map[string]interface{}{
+		"sessions":          t.Sessions,
+		"streaming_seconds": t.StreamingSeconds,
+		"streaming_minutes": math.Round(float64(t.StreamingSeconds)/60*10) / 10,
+		"bytes_sent":        t.BytesSent,
+	}
+}
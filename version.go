@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Build identity, set at release time with -ldflags "-X main.version=v1.2.3
+// -X main.commit=<sha> -X main.buildDate=<RFC 3339 time>". Local builds
+// fall back to what the Go toolchain recorded from git.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+var (
+	ffmpegVersionOnce  sync.Once
+	ffmpegVersionValue string
+)
+
+// ffmpegVersion asks FFmpeg once; empty when it is not installed
+func ffmpegVersion() string {
+	ffmpegVersionOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-version").Output()
+		if err != nil {
+			return
+		}
+		// "ffmpeg version 6.1.1-3ubuntu5 Copyright (c) ..."
+		fields := strings.Fields(string(out))
+		if len(fields) >= 3 && fields[0] == "ffmpeg" && fields[1] == "version" {
+			ffmpegVersionValue = fields[2]
+		}
+	})
+	return ffmpegVersionValue
+}
+
+// buildInfo describes the running binary
+func buildInfo() map[string]interface{} {
+	rev, date, modified := commit, buildDate, false
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if rev == "" {
+					rev = setting.Value
+				}
+			case "vcs.time":
+				if date == "" {
+					date = setting.Value
+				}
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+	}
+
+	info := map[string]interface{}{
+		"version":    version,
+		"commit":     rev,
+		"modified":   modified,
+		"build_date": date,
+		"go_version": runtime.Version(),
+		"platform":   runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if v := ffmpegVersion(); v != "" {
+		info["ffmpeg_version"] = v
+	} else {
+		info["ffmpeg_version"] = nil
+	}
+	return info
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildInfo())
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+)
+
+// Clients keep the host told of the space they show the video in, so the
+// encoding follows a window being resized or a phone being rotated. The
+// bitrate ladder picks up the new size on its next tick, which also keeps
+// a burst of resize events to one reconfiguration a second.
+
+// ViewportMessage is sent by the client as text on the "input"
+// DataChannel whenever its viewport changes
+type ViewportMessage struct {
+	Type string `json:"type"` // "viewport"
+	// Width and Height are in CSS pixels, DPR device pixels per CSS pixel
+	// (1 when 0)
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	DPR    float64 `json:"dpr"`
+	// Orientation is "portrait" or "landscape" when the client knows it.
+	// Some mobile browsers report the size from before a rotation for a
+	// moment; a size that disagrees with the orientation is swapped.
+	Orientation string `json:"orientation"`
+}
+
+const maxViewportSide = 16384
+
+// devicePixels returns the viewport's size in device pixels, or false
+// when the message is not a valid viewport
+func (m ViewportMessage) devicePixels() (width, height int, ok bool) {
+	dpr := m.DPR
+	if dpr == 0 {
+		dpr = 1
+	}
+	if m.Width <= 0 || m.Height <= 0 || dpr < 0.25 || dpr > 8 {
+		return 0, 0, false
+	}
+	width = int(math.Round(float64(m.Width) * dpr))
+	height = int(math.Round(float64(m.Height) * dpr))
+	if width > maxViewportSide || height > maxViewportSide {
+		return 0, 0, false
+	}
+
+	switch m.Orientation {
+	case "":
+	case "portrait":
+		if width > height {
+			width, height = height, width
+		}
+	case "landscape":
+		if height > width {
+			width, height = height, width
+		}
+	default:
+		return 0, 0, false
+	}
+	return width, height, true
+}
+
+func (s *StreamSession) handleViewportMessage(data []byte) {
+	var m ViewportMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		s.Input.rejected.Add(1)
+		return
+	}
+	width, height, ok := m.devicePixels()
+	if !ok {
+		s.Input.rejected.Add(1)
+		return
+	}
+	// Co-op guests watch the host's encoding
+	if s.parent != nil || s.videoTrack == nil {
+		return
+	}
+	s.viewport.Store(int32(viewportHeight(s.Width, s.Height, width, height)))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// FFmpeg pointed at a capture device it cannot open often neither writes
+// a frame nor exits: x11grab waiting on a display it has no access to, a
+// v4l2 device held by another program. The watchdog kills an FFmpeg that
+// has written nothing by the startup deadline, and the session ends with
+// an error the client is told of, instead of a black picture.
+
+// defaultStartupTimeout is long enough for a hardware encoder to open and
+// for the first keyframe of a 4K capture; pipeline.json's
+// startup_timeout_seconds overrides it
+const defaultStartupTimeout = 10 * time.Second
+
+func ffmpegStartupTimeout() time.Duration {
+	if hostPipeline.StartupTimeoutSeconds > 0 {
+		return time.Duration(hostPipeline.StartupTimeoutSeconds) * time.Second
+	}
+	return defaultStartupTimeout
+}
+
+// ffmpegStalledError is returned by a capture whose FFmpeg the watchdog
+// killed
+type ffmpegStalledError struct {
+	capture string
+	timeout time.Duration
+	// lastLine is FFmpeg's last log line, which usually says what it is
+	// stuck on
+	lastLine string
+}
+
+func (e *ffmpegStalledError) Error() string {
+	msg := fmt.Sprintf("%s capture produced no video in %v", e.capture, e.timeout)
+	if e.lastLine != "" {
+		msg += ": " + e.lastLine
+	}
+	return msg
+}
+
+// outputReader closes output on its first bytes
+type outputReader struct {
+	r      io.Reader
+	once   sync.Once
+	output chan struct{}
+}
+
+func newOutputReader(r io.Reader) *outputReader {
+	return &outputReader{r: r, output: make(chan struct{})}
+}
+
+func (o *outputReader) Read(p []byte) (int, error) {
+	n, err := o.r.Read(p)
+	if n > 0 {
+		o.once.Do(func() { close(o.output) })
+	}
+	return n, err
+}
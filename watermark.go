@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A watermark marks every session's picture with who is watching, to
+// deter leaks of content that is not public yet. It is the host's choice,
+// not the client's: with watermark.json in place, every session gets it
+// and capture sources that cannot draw it are refused.
+//
+//	{"text": "viewer: {user}", "text_position": "center",
+//	 "image": "logo.png", "image_position": "top-right", "opacity": 0.4}
+//
+// The text may name the session's {user} and {session}. Spectators and
+// co-op guests share the host's picture, watermark included.
+
+var watermarkFile = "watermark.json"
+
+// watermarkSettings are watermark.json; a text, an image or both
+type watermarkSettings struct {
+	Text          string  `json:"text"`
+	TextPosition  string  `json:"text_position"`
+	Image         string  `json:"image"`
+	ImagePosition string  `json:"image_position"`
+	Opacity       float64 `json:"opacity"`
+}
+
+var hostWatermark watermarkSettings
+
+// watermarkPositions map a position to the x and y of what is drawn there,
+// as expressions of the picture's size (W, H) and the drawing's (w, h)
+var watermarkPositions = map[string][2]string{
+	"top-left":     {"16", "16"},
+	"top-right":    {"W-w-16", "16"},
+	"bottom-left":  {"16", "H-h-16"},
+	"bottom-right": {"W-w-16", "H-h-16"},
+	"center":       {"(W-w)/2", "(H-h)/2"},
+}
+
+func (w watermarkSettings) enabled() bool {
+	return w.Text != "" || w.Image != ""
+}
+
+func (w watermarkSettings) validate() error {
+	if _, ok := watermarkPositions[w.TextPosition]; !ok {
+		return fmt.Errorf("unknown text_position %q", w.TextPosition)
+	}
+	if _, ok := watermarkPositions[w.ImagePosition]; !ok {
+		return fmt.Errorf("unknown image_position %q", w.ImagePosition)
+	}
+	if w.Opacity <= 0 || w.Opacity > 1 {
+		return errors.New("opacity must be within 0-1")
+	}
+	if w.Image != "" {
+		if _, err := os.Stat(w.Image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadWatermark() {
+	data, err := os.ReadFile(watermarkFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading watermark: %v", err)
+		}
+		return
+	}
+
+	settings := watermarkSettings{TextPosition: "bottom-right", ImagePosition: "top-right", Opacity: 0.5}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		log.Printf("Error parsing %s: %v", watermarkFile, err)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		log.Printf("Ignoring %s: %v", watermarkFile, err)
+		return
+	}
+	hostWatermark = settings
+	log.Printf("Watermarking sessions with text %q and image %q", settings.Text, settings.Image)
+}
+
+// watermarkOverlay is a session's watermark as drawn: the host's settings
+// with the session's text written to textFile. The zero value draws none.
+type watermarkOverlay struct {
+	textFile, textPosition string
+	image, imagePosition   string
+	opacity                float64
+}
+
+// watermark writes the session's watermark text and returns the overlay
+// drawing it
+func (s *StreamSession) watermark() (watermarkOverlay, error) {
+	w := watermarkOverlay{
+		textPosition:  hostWatermark.TextPosition,
+		image:         hostWatermark.Image,
+		imagePosition: hostWatermark.ImagePosition,
+		opacity:       hostWatermark.Opacity,
+	}
+	if hostWatermark.Text != "" {
+		user := s.user
+		if user == "" {
+			user = "guest"
+		}
+		text := strings.NewReplacer("{user}", user, "{session}", s.ID).Replace(hostWatermark.Text)
+		w.textFile = filepath.Join(os.TempDir(), "chimera-watermark-"+s.ID+".txt")
+		if err := os.WriteFile(w.textFile, []byte(text), 0o644); err != nil {
+			return watermarkOverlay{}, err
+		}
+	}
+	return w, nil
+}
+
+// remove deletes the watermark's text file
+func (w watermarkOverlay) remove() {
+	if w.textFile != "" {
+		os.Remove(w.textFile)
+	}
+}
+
+// filters draw the watermark over a picture height pixels tall
+func (w watermarkOverlay) filters(height int) []string {
+	var filters []string
+	if w.image != "" {
+		// The image is a second input, so the chain branches: the picture
+		// so far is labeled and the image overlaid onto it
+		pos := watermarkPositions[w.imagePosition]
+		filters = append(filters, fmt.Sprintf(
+			"null[picture];movie=%s,format=rgba,colorchannelmixer=aa=%.2f[watermark];[picture][watermark]overlay=x=%s:y=%s",
+			filterPath(w.image), w.opacity, pos[0], pos[1]))
+	}
+	if w.textFile != "" {
+		// drawtext names the text's size tw and th
+		pos := watermarkPositions[w.textPosition]
+		x := strings.NewReplacer("W", "w", "w", "tw").Replace(pos[0])
+		y := strings.NewReplacer("H", "h", "h", "th").Replace(pos[1])
+		filters = append(filters, fmt.Sprintf(
+			"drawtext=textfile=%s:expansion=none:font=sans:fontsize=%d:fontcolor=white@%.2f"+
+				":shadowcolor=black@%.2f:shadowx=1:shadowy=1:x=%s:y=%s",
+			filterPath(w.textFile), max(14, height/24), w.opacity, w.opacity, x, y))
+	}
+	return filters
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The web client is served from webRoot at webPrefix, "/play/" to share
+// the host name with other sites, and can be turned off for headless
+// hosts whose clients come from a frontend of their own. The API stays at
+// apiPrefix either way.
+var (
+	webUIEnabled = true
+	webRoot      = "web"
+	webPrefix    = "/"
+)
+
+// checkWebUI normalizes webPrefix and checks webRoot is there to serve
+func checkWebUI() error {
+	webPrefix = "/" + strings.Trim(webPrefix, "/")
+	if webPrefix != "/" {
+		webPrefix += "/"
+	}
+	if strings.HasPrefix(webPrefix, apiPrefix+"/") {
+		return fmt.Errorf("web prefix %s is inside the API", webPrefix)
+	}
+	if !webUIEnabled {
+		return nil
+	}
+	info, err := os.Stat(webRoot)
+	if err != nil {
+		return fmt.Errorf("web root: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("web root %s is not a directory", webRoot)
+	}
+	return nil
+}
+
+func serveWebUI() {
+	if !webUIEnabled {
+		log.Printf("[Go] Web client off, serving the API only")
+		return
+	}
+	http.Handle(webPrefix, http.StripPrefix(strings.TrimSuffix(webPrefix, "/"), compressed(cachedAssets(webRoot))))
+	if webPrefix != "/" {
+		log.Printf("[Go] Web client at %s, from %s", webPrefix, webRoot)
+	}
+}